@@ -2,64 +2,266 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/segmentio/kafka-go"
 
+	"WB_L3_4/internal/auth"
+	"WB_L3_4/internal/backup"
+	"WB_L3_4/internal/logging"
+	"WB_L3_4/internal/metrics"
 	"WB_L3_4/internal/models"
 	"WB_L3_4/internal/server"
 	"WB_L3_4/internal/storage"
 )
 
+// commitTimeout bounds committing a processed message's offset
+const commitTimeout = 10 * time.Second
+
 func main() {
+	backupDir := flag.String("backup", "", "write a backup archive into this directory and exit")
+	incremental := flag.Bool("incremental", false, "with -backup, only include images changed since the last backup")
+	restoreArchive := flag.String("restore", "", "restore a backup archive and exit")
+	reenqueue := flag.Bool("reenqueue", false, "with -restore, enqueue images whose processed variants are missing")
+	check := flag.Bool("check", false, "cross-check database paths with the files on disk, print a JSON report and exit")
+	repair := flag.Bool("repair", false, "with -check, requeue images with broken variants and remove orphan files")
+	issueScopes := flag.String("issue-token", "", "print a token with these comma-separated scopes and exit, e.g. admin or upload,read")
+	tokenTenant := flag.String("token-tenant", "", "with -issue-token, limit the token to this tenant's images")
+	tokenSubject := flag.String("token-subject", "", "with -issue-token, who the token is for; recorded as the audit actor")
+	tokenTTL := flag.Duration("token-ttl", 0, "with -issue-token, token lifetime (default auth.default_token_ttl)")
+	importDir := flag.String("import", "", "register every image under this directory, enqueue it for processing and exit")
+	importLink := flag.Bool("import-link", false, "with -import, hard link files into storage instead of copying them")
+	importPreset := flag.String("import-preset", "", "with -import, preset rendered for every image")
+	importTenant := flag.String("import-tenant", "", "with -import, tenant the images belong to")
+	importCheckpoint := flag.String("import-checkpoint", "", "with -import, file recording imported paths to resume from (default under storage_path)")
+	migrateObjects := flag.Bool("migrate-objects", false, "move stored files into object_store, verifying checksums, and exit; processing must be paused")
+	migrateBatch := flag.Int("migrate-batch", 100, "with -migrate-objects, images whose paths are rewritten per transaction")
+	flag.Parse()
+
 	cfg, err := models.LoadConfig("config.yaml")
 	if err != nil {
 		log.Fatalf("failed to load config: %v", err)
 	}
 
+	if *issueScopes != "" {
+		if cfg.Auth.TokenSecret == "" {
+			log.Fatalf("auth.token_secret is not set")
+		}
+		ttl := *tokenTTL
+		if ttl == 0 {
+			ttl = cfg.Auth.DefaultTokenTTL
+		}
+		token, _, err := auth.Issue([]byte(cfg.Auth.TokenSecret), auth.Claims{
+			Subject: *tokenSubject,
+			Scopes:  strings.Split(*issueScopes, ","),
+			Tenant:  *tokenTenant,
+		}, ttl)
+		if err != nil {
+			log.Fatalf("failed to issue token: %v", err)
+		}
+		fmt.Println(token)
+		return
+	}
+
+	logCtx, stopLogRotation := context.WithCancel(context.Background())
+	defer stopLogRotation()
+	logFile, err := logging.Setup(logCtx, cfg.Log)
+	if err != nil {
+		log.Fatalf("failed to open log file: %v", err)
+	}
+	if logFile != nil {
+		defer logFile.Close()
+	}
+	log.SetOutput(server.CaptureImageLogs(log.Writer(), cfg.ImageLogImages, cfg.ImageLogLines))
+
+	if err := server.CheckEngine(cfg); err != nil {
+		log.Fatalf("invalid processing engine: %v", err)
+	}
+	if err := server.SetupEncryption(cfg); err != nil {
+		log.Fatalf("invalid encryption keys: %v", err)
+	}
+	if err := server.SetupObjectStore(cfg); err != nil {
+		log.Fatalf("invalid object store: %v", err)
+	}
+
 	db, err := storage.NewStorage(cfg.DatabaseURL)
 	if err != nil {
 		log.Fatalf("failed to init storage: %v", err)
 	}
 	defer db.Close()
 
-	// Kafka producer
+	if *backupDir != "" {
+		path, manifest, err := backup.Backup(cfg, db, *backupDir, *incremental)
+		if err != nil {
+			log.Fatalf("backup failed: %v", err)
+		}
+		log.Printf("backup written to %s: %d images, %d files", path, manifest.Images, manifest.Files)
+		return
+	}
+
+	if *migrateObjects {
+		result, err := server.MigrateToObjectStore(context.Background(), cfg, db, max(*migrateBatch, 1))
+		if err != nil {
+			log.Fatalf("migration failed after %d images, run again to resume: %v", result.Images, err)
+		}
+		log.Printf("moved %d files of %d images into the object store, %d left in place", result.Files, result.Images, result.Skipped)
+		if result.Skipped > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Kafka producer. Messages are keyed by image ID and hashed to a
+	// partition, keeping each image's messages in order on one consumer.
 	producer := kafka.NewWriter(kafka.WriterConfig{
-		Brokers: []string{cfg.KafkaBroker},
-		Topic:   cfg.KafkaTopic,
+		Brokers:  []string{cfg.KafkaBroker},
+		Topic:    cfg.KafkaTopic,
+		Balancer: &kafka.Hash{},
 	})
 
-	// Start Kafka consumer in background
+	if *restoreArchive != "" {
+		// Images go to the outbox if Kafka is down
+		var enqueue func(uuid.UUID) error
+		if *reenqueue {
+			enqueue = enqueueOrOutbox(cfg, producer, db, "restore")
+		}
+		result, err := backup.Restore(cfg, db, *restoreArchive, enqueue)
+		producer.Close()
+		if err != nil {
+			log.Fatalf("restore failed after %d images: %v", result.Images, err)
+		}
+		log.Printf("restored %d images, %d files, %d enqueued for processing", result.Images, result.Files, result.Reenqueued)
+		return
+	}
+
+	if *check {
+		// Requeued images go to the outbox if Kafka is down
+		enqueue := enqueueOrOutbox(cfg, producer, db, "consistency repair")
+		report, err := server.CheckConsistency(context.Background(), cfg, db, *repair, enqueue)
+		producer.Close()
+		if err != nil {
+			log.Fatalf("consistency check failed: %v", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		log.Printf("checked %d images and %d files: %d missing, %d orphans, %d size mismatches, %d repaired",
+			report.CheckedImages, report.CheckedFiles, report.Missing, report.Orphans, report.SizeMismatches, report.Repaired)
+		if len(report.Issues) > report.Repaired {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *importDir != "" {
+		// Images go to the outbox if Kafka is down
+		enqueue := enqueueOrOutbox(cfg, producer, db, "bulk import")
+		result, err := server.BulkImport(context.Background(), cfg, db, *importDir, server.ImportOptions{
+			Link:       *importLink,
+			Preset:     *importPreset,
+			Tenant:     *importTenant,
+			Checkpoint: *importCheckpoint,
+		}, enqueue)
+		producer.Close()
+		if err != nil {
+			log.Fatalf("import failed after %d images, run again to resume: %v", result.Imported, err)
+		}
+		log.Printf("imported %d of %d files, %d already imported, %d rejected",
+			result.Imported, result.Files, result.Skipped, result.Rejected)
+		return
+	}
+
+	// Shared by the worker and the HTTP endpoints
+	limiter := server.NewLimiter(cfg)
+
+	// Holds the consumer back while processing is paused
+	gate := server.NewProcessingGate(db)
+
+	// Billing events of the worker and the HTTP endpoints, nil when off
+	meter := server.StartMetering(cfg)
+
+	// Start Kafka consumer in background. Canceling ctx only stops fetching,
+	// the image being processed is finished and committed before workerDone
+	// is closed.
 	ctx, cancel := context.WithCancel(context.Background())
+	workerDone := make(chan struct{})
 	go func() {
+		defer close(workerDone)
 		consumer := kafka.NewReader(kafka.ReaderConfig{
 			Brokers: []string{cfg.KafkaBroker},
 			Topic:   cfg.KafkaTopic,
-			GroupID: "image-processor-group",
+			GroupID: cfg.KafkaGroupID,
 		})
 		defer consumer.Close()
 
 		for {
-			msg, err := consumer.ReadMessage(ctx)
+			if err := gate.Wait(ctx); err != nil {
+				return
+			}
+			msg, err := consumer.FetchMessage(ctx)
 			if err != nil {
-				if err == context.Canceled {
+				if ctx.Err() != nil {
 					return
 				}
 				log.Printf("error reading message: %v", err)
 				continue
 			}
 			// Process image
-			err = server.ProcessImage(string(msg.Value), cfg)
+			err = server.ProcessImage(string(msg.Value), cfg, db, limiter)
 			if err != nil {
 				log.Printf("error processing image: %v", err)
 			}
+			// Committed only once processed, so a message abandoned by a
+			// crash is delivered again
+			commitCtx, cancelCommit := context.WithTimeout(context.Background(), commitTimeout)
+			if err := consumer.CommitMessages(commitCtx, msg); err != nil {
+				log.Printf("error committing message: %v", err)
+			}
+			cancelCommit()
 		}
 	}()
 
-	srv := server.NewServer(cfg, db, producer)
+	readiness := server.NewReadiness(cfg, db)
+
+	go metrics.MonitorConsumerLag(ctx, cfg.KafkaBroker, cfg.KafkaTopic, cfg.KafkaGroupID, cfg.KafkaLagInterval)
+
+	go server.Replicate(ctx, cfg, db)
+	go server.RunWebhookDeliveries(ctx, cfg, db)
+
+	srv := server.NewServer(cfg, db, producer, limiter, readiness, gate)
+
+	if cfg.GRPCAddr != "" {
+		go func() {
+			if err := server.ServeGRPC(ctx, srv); err != nil {
+				log.Fatalf("failed to start grpc server: %v", err)
+			}
+		}()
+	}
+
+	go readiness.Run(ctx)
+	go gate.Run(ctx)
+	go srv.RunScheduler(ctx, cfg.ScheduleInterval)
+	go srv.RunMaintenance(ctx)
+	go srv.RunOpsAlerts(ctx)
+	go srv.RunOutboxRelay(ctx)
+
+	go srv.MonitorDiskSpace(ctx, cfg.DiskCheckInterval)
+
+	if cfg.HotFolder.Path != "" {
+		go srv.WatchHotFolder(ctx)
+	}
+	if cfg.SFTP.Addr != "" {
+		go srv.PollSFTP(ctx)
+	}
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -72,7 +274,28 @@ func main() {
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	<-sig
 
+	// Stop fetching and let the image being processed finish
 	cancel()
 	srv.Stop()
+	select {
+	case <-workerDone:
+	case <-time.After(cfg.DrainTimeout):
+		log.Printf("processing didn't finish within %s, exiting anyway; the image is requeued once it is stuck", cfg.DrainTimeout)
+	}
+	meter.Close()
 	producer.Close()
 }
+
+// enqueueOrOutbox returns an enqueue func for the one-off commands: each
+// image is published within kafka_breaker.publish_timeout, or stored in the
+// outbox for the relay of a running server when Kafka is down
+func enqueueOrOutbox(cfg *models.Config, producer *kafka.Writer, db *storage.Storage, reason string) func(uuid.UUID) error {
+	return func(id uuid.UUID) error {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.KafkaBreaker.PublishTimeout)
+		defer cancel()
+		if err := producer.WriteMessages(ctx, server.ImageMessage(id)); err != nil {
+			return db.AddOutboxEntry(id, reason)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,35 @@
+// Command migrate-layout moves images stored in the flat original/ and
+// processed/ directories into the sharded layout used by the server.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/server"
+	"WB_L3_4/internal/storage"
+)
+
+func main() {
+	configPath := flag.String("config", "config.yaml", "path to the config file")
+	dryRun := flag.Bool("dry-run", false, "only log the files that would be moved")
+	flag.Parse()
+
+	cfg, err := models.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+
+	db, err := storage.NewStorage(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("failed to init storage: %v", err)
+	}
+	defer db.Close()
+
+	moved, err := server.MigrateLayout(cfg, db, *dryRun)
+	if err != nil {
+		log.Fatalf("migration stopped after %d files: %v", moved, err)
+	}
+	log.Printf("migrated %d files", moved)
+}
@@ -0,0 +1,270 @@
+// Package backup exports images and their files into portable archives and
+// restores them.
+//
+// An archive is a gzipped tar holding, for every image, an images/<id>.json
+// record followed by the image's files under files/<path relative to the
+// storage root>, and a manifest.json written last.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/server"
+	"WB_L3_4/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+const (
+	formatVersion = 1
+	batchSize     = 100
+	// stateFile in the backup directory holds the start time of the last
+	// successful backup, used as the starting point of incremental backups
+	stateFile = ".last_backup"
+)
+
+// Manifest describes an archive
+type Manifest struct {
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	Since     *time.Time `json:"since,omitempty"` // set for incremental backups
+	Images    int        `json:"images"`
+	Files     int        `json:"files"`
+}
+
+// record is the archived form of an image. Paths are relative to the
+// storage root so the archive can be restored elsewhere.
+type record struct {
+	Image     models.Image          `json:"image"`
+	Checksums []models.FileChecksum `json:"checksums"`
+}
+
+// Backup writes an archive of every image into dir. With incremental set
+// only images changed since the last successful backup into dir are
+// included; deletions are not recorded. It returns the archive path.
+func Backup(cfg *models.Config, db *storage.Storage, dir string, incremental bool) (string, *Manifest, error) {
+	const op = "backup.Backup"
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, fmt.Errorf("%s: %v", op, err)
+	}
+
+	manifest := &Manifest{Version: formatVersion, CreatedAt: time.Now().UTC()}
+	since := time.Time{}
+	if incremental {
+		last, err := readState(dir)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %v", op, err)
+		}
+		if last != nil {
+			since = *last
+			manifest.Since = last
+		}
+	}
+
+	name := "backup-" + manifest.CreatedAt.Format("20060102T150405Z")
+	if manifest.Since != nil {
+		name += "-incr"
+	}
+	archivePath := filepath.Join(dir, name+".tar.gz")
+	tmpPath := archivePath + ".tmp"
+
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", op, err)
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	after := uuid.Nil
+	for {
+		images, err := db.ListImagesChangedSince(since, after, batchSize)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %v", op, err)
+		}
+		if len(images) == 0 {
+			break
+		}
+		after = images[len(images)-1].ID
+
+		for _, img := range images {
+			files, err := writeImage(cfg, db, tw, img)
+			if err != nil {
+				return "", nil, fmt.Errorf("%s: image %s: %v", op, img.ID.String(), err)
+			}
+			manifest.Images++
+			manifest.Files += files
+		}
+	}
+
+	if err := writeJSON(tw, "manifest.json", manifest); err != nil {
+		return "", nil, fmt.Errorf("%s: %v", op, err)
+	}
+	if err := tw.Close(); err != nil {
+		return "", nil, fmt.Errorf("%s: %v", op, err)
+	}
+	if err := gz.Close(); err != nil {
+		return "", nil, fmt.Errorf("%s: %v", op, err)
+	}
+	if err := f.Sync(); err != nil {
+		return "", nil, fmt.Errorf("%s: %v", op, err)
+	}
+	if err := f.Close(); err != nil {
+		return "", nil, fmt.Errorf("%s: %v", op, err)
+	}
+	if err := os.Rename(tmpPath, archivePath); err != nil {
+		return "", nil, fmt.Errorf("%s: %v", op, err)
+	}
+	if err := writeState(dir, manifest.CreatedAt); err != nil {
+		return "", nil, fmt.Errorf("%s: %v", op, err)
+	}
+
+	return archivePath, manifest, nil
+}
+
+// writeImage archives one image record followed by its files and returns the
+// number of files written
+func writeImage(cfg *models.Config, db *storage.Storage, tw *tar.Writer, img *models.Image) (int, error) {
+	sums, err := db.ListImageChecksums(img.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Checksums cover every written file including presets; the image paths
+	// are added for files stored before checksums were recorded
+	paths := map[string]bool{}
+	for _, p := range []string{img.OriginalPath, img.ProcessedPath, img.ThumbnailPath, img.WatermarkedPath, img.VideoPath, img.UpscaledPath} {
+		if p != "" {
+			paths[p] = true
+		}
+	}
+	for _, sum := range sums {
+		paths[sum.Path] = true
+	}
+
+	rec := record{Image: *img, Checksums: sums}
+	rel := func(p string) string {
+		if p == "" {
+			return ""
+		}
+		// Files in the object store keep their relative path as key
+		r, err := server.StoredRel(cfg, p)
+		if err != nil {
+			return p
+		}
+		return filepath.ToSlash(r)
+	}
+	rec.Image.OriginalPath = rel(img.OriginalPath)
+	rec.Image.ProcessedPath = rel(img.ProcessedPath)
+	rec.Image.ThumbnailPath = rel(img.ThumbnailPath)
+	rec.Image.WatermarkedPath = rel(img.WatermarkedPath)
+	rec.Image.VideoPath = rel(img.VideoPath)
+	rec.Image.UpscaledPath = rel(img.UpscaledPath)
+	for i := range rec.Checksums {
+		rec.Checksums[i].Path = rel(rec.Checksums[i].Path)
+	}
+
+	if err := writeJSON(tw, path.Join("images", img.ID.String()+".json"), rec); err != nil {
+		return 0, err
+	}
+
+	files := 0
+	for p := range paths {
+		r := rel(p)
+		if strings.HasPrefix(r, "../") || filepath.IsAbs(r) {
+			log.Printf("backup.writeImage: skipping %s outside the storage path", p)
+			continue
+		}
+		ok, err := writeFile(tw, path.Join("files", r), p)
+		if err != nil {
+			return files, err
+		}
+		if ok {
+			files++
+		}
+	}
+	return files, nil
+}
+
+// writeFile copies a stored file into the archive. Missing files are logged
+// and skipped, the restore re-enqueues missing variants.
+func writeFile(tw *tar.Writer, name, src string) (bool, error) {
+	f, err := server.OpenStoredFile(src)
+	if os.IsNotExist(err) {
+		log.Printf("backup.writeFile: %s is missing, skipping", src)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	})
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func writeJSON(tw *tar.Writer, name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func readState(dir string) (*time.Time, error) {
+	data, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", stateFile, err)
+	}
+	return &t, nil
+}
+
+func writeState(dir string, t time.Time) error {
+	return os.WriteFile(filepath.Join(dir, stateFile), []byte(t.Format(time.RFC3339Nano)+"\n"), 0644)
+}
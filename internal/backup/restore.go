@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/server"
+	"WB_L3_4/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// RestoreResult summarizes a restore
+type RestoreResult struct {
+	Images     int
+	Files      int
+	Reenqueued int
+}
+
+// Restore imports an archive written by Backup: files are placed in the
+// storage layout and image rows are recreated, replacing existing ones. If
+// enqueue is set, images whose processed variants are missing are reset and
+// enqueued for processing again.
+func Restore(cfg *models.Config, db *storage.Storage, archivePath string, enqueue func(uuid.UUID) error) (*RestoreResult, error) {
+	const op = "backup.Restore"
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	defer gz.Close()
+
+	result := &RestoreResult{}
+	var current *pendingImage
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+		err := current.save(db, enqueue, result)
+		current = nil
+		return err
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("%s: %v", op, err)
+		}
+
+		switch {
+		case strings.HasPrefix(hdr.Name, "images/"):
+			if err := flush(); err != nil {
+				return result, fmt.Errorf("%s: %v", op, err)
+			}
+			var rec record
+			if err := json.NewDecoder(tr).Decode(&rec); err != nil {
+				return result, fmt.Errorf("%s: %s: %v", op, hdr.Name, err)
+			}
+			current = newPendingImage(rec)
+
+		case strings.HasPrefix(hdr.Name, "files/"):
+			if current == nil {
+				return result, fmt.Errorf("%s: %s precedes its image record", op, hdr.Name)
+			}
+			if err := current.restoreFile(cfg, strings.TrimPrefix(hdr.Name, "files/"), tr); err != nil {
+				return result, fmt.Errorf("%s: %s: %v", op, hdr.Name, err)
+			}
+			result.Files++
+
+		case hdr.Name == "manifest.json":
+			var manifest Manifest
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return result, fmt.Errorf("%s: %s: %v", op, hdr.Name, err)
+			}
+			if manifest.Version != formatVersion {
+				return result, fmt.Errorf("%s: unsupported archive version %d", op, manifest.Version)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return result, fmt.Errorf("%s: %v", op, err)
+	}
+	return result, nil
+}
+
+// pendingImage is an image record whose files are being restored
+type pendingImage struct {
+	rec record
+	// archived relative path -> restored absolute path
+	paths map[string]string
+	sums  map[string]string
+}
+
+func newPendingImage(rec record) *pendingImage {
+	p := &pendingImage{rec: rec, paths: map[string]string{}, sums: map[string]string{}}
+	for _, sum := range rec.Checksums {
+		p.sums[sum.Path] = sum.SHA256
+	}
+	return p
+}
+
+// restoreFile writes an archived file to its place in the sharded layout,
+// checking it against the recorded checksum
+func (p *pendingImage) restoreFile(cfg *models.Config, rel string, r io.Reader) error {
+	rel = path.Clean(rel)
+	kind, name, ok := strings.Cut(rel, "/")
+	if !ok || (kind != "original" && kind != "processed") {
+		return fmt.Errorf("unexpected file location")
+	}
+	// Both the flat and the sharded layout end in the file name, which
+	// always starts with the image ID
+	name = path.Base(name)
+	if !strings.HasPrefix(name, p.rec.Image.ID.String()) {
+		return fmt.Errorf("file does not belong to image %s", p.rec.Image.ID.String())
+	}
+
+	dst := filepath.Join(server.ShardDir(cfg.StoragePath, kind, p.rec.Image.ID), name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	tmp := dst + ".restore"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// Checksums are of the content, encrypted files are restored as they
+	// were archived and need their key configured
+	if expected, ok := p.sums[rel]; ok {
+		sum, _, err := server.ContentChecksum(tmp)
+		if err != nil {
+			return err
+		}
+		if sum != expected {
+			return fmt.Errorf("checksum mismatch")
+		}
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+
+	p.paths[rel] = dst
+	return nil
+}
+
+// save recreates the image row and checksums once all its files are restored
+func (p *pendingImage) save(db *storage.Storage, enqueue func(uuid.UUID) error, result *RestoreResult) error {
+	img := p.rec.Image
+	resolve := func(rel string) string {
+		if rel == "" {
+			return ""
+		}
+		if dst, ok := p.paths[path.Clean(rel)]; ok {
+			return dst
+		}
+		return "" // not in the archive
+	}
+	img.OriginalPath = resolve(img.OriginalPath)
+	if img.OriginalPath == "" {
+		log.Printf("backup.Restore: skipping image %s, its original is not in the archive", img.ID.String())
+		return nil
+	}
+	img.ProcessedPath = resolve(img.ProcessedPath)
+	img.ThumbnailPath = resolve(img.ThumbnailPath)
+	img.WatermarkedPath = resolve(img.WatermarkedPath)
+	img.VideoPath = resolve(img.VideoPath)
+	img.UpscaledPath = resolve(img.UpscaledPath)
+
+	missing := (img.ResizeStatus == "done" && img.ProcessedPath == "") ||
+		(img.ThumbnailStatus == "done" && img.ThumbnailPath == "") ||
+		(img.WatermarkStatus == "done" && img.WatermarkedPath == "") ||
+		(img.VideoStatus == "done" && img.VideoPath == "") ||
+		(img.UpscaleStatus == "done" && img.UpscaledPath == "")
+
+	if err := db.RestoreImage(&img); err != nil {
+		return err
+	}
+	for _, sum := range p.rec.Checksums {
+		sum.Path = resolve(sum.Path)
+		if sum.Path == "" {
+			continue
+		}
+		if err := db.SaveChecksum(&sum); err != nil {
+			return err
+		}
+	}
+	result.Images++
+
+	if missing && enqueue != nil {
+		if err := db.ResetForReprocessing([]uuid.UUID{img.ID}); err != nil {
+			return err
+		}
+		if err := enqueue(img.ID); err != nil {
+			return err
+		}
+		result.Reenqueued++
+	}
+	return nil
+}
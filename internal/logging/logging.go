@@ -0,0 +1,67 @@
+// Package logging sends the service's logs to a rotated file besides stdout.
+package logging
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"WB_L3_4/internal/models"
+)
+
+// Setup makes the standard logger and gin write to cfg.File as well as
+// stdout and stderr, and returns the file writer to close on exit, nil when
+// no file is configured. The file is rotated once it reaches MaxSizeMB and,
+// with RotateEvery set, at that interval until ctx is canceled; rotated files
+// are gzipped with Compress and removed after MaxAge or beyond MaxBackups.
+func Setup(ctx context.Context, cfg models.LogConfig) (io.Closer, error) {
+	const op = "logging.Setup"
+
+	if cfg.File == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.File), 0755); err != nil {
+		return nil, err
+	}
+
+	file := &lumberjack.Logger{
+		Filename:   cfg.File,
+		MaxSize:    cfg.MaxSizeMB,
+		MaxAge:     int(cfg.MaxAge / (24 * time.Hour)),
+		MaxBackups: cfg.MaxBackups,
+		LocalTime:  true,
+		Compress:   cfg.Compress,
+	}
+
+	log.SetOutput(io.MultiWriter(os.Stderr, file))
+	gin.DefaultWriter = io.MultiWriter(os.Stdout, file)
+	gin.DefaultErrorWriter = io.MultiWriter(os.Stderr, file)
+
+	if cfg.RotateEvery > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.RotateEvery)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					// Quiet periods don't leave empty archives behind
+					if info, err := os.Stat(cfg.File); err == nil && info.Size() == 0 {
+						continue
+					}
+					if err := file.Rotate(); err != nil {
+						log.Printf("%s: failed to rotate %s: %v", op, cfg.File, err)
+					}
+				}
+			}
+		}()
+	}
+	return file, nil
+}
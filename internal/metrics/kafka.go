@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+var KafkaConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "kafka_consumer_group_lag",
+	Help: "Messages not yet committed by the consumer group, per partition.",
+}, []string{"topic", "partition"})
+
+// MonitorConsumerLag periodically computes the lag of the consumer group on
+// every partition of the topic (last offset minus committed offset) until
+// the context is canceled
+func MonitorConsumerLag(ctx context.Context, broker, topic, groupID string, interval time.Duration) {
+	const op = "metrics.MonitorConsumerLag"
+
+	client := &kafka.Client{Addr: kafka.TCP(broker), Timeout: 10 * time.Second}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := updateConsumerLag(ctx, client, topic, groupID); err != nil && ctx.Err() == nil {
+			log.Printf("%s: %v", op, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func updateConsumerLag(ctx context.Context, client *kafka.Client, topic, groupID string) error {
+	meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return fmt.Errorf("metadata: %v", err)
+	}
+	if len(meta.Topics) == 0 || meta.Topics[0].Error != nil {
+		return fmt.Errorf("topic %s not available", topic)
+	}
+
+	var (
+		ids  []int
+		last []kafka.OffsetRequest
+	)
+	for _, p := range meta.Topics[0].Partitions {
+		ids = append(ids, p.ID)
+		last = append(last, kafka.LastOffsetOf(p.ID))
+	}
+
+	committed, err := client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{
+		GroupID: groupID,
+		Topics:  map[string][]int{topic: ids},
+	})
+	if err != nil {
+		return fmt.Errorf("offset fetch: %v", err)
+	}
+	offsets, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{topic: last},
+	})
+	if err != nil {
+		return fmt.Errorf("list offsets: %v", err)
+	}
+
+	committedByPartition := make(map[int]int64)
+	for _, p := range committed.Topics[topic] {
+		committedByPartition[p.Partition] = p.CommittedOffset
+	}
+	for _, p := range offsets.Topics[topic] {
+		if p.Error != nil {
+			continue
+		}
+		lag := p.LastOffset
+		// A negative committed offset means the group has not committed yet
+		if c, ok := committedByPartition[p.Partition]; ok && c >= 0 {
+			lag = p.LastOffset - c
+		}
+		if lag < 0 {
+			lag = 0
+		}
+		KafkaConsumerLag.WithLabelValues(topic, strconv.Itoa(p.Partition)).Set(float64(lag))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	PNGOptimizedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "png_optimized_total",
+		Help: "Number of PNG outputs passed through the optimization step.",
+	})
+	PNGSavedBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "png_optimization_saved_bytes_total",
+		Help: "Bytes saved by PNG optimization compared to default encoding.",
+	})
+
+	OperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "image_operation_duration_seconds",
+		Help:    "Duration of resize, thumbnail and watermark operations, by operation and output format.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12), // 10ms to ~20s
+	}, []string{"operation", "format"})
+	OperationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_operations_total",
+		Help: "Resize, thumbnail and watermark operations, by operation, output format and result (success or error).",
+	}, []string{"operation", "format", "result"})
+
+	ProcessingInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "image_processing_in_flight",
+		Help: "Images currently being decoded and processed.",
+	})
+	ProcessingWaiting = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "image_processing_waiting",
+		Help: "Processing jobs waiting for a free concurrency slot.",
+	})
+	StorageFreeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "storage_free_bytes",
+		Help: "Free disk space under the storage path.",
+	})
+	UploadsRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "uploads_rejected_total",
+		Help: "Uploads rejected before being stored, by reason.",
+	}, []string{"reason"})
+
+	IntegrityFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "storage_integrity_failures_total",
+		Help: "Stored files whose content no longer matches the recorded checksum.",
+	})
+
+	ReplicatedFilesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "replication_files_total",
+		Help: "Files copied to the replica, by result.",
+	}, []string{"result"})
+
+	ReadinessState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "readiness_state",
+		Help: "1 for the current readiness state (ready, degraded or unready), 0 otherwise.",
+	}, []string{"state"})
+
+	DependencyUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dependency_up",
+		Help: "Whether a dependency passed its last health check.",
+	}, []string{"dependency"})
+
+	MaintenanceRunsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "maintenance_runs_total",
+		Help: "Maintenance job runs, by job and result.",
+	}, []string{"job", "result"})
+
+	WebhookDeliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_delivery_attempts_total",
+		Help: "Webhook delivery attempts, by resulting delivery status (pending means retrying).",
+	}, []string{"status"})
+
+	DecodeMemoryReserved = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "image_decode_memory_reserved_bytes",
+		Help: "Memory reserved for decoded images from the decode budget.",
+	})
+
+	DecodeDownsampledTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "image_decode_downsampled_total",
+		Help: "Images above the megapixel limit scaled down to it after decoding.",
+	})
+
+	ProxyRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_requests_total",
+		Help: "Requests to the remote image proxy, by result (hit, miss or error).",
+	}, []string{"result"})
+
+	BreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "circuit_breaker_state",
+		Help: "1 for the current state (closed, half_open or open) of a circuit breaker, 0 otherwise.",
+	}, []string{"breaker", "state"})
+
+	BreakerCallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "circuit_breaker_calls_total",
+		Help: "Calls through a circuit breaker, by result (ok, error, canceled or rejected while open).",
+	}, []string{"breaker", "result"})
+
+	OutboxSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "kafka_outbox_size",
+		Help: "Processing messages waiting in the outbox for Kafka to come back.",
+	})
+
+	OutboxEntriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_outbox_entries_total",
+		Help: "Processing messages stored in or relayed from the outbox.",
+	}, []string{"result"})
+
+	ProcessingPaused = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "processing_paused",
+		Help: "1 while processing is paused by an admin, 0 otherwise.",
+	})
+
+	DeprecatedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_deprecated_requests_total",
+		Help: "Requests to deprecated API paths, by route, to tell when they can be removed.",
+	}, []string{"route"})
+
+	MeteringEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metering_events_total",
+		Help: "Metering events for billing, by type and result (published, failed or dropped with a full buffer).",
+	}, []string{"type", "result"})
+
+	SyncUploadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_uploads_total",
+		Help: "Uploads processed inline, by result (done, timeout or queued when processing couldn't start).",
+	}, []string{"result"})
+)
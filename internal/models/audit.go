@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuditEntry records a mutating operation for compliance review
+type AuditEntry struct {
+	ID         int64          `db:"id" json:"id"`
+	CreatedAt  time.Time      `db:"created_at" json:"created_at"`
+	Actor      string         `db:"actor" json:"actor"`
+	RemoteAddr string         `db:"remote_addr" json:"remote_addr"`
+	Action     string         `db:"action" json:"action"` // upload, delete, reprocess, resize, thumbnail, watermark
+	ImageID    *uuid.UUID     `db:"image_id" json:"image_id,omitempty"`
+	Details    map[string]any `db:"details" json:"details"`
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FileChecksum is the SHA-256 of a stored file, recorded when it is written
+type FileChecksum struct {
+	ImageID    uuid.UUID  `db:"image_id" json:"image_id"`
+	Variant    string     `db:"variant" json:"variant"` // original, resized, thumbnail, watermarked or preset:<name>
+	Path       string     `db:"path" json:"path"`
+	SHA256     string     `db:"sha256" json:"sha256"`
+	Size       int64      `db:"size" json:"size"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	VerifiedAt *time.Time `db:"verified_at" json:"verified_at,omitempty"`
+	// Set once the file is copied to the replica, cleared when it's rewritten
+	ReplicatedAt     *time.Time `db:"replicated_at" json:"replicated_at,omitempty"`
+	ReplicationError *string    `db:"replication_error" json:"replication_error,omitempty"`
+}
+
+// ReplicationCounts summarizes the replication state of stored files
+type ReplicationCounts struct {
+	Replicated int64 `json:"replicated"`
+	Pending    int64 `json:"pending"`
+	Failed     int64 `json:"failed"`
+}
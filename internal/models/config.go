@@ -1,18 +1,576 @@
 package models
 
 import (
+	"encoding/base64"
+	"fmt"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+const DefaultJPEGQuality = 85
+
 type Config struct {
 	ServerAddr    string `yaml:"server_addr"`
 	DatabaseURL   string `yaml:"database_url"`
 	KafkaBroker   string `yaml:"kafka_broker"`
 	KafkaTopic    string `yaml:"kafka_topic"`
+	KafkaGroupID  string `yaml:"kafka_group_id"`
 	StoragePath   string `yaml:"storage_path"`
 	WatermarkText string `yaml:"watermark_text"`
+	JPEGQuality   int    `yaml:"jpeg_quality"` // 1-100, applied to every JPEG output
+	// Base URL clients reach the service at, used for links in notifications
+	PublicURL string `yaml:"public_url"`
+	// Serves the grpc.health.v1 and upload services when set, e.g. ":9090"
+	GRPCAddr            string        `yaml:"grpc_addr"`
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"`
+	// Encode resized and watermarked variants as progressive JPEGs (requires jpegtran)
+	ProgressiveJPEG bool   `yaml:"progressive_jpeg"`
+	JpegtranPath    string `yaml:"jpegtran_path"`
+	// Optimize PNG outputs (palette reduction, best compression, optional zopflipng)
+	PNGOptimize   bool   `yaml:"png_optimize"`
+	PNGZopfli     bool   `yaml:"png_zopfli"`
+	ZopflipngPath string `yaml:"zopflipng_path"`
+	// How often the consumer group lag metric is refreshed
+	KafkaLagInterval time.Duration `yaml:"kafka_lag_interval"`
+	// Processing engine for resize and thumbnail: imaging (default, pure Go)
+	// or vips (libvips, requires building with -tags vips)
+	Engine string `yaml:"engine"`
+	// Maximum number of images decoded and processed concurrently
+	MaxConcurrentDecodes int `yaml:"max_concurrent_decodes"`
+	// Uploads are rejected with 507 when free space under StoragePath would
+	// drop below this
+	MinFreeDiskMB     int           `yaml:"min_free_disk_mb"`
+	DiskCheckInterval time.Duration `yaml:"disk_check_interval"`
+	// Check files against their stored checksum every time they are served
+	VerifyOnServe bool `yaml:"verify_on_serve"`
+	// How often images scheduled with process_at are checked
+	ScheduleInterval time.Duration `yaml:"schedule_interval"`
+	// Every stored file is copied to this directory (e.g. a second volume)
+	// when set; pending files are picked up every ReplicationInterval
+	ReplicaPath         string        `yaml:"replica_path"`
+	ReplicationInterval time.Duration `yaml:"replication_interval"`
+	// Memory budget for decoded images, and the largest accepted resolution
+	DecodeMemoryBudgetMB int `yaml:"decode_memory_budget_mb"`
+	MaxMegapixels        int `yaml:"max_megapixels"`
+	// Scale images above max_megapixels down to it instead of rejecting
+	// them. The vips engine shrinks them on load; with imaging those too
+	// large to decode within the budget are still rejected
+	DownsampleOversized bool `yaml:"downsample_oversized"`
+	// Decoded originals kept in memory for the async operation endpoints,
+	// counted against decode_memory_budget_mb and dropped when it runs short
+	DecodeCacheSize int           `yaml:"decode_cache_size"`
+	DecodeCacheTTL  time.Duration `yaml:"decode_cache_ttl"`
+	// Default encoding of each operation's output, keyed by resize,
+	// thumbnail and watermark; upload options override it
+	Outputs map[string]OutputFormat `yaml:"outputs"`
+	// Named processing presets referenced by upload and render requests
+	Presets map[string]Preset `yaml:"presets"`
+	// Schedules of the built-in maintenance jobs
+	Maintenance MaintenanceConfig `yaml:"maintenance"`
+	// Delivery of the callback_url webhooks
+	Webhooks WebhookConfig `yaml:"webhooks"`
+	// SMTP server for notify_email; email notifications are off without a host
+	Email EmailConfig `yaml:"email"`
+	// Operational alerts posted to Slack and/or Telegram
+	Notifications NotificationsConfig `yaml:"notifications"`
+	// Retention applies to every tenant without a policy of its own
+	Retention RetentionPolicy         `yaml:"retention"`
+	Tenants   map[string]TenantConfig `yaml:"tenants"`
+	// Scoped access tokens; every endpoint is open while no secret is set
+	Auth AuthConfig `yaml:"auth"`
+	// Remote images served through /proxy; disabled without allowed hosts
+	Proxy ProxyConfig `yaml:"proxy"`
+	// Network allowlists enforced in addition to auth
+	Network NetworkConfig `yaml:"network"`
+	// HTTPS is served instead of plain HTTP when a certificate is set
+	TLS TLSConfig `yaml:"tls"`
+	// Permissions of the socket when server_addr is unix:///path, e.g. 0660
+	// to let only the web server's group connect
+	SocketMode string `yaml:"socket_mode"`
+	// Limits of the HTTP server, protecting against slow or oversized requests
+	HTTP HTTPConfig `yaml:"http"`
+	// Publishing to Kafka fails fast while the breaker is open
+	KafkaBreaker BreakerConfig `yaml:"kafka_breaker"`
+	// How often messages that couldn't be published are retried from the outbox
+	OutboxRelayInterval time.Duration `yaml:"outbox_relay_interval"`
+	// How long a GET for a missing thumbnail or watermarked variant waits for
+	// it to be generated before answering 202
+	LazyVariantTimeout time.Duration `yaml:"lazy_variant_timeout"`
+	// Animated GIFs are also converted to a much smaller mp4 or webm video
+	// with ffmpeg when set; off when empty
+	GIFVideoFormat string        `yaml:"gif_video_format"`
+	FFmpegPath     string        `yaml:"ffmpeg_path"`
+	FFmpegTimeout  time.Duration `yaml:"ffmpeg_timeout"`
+	// Color profile of outputs: preserve (default) carries the original's
+	// ICC profile over, srgb converts to sRGB (vips engine; the imaging
+	// outputs still carry the profile over) and strip drops it
+	ICCProfile string `yaml:"icc_profile"`
+	// Unsharp mask applied after resize and thumbnail generation to offset
+	// the softening of downscaling; off when the amount is 0. The radius is
+	// the blur sigma in pixels, 1 by default.
+	SharpenAmount float64 `yaml:"sharpen_amount"`
+	SharpenRadius float64 `yaml:"sharpen_radius"`
+	// External super-resolution service such as Real-ESRGAN, used for
+	// uploads that ask for an upscaled variant
+	Upscale UpscaleConfig `yaml:"upscale"`
+	// Text in uploads is recognized with tesseract and indexed for search
+	// when enabled
+	OCR OCRConfig `yaml:"ocr"`
+	// Largest image accepted by the streaming gRPC upload
+	GRPCMaxUploadMB int `yaml:"grpc_max_upload_mb"`
+	// Images copied into this folder are imported and processed
+	HotFolder HotFolderConfig `yaml:"hot_folder"`
+	// Images are pulled from this SFTP directory on a schedule
+	SFTP SFTPConfig `yaml:"sftp"`
+	// Logs are also written to a rotated file when log.file is set
+	Log LogConfig `yaml:"log"`
+	// One line per HTTP request, written to stdout and the log file
+	AccessLog AccessLogConfig `yaml:"access_log"`
+	// Log lines mentioning an image are kept in memory for GET
+	// /image/:id/logs: up to ImageLogLines lines (default 200) for each of
+	// the last ImageLogImages images (default 1000)
+	ImageLogImages int `yaml:"image_log_images"`
+	ImageLogLines  int `yaml:"image_log_lines"`
+	// Processing runs an image gets before it is quarantined instead of
+	// being requeued again, e.g. when it keeps crashing the worker
+	MaxProcessingAttempts int `yaml:"max_processing_attempts"`
+	// How long shutdown waits for the image being processed to finish
+	// before exiting anyway
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	// Stored files are handed to the reverse proxy to send instead of being
+	// streamed through the service
+	Sendfile SendfileConfig `yaml:"sendfile"`
+	// Users sign in with an OpenID Connect provider when oidc.issuer is set
+	OIDC OIDCConfig `yaml:"oidc"`
+	// Limits on what each owner, e.g. a signed in user, can store
+	Quota QuotaConfig `yaml:"quota"`
+	// Usage events for billing, published to Kafka when metering.topic is set
+	Metering MeteringConfig `yaml:"metering"`
+	// Uploads processed inline with POST /upload?sync=true
+	SyncUpload SyncUploadConfig `yaml:"sync_upload"`
+	// Render picks among presets by the client's Width and DPR hints
+	ClientHints ClientHintsConfig `yaml:"client_hints"`
+	// Stored images are encrypted at rest when encryption.key is set
+	Encryption EncryptionConfig `yaml:"encryption"`
+	// S3 compatible bucket stored files are moved into with -migrate-objects
+	ObjectStore ObjectStoreConfig `yaml:"object_store"`
+}
+
+type BreakerConfig struct {
+	// Consecutive failures that open the breaker
+	FailureThreshold int `yaml:"failure_threshold"`
+	// How long it stays open before a single publish is tried again
+	Cooldown time.Duration `yaml:"cooldown"`
+	// Upper bound on a single publish
+	PublishTimeout time.Duration `yaml:"publish_timeout"`
+}
+
+type HTTPConfig struct {
+	// Time allowed to read the request headers, and the whole request
+	// including the upload body
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	// How long a keep-alive connection may stay idle between requests
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes int           `yaml:"max_header_bytes"`
+	// Multipart uploads beyond this are buffered in temp files, not memory
+	MaxMultipartMemoryMB int `yaml:"max_multipart_memory_mb"`
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Admin routes require a client certificate signed by this CA when set
+	AdminClientCA string `yaml:"admin_client_ca"`
+	// Certificates for these domains are obtained from Let's Encrypt and
+	// renewed automatically, instead of using CertFile and KeyFile. Keep
+	// the cache directory on a persistent volume, never inside StoragePath.
+	AutocertDomains  []string `yaml:"autocert_domains"`
+	AutocertEmail    string   `yaml:"autocert_email"`
+	AutocertCacheDir string   `yaml:"autocert_cache_dir"`
+	// Plain HTTP listener answering ACME challenges and redirecting
+	// everything else to HTTPS
+	HTTPRedirectAddr string `yaml:"http_redirect_addr"`
+}
+
+// Enabled reports whether the server terminates TLS itself
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || len(t.AutocertDomains) > 0
+}
+
+// NetworkConfig lists the networks (CIDRs or single addresses) allowed to
+// reach sensitive routes; an empty list allows every address
+type NetworkConfig struct {
+	AdminCIDRs []string `yaml:"admin_cidrs"`
+	// DELETE endpoints
+	DeleteCIDRs []string `yaml:"delete_cidrs"`
+	// Proxies trusted to report the client address in X-Forwarded-For;
+	// without any the address of the connection is used
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+// ParsePrefixes parses a list of CIDRs, single addresses count as /32 or /128
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if addr, err := netip.ParseAddr(cidr); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", cidr)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+type ProxyConfig struct {
+	// Hosts images may be fetched from, e.g. cdn.example.com; a leading dot
+	// (.example.com) also allows every subdomain
+	AllowedHosts []string      `yaml:"allowed_hosts"`
+	Timeout      time.Duration `yaml:"timeout"`
+	MaxSizeMB    int           `yaml:"max_size_mb"`
+	// Fetched and rendered images are reused for this long, and clients are
+	// told to cache them as long
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+type UpscaleConfig struct {
+	// Endpoint the original is POSTed to; upscaling is off when empty
+	URL string `yaml:"url"`
+	// Sent as a bearer token when set
+	Token string `yaml:"token"`
+	Scale int    `yaml:"scale"` // 2 or 4, default 4
+	// Upper bound on one upscale, including waiting for an accepted job
+	Timeout time.Duration `yaml:"timeout"`
+	// How often an accepted job is polled for its result
+	PollInterval time.Duration `yaml:"poll_interval"`
+	MaxSizeMB    int           `yaml:"max_size_mb"` // of the result, default 200
+}
+
+type OCRConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	TesseractPath string        `yaml:"tesseract_path"` // default tesseract
+	Languages     string        `yaml:"languages"`      // e.g. eng+rus, default eng
+	Timeout       time.Duration `yaml:"timeout"`
+}
+
+type HotFolderConfig struct {
+	// Watched directory, disabled when empty
+	Path string `yaml:"path"`
+	// A file is imported once it hasn't changed for this long, so copies
+	// still in progress are left alone
+	SettleDelay time.Duration `yaml:"settle_delay"`
+	// Applied to every imported image like the upload fields
+	Preset  string `yaml:"preset"`
+	Options string `yaml:"options"` // JSON processing options
+	Tenant  string `yaml:"tenant"`
+	// Files that can't be imported are moved here, default <path>/failed
+	FailedDir string `yaml:"failed_dir"`
+	MaxSizeMB int    `yaml:"max_size_mb"` // default 100
+}
+
+type SFTPConfig struct {
+	// host:port of the server, disabled when empty
+	Addr     string `yaml:"addr"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// PEM private key, used instead of or in addition to the password
+	PrivateKeyPath string `yaml:"private_key_path"`
+	// known_hosts file the server's key is checked against; required unless
+	// insecure_ignore_host_key is set
+	KnownHostsPath        string `yaml:"known_hosts_path"`
+	InsecureIgnoreHostKey bool   `yaml:"insecure_ignore_host_key"`
+	// Remote directory polled for images
+	Dir      string        `yaml:"dir"`
+	Interval time.Duration `yaml:"interval"` // default 1m
+	// Files modified more recently are left for the next poll, so uploads
+	// still in progress are skipped
+	MinAge time.Duration `yaml:"min_age"` // default 10s
+	// Imported files are deleted, or moved to processed_dir when set
+	ProcessedDir string `yaml:"processed_dir"`
+	// Files that can't be imported are moved here, default <dir>/failed
+	FailedDir string `yaml:"failed_dir"`
+	// Applied to every imported image like the upload fields
+	Preset    string        `yaml:"preset"`
+	Options   string        `yaml:"options"` // JSON processing options
+	Tenant    string        `yaml:"tenant"`
+	MaxSizeMB int           `yaml:"max_size_mb"` // default 100
+	Timeout   time.Duration `yaml:"timeout"`     // of connecting, default 30s
+}
+
+type LogConfig struct {
+	// Path of the log file, stdout only when empty
+	File      string `yaml:"file"`
+	MaxSizeMB int    `yaml:"max_size_mb"` // rotated at this size, default 100
+	// Also rotated at this interval when set, e.g. 24h for daily files
+	RotateEvery time.Duration `yaml:"rotate_every"`
+	// Rotated files older than MaxAge (rounded down to days) or beyond
+	// MaxBackups are removed; 0 keeps them
+	MaxAge     time.Duration `yaml:"max_age"`
+	MaxBackups int           `yaml:"max_backups"`
+	Compress   bool          `yaml:"compress"` // gzip rotated files
+}
+
+type AccessLogConfig struct {
+	// combined (default), json or off
+	Format string `yaml:"format"`
+	// Request paths not logged, default /readyz and /metrics
+	SkipPaths []string `yaml:"skip_paths"`
+}
+
+// SendfileConfig offloads file delivery to the reverse proxy in front
+type SendfileConfig struct {
+	// "x-accel-redirect" for nginx, "x-sendfile" for Apache or lighttpd;
+	// empty streams files from the service
+	Mode string `yaml:"mode"`
+	// With x-accel-redirect, the internal nginx location the storage path
+	// is aliased to, default /protected/
+	AccelPrefix string `yaml:"accel_prefix"`
+}
+
+// MeteringConfig publishes upload, processing and bandwidth events to a
+// Kafka topic on kafka_broker for billing
+type MeteringConfig struct {
+	// Metering is off when empty
+	Topic string `yaml:"topic"`
+	// Events held while Kafka is slow; further ones are dropped
+	BufferSize int `yaml:"buffer_size"`
+	// How often queued events are published, default 1s
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+// EncryptionConfig encrypts stored images and their variants with
+// AES-256-GCM. Files stored before it was enabled stay readable as they are.
+type EncryptionConfig struct {
+	// Base64 encoded 32 byte key new files are encrypted with
+	Key string `yaml:"key"`
+	// File holding the key instead, e.g. one a KMS agent or secrets mount
+	// provides, so it stays out of the config
+	KeyFile string `yaml:"key_file"`
+	// Keys rotated out, still used to read the files encrypted with them.
+	// Set without key, files are read but no longer encrypted.
+	PreviousKeys []string `yaml:"previous_keys"`
+}
+
+// ObjectStoreConfig is an S3 compatible bucket. Files moved into it keep
+// their path relative to storage_path as key, after prefix; files are still
+// written under storage_path first.
+type ObjectStoreConfig struct {
+	// e.g. https://s3.eu-central-1.amazonaws.com or a MinIO URL; the
+	// object store is off when empty
+	Endpoint string `yaml:"endpoint"`
+	// Signing region, default us-east-1
+	Region string `yaml:"region"`
+	Bucket string `yaml:"bucket"`
+	// Prepended to every key, e.g. images/
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	// Per request, default 30s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ClientHintsConfig lets the render endpoint choose a preset by Client
+// Hints instead of taking ?preset= as is
+type ClientHintsConfig struct {
+	// Presets of the same look at different widths, e.g. card_480,
+	// card_960 and card_1920; hints are ignored when empty
+	Presets []string `yaml:"presets"`
+}
+
+// SyncUploadConfig bounds uploads processed inline instead of through
+// Kafka, meant for small images such as avatars
+type SyncUploadConfig struct {
+	// Time budget for processing before the response, default 5s. Processing
+	// still going on then finishes in the background.
+	Timeout time.Duration `yaml:"timeout"`
+	// Larger uploads can't be processed inline, default 2
+	MaxSizeMB int64 `yaml:"max_size_mb"`
+}
+
+// QuotaConfig limits the storage of each owner. Uploads over a limit are
+// refused; 0 means no limit.
+type QuotaConfig struct {
+	MaxImages int64 `yaml:"max_images"`
+	// Counts every stored variant, not just the originals
+	MaxStorageMB int64 `yaml:"max_storage_mb"`
+}
+
+// OIDCConfig signs users in with an OpenID Connect provider. A login is
+// exchanged for an access token bound to the user as owner.
+type OIDCConfig struct {
+	// Provider URL, e.g. https://accounts.google.com
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// Defaults to public_url + /auth/callback
+	RedirectURL string `yaml:"redirect_url"`
+	// Requested from the provider, default openid, profile and email
+	Scopes []string `yaml:"scopes"`
+	// Granted to signed in users, default upload, read and write
+	TokenScopes []string `yaml:"token_scopes"`
+	// Lifetime of the token issued on login, default auth.default_token_ttl
+	TokenTTL time.Duration `yaml:"token_ttl"`
+}
+
+type AuthConfig struct {
+	// HMAC key the tokens are signed with
+	TokenSecret string `yaml:"token_secret"`
+	// Lifetime of tokens issued without an explicit ttl, and the longest
+	// lifetime one can ask for
+	DefaultTokenTTL time.Duration `yaml:"default_token_ttl"`
+	MaxTokenTTL     time.Duration `yaml:"max_token_ttl"`
+	// Origins allowed to call the API from a browser, e.g. third-party sites
+	// embedding the upload widget; "*" allows any
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+// WebhookConfig controls webhook delivery and its retries
+type WebhookConfig struct {
+	Timeout      time.Duration `yaml:"timeout"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Attempts before a delivery is dead-lettered as failed
+	MaxAttempts int `yaml:"max_attempts"`
+	// Retry delay after the first failure, doubled after each further one
+	BackoffBase time.Duration `yaml:"backoff_base"`
+	BackoffMax  time.Duration `yaml:"backoff_max"`
+	// Hosts callbacks may be sent to, like proxy.allowed_hosts; any host
+	// when empty
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	// Callbacks to loopback, private and link-local addresses are refused
+	// unless set, e.g. for receivers inside the cluster
+	AllowPrivateNetworks bool `yaml:"allow_private_networks"`
+}
+
+type EmailConfig struct {
+	SMTPHost string `yaml:"smtp_host"`
+	SMTPPort int    `yaml:"smtp_port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+// NotificationsConfig sets where ops alerts go and when they fire
+type NotificationsConfig struct {
+	SlackWebhookURL  string `yaml:"slack_webhook_url"`
+	TelegramBotToken string `yaml:"telegram_bot_token"`
+	TelegramChatID   string `yaml:"telegram_chat_id"`
+	// Any endpoint taking {"text": ...}, sent the token as a bearer token
+	WebhookURL    string        `yaml:"webhook_url"`
+	WebhookToken  string        `yaml:"webhook_token"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+	// A still firing alert is posted again after this long
+	RepeatInterval time.Duration `yaml:"repeat_interval"`
+	// Fires when more than ErrorRateThreshold (0-1) of at least
+	// ErrorRateMinSamples images failed over ErrorRateWindow
+	ErrorRateWindow     time.Duration `yaml:"error_rate_window"`
+	ErrorRateThreshold  float64       `yaml:"error_rate_threshold"`
+	ErrorRateMinSamples int           `yaml:"error_rate_min_samples"`
+	// Fires when this many webhook deliveries are dead-lettered
+	DeadLetterThreshold int `yaml:"dead_letter_threshold"`
+	// Fires when free storage space drops below this
+	DiskFreeMB int `yaml:"disk_free_mb"`
+	// Fires when this many images wait for processing, counting pending and
+	// deferred images and the Kafka outbox
+	QueueBacklogThreshold int `yaml:"queue_backlog_threshold"`
+}
+
+// TenantConfig holds the settings of one tenant, keyed by the X-Tenant value
+type TenantConfig struct {
+	Retention RetentionPolicy `yaml:"retention"`
+}
+
+// RetentionPolicy sets how long each kind of stored file is kept after
+// upload, e.g. originals 720h and thumbnails forever; 0 keeps it forever
+type RetentionPolicy struct {
+	Original    time.Duration `yaml:"original"`
+	Resized     time.Duration `yaml:"resized"`
+	Thumbnail   time.Duration `yaml:"thumbnail"`
+	Watermarked time.Duration `yaml:"watermarked"`
+}
+
+// Kinds returns the retention of each file kind
+func (p RetentionPolicy) Kinds() map[string]time.Duration {
+	return map[string]time.Duration{
+		"original":    p.Original,
+		"resized":     p.Resized,
+		"thumbnail":   p.Thumbnail,
+		"watermarked": p.Watermarked,
+	}
+}
+
+// MaintenanceConfig sets how often each maintenance job runs; 0 disables it
+type MaintenanceConfig struct {
+	// Deletes images past ImageTTL and enforces the retention policies
+	ExpireImages     time.Duration `yaml:"expire_images"`
+	ReconcileOrphans time.Duration `yaml:"reconcile_orphans"`
+	RequeueStuck     time.Duration `yaml:"requeue_stuck"`
+	AggregateStats   time.Duration `yaml:"aggregate_stats"`
+	// Removes /proxy cache files older than proxy.cache_ttl
+	PruneProxyCache time.Duration `yaml:"prune_proxy_cache"`
+	// Images older than this are deleted by expire_images; 0 keeps them forever
+	ImageTTL time.Duration `yaml:"image_ttl"`
+	// Images processing for longer than this without progress are requeued
+	StuckAfter time.Duration `yaml:"stuck_after"`
+}
+
+// ValidateOutput checks that operation can produce out with the configured
+// engine; only vips encodes webp
+func (c *Config) ValidateOutput(operation string, out OutputFormat) error {
+	if err := out.Validate(operation); err != nil {
+		return err
+	}
+	if out.Format == "webp" && c.Engine != "vips" {
+		return fmt.Errorf("%s: webp output requires the vips engine", operation)
+	}
+	return nil
+}
+
+// ValidatePreset checks the configured engine can render the preset; only
+// vips encodes webp
+func (c *Config) ValidatePreset(p Preset) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if p.Format == "webp" && c.Engine != "vips" {
+		return fmt.Errorf("webp format requires the vips engine")
+	}
+	return nil
+}
+
+// Preset describes a named variant, e.g. avatar: 256x256 crop png q80
+type Preset struct {
+	Width  int `yaml:"width"`
+	Height int `yaml:"height"`
+	// fit (default), fill or pad, like the resize modes; crop is fill
+	Mode       string `yaml:"mode"`
+	Gravity    string `yaml:"gravity"`    // anchor of the fill crop, default center
+	Background string `yaml:"background"` // color of the pad borders, default white
+	Format     string `yaml:"format"`     // jpg (default), png, gif or webp (vips engine)
+	Quality    int    `yaml:"quality"`
+	Watermark  bool   `yaml:"watermark"`
+	// circle or rounded cuts the image with transparent corners, e.g. for
+	// avatars; needs png or webp output
+	Shape  string `yaml:"shape"`
+	Radius int    `yaml:"radius"` // rounded corner radius in pixels, default a tenth of the shorter side
+	// Border of BorderWidth pixels around the image, padded outside it by
+	// default or drawn over its edges with BorderInset
+	BorderWidth int    `yaml:"border_width"`
+	BorderColor string `yaml:"border_color"` // #RRGGBB, default black
+	BorderInset bool   `yaml:"border_inset"`
+	Filter      string `yaml:"filter"` // resampling kernel, default lanczos
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -21,6 +579,466 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 	var cfg Config
-	err = yaml.Unmarshal(data, &cfg)
-	return &cfg, err
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.JPEGQuality == 0 {
+		cfg.JPEGQuality = DefaultJPEGQuality
+	}
+	if cfg.JPEGQuality < 1 || cfg.JPEGQuality > 100 {
+		return nil, fmt.Errorf("jpeg_quality: %d is not between 1 and 100", cfg.JPEGQuality)
+	}
+	if cfg.KafkaGroupID == "" {
+		cfg.KafkaGroupID = "image-processor-group"
+	}
+	if cfg.HealthCheckInterval <= 0 {
+		cfg.HealthCheckInterval = 10 * time.Second
+	}
+	if cfg.KafkaLagInterval <= 0 {
+		cfg.KafkaLagInterval = 15 * time.Second
+	}
+	if cfg.MaxConcurrentDecodes <= 0 {
+		cfg.MaxConcurrentDecodes = runtime.NumCPU()
+	}
+	if cfg.MinFreeDiskMB <= 0 {
+		cfg.MinFreeDiskMB = 512
+	}
+	if cfg.DiskCheckInterval <= 0 {
+		cfg.DiskCheckInterval = 30 * time.Second
+	}
+	if cfg.ScheduleInterval <= 0 {
+		cfg.ScheduleInterval = 30 * time.Second
+	}
+	if cfg.ReplicationInterval <= 0 {
+		cfg.ReplicationInterval = time.Minute
+	}
+	if cfg.DecodeMemoryBudgetMB <= 0 {
+		cfg.DecodeMemoryBudgetMB = 1024
+	}
+	if cfg.MaxMegapixels <= 0 {
+		cfg.MaxMegapixels = 100
+	}
+	if cfg.DecodeCacheSize <= 0 {
+		cfg.DecodeCacheSize = 4
+	}
+	if cfg.DecodeCacheTTL == 0 {
+		cfg.DecodeCacheTTL = 30 * time.Second
+	}
+	if cfg.Maintenance.StuckAfter == 0 {
+		cfg.Maintenance.StuckAfter = 30 * time.Minute
+	}
+	if cfg.Webhooks.Timeout == 0 {
+		cfg.Webhooks.Timeout = 10 * time.Second
+	}
+	if cfg.Webhooks.PollInterval == 0 {
+		cfg.Webhooks.PollInterval = 5 * time.Second
+	}
+	if cfg.Webhooks.MaxAttempts <= 0 {
+		cfg.Webhooks.MaxAttempts = 8
+	}
+	if cfg.Webhooks.BackoffBase == 0 {
+		cfg.Webhooks.BackoffBase = 10 * time.Second
+	}
+	if cfg.Webhooks.BackoffMax == 0 {
+		cfg.Webhooks.BackoffMax = time.Hour
+	}
+	if cfg.Email.SMTPPort == 0 {
+		cfg.Email.SMTPPort = 587
+	}
+	if cfg.PublicURL == "" {
+		switch {
+		case len(cfg.TLS.AutocertDomains) > 0:
+			cfg.PublicURL = "https://" + cfg.TLS.AutocertDomains[0]
+		case strings.HasPrefix(cfg.ServerAddr, "unix://"):
+			// Behind a local web server that should set public_url
+			cfg.PublicURL = "http://localhost"
+		case cfg.TLS.CertFile != "":
+			cfg.PublicURL = "https://localhost" + cfg.ServerAddr
+		default:
+			cfg.PublicURL = "http://localhost" + cfg.ServerAddr
+		}
+	}
+	if cfg.Notifications.CheckInterval == 0 {
+		cfg.Notifications.CheckInterval = time.Minute
+	}
+	if cfg.Notifications.RepeatInterval == 0 {
+		cfg.Notifications.RepeatInterval = time.Hour
+	}
+	if cfg.Notifications.ErrorRateWindow == 0 {
+		cfg.Notifications.ErrorRateWindow = 15 * time.Minute
+	}
+	if cfg.Notifications.ErrorRateThreshold == 0 {
+		cfg.Notifications.ErrorRateThreshold = 0.2
+	}
+	if cfg.Notifications.ErrorRateMinSamples <= 0 {
+		cfg.Notifications.ErrorRateMinSamples = 20
+	}
+	if cfg.Notifications.DeadLetterThreshold <= 0 {
+		cfg.Notifications.DeadLetterThreshold = 10
+	}
+	if cfg.Notifications.DiskFreeMB <= 0 {
+		cfg.Notifications.DiskFreeMB = 2 * cfg.MinFreeDiskMB
+	}
+	if cfg.Notifications.QueueBacklogThreshold <= 0 {
+		cfg.Notifications.QueueBacklogThreshold = 1000
+	}
+	if cfg.Auth.DefaultTokenTTL == 0 {
+		cfg.Auth.DefaultTokenTTL = time.Hour
+	}
+	if cfg.Auth.MaxTokenTTL == 0 {
+		cfg.Auth.MaxTokenTTL = 30 * 24 * time.Hour
+	}
+	if cfg.Metering.BufferSize <= 0 {
+		cfg.Metering.BufferSize = 10000
+	}
+	if cfg.Metering.FlushInterval <= 0 {
+		cfg.Metering.FlushInterval = time.Second
+	}
+	if cfg.Encryption.KeyFile != "" {
+		if cfg.Encryption.Key != "" {
+			return nil, fmt.Errorf("encryption: key and key_file are mutually exclusive")
+		}
+		key, err := os.ReadFile(cfg.Encryption.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("encryption.key_file: %v", err)
+		}
+		cfg.Encryption.Key = strings.TrimSpace(string(key))
+	}
+	for _, key := range append([]string{cfg.Encryption.Key}, cfg.Encryption.PreviousKeys...) {
+		if raw, err := base64.StdEncoding.DecodeString(key); key != "" && (err != nil || len(raw) != 32) {
+			return nil, fmt.Errorf("encryption: keys must be 32 bytes, base64 encoded")
+		}
+	}
+	if cfg.ObjectStore.Endpoint != "" && cfg.ObjectStore.Bucket == "" {
+		return nil, fmt.Errorf("object_store.bucket is required with object_store.endpoint")
+	}
+	if cfg.ObjectStore.Region == "" {
+		cfg.ObjectStore.Region = "us-east-1"
+	}
+	if cfg.ObjectStore.Timeout <= 0 {
+		cfg.ObjectStore.Timeout = 30 * time.Second
+	}
+	if cfg.SyncUpload.Timeout <= 0 {
+		cfg.SyncUpload.Timeout = 5 * time.Second
+	}
+	if cfg.SyncUpload.MaxSizeMB <= 0 {
+		cfg.SyncUpload.MaxSizeMB = 2
+	}
+	if cfg.Quota.MaxImages < 0 || cfg.Quota.MaxStorageMB < 0 {
+		return nil, fmt.Errorf("quota: limits can't be negative")
+	}
+	if cfg.OIDC.Issuer != "" {
+		if cfg.OIDC.ClientID == "" {
+			return nil, fmt.Errorf("oidc.client_id is required with oidc.issuer")
+		}
+		if cfg.Auth.TokenSecret == "" {
+			return nil, fmt.Errorf("auth.token_secret is required with oidc.issuer")
+		}
+		if cfg.OIDC.RedirectURL == "" {
+			cfg.OIDC.RedirectURL = strings.TrimRight(cfg.PublicURL, "/") + "/auth/callback"
+		}
+		if len(cfg.OIDC.Scopes) == 0 {
+			cfg.OIDC.Scopes = []string{"openid", "profile", "email"}
+		}
+		if len(cfg.OIDC.TokenScopes) == 0 {
+			cfg.OIDC.TokenScopes = []string{"upload", "read", "write"}
+		}
+		if cfg.OIDC.TokenTTL == 0 {
+			cfg.OIDC.TokenTTL = cfg.Auth.DefaultTokenTTL
+		}
+	}
+	if cfg.Proxy.Timeout == 0 {
+		cfg.Proxy.Timeout = 10 * time.Second
+	}
+	if cfg.Proxy.MaxSizeMB <= 0 {
+		cfg.Proxy.MaxSizeMB = 10
+	}
+	if cfg.Proxy.CacheTTL == 0 {
+		cfg.Proxy.CacheTTL = 24 * time.Hour
+	}
+	if cfg.JpegtranPath == "" {
+		cfg.JpegtranPath = "jpegtran"
+	}
+	if cfg.ZopflipngPath == "" {
+		cfg.ZopflipngPath = "zopflipng"
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return nil, fmt.Errorf("tls: cert_file and key_file must be set together")
+	}
+	if cfg.TLS.CertFile != "" && len(cfg.TLS.AutocertDomains) > 0 {
+		return nil, fmt.Errorf("tls: cert_file and autocert_domains are mutually exclusive")
+	}
+	if cfg.TLS.AdminClientCA != "" && !cfg.TLS.Enabled() {
+		return nil, fmt.Errorf("tls: admin_client_ca requires a certificate")
+	}
+	if cfg.HTTP.ReadHeaderTimeout == 0 {
+		cfg.HTTP.ReadHeaderTimeout = 10 * time.Second
+	}
+	if cfg.HTTP.ReadTimeout == 0 {
+		cfg.HTTP.ReadTimeout = 2 * time.Minute
+	}
+	if cfg.HTTP.WriteTimeout == 0 {
+		cfg.HTTP.WriteTimeout = 5 * time.Minute
+	}
+	if cfg.HTTP.IdleTimeout == 0 {
+		cfg.HTTP.IdleTimeout = 2 * time.Minute
+	}
+	if cfg.HTTP.MaxHeaderBytes <= 0 {
+		cfg.HTTP.MaxHeaderBytes = 1 << 20
+	}
+	if cfg.HTTP.MaxMultipartMemoryMB <= 0 {
+		cfg.HTTP.MaxMultipartMemoryMB = 8
+	}
+	switch cfg.GIFVideoFormat {
+	case "", "mp4", "webm":
+	default:
+		return nil, fmt.Errorf("gif_video_format: %q is not mp4 or webm", cfg.GIFVideoFormat)
+	}
+	switch cfg.ICCProfile {
+	case "":
+		cfg.ICCProfile = "preserve"
+	case "preserve", "srgb", "strip":
+	default:
+		return nil, fmt.Errorf("icc_profile: %q is not preserve, srgb or strip", cfg.ICCProfile)
+	}
+	if cfg.ICCProfile == "srgb" && cfg.Engine != "vips" {
+		return nil, fmt.Errorf("icc_profile: srgb needs the vips engine")
+	}
+	if cfg.SharpenAmount < 0 || cfg.SharpenAmount > 5 {
+		return nil, fmt.Errorf("sharpen_amount: %v is not between 0 and 5", cfg.SharpenAmount)
+	}
+	if cfg.SharpenRadius == 0 {
+		cfg.SharpenRadius = 1
+	}
+	if cfg.SharpenRadius < 0 || cfg.SharpenRadius > 10 {
+		return nil, fmt.Errorf("sharpen_radius: %v is not between 0 and 10", cfg.SharpenRadius)
+	}
+	if cfg.Upscale.Scale == 0 {
+		cfg.Upscale.Scale = 4
+	}
+	if cfg.Upscale.Scale != 2 && cfg.Upscale.Scale != 4 {
+		return nil, fmt.Errorf("upscale.scale: %d is not 2 or 4", cfg.Upscale.Scale)
+	}
+	if cfg.Upscale.Timeout == 0 {
+		cfg.Upscale.Timeout = 10 * time.Minute
+	}
+	if cfg.Upscale.PollInterval == 0 {
+		cfg.Upscale.PollInterval = 5 * time.Second
+	}
+	if cfg.Upscale.MaxSizeMB <= 0 {
+		cfg.Upscale.MaxSizeMB = 200
+	}
+	if cfg.OCR.TesseractPath == "" {
+		cfg.OCR.TesseractPath = "tesseract"
+	}
+	if cfg.OCR.Languages == "" {
+		cfg.OCR.Languages = "eng"
+	}
+	if cfg.OCR.Timeout == 0 {
+		cfg.OCR.Timeout = time.Minute
+	}
+	if cfg.GRPCMaxUploadMB <= 0 {
+		cfg.GRPCMaxUploadMB = 100
+	}
+	if cfg.HotFolder.SettleDelay <= 0 {
+		cfg.HotFolder.SettleDelay = 2 * time.Second
+	}
+	if cfg.HotFolder.Path != "" && cfg.HotFolder.FailedDir == "" {
+		cfg.HotFolder.FailedDir = filepath.Join(cfg.HotFolder.Path, "failed")
+	}
+	if cfg.HotFolder.MaxSizeMB <= 0 {
+		cfg.HotFolder.MaxSizeMB = 100
+	}
+	if cfg.SFTP.Addr != "" {
+		if cfg.SFTP.KnownHostsPath == "" && !cfg.SFTP.InsecureIgnoreHostKey {
+			return nil, fmt.Errorf("sftp: known_hosts_path is required unless insecure_ignore_host_key is set")
+		}
+		if cfg.SFTP.Password == "" && cfg.SFTP.PrivateKeyPath == "" {
+			return nil, fmt.Errorf("sftp: password or private_key_path is required")
+		}
+		if cfg.SFTP.Dir == "" {
+			cfg.SFTP.Dir = "."
+		}
+		if cfg.SFTP.FailedDir == "" {
+			cfg.SFTP.FailedDir = strings.TrimSuffix(cfg.SFTP.Dir, "/") + "/failed"
+		}
+	}
+	if cfg.SFTP.Interval <= 0 {
+		cfg.SFTP.Interval = time.Minute
+	}
+	if cfg.SFTP.MinAge <= 0 {
+		cfg.SFTP.MinAge = 10 * time.Second
+	}
+	if cfg.SFTP.MaxSizeMB <= 0 {
+		cfg.SFTP.MaxSizeMB = 100
+	}
+	if cfg.SFTP.Timeout <= 0 {
+		cfg.SFTP.Timeout = 30 * time.Second
+	}
+	if cfg.Log.MaxSizeMB <= 0 {
+		cfg.Log.MaxSizeMB = 100
+	}
+	if cfg.ImageLogImages <= 0 {
+		cfg.ImageLogImages = 1000
+	}
+	if cfg.ImageLogLines <= 0 {
+		cfg.ImageLogLines = 200
+	}
+	switch cfg.AccessLog.Format {
+	case "":
+		cfg.AccessLog.Format = "combined"
+	case "combined", "json", "off":
+	default:
+		return nil, fmt.Errorf("access_log.format: %q is not combined, json or off", cfg.AccessLog.Format)
+	}
+	if cfg.AccessLog.SkipPaths == nil {
+		cfg.AccessLog.SkipPaths = []string{"/readyz", "/metrics"}
+	}
+	if cfg.Log.MaxAge > 0 && cfg.Log.MaxAge < 24*time.Hour {
+		return nil, fmt.Errorf("log.max_age: %s is less than a day", cfg.Log.MaxAge)
+	}
+	switch cfg.Sendfile.Mode {
+	case "", "x-accel-redirect", "x-sendfile":
+	default:
+		return nil, fmt.Errorf("sendfile.mode: %q is not x-accel-redirect or x-sendfile", cfg.Sendfile.Mode)
+	}
+	if cfg.Sendfile.AccelPrefix == "" {
+		cfg.Sendfile.AccelPrefix = "/protected/"
+	}
+	if cfg.MaxProcessingAttempts <= 0 {
+		cfg.MaxProcessingAttempts = 3
+	}
+	if cfg.DrainTimeout == 0 {
+		cfg.DrainTimeout = 30 * time.Second
+	}
+	if cfg.FFmpegPath == "" {
+		cfg.FFmpegPath = "ffmpeg"
+	}
+	if cfg.FFmpegTimeout == 0 {
+		cfg.FFmpegTimeout = 2 * time.Minute
+	}
+	if cfg.LazyVariantTimeout == 0 {
+		cfg.LazyVariantTimeout = 3 * time.Second
+	}
+	if cfg.OutboxRelayInterval == 0 {
+		cfg.OutboxRelayInterval = 15 * time.Second
+	}
+	if cfg.KafkaBreaker.FailureThreshold <= 0 {
+		cfg.KafkaBreaker.FailureThreshold = 5
+	}
+	if cfg.KafkaBreaker.Cooldown == 0 {
+		cfg.KafkaBreaker.Cooldown = 30 * time.Second
+	}
+	if cfg.KafkaBreaker.PublishTimeout == 0 {
+		cfg.KafkaBreaker.PublishTimeout = 5 * time.Second
+	}
+	if cfg.SocketMode == "" {
+		cfg.SocketMode = "0660"
+	}
+	if mode, err := strconv.ParseUint(cfg.SocketMode, 8, 32); err != nil || mode > 0777 {
+		return nil, fmt.Errorf("socket_mode: %q is not an octal file mode", cfg.SocketMode)
+	}
+	if cfg.TLS.AutocertCacheDir == "" {
+		cfg.TLS.AutocertCacheDir = "autocert-cache"
+	}
+	if cfg.TLS.HTTPRedirectAddr == "" {
+		cfg.TLS.HTTPRedirectAddr = ":80"
+	}
+	for name, cidrs := range map[string][]string{
+		"admin_cidrs":     cfg.Network.AdminCIDRs,
+		"delete_cidrs":    cfg.Network.DeleteCIDRs,
+		"trusted_proxies": cfg.Network.TrustedProxies,
+	} {
+		if _, err := ParsePrefixes(cidrs); err != nil {
+			return nil, fmt.Errorf("network.%s: %v", name, err)
+		}
+	}
+	for operation, out := range cfg.Outputs {
+		if err := cfg.ValidateOutput(operation, out); err != nil {
+			return nil, fmt.Errorf("outputs: %v", err)
+		}
+	}
+	for name, preset := range cfg.Presets {
+		if err := cfg.ValidatePreset(preset); err != nil {
+			return nil, fmt.Errorf("preset %q: %v", name, err)
+		}
+		if preset.Format == "" {
+			preset.Format = "jpg"
+		}
+		if preset.Quality == 0 {
+			preset.Quality = cfg.JPEGQuality
+		}
+		cfg.Presets[name] = preset
+	}
+	if _, ok := cfg.Presets[cfg.HotFolder.Preset]; cfg.HotFolder.Preset != "" && !ok {
+		return nil, fmt.Errorf("hot_folder.preset: unknown preset %q", cfg.HotFolder.Preset)
+	}
+	if _, ok := cfg.Presets[cfg.SFTP.Preset]; cfg.SFTP.Preset != "" && !ok {
+		return nil, fmt.Errorf("sftp.preset: unknown preset %q", cfg.SFTP.Preset)
+	}
+	for _, name := range cfg.ClientHints.Presets {
+		// Presets are chosen by width, one without can't be compared
+		if preset, ok := cfg.Presets[name]; !ok || preset.Width == 0 {
+			return nil, fmt.Errorf("client_hints.presets: %q is not a preset with a width", name)
+		}
+	}
+	return &cfg, nil
+}
+
+// Validate checks the preset is one the renderer can produce
+func (p Preset) Validate() error {
+	if p.Width < 0 || p.Height < 0 || (p.Width == 0 && p.Height == 0) {
+		return fmt.Errorf("width or height must be set")
+	}
+	switch p.Mode {
+	case "", "fit":
+	case "crop", "fill", "pad":
+		if p.Width == 0 || p.Height == 0 {
+			return fmt.Errorf("%s mode requires both width and height", p.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", p.Mode)
+	}
+	if p.Gravity != "" && !slices.Contains(Gravities, p.Gravity) {
+		return fmt.Errorf("unsupported gravity %q", p.Gravity)
+	}
+	if p.Background != "" {
+		if _, err := ParseColor(p.Background); err != nil {
+			return fmt.Errorf("background: %v", err)
+		}
+	}
+	switch p.Format {
+	case "", "jpg", "png", "gif", "webp":
+	default:
+		return fmt.Errorf("unsupported format %q", p.Format)
+	}
+	if p.Quality < 0 || p.Quality > 100 {
+		return fmt.Errorf("quality must be between 1 and 100")
+	}
+	switch p.Shape {
+	case "":
+	case "circle", "rounded":
+		if p.Format != "png" && p.Format != "webp" {
+			return fmt.Errorf("shape %s needs png or webp format for transparency", p.Shape)
+		}
+	default:
+		return fmt.Errorf("unknown shape %q", p.Shape)
+	}
+	if p.Radius < 0 {
+		return fmt.Errorf("radius must not be negative")
+	}
+	if p.BorderWidth < 0 || p.BorderWidth > maxBorderWidth {
+		return fmt.Errorf("border_width must be between 0 and %d", maxBorderWidth)
+	}
+	if p.BorderColor != "" {
+		if _, err := ParseColor(p.BorderColor); err != nil {
+			return fmt.Errorf("border_color: %v", err)
+		}
+	}
+	if p.Filter != "" && !slices.Contains(Filters, p.Filter) {
+		return fmt.Errorf("unsupported filter %q", p.Filter)
+	}
+	return nil
 }
+
+const maxBorderWidth = 500
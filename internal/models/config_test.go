@@ -0,0 +1,65 @@
+package models
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadTestConfig(t *testing.T, yaml string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(path)
+}
+
+func TestLoadConfigJPEGQuality(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    int
+		wantErr bool
+	}{
+		{"default", "storage_path: ./storage\n", DefaultJPEGQuality, false},
+		{"set", "jpeg_quality: 60\n", 60, false},
+		{"lowest", "jpeg_quality: 1\n", 1, false},
+		{"highest", "jpeg_quality: 100\n", 100, false},
+		{"negative", "jpeg_quality: -1\n", 0, true},
+		{"too high", "jpeg_quality: 101\n", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, tt.yaml)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadConfig accepted %q", tt.yaml)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if cfg.JPEGQuality != tt.want {
+				t.Errorf("JPEGQuality = %d, want %d", cfg.JPEGQuality, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMalformed(t *testing.T) {
+	cfg, err := loadTestConfig(t, "jpeg_quality: [85\n")
+	if err == nil {
+		t.Fatalf("LoadConfig accepted malformed YAML")
+	}
+	if cfg != nil {
+		t.Errorf("LoadConfig returned a config along with %v", err)
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Errorf("LoadConfig of a missing file succeeded")
+	}
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ImageFingerprint is what duplicate images are found by: the checksum of
+// the original for exact copies and its perceptual hash for near ones
+type ImageFingerprint struct {
+	ImageID uuid.UUID `db:"image_id" json:"image_id"`
+	Tenant  string    `db:"tenant" json:"tenant,omitempty"`
+	// Empty when the original's checksum wasn't recorded
+	SHA256 string `db:"sha256" json:"-"`
+	// Difference hash, nil for images processed before hashes were recorded
+	DHash     *int64    `db:"dhash" json:"-"`
+	Size      int64     `db:"size" json:"size"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ImageEvent is one step of an image's processing lifecycle
+type ImageEvent struct {
+	ID        int64     `db:"id" json:"id"`
+	ImageID   uuid.UUID `db:"image_id" json:"image_id"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	Event     string    `db:"event" json:"event"`         // queued, started, finished, error
+	Operation string    `db:"operation" json:"operation"` // resize, thumbnail, watermark, preset or empty for the whole pipeline
+	Message   string    `db:"message" json:"message,omitempty"`
+	// How long the operation took, set on finished and error events
+	DurationMS *int64 `db:"duration_ms" json:"duration_ms,omitempty"`
+}
+
+// OperationStats aggregates operation durations over a time window
+type OperationStats struct {
+	Operation string  `json:"operation"`
+	Count     int64   `json:"count"`
+	Errors    int64   `json:"errors"`
+	P50MS     float64 `json:"p50_ms"`
+	P90MS     float64 `json:"p90_ms"`
+	P99MS     float64 `json:"p99_ms"`
+	MaxMS     int64   `json:"max_ms"`
+}
+
+// StatsPoint is one hourly or daily bucket of the stats rollup
+type StatsPoint struct {
+	Time          time.Time `db:"bucket" json:"time"`
+	Uploaded      int64     `db:"uploaded" json:"uploaded"`
+	Processed     int64     `db:"processed" json:"processed"`
+	Failed        int64     `db:"failed" json:"failed"`
+	AvgDurationMS float64   `db:"avg_duration_ms" json:"avg_duration_ms"`
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ImageExport is the row of an image in the metadata export
+type ImageExport struct {
+	ID               uuid.UUID `db:"id" json:"id"`
+	Tenant           string    `db:"tenant" json:"tenant"`
+	OriginalFilename string    `db:"original_filename" json:"original_filename"`
+	ContentType      string    `db:"content_type" json:"content_type"`
+	Status           string    `db:"status" json:"status"`
+	ResizeStatus     string    `db:"resize_status" json:"resize_status"`
+	ThumbnailStatus  string    `db:"thumbnail_status" json:"thumbnail_status"`
+	WatermarkStatus  string    `db:"watermark_status" json:"watermark_status"`
+	Preset           string    `db:"preset" json:"preset"`
+	Title            string    `db:"title" json:"title"`
+	// Bytes of the original and of every stored file, from the recorded
+	// checksums
+	OriginalSize int64     `db:"original_size" json:"original_size"`
+	TotalSize    int64     `db:"total_size" json:"total_size"`
+	SHA256       string    `db:"sha256" json:"sha256"` // of the original
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt    time.Time `db:"updated_at" json:"updated_at"`
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 5000
+	maxTags              = 50
+	maxTagLength         = 64
+)
+
+// ImageMetadata is a change to an image's descriptive metadata; nil fields
+// are left as they are
+type ImageMetadata struct {
+	Title       *string   `json:"title"`
+	Description *string   `json:"description"`
+	Tags        *[]string `json:"tags"`
+}
+
+// Apply validates the change and applies it to img
+func (m ImageMetadata) Apply(img *Image) error {
+	if m.Title != nil {
+		title := strings.TrimSpace(*m.Title)
+		if utf8.RuneCountInString(title) > maxTitleLength {
+			return fmt.Errorf("title is longer than %d characters", maxTitleLength)
+		}
+		img.Title = title
+	}
+	if m.Description != nil {
+		description := strings.TrimSpace(*m.Description)
+		if utf8.RuneCountInString(description) > maxDescriptionLength {
+			return fmt.Errorf("description is longer than %d characters", maxDescriptionLength)
+		}
+		img.Description = description
+	}
+	if m.Tags != nil {
+		tags, err := NormalizeTags(*m.Tags)
+		if err != nil {
+			return err
+		}
+		img.Tags = tags
+	}
+	return nil
+}
+
+// NormalizeTags trims and lowercases tags, dropping empty and repeated ones
+func NormalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || slices.Contains(normalized, tag) {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLength)
+		}
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	return normalized, nil
+}
@@ -1,16 +1,219 @@
 package models
 
-import "github.com/google/uuid"
+import (
+	"encoding/hex"
+	"fmt"
+	"image/color"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type Image struct {
-	ID              uuid.UUID `db:"id"`
-	Status          string    `db:"status"` // pending, processing, done, error
-	OriginalPath    string    `db:"original_path"`
-	ProcessedPath   string    `db:"processed_path"`
-	ThumbnailPath   string    `db:"thumbnail_path"`
-	WatermarkedPath string    `db:"watermarked_path"`
+	ID           uuid.UUID `db:"id" json:"id"`
+	Status       string    `db:"status" json:"status"` // scheduled, deferred, pending, processing, done, partial, error
+	OriginalPath string    `db:"original_path" json:"original_path"`
+	// Tenant the image was uploaded for, empty without one
+	Tenant string `db:"tenant" json:"tenant"`
+	// Identity that uploaded it with an owner-bound token, e.g. after an
+	// OIDC login; empty otherwise
+	Owner string `db:"owner" json:"owner,omitempty"`
+	// Size of the original in bytes
+	Size int64 `db:"size" json:"size"`
+	// Uploaded filename and detected MIME type of the original
+	OriginalFilename string `db:"original_filename" json:"original_filename"`
+	ContentType      string `db:"content_type" json:"content_type"`
+	ProcessedPath    string `db:"processed_path" json:"processed_path"`
+	ThumbnailPath    string `db:"thumbnail_path" json:"thumbnail_path"`
+	WatermarkedPath  string `db:"watermarked_path" json:"watermarked_path"`
 	// Individual processing status
-	ResizeStatus    string `db:"resize_status"`    // pending, processing, done, error
-	ThumbnailStatus string `db:"thumbnail_status"` // pending, processing, done, error
-	WatermarkStatus string `db:"watermark_status"` // pending, processing, done, error
+	ResizeStatus    string `db:"resize_status" json:"resize_status"`       // pending, processing, done, error, expired
+	ThumbnailStatus string `db:"thumbnail_status" json:"thumbnail_status"` // pending, processing, done, error, expired
+	WatermarkStatus string `db:"watermark_status" json:"watermark_status"` // pending, processing, done, error, skipped, expired
+	// Video converted from an animated GIF, empty status for other images
+	VideoStatus string `db:"video_status" json:"video_status,omitempty"` // processing, done, error
+	VideoPath   string `db:"video_path" json:"video_path,omitempty"`
+	// Result of the external upscaling service, empty status unless requested
+	UpscaleStatus string `db:"upscale_status" json:"upscale_status,omitempty"` // processing, done, error
+	UpscaledPath  string `db:"upscaled_path" json:"upscaled_path,omitempty"`
+	// Descriptive metadata, searchable along with the filename and OCRText
+	Title       string   `db:"title" json:"title,omitempty"`
+	Description string   `db:"description" json:"description,omitempty"`
+	Tags        []string `db:"tags" json:"tags,omitempty"`
+	// Text recognized in the image when OCR is enabled
+	OCRText string `db:"ocr_text" json:"ocr_text,omitempty"`
+	// Last error of each operation that failed and hasn't succeeded since,
+	// keyed by operation; "processing" holds failures of the whole run
+	Errors map[string]string `db:"errors" json:"errors,omitempty"`
+	// Runs of each operation started by the worker, keyed like Errors
+	Attempts map[string]int `db:"attempts" json:"attempts,omitempty"`
+	// Preset requested at upload, rendered after the standard variants
+	Preset string `db:"preset" json:"preset"`
+	// Processing options supplied at upload
+	Options ProcessingOptions `db:"options" json:"options"`
+	// Notified with a webhook once processing finishes, empty for none
+	CallbackURL string `db:"callback_url" json:"callback_url,omitempty"`
+	// Emailed once processing finishes, empty for none
+	NotifyEmail string `db:"notify_email" json:"notify_email,omitempty"`
+	// Processing is held back until this time when set at upload
+	ProcessAt *time.Time `db:"process_at" json:"process_at,omitempty"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+// ProcessingOptions override the default processing behavior for one image.
+// Zero values fall back to the defaults.
+type ProcessingOptions struct {
+	ResizeWidth   int    `json:"resize_width,omitempty"`   // default 800
+	ThumbnailSize int    `json:"thumbnail_size,omitempty"` // default 100
+	Format        string `json:"format,omitempty"`         // jpg (default), png or gif
+	Quality       int    `json:"quality,omitempty"`        // default Config.JPEGQuality
+	DPI           int    `json:"dpi,omitempty"`            // default the original's density
+	// fit (contain), fill (cover and crop at Gravity) or pad (letterbox) to
+	// exactly ResizeWidth x ResizeHeight; by default only the width is set
+	// and the height follows the aspect ratio
+	ResizeMode   string `json:"resize_mode,omitempty"`
+	ResizeHeight int    `json:"resize_height,omitempty"`
+	Gravity      string `json:"gravity,omitempty"` // default center
+	// Color of pad borders and of the matte transparent images are
+	// flattened onto for JPEG: #RRGGBB or transparent (pad only); default white
+	Background string `json:"background,omitempty"`
+	// Resampling kernel of resize and thumbnail: nearest, box, linear,
+	// catmullrom or lanczos (default); the cheaper ones trade quality for speed
+	Filter string `json:"filter,omitempty"`
+	// Encoding of single operations, keyed by resize, thumbnail or watermark,
+	// e.g. {"thumbnail": {"format": "png"}}; overrides Format and Quality
+	Outputs map[string]OutputFormat `json:"outputs,omitempty"`
+	// Operations can be skipped, all of them run by default
+	Resize    *bool `json:"resize,omitempty"`
+	Thumbnail *bool `json:"thumbnail,omitempty"`
+	Watermark *bool `json:"watermark,omitempty"`
+	// Also produce an upscaled variant with the configured upscaling service
+	Upscale bool `json:"upscale,omitempty"`
+}
+
+const (
+	maxOptionSize = 10000
+	maxDPI        = 4800
+)
+
+func (o ProcessingOptions) Validate() error {
+	if o.ResizeWidth < 0 || o.ResizeWidth > maxOptionSize {
+		return fmt.Errorf("resize_width must be between 1 and %d", maxOptionSize)
+	}
+	if o.ThumbnailSize < 0 || o.ThumbnailSize > maxOptionSize {
+		return fmt.Errorf("thumbnail_size must be between 1 and %d", maxOptionSize)
+	}
+	switch o.Format {
+	case "", "jpg", "png", "gif":
+	default:
+		return fmt.Errorf("unsupported format %q", o.Format)
+	}
+	if o.Quality < 0 || o.Quality > 100 {
+		return fmt.Errorf("quality must be between 1 and 100")
+	}
+	if o.ResizeHeight < 0 || o.ResizeHeight > maxOptionSize {
+		return fmt.Errorf("resize_height must be between 1 and %d", maxOptionSize)
+	}
+	switch o.ResizeMode {
+	case "":
+	case "fit", "fill", "pad":
+		if o.ResizeHeight == 0 {
+			return fmt.Errorf("resize_mode %s needs resize_height", o.ResizeMode)
+		}
+	default:
+		return fmt.Errorf("unsupported resize_mode %q", o.ResizeMode)
+	}
+	if o.Gravity != "" && !slices.Contains(Gravities, o.Gravity) {
+		return fmt.Errorf("unsupported gravity %q", o.Gravity)
+	}
+	if o.Background != "" {
+		if _, err := ParseColor(o.Background); err != nil {
+			return fmt.Errorf("background: %v", err)
+		}
+	}
+	if o.Filter != "" && !slices.Contains(Filters, o.Filter) {
+		return fmt.Errorf("unsupported filter %q", o.Filter)
+	}
+	if o.DPI < 0 || o.DPI > maxDPI {
+		return fmt.Errorf("dpi must be between 1 and %d", maxDPI)
+	}
+	for operation, out := range o.Outputs {
+		if err := out.Validate(operation); err != nil {
+			return fmt.Errorf("outputs: %v", err)
+		}
+	}
+	return nil
+}
+
+// ParseColor parses #RRGGBB, #RRGGBBAA or transparent
+func ParseColor(s string) (color.NRGBA, error) {
+	if s == "transparent" {
+		return color.NRGBA{}, nil
+	}
+	hexStr := strings.TrimPrefix(s, "#")
+	if len(hexStr) != 6 && len(hexStr) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	if len(hexStr) == 6 {
+		hexStr += "ff"
+	}
+	b, err := hex.DecodeString(hexStr)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	return color.NRGBA{R: b[0], G: b[1], B: b[2], A: b[3]}, nil
+}
+
+// Gravities are the anchors a fill crop can keep
+var Gravities = []string{"center", "top", "bottom", "left", "right", "top-left", "top-right", "bottom-left", "bottom-right"}
+
+// Filters are the resampling kernels, fastest first
+var Filters = []string{"nearest", "box", "linear", "catmullrom", "lanczos"}
+
+// Operations whose output encoding can be chosen
+var outputOperations = []string{"resize", "thumbnail", "watermark"}
+
+// OutputFormat is the encoding of one operation's output
+type OutputFormat struct {
+	Format  string `yaml:"format" json:"format,omitempty"` // jpg, png, gif or webp (resize and thumbnail with the vips engine)
+	Quality int    `yaml:"quality" json:"quality,omitempty"`
+}
+
+// Validate checks the format is one the operation can produce. Whether webp
+// is available depends on the engine, see Config.ValidateOutput.
+func (f OutputFormat) Validate(operation string) error {
+	if !slices.Contains(outputOperations, operation) {
+		return fmt.Errorf("unknown operation %q", operation)
+	}
+	switch f.Format {
+	case "", "jpg", "png", "gif":
+	case "webp":
+		if operation == "watermark" {
+			return fmt.Errorf("%s: webp is only supported for resize and thumbnail", operation)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported format %q", operation, f.Format)
+	}
+	if f.Quality < 0 || f.Quality > 100 {
+		return fmt.Errorf("%s: quality must be between 1 and 100", operation)
+	}
+	return nil
+}
+
+// ResizeEnabled reports whether the resized variant should be produced
+func (o ProcessingOptions) ResizeEnabled() bool {
+	return o.Resize == nil || *o.Resize
+}
+
+// ThumbnailEnabled reports whether the thumbnail should be produced
+func (o ProcessingOptions) ThumbnailEnabled() bool {
+	return o.Thumbnail == nil || *o.Thumbnail
+}
+
+// WatermarkEnabled reports whether the watermark variant should be produced
+func (o ProcessingOptions) WatermarkEnabled() bool {
+	return o.Watermark == nil || *o.Watermark
 }
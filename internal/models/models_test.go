@@ -0,0 +1,64 @@
+package models
+
+import "testing"
+
+func TestProcessingOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    ProcessingOptions
+		wantErr bool
+	}{
+		{"defaults", ProcessingOptions{}, false},
+		{"sizes", ProcessingOptions{ResizeWidth: 1200, ThumbnailSize: 200}, false},
+		{"largest size", ProcessingOptions{ResizeWidth: maxOptionSize, ThumbnailSize: maxOptionSize}, false},
+		{"png", ProcessingOptions{Format: "png"}, false},
+		{"quality", ProcessingOptions{Quality: 100}, false},
+		{"fill", ProcessingOptions{ResizeMode: "fill", ResizeWidth: 400, ResizeHeight: 300, Gravity: "top"}, false},
+		{"pad", ProcessingOptions{ResizeMode: "pad", ResizeHeight: 300, Background: "#336699"}, false},
+		{"transparent background", ProcessingOptions{Background: "transparent"}, false},
+		{"filter", ProcessingOptions{Filter: "box"}, false},
+		{"output", ProcessingOptions{Outputs: map[string]OutputFormat{"thumbnail": {Format: "png"}}}, false},
+		{"operations skipped", ProcessingOptions{Resize: new(bool), Thumbnail: new(bool), Watermark: new(bool)}, false},
+
+		{"negative width", ProcessingOptions{ResizeWidth: -1}, true},
+		{"width too large", ProcessingOptions{ResizeWidth: maxOptionSize + 1}, true},
+		{"thumbnail too large", ProcessingOptions{ThumbnailSize: maxOptionSize + 1}, true},
+		{"height too large", ProcessingOptions{ResizeHeight: maxOptionSize + 1}, true},
+		{"unknown format", ProcessingOptions{Format: "bmp"}, true},
+		{"quality too high", ProcessingOptions{Quality: 101}, true},
+		{"negative quality", ProcessingOptions{Quality: -1}, true},
+		{"mode without height", ProcessingOptions{ResizeMode: "fit", ResizeWidth: 400}, true},
+		{"unknown mode", ProcessingOptions{ResizeMode: "stretch", ResizeHeight: 300}, true},
+		{"unknown gravity", ProcessingOptions{Gravity: "middle"}, true},
+		{"bad background", ProcessingOptions{Background: "#12345"}, true},
+		{"unknown filter", ProcessingOptions{Filter: "bicubic"}, true},
+		{"dpi too high", ProcessingOptions{DPI: maxDPI + 1}, true},
+		{"unknown output operation", ProcessingOptions{Outputs: map[string]OutputFormat{"crop": {Format: "png"}}}, true},
+		{"watermark as webp", ProcessingOptions{Outputs: map[string]OutputFormat{"watermark": {Format: "webp"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if tt.wantErr && err == nil {
+				t.Errorf("Validate accepted %+v", tt.opts)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Validate: %v", err)
+			}
+		})
+	}
+}
+
+func TestProcessingOptionsEnabled(t *testing.T) {
+	var opts ProcessingOptions
+	if !opts.ResizeEnabled() || !opts.ThumbnailEnabled() || !opts.WatermarkEnabled() {
+		t.Errorf("operations aren't all enabled by default")
+	}
+
+	off, on := false, true
+	opts = ProcessingOptions{Resize: &off, Thumbnail: &on, Watermark: &off}
+	if opts.ResizeEnabled() || !opts.ThumbnailEnabled() || opts.WatermarkEnabled() {
+		t.Errorf("ResizeEnabled, ThumbnailEnabled, WatermarkEnabled = %v, %v, %v, want false, true, false",
+			opts.ResizeEnabled(), opts.ThumbnailEnabled(), opts.WatermarkEnabled())
+	}
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OutboxEntry is a processing message that couldn't be published to Kafka
+// and waits for the relay
+type OutboxEntry struct {
+	ID            int64     `db:"id" json:"id"`
+	ImageID       uuid.UUID `db:"image_id" json:"image_id"`
+	Reason        string    `db:"reason" json:"reason"`
+	Attempts      int       `db:"attempts" json:"attempts"`
+	LastError     string    `db:"last_error" json:"last_error,omitempty"`
+	NextAttemptAt time.Time `db:"next_attempt_at" json:"next_attempt_at"`
+	CreatedAt     time.Time `db:"created_at" json:"created_at"`
+}
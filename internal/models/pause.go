@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// ProcessingPause records who paused processing and why
+type ProcessingPause struct {
+	PausedBy string    `db:"paused_by" json:"paused_by"`
+	Reason   string    `db:"reason" json:"reason,omitempty"`
+	PausedAt time.Time `db:"paused_at" json:"paused_at"`
+}
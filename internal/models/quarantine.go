@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// QuarantineEntry is a processing message that failed for good, with the
+// reason it was given up on
+type QuarantineEntry struct {
+	ID        int64      `db:"id" json:"id"`
+	ImageID   *uuid.UUID `db:"image_id" json:"image_id,omitempty"`
+	Payload   string     `db:"payload" json:"payload"`
+	Error     string     `db:"error" json:"error"`
+	Attempts  int        `db:"attempts" json:"attempts"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time  `db:"updated_at" json:"updated_at"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// OwnerUsage is the storage used by the images of one owner
+type OwnerUsage struct {
+	Owner  string `json:"owner"`
+	Images int64  `json:"images"`
+	// Total size of every stored file
+	Bytes int64 `json:"bytes"`
+	// Files and bytes per variant, e.g. original or thumbnail
+	Variants  map[string]VariantUsage `json:"variants"`
+	UpdatedAt *time.Time              `json:"updated_at,omitempty"`
+}
+
+// VariantUsage is the storage used by one variant of an owner's images
+type VariantUsage struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WebhookDelivery is one callback notification and its delivery state
+type WebhookDelivery struct {
+	ID             int64          `db:"id" json:"id"`
+	ImageID        uuid.UUID      `db:"image_id" json:"image_id"`
+	URL            string         `db:"url" json:"url"`
+	Event          string         `db:"event" json:"event"`
+	Payload        map[string]any `db:"payload" json:"payload"`
+	Status         string         `db:"status" json:"status"` // pending, delivered, failed
+	Attempts       int            `db:"attempts" json:"attempts"`
+	NextAttemptAt  time.Time      `db:"next_attempt_at" json:"next_attempt_at"`
+	LastStatusCode *int           `db:"last_status_code" json:"last_status_code,omitempty"`
+	LastError      string         `db:"last_error" json:"last_error,omitempty"`
+	CreatedAt      time.Time      `db:"created_at" json:"created_at"`
+	DeliveredAt    *time.Time     `db:"delivered_at" json:"delivered_at,omitempty"`
+}
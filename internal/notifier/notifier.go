@@ -0,0 +1,96 @@
+// Package notifier posts operational messages to chat services.
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const requestTimeout = 10 * time.Second
+
+// Notifier delivers a plain text message
+type Notifier interface {
+	Notify(ctx context.Context, text string) error
+}
+
+// Slack posts to an incoming webhook URL
+type Slack struct {
+	WebhookURL string
+}
+
+func (s Slack) Notify(ctx context.Context, text string) error {
+	return postJSON(ctx, s.WebhookURL, map[string]string{"text": text}, "")
+}
+
+// Telegram sends messages to a chat through a bot
+type Telegram struct {
+	BotToken string
+	ChatID   string
+}
+
+func (t Telegram) Notify(ctx context.Context, text string) error {
+	url := "https://api.telegram.org/bot" + t.BotToken + "/sendMessage"
+	return postJSON(ctx, url, map[string]string{"chat_id": t.ChatID, "text": text}, "")
+}
+
+// Webhook posts {"text": ...} to any endpoint, e.g. an internal incident
+// tool, with the token as a bearer token when set
+type Webhook struct {
+	URL   string
+	Token string
+}
+
+func (w Webhook) Notify(ctx context.Context, text string) error {
+	return postJSON(ctx, w.URL, map[string]string{"text": text}, w.Token)
+}
+
+// Multi sends every message through all notifiers
+type Multi []Notifier
+
+func (m Multi) Notify(ctx context.Context, text string) error {
+	var errs []error
+	for _, n := range m {
+		if err := n.Notify(ctx, text); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func postJSON(ctx context.Context, url string, v any, token string) error {
+	const op = "notifier.postJSON"
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: unexpected status %s", op, resp.Status)
+	}
+	return nil
+}
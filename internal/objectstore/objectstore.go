@@ -0,0 +1,379 @@
+// Package objectstore keeps files in an S3 compatible bucket. It speaks the
+// handful of S3 calls stored files need, signed with AWS Signature V4, so it
+// works with AWS, MinIO, Ceph and the like.
+//
+// Files in the bucket are referred to by paths of the form
+// s3://<bucket>/<key>, stored in the database like local paths.
+package objectstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"WB_L3_4/internal/models"
+)
+
+// Scheme starts the path of every file in an object store
+const Scheme = "s3://"
+
+// readAhead is the least fetched by one ranged GET, so sequential reads in
+// small pieces don't turn into a request each
+const readAhead = 1 << 20
+
+// emptyHash is the SHA-256 of an empty payload
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Client reads and writes the objects of one bucket
+type Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	http      *http.Client
+}
+
+// New returns a client of the bucket cfg describes
+func New(cfg models.ObjectStoreConfig) (*Client, error) {
+	const op = "objectstore.New"
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("%s: endpoint must be an http(s) URL", op)
+	}
+	return &Client{
+		endpoint:  endpoint,
+		region:    cfg.Region,
+		bucket:    cfg.Bucket,
+		prefix:    cfg.Prefix,
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		http:      &http.Client{Timeout: cfg.Timeout},
+	}, nil
+}
+
+// Path returns the path of the object a file stored at rel, relative to
+// the storage path, is kept in
+func (c *Client) Path(rel string) string {
+	return Scheme + c.bucket + "/" + c.prefix + strings.TrimPrefix(path.Clean("/"+rel), "/")
+}
+
+// key returns the key of the object at p, which must be in this bucket
+func (c *Client) key(p string) (string, error) {
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(p, Scheme), "/")
+	if !strings.HasPrefix(p, Scheme) || !ok || key == "" {
+		return "", fmt.Errorf("%s: not an object path", p)
+	}
+	if bucket != c.bucket {
+		return "", fmt.Errorf("%s: bucket %q isn't configured", p, bucket)
+	}
+	return key, nil
+}
+
+// Rel returns the path, relative to the storage path, of the file kept at
+// the object path p
+func (c *Client) Rel(p string) (string, error) {
+	key, err := c.key(p)
+	if err != nil {
+		return "", err
+	}
+	rel, ok := strings.CutPrefix(key, c.prefix)
+	if !ok {
+		return "", fmt.Errorf("%s: outside the prefix %q", p, c.prefix)
+	}
+	return rel, nil
+}
+
+// Put stores the content of r at the object path p, replacing the object
+// there. r is read twice, once to sign its hash.
+func (c *Client) Put(p string, r io.ReadSeeker) error {
+	key, err := c.key(p)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := c.request(http.MethodPut, key, io.NopCloser(r), hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := c.do(req, p)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Stat returns the size and modification time of the object at p. A
+// missing object is an fs.ErrNotExist.
+func (c *Client) Stat(p string) (fs.FileInfo, error) {
+	key, err := c.key(p)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.request(http.MethodHead, key, nil, emptyHash)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, p)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return fileInfo{name: path.Base(key), size: resp.ContentLength, modTime: modTime}, nil
+}
+
+// Remove deletes the object at p. Removing a missing object succeeds.
+func (c *Client) Remove(p string) error {
+	key, err := c.key(p)
+	if err != nil {
+		return err
+	}
+	req, err := c.request(http.MethodDelete, key, nil, emptyHash)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Open opens the object at p for reading. Reads are ranged GETs, so the
+// object can be read anywhere without being downloaded whole.
+func (c *Client) Open(p string) (*Object, error) {
+	info, err := c.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	key, _ := c.key(p)
+	return &Object{client: c, path: p, key: key, info: info}, nil
+}
+
+// readRange reads the object's bytes from off into p
+func (c *Client) readRange(o *Object, p []byte, off int64) (int, error) {
+	req, err := c.request(http.MethodGet, o.key, nil, emptyHash)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := c.do(req, o.path)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("%s: range request answered with %s", o.path, resp.Status)
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	return n, err
+}
+
+// request returns a request of key signed for the payload with the hash
+// given
+func (c *Client) request(method, key string, body io.Reader, payloadHash string) (*http.Request, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket + "/" + key
+	u.RawPath = strings.TrimSuffix(c.endpoint.EscapedPath(), "/") + "/" + uriEncode(c.bucket) + "/" + uriEncode(key)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, payloadHash, time.Now().UTC())
+	return req, nil
+}
+
+// do sends req and turns error responses into errors, a 404 into an
+// fs.ErrNotExist for the object path p
+func (c *Client) do(req *http.Request, p string) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &fs.PathError{Op: strings.ToLower(req.Method), Path: p, Err: fs.ErrNotExist}
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s %s: %s: %s", req.Method, p, resp.Status, bytes.TrimSpace(msg))
+}
+
+// sign adds an AWS Signature V4 Authorization header to req
+func (c *Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{date, c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode escapes everything but unreserved characters and slashes, as
+// the canonical request of Signature V4 asks for
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z' || '0' <= ch && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || ch == '/' {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+// Object is an object opened for reading. It reads like an *os.File.
+type Object struct {
+	client *Client
+	path   string
+	key    string
+	info   fs.FileInfo
+	pos    int64
+
+	mu sync.Mutex
+	// bytes of the object from bufOff, kept from the last GET
+	buf    []byte
+	bufOff int64
+}
+
+func (o *Object) Name() string { return o.path }
+
+func (o *Object) Stat() (fs.FileInfo, error) { return o.info, nil }
+
+func (o *Object) Close() error { return nil }
+
+// ReadAt reads from the buffer of the last GET when it holds the range,
+// otherwise fetches the range and what follows it up to readAhead bytes
+func (o *Object) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("objectstore.Object.ReadAt: negative offset")
+	}
+	size := o.info.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	want := min(int64(len(p)), size-off)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if off < o.bufOff || off+want > o.bufOff+int64(len(o.buf)) {
+		buf := make([]byte, min(max(want, readAhead), size-off))
+		n, err := o.client.readRange(o, buf, off)
+		if err != nil {
+			return 0, err
+		}
+		o.buf, o.bufOff = buf[:n], off
+	}
+	n := copy(p[:want], o.buf[off-o.bufOff:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (o *Object) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := o.ReadAt(p, o.pos)
+	o.pos += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (o *Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.info.Size()
+	default:
+		return 0, errors.New("objectstore.Object.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("objectstore.Object.Seek: negative position")
+	}
+	o.pos = offset
+	return offset, nil
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() fs.FileMode  { return 0444 }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return false }
+func (fi fileInfo) Sys() any           { return nil }
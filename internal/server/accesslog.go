@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "request_id"
+	// Longest request ID taken from a client, longer ones are replaced
+	maxRequestIDLength = 128
+)
+
+// requestID gives every request an ID, the client's X-Request-ID if it sent
+// one, and echoes it in the response so logs on both sides can be matched
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = uuid.NewString()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// accessLogEntry is one line of the JSON access log
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	LatencyMS  float64   `json:"latency_ms"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// accessLog writes a line per request to w once it is served, in the Apache
+// combined format followed by the latency in seconds and the request ID, or
+// as JSON. Requests to the skipped paths are not logged.
+func accessLog(cfg models.AccessLogConfig, w io.Writer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		if slices.Contains(cfg.SkipPaths, c.Request.URL.Path) {
+			return
+		}
+
+		entry := accessLogEntry{
+			Time:       start,
+			RequestID:  c.GetString(requestIDKey),
+			RemoteAddr: c.ClientIP(),
+			Method:     c.Request.Method,
+			URI:        redactedURI(c.Request.URL),
+			Proto:      c.Request.Proto,
+			Status:     c.Writer.Status(),
+			Bytes:      max(c.Writer.Size(), 0),
+			LatencyMS:  float64(time.Since(start).Microseconds()) / 1000,
+			Referer:    c.Request.Referer(),
+			UserAgent:  c.Request.UserAgent(),
+		}
+		if claims := claimsFrom(c); claims != nil {
+			entry.User = auditActor(claims, "")
+		}
+
+		if cfg.Format == "json" {
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return
+			}
+			w.Write(append(line, '\n'))
+			return
+		}
+		fmt.Fprintf(w, "%s - %s [%s] %q %d %d %q %q %.3f %s\n",
+			entry.RemoteAddr, orDash(entry.User), start.Format("02/Jan/2006:15:04:05 -0700"),
+			entry.Method+" "+entry.URI+" "+entry.Proto, entry.Status, entry.Bytes,
+			orDash(entry.Referer), orDash(entry.UserAgent), entry.LatencyMS/1000, entry.RequestID)
+	}
+}
+
+// redactedURI returns the request URI with the value of every ?token=
+// masked, since tokenFromRequest and /access take tokens in the query
+func redactedURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		if name, _, ok := strings.Cut(param, "="); ok {
+			if key, err := url.QueryUnescape(name); err == nil && key == "token" {
+				params[i] = name + "=REDACTED"
+			}
+		}
+	}
+	r := *u
+	r.RawQuery = strings.Join(params, "&")
+	return r.RequestURI()
+}
+
+// orDash returns s, or "-" for empty fields of the combined format
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRedactedURI(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"/image/1", "/image/1"},
+		{"/image/1?download=1", "/image/1?download=1"},
+		{"/image/1?token=secret", "/image/1?token=REDACTED"},
+		{"/access?id=1&token=secret&size=thumb", "/access?id=1&token=REDACTED&size=thumb"},
+		{"/image/1?token=a&token=b", "/image/1?token=REDACTED&token=REDACTED"},
+		// Escaped the way clients may send it, read as token all the same
+		{"/image/1?tok%65n=secret", "/image/1?tok%65n=REDACTED"},
+		{"/image/1?token=", "/image/1?token=REDACTED"},
+		{"/image/1?access_token=x&tokens=y", "/image/1?access_token=x&tokens=y"},
+		{"/image/1?token", "/image/1?token"},
+		{"/image/1/attachment/a%20b.jpg?token=secret", "/image/1/attachment/a%20b.jpg?token=REDACTED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			u, err := url.ParseRequestURI(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := redactedURI(u); got != tt.want {
+				t.Errorf("redactedURI(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"WB_L3_4/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultReprocessBatchSize = 100
+	maxReprocessBatchSize     = 1000
+	defaultReprocessRate      = 50 // messages per second
+	maxReprocessRate          = 1000
+)
+
+type reprocessRequest struct {
+	storage.ImageFilter
+	// All must be set to reprocess without any filter
+	All       bool `json:"all"`
+	BatchSize int  `json:"batch_size"`
+	Rate      int  `json:"rate"` // messages per second
+}
+
+// handleReprocess re-enqueues processing for every image matching the filter,
+// e.g. {"watermark_status": "error"} or {"all": true} after the watermark changes
+func (s *Server) handleReprocess(c *gin.Context) {
+	const op = "server.handleReprocess"
+
+	var req reprocessRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.ImageFilter == (storage.ImageFilter{}) && !req.All {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Specify a filter or set all to true"})
+		return
+	}
+	if req.BatchSize <= 0 {
+		req.BatchSize = defaultReprocessBatchSize
+	}
+	if req.BatchSize > maxReprocessBatchSize {
+		req.BatchSize = maxReprocessBatchSize
+	}
+	if req.Rate <= 0 {
+		req.Rate = defaultReprocessRate
+	}
+	if req.Rate > maxReprocessRate {
+		req.Rate = maxReprocessRate
+	}
+
+	count, err := s.db.CountImages(req.ImageFilter)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count images"})
+		return
+	}
+
+	go s.reprocess(req.ImageFilter, req.BatchSize, req.Rate)
+	s.audit(c, "reprocess", uuid.Nil, map[string]any{
+		"filter":  req.ImageFilter,
+		"all":     req.All,
+		"matched": count,
+	})
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "Reprocessing started",
+		"matched": count,
+	})
+}
+
+// reprocess walks the matching images in ID order batch by batch, resets
+// their statuses and publishes them at no more than rate messages per second
+func (s *Server) reprocess(filter storage.ImageFilter, batchSize, rate int) {
+	const op = "server.reprocess"
+
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+
+	ctx := context.Background()
+	after := uuid.Nil
+	enqueued := 0
+	for {
+		ids, err := s.db.ListImageIDs(filter, after, batchSize)
+		if err != nil {
+			log.Printf("%s: %v", op, err)
+			return
+		}
+		if len(ids) == 0 {
+			break
+		}
+		after = ids[len(ids)-1]
+
+		if err := s.db.ResetForReprocessing(ids); err != nil {
+			log.Printf("%s: %v", op, err)
+			return
+		}
+		// Asked for explicitly, so quarantined images get another chance
+		if err := s.db.ResetAttempts(ids); err != nil {
+			log.Printf("%s: %v", op, err)
+			return
+		}
+
+		for _, id := range ids {
+			<-ticker.C
+			if err := s.enqueueOrStore(ctx, id, "reprocess"); err != nil {
+				log.Printf("%s: failed to enqueue image %s: %v", op, id.String(), err)
+				recordEvent(s.db, id, "error", "", "failed to enqueue for reprocessing: "+err.Error())
+				continue
+			}
+			recordEvent(s.db, id, "queued", "", "reprocess")
+			enqueued++
+		}
+		log.Printf("%s: enqueued %d images so far", op, enqueued)
+	}
+
+	log.Printf("%s: reprocessing finished, %d images enqueued", op, enqueued)
+}
+
+const defaultStatsWindow = 24 * time.Hour
+
+// handleStats reports image counts by status and per-operation duration
+// percentiles over the window given by ?window= (default 24h)
+func (s *Server) handleStats(c *gin.Context) {
+	const op = "server.handleStats"
+
+	window := defaultStatsWindow
+	if v := c.Query("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid window"})
+			return
+		}
+		window = d
+	}
+
+	counts, err := s.db.CountImagesByStatus()
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load stats"})
+		return
+	}
+
+	durations, err := s.db.OperationDurationStats(time.Now().Add(-window))
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load stats"})
+		return
+	}
+
+	daily, err := s.db.ListStats("day", time.Now().Add(-window))
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load stats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"images":     counts,
+		"window":     window.String(),
+		"operations": durations,
+		"daily":      daily,
+	})
+}
+
+const (
+	defaultTimeseriesRange = 7 * 24 * time.Hour
+	maxTimeseriesRange     = 366 * 24 * time.Hour
+	// Longer ranges are reported per day, shorter ones per hour
+	hourlyTimeseriesLimit = 48 * time.Hour
+)
+
+// parseRange parses a range like 7d, 12h or 90m
+func parseRange(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		// More days would wrap around to a short range
+		if maxDays := int(math.MaxInt64 / (24 * time.Hour)); n > maxDays || n < -maxDays {
+			return 0, fmt.Errorf("range %s is out of bounds", v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// handleStatsTimeseries reports uploads, failures and processing times per
+// bucket over ?range= (default 7d). ?granularity= is hour or day, by default
+// hour for ranges up to 48h.
+func (s *Server) handleStatsTimeseries(c *gin.Context) {
+	const op = "server.handleStatsTimeseries"
+
+	rng := defaultTimeseriesRange
+	if v := c.Query("range"); v != "" {
+		d, err := parseRange(v)
+		if err != nil || d <= 0 || d > maxTimeseriesRange {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid range"})
+			return
+		}
+		rng = d
+	}
+
+	granularity := c.Query("granularity")
+	switch granularity {
+	case "":
+		granularity = "day"
+		if rng <= hourlyTimeseriesLimit {
+			granularity = "hour"
+		}
+	case "hour", "day":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid granularity, expected hour or day"})
+		return
+	}
+
+	points, err := s.db.ListStats(granularity, time.Now().Add(-rng))
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load stats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"range":       rng.String(),
+		"granularity": granularity,
+		"points":      points,
+	})
+}
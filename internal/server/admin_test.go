@@ -0,0 +1,48 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"7d", 7 * 24 * time.Hour, false},
+		{"1d", 24 * time.Hour, false},
+		{"366d", 366 * 24 * time.Hour, false},
+		{"12h", 12 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"0d", 0, false},
+		{"-1d", -24 * time.Hour, false},
+		{"", 0, true},
+		{"d", 0, true},
+		{"1.5d", 0, true},
+		{"7", 0, true},
+		{"week", 0, true},
+		// Would wrap around to about 25 minutes
+		{"213504d", 0, true},
+		{"-213504d", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseRange(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseRange(%q) = %s, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRange(%q): %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseRange(%q) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"WB_L3_4/internal/notifier"
+)
+
+// opsAlert is a condition watched by the ops notifier. It notifies when the
+// condition starts firing, again every repeat interval while it keeps
+// firing, and once when it resolves.
+type opsAlert struct {
+	name     string
+	check    func() (firing bool, message string, err error)
+	firing   bool
+	notified time.Time
+}
+
+// newOpsNotifier returns the configured chat and webhook notifiers, or nil if
+// none is set
+func (s *Server) newOpsNotifier() notifier.Notifier {
+	n := s.cfg.Notifications
+	var notifiers notifier.Multi
+	if n.SlackWebhookURL != "" {
+		notifiers = append(notifiers, notifier.Slack{WebhookURL: n.SlackWebhookURL})
+	}
+	if n.TelegramBotToken != "" && n.TelegramChatID != "" {
+		notifiers = append(notifiers, notifier.Telegram{BotToken: n.TelegramBotToken, ChatID: n.TelegramChatID})
+	}
+	if n.WebhookURL != "" {
+		notifiers = append(notifiers, notifier.Webhook{URL: n.WebhookURL, Token: n.WebhookToken})
+	}
+	if len(notifiers) == 0 {
+		return nil
+	}
+	return notifiers
+}
+
+// RunOpsAlerts watches the error rate, the dead-lettered webhook deliveries,
+// free disk space and the processing backlog and posts to Slack/Telegram or
+// a webhook until ctx is canceled. It does nothing when no notifier is
+// configured.
+func (s *Server) RunOpsAlerts(ctx context.Context) {
+	const op = "server.RunOpsAlerts"
+
+	n := s.newOpsNotifier()
+	if n == nil {
+		return
+	}
+	cfg := s.cfg.Notifications
+
+	alerts := []*opsAlert{
+		{name: "error_rate", check: s.checkErrorRate},
+		{name: "dead_letters", check: s.checkDeadLetters},
+		{name: "disk_space", check: s.checkDiskSpace},
+		{name: "queue_backlog", check: s.checkQueueBacklog},
+	}
+
+	ticker := time.NewTicker(cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, alert := range alerts {
+			firing, message, err := alert.check()
+			if err != nil {
+				log.Printf("%s: %s: %v", op, alert.name, err)
+				continue
+			}
+
+			var text string
+			switch {
+			case firing && (!alert.firing || time.Since(alert.notified) >= cfg.RepeatInterval):
+				text = "[ALERT] " + message
+			case !firing && alert.firing:
+				text = "[RESOLVED] " + message
+			}
+			alert.firing = firing
+			if text == "" {
+				continue
+			}
+			if err := n.Notify(ctx, text); err != nil {
+				log.Printf("%s: failed to send %s notification: %v", op, alert.name, err)
+				continue
+			}
+			alert.notified = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) checkErrorRate() (bool, string, error) {
+	cfg := s.cfg.Notifications
+	finished, failed, err := s.db.ProcessingOutcomes(time.Now().Add(-cfg.ErrorRateWindow))
+	if err != nil {
+		return false, "", err
+	}
+	total := finished + failed
+	rate := 0.0
+	if total > 0 {
+		rate = float64(failed) / float64(total)
+	}
+	firing := total >= int64(cfg.ErrorRateMinSamples) && rate > cfg.ErrorRateThreshold
+	return firing, fmt.Sprintf("processing error rate %.0f%% (%d of %d images) over the last %s",
+		rate*100, failed, total, cfg.ErrorRateWindow), nil
+}
+
+func (s *Server) checkDeadLetters() (bool, string, error) {
+	failed, err := s.db.CountWebhookDeliveries("failed")
+	if err != nil {
+		return false, "", err
+	}
+	threshold := s.cfg.Notifications.DeadLetterThreshold
+	return failed >= int64(threshold), fmt.Sprintf("%d dead-lettered webhook deliveries (threshold %d)", failed, threshold), nil
+}
+
+func (s *Server) checkDiskSpace() (bool, string, error) {
+	free, err := s.storageFreeBytes()
+	if err != nil {
+		return false, "", err
+	}
+	threshold := int64(s.cfg.Notifications.DiskFreeMB) << 20
+	return free < threshold, fmt.Sprintf("%d MB free on storage (alert below %d MB)", free>>20, s.cfg.Notifications.DiskFreeMB), nil
+}
+
+func (s *Server) checkQueueBacklog() (bool, string, error) {
+	// The queue is expected to grow while an admin paused processing
+	if s.gate.Paused() != nil {
+		return false, "", nil
+	}
+	counts, err := s.db.CountImagesByStatus()
+	if err != nil {
+		return false, "", err
+	}
+	outbox, err := s.db.CountOutboxEntries()
+	if err != nil {
+		return false, "", err
+	}
+	// Deferred images are usually in the outbox as well
+	waiting := counts["pending"] + max(counts["deferred"], int64(outbox))
+	threshold := s.cfg.Notifications.QueueBacklogThreshold
+	return waiting >= int64(threshold), fmt.Sprintf("%d images waiting for processing (threshold %d)", waiting, threshold), nil
+}
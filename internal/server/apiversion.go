@@ -0,0 +1,47 @@
+package server
+
+import (
+	"strings"
+
+	"WB_L3_4/internal/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiPrefix is where the current version of the API is served. Links the
+// service hands out, e.g. in notifications, point here.
+const apiPrefix = "/api/v1"
+
+// apiVersionKey is where the version of the matched API route is stored
+const apiVersionKey = "api.version"
+
+// withAPIVersion records the API version a route was registered for
+func withAPIVersion(version int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(apiVersionKey, version)
+		c.Next()
+	}
+}
+
+// apiVersion returns the API version the request was made against, so a
+// handler shared between versions can keep the older response shape
+func apiVersion(c *gin.Context) int {
+	return c.GetInt(apiVersionKey)
+}
+
+// deprecatedAlias marks responses of the unversioned paths kept from before
+// /api/v1 as deprecated (RFC 9745) and links the successor path
+func deprecatedAlias(successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		metrics.DeprecatedRequestsTotal.WithLabelValues(c.FullPath()).Inc()
+		h := c.Writer.Header()
+		h.Set("Deprecation", "true")
+		h.Add("Link", "<"+successor+c.Request.URL.Path+`>; rel="successor-version"`)
+		c.Next()
+	}
+}
+
+// imageURL returns the absolute API URL of an image
+func imageURL(publicURL, id string) string {
+	return strings.TrimRight(publicURL, "/") + apiPrefix + "/image/" + id
+}
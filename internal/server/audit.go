@@ -0,0 +1,135 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"WB_L3_4/internal/auth"
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Without token auth the actor is whatever the caller (usually the gateway)
+// puts in this header
+const actorHeader = "X-Actor"
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// audit records a mutating operation. Failures are logged and never fail
+// the request itself.
+func (s *Server) audit(c *gin.Context, action string, imageID uuid.UUID, details map[string]any) {
+	const op = "server.audit"
+
+	entry := models.AuditEntry{
+		Actor:      auditActor(claimsFrom(c), c.GetHeader(actorHeader)),
+		RemoteAddr: c.ClientIP(),
+		Action:     action,
+		Details:    details,
+	}
+	if imageID != uuid.Nil {
+		entry.ImageID = &imageID
+	}
+	if err := s.db.AddAuditEntry(&entry); err != nil {
+		log.Printf("%s: failed to record %s: %v", op, action, err)
+	}
+}
+
+// auditActor names who acted: the token's subject or ID, else the actor
+// the caller claims to be
+func auditActor(claims *auth.Claims, claimed string) string {
+	if claims != nil {
+		if claims.Subject != "" {
+			return claims.Subject
+		}
+		return "token:" + claims.ID
+	}
+	if claimed == "" {
+		return "anonymous"
+	}
+	return claimed
+}
+
+// auditSystem records an operation the service performed on its own, e.g.
+// a maintenance job deleting expired images
+func (s *Server) auditSystem(action string, imageID uuid.UUID, details map[string]any) {
+	entry := models.AuditEntry{
+		Actor:   "system",
+		Action:  action,
+		Details: details,
+	}
+	if imageID != uuid.Nil {
+		entry.ImageID = &imageID
+	}
+	if err := s.db.AddAuditEntry(&entry); err != nil {
+		log.Printf("server.auditSystem: failed to record %s: %v", action, err)
+	}
+}
+
+func (s *Server) handleListAudit(c *gin.Context) {
+	const op = "server.handleListAudit"
+
+	filter := storage.AuditFilter{
+		Action: c.Query("action"),
+		Actor:  c.Query("actor"),
+		Limit:  defaultAuditLimit,
+	}
+	if v := c.Query("image_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+			return
+		}
+		filter.ImageID = id
+	}
+	if v := c.Query("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be an RFC 3339 timestamp"})
+			return
+		}
+		filter.Since = since
+	}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		filter.Limit = limit
+	}
+	if v := c.Query("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+			return
+		}
+		filter.Offset = offset
+	}
+	filter.After = c.Query("cursor")
+	if filter.After != "" && filter.Offset > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Use either cursor or offset"})
+		return
+	}
+
+	entries, next, err := s.db.ListAuditEntries(filter)
+	if errors.Is(err, storage.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		return
+	}
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load audit log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "next_cursor": next})
+}
@@ -0,0 +1,336 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"WB_L3_4/internal/auth"
+	"WB_L3_4/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// claimsKey is where requireScope stores the verified token claims
+const claimsKey = "auth.claims"
+
+// accessCookie holds an image-limited read token set by GET /access
+const accessCookie = "image_access"
+
+// tokenFromRequest returns the bearer token of the request. Browsers can't
+// set headers on <img> tags, so ?token= is accepted as well.
+func tokenFromRequest(c *gin.Context) string {
+	if h := c.GetHeader("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return c.Query("token")
+}
+
+// claimsFrom returns the claims of the request's token, nil when auth is
+// disabled
+func claimsFrom(c *gin.Context) *auth.Claims {
+	if v, ok := c.Get(claimsKey); ok {
+		return v.(*auth.Claims)
+	}
+	return nil
+}
+
+// requestTenant returns the tenant a request acts for. A tenant-bound token
+// wins over the X-Tenant header.
+func requestTenant(c *gin.Context) string {
+	if claims := claimsFrom(c); claims != nil && claims.Tenant != "" {
+		return claims.Tenant
+	}
+	return c.GetHeader(tenantHeader)
+}
+
+// requestOwner returns the owner recorded on images the request uploads,
+// the identity of the signed in user
+func requestOwner(c *gin.Context) string {
+	if claims := claimsFrom(c); claims != nil {
+		return claims.Owner
+	}
+	return ""
+}
+
+// imageVisible reports whether img is within the tenant and owner the
+// claims are bound to
+func imageVisible(claims *auth.Claims, img *models.Image) bool {
+	if claims == nil {
+		return true
+	}
+	return (claims.Tenant == "" || img.Tenant == claims.Tenant) &&
+		(claims.Owner == "" || img.Owner == claims.Owner)
+}
+
+// isHTTPS reports whether url is served over TLS
+func isHTTPS(url string) bool {
+	return strings.HasPrefix(url, "https://")
+}
+
+// localRedirect reports whether redirect is a path on this host, so
+// redirecting to it can't be abused as an open redirect
+func localRedirect(redirect string) bool {
+	return strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//") && !strings.HasPrefix(redirect, "/\\")
+}
+
+// requireScope rejects requests without a valid token granting scope. On
+// routes with an :id the image must also belong to the token's tenant and
+// owner, if the token is bound to them. Everything is let through while no token
+// secret is configured.
+func (s *Server) requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.cfg.Auth.TokenSecret == "" {
+			c.Next()
+			return
+		}
+
+		token := tokenFromRequest(c)
+		fromCookie := false
+		if token == "" {
+			if v, err := c.Cookie(accessCookie); err == nil && v != "" {
+				token, fromCookie = v, true
+			}
+		}
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing access token"})
+			return
+		}
+		claims, err := s.verifyBearer(c, token)
+		if err != nil {
+			msg := "Invalid access token"
+			if errors.Is(err, auth.ErrTokenExpired) {
+				msg = "Access token expired"
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": msg})
+			return
+		}
+		if !claims.Allows(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Token does not allow " + scope})
+			return
+		}
+		// Browsers send cookies with cross-site requests too, so they are
+		// only trusted for reading the images they were issued for
+		if fromCookie && (scope != auth.ScopeRead || len(claims.Images) == 0) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access cookie only allows reading its images"})
+			return
+		}
+		if len(claims.Images) > 0 {
+			if c.Param("id") == "" {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Token only allows specific images"})
+				return
+			}
+			if !claims.AllowsImage(c.Param("id")) {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+				return
+			}
+		}
+
+		if (claims.Tenant != "" || claims.Owner != "") && c.Param("id") != "" {
+			// Someone else's image is reported as missing, not forbidden,
+			// so tokens can't be used to probe for IDs
+			id, err := uuid.Parse(c.Param("id"))
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+				return
+			}
+			img, err := s.db.GetImage(id)
+			if err != nil || !imageVisible(claims, img) {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+				return
+			}
+		}
+
+		c.Set(claimsKey, claims)
+		c.Next()
+	}
+}
+
+// cors answers preflight requests and sets the CORS headers for the
+// configured origins, letting third-party sites embed the upload widget
+func (s *Server) cors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		allowed := s.cfg.Auth.AllowedOrigins
+		if origin == "" || !(slices.Contains(allowed, "*") || slices.Contains(allowed, origin)) {
+			c.Next()
+			return
+		}
+
+		h := c.Writer.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, DELETE, OPTIONS")
+		h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Tenant, X-Request-ID, If-None-Match")
+		h.Set("Access-Control-Expose-Headers", "X-Request-ID, Deprecation, Link, ETag")
+		if c.Request.Method == http.MethodOptions {
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
+
+type issueTokenRequest struct {
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes"`
+	Tenant  string   `json:"tenant"`
+	// Limits the token to the images uploaded by this owner
+	Owner string `json:"owner"`
+	// Image IDs the token is limited to; such tokens can only read and can
+	// be turned into an access cookie with GET /access
+	Images []string `json:"images"`
+	// Go duration, e.g. "15m"; defaults to auth.default_token_ttl
+	TTL string `json:"ttl"`
+}
+
+// handleIssueToken issues a token limited to the requested scopes, e.g. an
+// upload-only token for an embedded widget
+func (s *Server) handleIssueToken(c *gin.Context) {
+	const op = "server.handleIssueToken"
+
+	if s.cfg.Auth.TokenSecret == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Token auth is not configured"})
+		return
+	}
+
+	var req issueTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	ttl := s.cfg.Auth.DefaultTokenTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ttl"})
+			return
+		}
+		ttl = d
+	}
+	if ttl > s.cfg.Auth.MaxTokenTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl exceeds the maximum of " + s.cfg.Auth.MaxTokenTTL.String()})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !auth.ValidScope(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope: " + scope})
+			return
+		}
+	}
+	for _, id := range req.Images {
+		if _, err := uuid.Parse(id); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID: " + id})
+			return
+		}
+	}
+	if len(req.Images) > 0 && !slices.Equal(req.Scopes, []string{auth.ScopeRead}) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Tokens limited to images can only have the read scope"})
+		return
+	}
+	// A tenant-bound caller can only hand out tokens for its own tenant
+	if issuer := claimsFrom(c); issuer != nil && issuer.Tenant != "" {
+		if req.Tenant != "" && req.Tenant != issuer.Tenant {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Cannot issue tokens for another tenant"})
+			return
+		}
+		req.Tenant = issuer.Tenant
+	}
+	// Likewise a signed in user only for their own images
+	if issuer := claimsFrom(c); issuer != nil && issuer.Owner != "" {
+		if req.Owner != "" && req.Owner != issuer.Owner {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Cannot issue tokens for another owner"})
+			return
+		}
+		req.Owner = issuer.Owner
+	}
+
+	token, claims, err := auth.Issue([]byte(s.cfg.Auth.TokenSecret), auth.Claims{
+		Subject: req.Subject,
+		Scopes:  req.Scopes,
+		Tenant:  req.Tenant,
+		Owner:   req.Owner,
+		Images:  req.Images,
+	}, ttl)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue token"})
+		return
+	}
+	s.audit(c, "issue_token", uuid.Nil, map[string]any{
+		"token_id": claims.ID,
+		"subject":  claims.Subject,
+		"scopes":   claims.Scopes,
+		"tenant":   claims.Tenant,
+		"owner":    claims.Owner,
+		"images":   claims.Images,
+	})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token":      token,
+		"id":         claims.ID,
+		"scopes":     claims.Scopes,
+		"tenant":     claims.Tenant,
+		"owner":      claims.Owner,
+		"images":     claims.Images,
+		"expires_at": time.Unix(claims.ExpiresAt, 0).UTC(),
+	})
+}
+
+// handleAccessCookie stores an image-limited read token from ?token= in a
+// cookie expiring with it, so a private gallery can be embedded with plain
+// image URLs. With ?redirect=<path> it then redirects there, e.g. to the
+// gallery page.
+func (s *Server) handleAccessCookie(c *gin.Context) {
+	if s.cfg.Auth.TokenSecret == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Token auth is not configured"})
+		return
+	}
+
+	claims, err := auth.Verify([]byte(s.cfg.Auth.TokenSecret), c.Query("token"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired access token"})
+		return
+	}
+	if len(claims.Images) == 0 || !slices.Equal(claims.Scopes, []string{auth.ScopeRead}) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only read tokens limited to images can be used as an access cookie"})
+		return
+	}
+	redirect := c.Query("redirect")
+	if redirect != "" && !localRedirect(redirect) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid redirect"})
+		return
+	}
+
+	// Embedding pages are usually on another site, which needs SameSite=None
+	// and so a secure cookie
+	secure := c.Request.TLS != nil || isHTTPS(s.cfg.PublicURL)
+	sameSite := http.SameSiteLaxMode
+	if secure {
+		sameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     accessCookie,
+		Value:    c.Query("token"),
+		Path:     "/",
+		Expires:  time.Unix(claims.ExpiresAt, 0),
+		MaxAge:   int(time.Until(time.Unix(claims.ExpiresAt, 0)).Seconds()),
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: sameSite,
+	})
+
+	if redirect != "" {
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
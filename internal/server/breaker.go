@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerHalfOpen = "half_open"
+	breakerOpen     = "open"
+)
+
+// breaker fails calls fast after threshold consecutive failures. Once the
+// cooldown has passed a single call is let through as a probe: its success
+// closes the breaker, its failure opens it for another cooldown.
+type breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	// Called in its own goroutine when the breaker closes after being open
+	onClose func()
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+func newBreaker(name string, threshold int, cooldown time.Duration, onClose func()) *breaker {
+	b := &breaker{name: name, threshold: threshold, cooldown: cooldown, onClose: onClose, state: breakerClosed}
+	b.setStateLocked(breakerClosed)
+	return b
+}
+
+// Do calls fn unless the breaker is open. Cancellation by the caller is not
+// counted as a failure.
+func (b *breaker) Do(fn func() error) error {
+	b.mu.Lock()
+	switch b.state {
+	case breakerHalfOpen:
+		// A probe is already in flight
+		b.mu.Unlock()
+		metrics.BreakerCallsTotal.WithLabelValues(b.name, "rejected").Inc()
+		return errCircuitOpen
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			b.mu.Unlock()
+			metrics.BreakerCallsTotal.WithLabelValues(b.name, "rejected").Inc()
+			return errCircuitOpen
+		}
+		b.setStateLocked(breakerHalfOpen)
+	}
+	b.mu.Unlock()
+
+	err := fn()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case errors.Is(err, context.Canceled):
+		if b.state == breakerHalfOpen {
+			// Inconclusive probe, let the next call try again
+			b.setStateLocked(breakerOpen)
+		}
+		metrics.BreakerCallsTotal.WithLabelValues(b.name, "canceled").Inc()
+	case err != nil:
+		b.failures++
+		if b.state == breakerHalfOpen || b.failures >= b.threshold {
+			if b.state == breakerClosed {
+				log.Printf("server.breaker: %s opened after %d failures: %v", b.name, b.failures, err)
+			}
+			b.openedAt = time.Now()
+			b.setStateLocked(breakerOpen)
+		}
+		metrics.BreakerCallsTotal.WithLabelValues(b.name, "error").Inc()
+	default:
+		b.failures = 0
+		if b.state != breakerClosed {
+			log.Printf("server.breaker: %s closed", b.name)
+			b.setStateLocked(breakerClosed)
+			if b.onClose != nil {
+				go b.onClose()
+			}
+		}
+		metrics.BreakerCallsTotal.WithLabelValues(b.name, "ok").Inc()
+	}
+	return err
+}
+
+// State returns the current breaker state
+func (b *breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *breaker) setStateLocked(state string) {
+	b.state = state
+	for _, st := range []string{breakerClosed, breakerHalfOpen, breakerOpen} {
+		v := 0.0
+		if st == state {
+			v = 1
+		}
+		metrics.BreakerState.WithLabelValues(b.name, st).Set(v)
+	}
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// importProgressEvery is how many files pass between progress lines
+const importProgressEvery = 100
+
+// ImportOptions are the settings of a bulk import
+type ImportOptions struct {
+	// Hard link the files into storage instead of copying them, falling back
+	// to a copy across filesystems
+	Link   bool
+	Preset string
+	Tenant string
+	// File listing the already imported paths, so an interrupted import can
+	// be resumed; defaults to one per directory under the storage path
+	Checkpoint string
+}
+
+// ImportResult summarizes a bulk import
+type ImportResult struct {
+	Files    int `json:"files"`
+	Imported int `json:"imported"`
+	// Already imported according to the checkpoint
+	Skipped int `json:"skipped"`
+	// Not a JPEG, PNG or GIF, or not decodable
+	Rejected int `json:"rejected"`
+}
+
+// DefaultImportCheckpoint returns the checkpoint file of importing dir
+func DefaultImportCheckpoint(cfg *models.Config, dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		abs = dir
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(cfg.StoragePath, "import-"+hex.EncodeToString(sum[:8])+".checkpoint")
+}
+
+// BulkImport registers every image under dir like an upload and enqueues it
+// for processing, printing progress as it goes. Every file handled is added
+// to the checkpoint, so running it again after an interruption continues
+// where it stopped.
+func BulkImport(ctx context.Context, cfg *models.Config, db *storage.Storage, dir string, opts ImportOptions, enqueue func(uuid.UUID) error) (*ImportResult, error) {
+	const op = "server.BulkImport"
+
+	result := &ImportResult{}
+	if _, ok := cfg.Presets[opts.Preset]; opts.Preset != "" && !ok {
+		return result, fmt.Errorf("%s: unknown preset %q", op, opts.Preset)
+	}
+	if opts.Checkpoint == "" {
+		opts.Checkpoint = DefaultImportCheckpoint(cfg, dir)
+	}
+
+	done, err := readImportCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return result, fmt.Errorf("%s: failed to read checkpoint: %v", op, err)
+	}
+	checkpoint, err := os.OpenFile(opts.Checkpoint, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return result, fmt.Errorf("%s: failed to open checkpoint: %v", op, err)
+	}
+	defer checkpoint.Close()
+
+	// Counted first so progress can be shown as a share of the total
+	var paths []string
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if d.Type().IsRegular() && !importSkipped(d.Name()) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("%s: failed to list %s: %v", op, dir, err)
+	}
+	result.Files = len(paths)
+	log.Printf("%s: %d files in %s, %d already imported", op, len(paths), dir, len(done))
+
+	fields := &uploadFields{Preset: opts.Preset}
+	for i, path := range paths {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		if i > 0 && i%importProgressEvery == 0 {
+			log.Printf("%s: %d/%d files (%d%%), %d imported, %d rejected",
+				op, i, len(paths), i*100/len(paths), result.Imported, result.Rejected)
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			rel = path
+		}
+		if done[rel] {
+			result.Skipped++
+			continue
+		}
+
+		err = importFile(cfg, db, path, opts.Link, fields, opts.Tenant, enqueue)
+		if err != nil && !importRejected(err) {
+			return result, fmt.Errorf("%s: failed to import %s: %v", op, path, err)
+		}
+		if err != nil {
+			log.Printf("%s: skipping %s: %v", op, path, err)
+			result.Rejected++
+		} else {
+			result.Imported++
+		}
+
+		// Only written once the image is stored, so a crash in between
+		// imports it again rather than losing it
+		if _, err := fmt.Fprintln(checkpoint, rel); err != nil {
+			return result, fmt.Errorf("%s: failed to update checkpoint: %v", op, err)
+		}
+	}
+	return result, nil
+}
+
+// readImportCheckpoint returns the paths a checkpoint lists
+func readImportCheckpoint(path string) (map[string]bool, error) {
+	done := map[string]bool{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			done[line] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+// importFile stores one local file as a new original, records it and
+// enqueues it. Files that aren't valid images fail with errUnsupportedImage
+// or errCorruptImage.
+func importFile(cfg *models.Config, db *storage.Storage, path string, link bool, fields *uploadFields, tenant string, enqueue func(uuid.UUID) error) error {
+	const op = "server.importFile"
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	contentType := http.DetectContentType(head[:n])
+	typeExt, ok := uploadExtensions[contentType]
+	if n == 0 || !ok {
+		f.Close()
+		return errUnsupportedImage
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	_, _, err = image.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		return errCorruptImage
+	}
+
+	id := uuid.New()
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == "" {
+		ext = typeExt
+	}
+	originalPath := filepath.Join(ShardDir(cfg.StoragePath, "original", id), id.String()+ext)
+	if err := os.MkdirAll(filepath.Dir(originalPath), 0755); err != nil {
+		return fmt.Errorf("%s: failed to create directory: %v", op, err)
+	}
+	if err := placeImportFile(path, originalPath, link); err != nil {
+		return fmt.Errorf("%s: failed to store file: %v", op, err)
+	}
+
+	img := fields.image(id, originalPath, filepath.Base(path), contentType, tenant)
+	if size, err := contentSize(originalPath); err == nil {
+		img.Size = size
+	}
+	if err := db.SaveImage(img); err != nil {
+		os.Remove(originalPath) // Clean up file
+		return fmt.Errorf("%s: failed to save to database: %v", op, err)
+	}
+	recordChecksum(db, id, "original", originalPath)
+
+	if err := enqueue(id); err != nil {
+		return fmt.Errorf("%s: failed to enqueue: %v", op, err)
+	}
+	recordEvent(db, id, "queued", "", "")
+
+	err = db.AddAuditEntry(&models.AuditEntry{
+		Actor:   "system",
+		Action:  "upload",
+		ImageID: &id,
+		Details: map[string]any{"filename": img.OriginalFilename, "preset": fields.Preset, "source": "bulk_import"},
+	})
+	if err != nil {
+		log.Printf("%s: failed to record upload: %v", op, err)
+	}
+	return nil
+}
+
+// placeImportFile hard links or copies src to dst. Files are always copied
+// while encryption is on, a link would store them in the clear.
+func placeImportFile(src, dst string, link bool) error {
+	if link && !sealing() {
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+		// Storage is on another filesystem, or links aren't supported
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeStored(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	maxCaptionLength = 500
+	minCaptionSize   = 8
+	maxCaptionSize   = 512
+
+	defaultCaptionSize = 48
+)
+
+// captionFonts are the fonts a caption can be drawn with, keyed by the name
+// accepted in the request
+var captionFonts = map[string][]byte{
+	"regular": goregular.TTF,
+	"bold":    gobold.TTF,
+	"mono":    gomono.TTF,
+}
+
+var (
+	parsedFontsMu sync.Mutex
+	parsedFonts   = map[string]*opentype.Font{}
+)
+
+// captionRequest is the body of POST /image/:id/caption
+type captionRequest struct {
+	Text string `json:"text"`
+	// regular, bold or mono; defaults to bold
+	Font string `json:"font"`
+	// Font size in pixels; defaults to 48
+	Size int `json:"size"`
+	// #RRGGBB or #RRGGBBAA; defaults to white
+	Color string `json:"color"`
+	// Outline color, same format; defaults to black, "none" disables it
+	Stroke string `json:"stroke"`
+	// top, center, bottom, top-left, top-right, bottom-left or bottom-right;
+	// defaults to bottom
+	Position string `json:"position"`
+	// jpg or png; defaults to jpg
+	Format string `json:"format"`
+}
+
+// normalize fills in defaults and validates the request
+func (r *captionRequest) normalize() error {
+	if strings.TrimSpace(r.Text) == "" {
+		return errors.New("text is required")
+	}
+	if len([]rune(r.Text)) > maxCaptionLength {
+		return fmt.Errorf("text is longer than %d characters", maxCaptionLength)
+	}
+	if r.Font == "" {
+		r.Font = "bold"
+	}
+	if _, ok := captionFonts[r.Font]; !ok {
+		return fmt.Errorf("unknown font %q", r.Font)
+	}
+	if r.Size == 0 {
+		r.Size = defaultCaptionSize
+	}
+	if r.Size < minCaptionSize || r.Size > maxCaptionSize {
+		return fmt.Errorf("size must be between %d and %d", minCaptionSize, maxCaptionSize)
+	}
+	if r.Color == "" {
+		r.Color = "#ffffff"
+	}
+	if _, err := models.ParseColor(r.Color); err != nil {
+		return err
+	}
+	if r.Stroke == "" {
+		r.Stroke = "#000000"
+	}
+	if r.Stroke != "none" {
+		if _, err := models.ParseColor(r.Stroke); err != nil {
+			return err
+		}
+	}
+	if r.Position == "" {
+		r.Position = "bottom"
+	}
+	switch r.Position {
+	case "top", "center", "bottom", "top-left", "top-right", "bottom-left", "bottom-right":
+	default:
+		return fmt.Errorf("unknown position %q", r.Position)
+	}
+	if r.Format == "" {
+		r.Format = "jpg"
+	}
+	if r.Format != "jpg" && r.Format != "png" {
+		return fmt.Errorf("unsupported format %q", r.Format)
+	}
+	return nil
+}
+
+// key identifies the rendered caption so identical requests reuse the file
+func (r *captionRequest) key() string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		r.Text, r.Font, strconv.Itoa(r.Size), r.Color, r.Stroke, r.Position, r.Format,
+	}, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// captionFace returns a face of the named caption font at size pixels
+func captionFace(name string, size int) (font.Face, error) {
+	parsedFontsMu.Lock()
+	f, ok := parsedFonts[name]
+	if !ok {
+		var err error
+		if f, err = opentype.Parse(captionFonts[name]); err != nil {
+			parsedFontsMu.Unlock()
+			return nil, err
+		}
+		parsedFonts[name] = f
+	}
+	parsedFontsMu.Unlock()
+
+	return opentype.NewFace(f, &opentype.FaceOptions{Size: float64(size), DPI: 72, Hinting: font.HintingFull})
+}
+
+// captionPath returns where a rendered caption of an image is stored
+func (p *ImageProcessor) captionPath(id uuid.UUID, req *captionRequest) string {
+	return filepath.Join(ShardDir(p.cfg.StoragePath, "processed", id), fmt.Sprintf("%s_caption_%s.%s", id.String(), req.key(), req.Format))
+}
+
+// applyCaption draws the caption text onto a copy of src
+func applyCaption(src image.Image, req *captionRequest) (image.Image, error) {
+	face, err := captionFace(req.Font, req.Size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load font %s: %v", req.Font, err)
+	}
+	defer face.Close()
+
+	fill, _ := models.ParseColor(req.Color)
+	dst := imaging.Clone(src)
+	bounds := dst.Bounds()
+
+	lines := strings.Split(req.Text, "\n")
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	blockHeight := lineHeight * len(lines)
+	margin := max(bounds.Dy()/40, 4)
+
+	// Top of the text block
+	var top int
+	switch req.Position {
+	case "top", "top-left", "top-right":
+		top = margin
+	case "center":
+		top = (bounds.Dy() - blockHeight) / 2
+	default:
+		top = bounds.Dy() - blockHeight - margin
+	}
+
+	d := &font.Drawer{Dst: dst, Face: face}
+	for i, line := range lines {
+		width := d.MeasureString(line).Ceil()
+		var left int
+		switch req.Position {
+		case "top-left", "bottom-left":
+			left = margin
+		case "top-right", "bottom-right":
+			left = bounds.Dx() - width - margin
+		default:
+			left = (bounds.Dx() - width) / 2
+		}
+		dot := fixed.P(left, top+i*lineHeight+metrics.Ascent.Ceil())
+
+		// Outline first by drawing the text shifted around the dot
+		if req.Stroke != "none" {
+			stroke, _ := models.ParseColor(req.Stroke)
+			d.Src = image.NewUniform(stroke)
+			w := max(req.Size/16, 1)
+			for dx := -w; dx <= w; dx++ {
+				for dy := -w; dy <= w; dy++ {
+					if dx == 0 && dy == 0 {
+						continue
+					}
+					d.Dot = dot.Add(fixed.P(dx, dy))
+					d.DrawString(line)
+				}
+			}
+		}
+		d.Src = image.NewUniform(fill)
+		d.Dot = dot
+		d.DrawString(line)
+	}
+
+	return dst, nil
+}
+
+// RenderCaption draws the caption onto a copy of the image and returns its path
+func (p *ImageProcessor) RenderCaption(img *models.Image, src image.Image, req *captionRequest) (string, error) {
+	const op = "ImageProcessor.RenderCaption"
+
+	log.Printf("%s: rendering caption for image %s", op, img.ID.String())
+
+	out, err := applyCaption(src, req)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", op, err)
+	}
+
+	path := p.captionPath(img.ID, req)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("%s: failed to create processed directory: %v", op, err)
+	}
+	if err := p.save(out, path); err != nil {
+		return "", fmt.Errorf("%s: %v", op, err)
+	}
+
+	recordChecksum(p.db, img.ID, "caption:"+req.key(), path)
+
+	log.Printf("%s: successfully rendered caption for image %s to %s", op, img.ID.String(), path)
+	return path, nil
+}
+
+// handleCaptionImage draws user-provided text onto a copy of the image and
+// serves it; the stored variants are left untouched
+func (s *Server) handleCaptionImage(c *gin.Context) {
+	const op = "server.handleCaptionImage"
+
+	idStr := c.Param("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	var req captionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	img, err := s.db.GetImage(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	if err := req.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	processor := newProcessorFor(s.cfg, s.db, img)
+	path := processor.captionPath(img.ID, &req)
+	if !s.fileExists(path) {
+		if err := s.limiter.Acquire(c.Request.Context()); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Request canceled while waiting for processing"})
+			return
+		}
+		defer s.limiter.Release()
+
+		release, err := s.limiter.AcquireMemory(c.Request.Context(), img.OriginalPath)
+		if errors.Is(err, ErrImageTooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("%s: failed to reserve decode memory for %s: %v", op, img.OriginalPath, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Image could not be decoded right now"})
+			return
+		}
+		defer release()
+
+		src, err := s.decoder.Open(img.OriginalPath)
+		if err != nil {
+			log.Printf("%s: failed to open image %s: %v", op, img.OriginalPath, err)
+			c.JSON(http.StatusNotFound, gin.H{"error": "Original image file not found"})
+			return
+		}
+
+		if path, err = processor.RenderCaption(img, src, &req); err != nil {
+			log.Printf("%s: %v", op, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render caption"})
+			return
+		}
+	}
+
+	s.audit(c, "caption", img.ID, map[string]any{"text": req.Text, "position": req.Position})
+	s.serveImageFile(c, img, path, "inline")
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+const verifyBatchSize = 500
+
+// ContentChecksum returns the SHA-256 and size of a stored file's content,
+// decrypted if it is encrypted at rest, so they don't change with the key
+func ContentChecksum(path string) (string, int64, error) {
+	f, err := openStored(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// recordChecksum hashes a freshly written file and stores its checksum.
+// Failures are only logged, a missing checksum just skips verification.
+func recordChecksum(db *storage.Storage, id uuid.UUID, variant, path string) {
+	const op = "server.recordChecksum"
+
+	sum, size, err := ContentChecksum(path)
+	if err == nil {
+		err = db.SaveChecksum(&models.FileChecksum{
+			ImageID: id,
+			Variant: variant,
+			Path:    path,
+			SHA256:  sum,
+			Size:    size,
+		})
+	}
+	if err != nil {
+		log.Printf("%s: failed to record checksum of %s: %v", op, path, err)
+	}
+}
+
+// verifyStoredFile checks a stored file against its recorded checksum. Files
+// without a recorded checksum pass.
+func verifyStoredFile(db *storage.Storage, id uuid.UUID, path string) error {
+	expected, err := db.GetChecksumByPath(id, path)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	sum, size, err := ContentChecksum(path)
+	if err != nil {
+		return err
+	}
+	if sum != expected.SHA256 || size != expected.Size {
+		metrics.IntegrityFailuresTotal.Inc()
+		return fmt.Errorf("%w: %s", errChecksumMismatch, path)
+	}
+	return nil
+}
+
+// verifyJob guards the state of the last /admin/verify run
+type verifyJob struct {
+	mu sync.Mutex
+	verifyStatus
+}
+
+type verifyStatus struct {
+	Running    bool            `json:"running"`
+	StartedAt  time.Time       `json:"started_at,omitempty"`
+	FinishedAt time.Time       `json:"finished_at,omitempty"`
+	Checked    int             `json:"checked"`
+	Failures   []verifyFailure `json:"failures"`
+}
+
+type verifyFailure struct {
+	ImageID uuid.UUID `json:"image_id"`
+	Variant string    `json:"variant"`
+	Path    string    `json:"path"`
+	Error   string    `json:"error"` // missing, checksum mismatch or read error
+}
+
+// handleStartVerify starts verifying every recorded checksum in the background
+func (s *Server) handleStartVerify(c *gin.Context) {
+	s.verify.mu.Lock()
+	if s.verify.Running {
+		s.verify.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "Verification already running"})
+		return
+	}
+	s.verify.Running = true
+	s.verify.StartedAt = time.Now()
+	s.verify.FinishedAt = time.Time{}
+	s.verify.Checked = 0
+	s.verify.Failures = nil
+	s.verify.mu.Unlock()
+
+	go s.runVerify()
+
+	s.audit(c, "verify", uuid.Nil, nil)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Verification started"})
+}
+
+func (s *Server) handleVerifyStatus(c *gin.Context) {
+	s.verify.mu.Lock()
+	status := s.verify.verifyStatus
+	status.Failures = append([]verifyFailure(nil), status.Failures...)
+	s.verify.mu.Unlock()
+
+	c.JSON(http.StatusOK, status)
+}
+
+func (s *Server) runVerify() {
+	const op = "server.runVerify"
+
+	defer func() {
+		s.verify.mu.Lock()
+		s.verify.Running = false
+		s.verify.FinishedAt = time.Now()
+		log.Printf("%s: verified %d files, %d failures", op, s.verify.Checked, len(s.verify.Failures))
+		s.verify.mu.Unlock()
+	}()
+
+	afterID, afterVariant := uuid.Nil, ""
+	for {
+		sums, err := s.db.ListChecksums(afterID, afterVariant, verifyBatchSize)
+		if err != nil {
+			log.Printf("%s: %v", op, err)
+			return
+		}
+		if len(sums) == 0 {
+			return
+		}
+		last := sums[len(sums)-1]
+		afterID, afterVariant = last.ImageID, last.Variant
+
+		for _, expected := range sums {
+			var failure string
+			sum, size, err := ContentChecksum(expected.Path)
+			switch {
+			case os.IsNotExist(err):
+				failure = "missing"
+			case err != nil:
+				failure = err.Error()
+			case sum != expected.SHA256 || size != expected.Size:
+				failure = errChecksumMismatch.Error()
+				metrics.IntegrityFailuresTotal.Inc()
+			default:
+				if err := s.db.MarkChecksumVerified(expected.ImageID, expected.Variant); err != nil {
+					log.Printf("%s: %v", op, err)
+				}
+			}
+
+			s.verify.mu.Lock()
+			s.verify.Checked++
+			if failure != "" {
+				log.Printf("%s: %s %s: %s", op, expected.ImageID.String(), expected.Variant, failure)
+				s.verify.Failures = append(s.verify.Failures, verifyFailure{
+					ImageID: expected.ImageID,
+					Variant: expected.Variant,
+					Path:    expected.Path,
+					Error:   failure,
+				})
+			}
+			s.verify.mu.Unlock()
+		}
+	}
+}
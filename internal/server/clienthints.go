@@ -0,0 +1,86 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clientHintsVary lists the request headers a render may be chosen by, old
+// and Sec-CH- prefixed names alike since browsers differ in what they send
+const clientHintsVary = "Sec-CH-Width, Width, Sec-CH-DPR, DPR"
+
+// maxDPR caps the device pixel ratio honored, no screen is denser
+const maxDPR = 4
+
+// hintedWidth returns the width in device pixels the client will display
+// the image at: the Width hint, or else base CSS pixels scaled by the DPR
+// hint. It is 0 when the hints don't tell.
+func hintedWidth(h http.Header, base int) int {
+	for _, name := range []string{"Sec-CH-Width", "Width"} {
+		if w, err := strconv.Atoi(h.Get(name)); err == nil && w > 0 {
+			return w
+		}
+	}
+	if base == 0 {
+		return 0
+	}
+	for _, name := range []string{"Sec-CH-DPR", "DPR"} {
+		if dpr, err := strconv.ParseFloat(h.Get(name), 64); err == nil && dpr > 0 {
+			return int(math.Ceil(float64(base) * min(dpr, maxDPR)))
+		}
+	}
+	return 0
+}
+
+// closestPreset returns the narrowest of the named presets at least width
+// wide, or the widest one when none is
+func closestPreset(presets map[string]models.Preset, names []string, width int) string {
+	best := ""
+	for _, name := range names {
+		w := presets[name].Width
+		if best == "" {
+			best = name
+			continue
+		}
+		bw := presets[best].Width
+		switch {
+		case bw < width:
+			// Anything wider gets closer to covering the width
+			if w > bw {
+				best = name
+			}
+		case w >= width && w < bw:
+			best = name
+		}
+	}
+	return best
+}
+
+// renderPresetName returns the preset a render request is for. With
+// client_hints.presets set, a request naming one of them or none at all
+// gets the one closest to its hinted width, and the response announces the
+// hints and varies by them.
+func (s *Server) renderPresetName(c *gin.Context) (string, bool) {
+	name := c.Query("preset")
+	hinted := s.cfg.ClientHints.Presets
+	if len(hinted) == 0 || (name != "" && !slices.Contains(hinted, name)) {
+		_, ok := s.cfg.Presets[name]
+		return name, ok
+	}
+
+	h := c.Writer.Header()
+	h.Set("Accept-CH", "Sec-CH-Width, Sec-CH-DPR")
+	h.Add("Vary", clientHintsVary)
+
+	width := hintedWidth(c.Request.Header, s.cfg.Presets[name].Width)
+	if width == 0 {
+		return name, name != ""
+	}
+	return closestPreset(s.cfg.Presets, hinted, width), true
+}
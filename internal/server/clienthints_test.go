@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"WB_L3_4/internal/models"
+)
+
+func TestHintedWidth(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		base   int
+		want   int
+	}{
+		{"no hints", nil, 400, 0},
+		{"width", map[string]string{"Sec-CH-Width": "640"}, 0, 640},
+		{"legacy width", map[string]string{"Width": "640"}, 0, 640},
+		{"width over dpr", map[string]string{"Sec-CH-Width": "640", "Sec-CH-DPR": "2"}, 400, 640},
+		{"sec-ch width first", map[string]string{"Sec-CH-Width": "640", "Width": "320"}, 0, 640},
+		{"invalid width falls back", map[string]string{"Sec-CH-Width": "wide", "Width": "320"}, 0, 320},
+		{"zero width ignored", map[string]string{"Sec-CH-Width": "0", "Sec-CH-DPR": "2"}, 400, 800},
+		{"dpr", map[string]string{"Sec-CH-DPR": "2"}, 400, 800},
+		{"legacy dpr", map[string]string{"DPR": "1.5"}, 400, 600},
+		{"fractional dpr rounds up", map[string]string{"Sec-CH-DPR": "1.33"}, 100, 133},
+		{"dpr capped", map[string]string{"Sec-CH-DPR": "10"}, 400, 400 * maxDPR},
+		{"dpr without base", map[string]string{"Sec-CH-DPR": "2"}, 0, 0},
+		{"negative dpr", map[string]string{"Sec-CH-DPR": "-2"}, 400, 0},
+		{"nan dpr", map[string]string{"Sec-CH-DPR": "NaN"}, 400, 0},
+		{"negative width", map[string]string{"Width": "-640"}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for name, value := range tt.header {
+				h.Set(name, value)
+			}
+			if got := hintedWidth(h, tt.base); got != tt.want {
+				t.Errorf("hintedWidth(%v, %d) = %d, want %d", tt.header, tt.base, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClosestPreset(t *testing.T) {
+	presets := map[string]models.Preset{
+		"small":  {Width: 320},
+		"medium": {Width: 640},
+		"large":  {Width: 1280},
+	}
+	names := []string{"large", "small", "medium"}
+	tests := []struct {
+		width int
+		want  string
+	}{
+		{1, "small"},
+		{320, "small"},
+		{321, "medium"},
+		{640, "medium"},
+		{1000, "large"},
+		{1280, "large"},
+		// Nothing covers it, the widest comes closest
+		{4000, "large"},
+	}
+	for _, tt := range tests {
+		if got := closestPreset(presets, names, tt.width); got != tt.want {
+			t.Errorf("closestPreset(%d) = %s, want %s", tt.width, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"net/http"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	maxCollageImages   = 50
+	defaultCollageCell = 300
+	maxCollageCell     = 2000
+	maxCollageSpacing  = 200
+)
+
+// collageRequest is the body of POST /collage
+type collageRequest struct {
+	IDs []string `json:"ids"`
+	// grid crops every image to a square cell, rows keeps aspect ratios and
+	// scales each image to the row height. Defaults to grid.
+	Layout string `json:"layout"`
+	// Images per row; defaults to a square-ish grid
+	Columns int `json:"columns"`
+	// Cell size for grid, row height for rows, in pixels; defaults to 300
+	Size int `json:"size"`
+	// Gap between images and around the edge, in pixels
+	Spacing int `json:"spacing"`
+	// #RRGGBB or #RRGGBBAA; defaults to white
+	Background string `json:"background"`
+	// jpg or png; defaults to jpg
+	Format string `json:"format"`
+}
+
+// validate fills in defaults and checks the request
+func (r *collageRequest) validate() error {
+	if len(r.IDs) < 2 {
+		return errors.New("at least two images are required")
+	}
+	if len(r.IDs) > maxCollageImages {
+		return fmt.Errorf("at most %d images are allowed", maxCollageImages)
+	}
+	if r.Layout == "" {
+		r.Layout = "grid"
+	}
+	if r.Layout != "grid" && r.Layout != "rows" {
+		return fmt.Errorf("unknown layout %q", r.Layout)
+	}
+	if r.Columns < 0 {
+		return errors.New("columns must not be negative")
+	}
+	if r.Columns == 0 {
+		r.Columns = int(math.Ceil(math.Sqrt(float64(len(r.IDs)))))
+	}
+	if r.Size == 0 {
+		r.Size = defaultCollageCell
+	}
+	if r.Size < 1 || r.Size > maxCollageCell {
+		return fmt.Errorf("size must be between 1 and %d", maxCollageCell)
+	}
+	if r.Spacing < 0 || r.Spacing > maxCollageSpacing {
+		return fmt.Errorf("spacing must be between 0 and %d", maxCollageSpacing)
+	}
+	if r.Background == "" {
+		r.Background = "#ffffff"
+	}
+	if _, err := models.ParseColor(r.Background); err != nil {
+		return err
+	}
+	if r.Format == "" {
+		r.Format = "jpg"
+	}
+	if r.Format != "jpg" && r.Format != "png" {
+		return fmt.Errorf("unsupported format %q", r.Format)
+	}
+	return nil
+}
+
+// collageTile scales src to the tile it takes in the collage
+func collageTile(src image.Image, req *collageRequest) image.Image {
+	if req.Layout == "rows" {
+		return imaging.Resize(src, 0, req.Size, imaging.Lanczos)
+	}
+	return imaging.Fill(src, req.Size, req.Size, imaging.Center, imaging.Lanczos)
+}
+
+// renderCollage lays the tiles out in rows of req.Columns
+func renderCollage(tiles []image.Image, req *collageRequest) image.Image {
+	background, _ := models.ParseColor(req.Background)
+
+	// Every row is as high as req.Size, so only the widths vary
+	var rowWidths []int
+	for start := 0; start < len(tiles); start += req.Columns {
+		width := req.Spacing
+		for _, tile := range tiles[start:min(start+req.Columns, len(tiles))] {
+			width += tile.Bounds().Dx() + req.Spacing
+		}
+		rowWidths = append(rowWidths, width)
+	}
+	width := 0
+	for _, w := range rowWidths {
+		width = max(width, w)
+	}
+	height := len(rowWidths)*(req.Size+req.Spacing) + req.Spacing
+
+	dst := imaging.New(width, height, color.Color(background))
+	for row, rowWidth := range rowWidths {
+		// Rows narrower than the widest one are centered
+		x := (width-rowWidth)/2 + req.Spacing
+		y := req.Spacing + row*(req.Size+req.Spacing)
+		start := row * req.Columns
+		for _, tile := range tiles[start:min(start+req.Columns, len(tiles))] {
+			dst = imaging.Paste(dst, tile, image.Pt(x, y))
+			x += tile.Bounds().Dx() + req.Spacing
+		}
+	}
+	return dst
+}
+
+// handleCreateCollage combines several stored images into one and stores it
+// as a new image, processed like an upload
+func (s *Server) handleCreateCollage(c *gin.Context) {
+	const op = "server.handleCreateCollage"
+
+	var req collageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims := claimsFrom(c)
+	images := make([]*models.Image, 0, len(req.IDs))
+	for _, raw := range req.IDs {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID: " + raw})
+			return
+		}
+		img, err := s.db.GetImage(id)
+		if err != nil || !imageVisible(claims, img) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Image not found: " + raw})
+			return
+		}
+		images = append(images, img)
+	}
+
+	if !s.hasSpaceFor(0) {
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Insufficient storage space, try again later"})
+		return
+	}
+
+	if err := s.limiter.Acquire(c.Request.Context()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Request canceled while waiting for processing"})
+		return
+	}
+	defer s.limiter.Release()
+
+	// Originals are decoded one at a time and only their scaled tiles are
+	// kept, so a large collage never holds every original in memory
+	tiles := make([]image.Image, 0, len(images))
+	for _, img := range images {
+		src, release, err := s.openReserved(c.Request.Context(), img.OriginalPath)
+		if errors.Is(err, ErrImageTooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("%s: failed to open image %s: %v", op, img.OriginalPath, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Image could not be decoded right now"})
+			return
+		}
+		tiles = append(tiles, collageTile(src, &req))
+		release()
+	}
+
+	out := renderCollage(tiles, &req)
+	img, err := s.saveGeneratedImage(c, out, "collage", req.Format, requestTenant(c))
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save collage"})
+		return
+	}
+
+	s.audit(c, "collage", img.ID, map[string]any{
+		"images": req.IDs,
+		"layout": req.Layout,
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      img.ID.String(),
+		"status":  img.Status,
+		"message": "Collage created",
+	})
+}
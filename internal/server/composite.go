@@ -0,0 +1,192 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// compositeRequest is the body of POST /image/:id/composite, the image in
+// the path being the base
+type compositeRequest struct {
+	Overlay string `json:"overlay"`
+	// Overlay width relative to the base width, e.g. 0.25; defaults to the
+	// overlay's own size
+	Scale float64 `json:"scale"`
+	// 0..1; defaults to 1
+	Opacity *float64 `json:"opacity"`
+	// center, top, bottom, left, right, top-left, top-right, bottom-left or
+	// bottom-right; ignored when x and y are given. Defaults to center.
+	Position string `json:"position"`
+	// Top-left corner of the overlay in base pixels
+	X *int `json:"x"`
+	Y *int `json:"y"`
+	// jpg or png; defaults to png
+	Format string `json:"format"`
+}
+
+// validate fills in defaults and checks the request
+func (r *compositeRequest) validate() error {
+	if r.Scale < 0 || r.Scale > 4 {
+		return errors.New("scale must be between 0 and 4")
+	}
+	if r.Opacity == nil {
+		one := 1.0
+		r.Opacity = &one
+	}
+	if *r.Opacity < 0 || *r.Opacity > 1 {
+		return errors.New("opacity must be between 0 and 1")
+	}
+	if (r.X == nil) != (r.Y == nil) {
+		return errors.New("x and y must be given together")
+	}
+	if r.Position == "" {
+		r.Position = "center"
+	}
+	switch r.Position {
+	case "center", "top", "bottom", "left", "right", "top-left", "top-right", "bottom-left", "bottom-right":
+	default:
+		return fmt.Errorf("unknown position %q", r.Position)
+	}
+	if r.Format == "" {
+		r.Format = "png"
+	}
+	if r.Format != "jpg" && r.Format != "png" {
+		return fmt.Errorf("unsupported format %q", r.Format)
+	}
+	return nil
+}
+
+// anchor returns the top-left corner of an overlay of the given size on base
+func (r *compositeRequest) anchor(base, overlay image.Rectangle) image.Point {
+	if r.X != nil {
+		return image.Pt(*r.X, *r.Y)
+	}
+	cx := (base.Dx() - overlay.Dx()) / 2
+	cy := (base.Dy() - overlay.Dy()) / 2
+	right := base.Dx() - overlay.Dx()
+	bottom := base.Dy() - overlay.Dy()
+	switch r.Position {
+	case "top":
+		return image.Pt(cx, 0)
+	case "bottom":
+		return image.Pt(cx, bottom)
+	case "left":
+		return image.Pt(0, cy)
+	case "right":
+		return image.Pt(right, cy)
+	case "top-left":
+		return image.Pt(0, 0)
+	case "top-right":
+		return image.Pt(right, 0)
+	case "bottom-left":
+		return image.Pt(0, bottom)
+	case "bottom-right":
+		return image.Pt(right, bottom)
+	}
+	return image.Pt(cx, cy)
+}
+
+// compositeImages draws overlay onto a copy of base as the request says
+func compositeImages(base, overlay image.Image, req *compositeRequest) image.Image {
+	if req.Scale > 0 {
+		width := max(int(float64(base.Bounds().Dx())*req.Scale), 1)
+		overlay = imaging.Resize(overlay, width, 0, imaging.Lanczos)
+	}
+	pos := req.anchor(base.Bounds(), overlay.Bounds())
+	return imaging.Overlay(base, overlay, pos, *req.Opacity)
+}
+
+// handleCompositeImage overlays another stored image onto this one and
+// stores the result as a new image, processed like an upload
+func (s *Server) handleCompositeImage(c *gin.Context) {
+	const op = "server.handleCompositeImage"
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	var req compositeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	overlayID, err := uuid.Parse(req.Overlay)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid overlay image ID"})
+		return
+	}
+
+	base, err := s.db.GetImage(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	overlay, err := s.db.GetImage(overlayID)
+	// The base is checked by requireScope, the overlay has to be checked here
+	if err == nil && !imageVisible(claimsFrom(c), overlay) {
+		err = errors.New("overlay belongs to another tenant or owner")
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Overlay image not found"})
+		return
+	}
+
+	if !s.hasSpaceFor(0) {
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Insufficient storage space, try again later"})
+		return
+	}
+
+	if err := s.limiter.Acquire(c.Request.Context()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Request canceled while waiting for processing"})
+		return
+	}
+	defer s.limiter.Release()
+
+	var srcs [2]image.Image
+	for i, path := range []string{base.OriginalPath, overlay.OriginalPath} {
+		src, release, err := s.openReserved(c.Request.Context(), path)
+		if errors.Is(err, ErrImageTooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("%s: failed to open image %s: %v", op, path, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Image could not be decoded right now"})
+			return
+		}
+		defer release()
+		srcs[i] = src
+	}
+
+	out := compositeImages(srcs[0], srcs[1], &req)
+	img, err := s.saveGeneratedImage(c, out, "composite", req.Format, base.Tenant)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save composite image"})
+		return
+	}
+
+	s.audit(c, "composite", img.ID, map[string]any{
+		"base":    base.ID.String(),
+		"overlay": overlay.ID.String(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      img.ID.String(),
+		"status":  img.Status,
+		"message": "Composite image created",
+	})
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const consistencyBatchSize = 500
+
+// Problems found by the consistency check
+const (
+	problemMissing      = "missing"
+	problemOrphan       = "orphan"
+	problemSizeMismatch = "size_mismatch"
+)
+
+// ConsistencyReport is the result of cross-referencing the database with the
+// files under the storage path
+type ConsistencyReport struct {
+	CheckedImages  int                `json:"checked_images"`
+	CheckedFiles   int                `json:"checked_files"`
+	Missing        int                `json:"missing"`
+	Orphans        int                `json:"orphans"`
+	SizeMismatches int                `json:"size_mismatches"`
+	Repaired       int                `json:"repaired"`
+	Issues         []ConsistencyIssue `json:"issues"`
+}
+
+type ConsistencyIssue struct {
+	ImageID      uuid.UUID `json:"image_id,omitempty"`
+	Variant      string    `json:"variant,omitempty"`
+	Path         string    `json:"path"`
+	Problem      string    `json:"problem"`
+	ExpectedSize int64     `json:"expected_size,omitempty"`
+	ActualSize   int64     `json:"actual_size,omitempty"`
+	// What the repair did: requeued, removed, or why nothing could be done
+	Repair string `json:"repair,omitempty"`
+}
+
+func (r *ConsistencyReport) add(issue ConsistencyIssue) {
+	switch issue.Problem {
+	case problemMissing:
+		r.Missing++
+	case problemOrphan:
+		r.Orphans++
+	case problemSizeMismatch:
+		r.SizeMismatches++
+	}
+	if issue.Repair == "requeued" || issue.Repair == "removed" {
+		r.Repaired++
+	}
+	r.Issues = append(r.Issues, issue)
+}
+
+// CheckConsistency reports files referenced by the database that are missing
+// or differ in size from their checksum record, and files on disk that no
+// image references. With repair set, images with a broken variant are reset
+// and passed to enqueue for reprocessing, and orphan files are removed; a
+// missing original can't be repaired and is only reported.
+func CheckConsistency(ctx context.Context, cfg *models.Config, db *storage.Storage, repair bool, enqueue func(uuid.UUID) error) (*ConsistencyReport, error) {
+	const op = "server.CheckConsistency"
+
+	report := &ConsistencyReport{Issues: []ConsistencyIssue{}}
+	referenced := map[string]bool{}
+
+	after := uuid.Nil
+	for ctx.Err() == nil {
+		images, err := db.ListImagesChangedSince(time.Time{}, after, consistencyBatchSize)
+		if err != nil {
+			return report, err
+		}
+		if len(images) == 0 {
+			break
+		}
+		after = images[len(images)-1].ID
+
+		for _, img := range images {
+			issues, err := checkImageFiles(db, img, referenced)
+			if err != nil {
+				return report, err
+			}
+			report.CheckedImages++
+
+			if len(issues) == 0 {
+				continue
+			}
+			if repair {
+				originalOK := true
+				for _, issue := range issues {
+					if issue.Variant == "original" {
+						originalOK = false
+					}
+				}
+				// One reprocessing regenerates every variant of the image
+				result := repairImage(db, img.ID, originalOK, enqueue)
+				for i := range issues {
+					issues[i].Repair = result
+				}
+			}
+			for i := range issues {
+				log.Printf("%s: %s %s %s: %s", op, issues[i].Problem, img.ID.String(), issues[i].Variant, issues[i].Path)
+				report.add(issues[i])
+			}
+		}
+	}
+
+	cutoff := time.Now().Add(-orphanGracePeriod)
+	for _, kind := range []string{"original", "processed"} {
+		err := filepath.WalkDir(filepath.Join(cfg.StoragePath, kind), func(path string, d fs.DirEntry, err error) error {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			report.CheckedFiles++
+			if referenced[filepath.Clean(path)] {
+				return nil
+			}
+			// Recent files may belong to an upload still in progress
+			info, err := d.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				return nil
+			}
+
+			issue := ConsistencyIssue{Path: path, Problem: problemOrphan, ActualSize: info.Size()}
+			if repair {
+				if err := os.Remove(path); err != nil {
+					issue.Repair = err.Error()
+				} else {
+					issue.Repair = "removed"
+					removeReplicas(cfg, path)
+				}
+			}
+			log.Printf("%s: orphan file %s", op, path)
+			report.add(issue)
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, ctx.Err()
+}
+
+// checkImageFiles checks the files of one image and adds their paths to
+// referenced
+func checkImageFiles(db *storage.Storage, img *models.Image, referenced map[string]bool) ([]ConsistencyIssue, error) {
+	expected := map[string]string{}
+	if img.OriginalPath != "" {
+		expected["original"] = img.OriginalPath
+	}
+	for variant, v := range map[string]struct{ status, path string }{
+		"resized":     {img.ResizeStatus, img.ProcessedPath},
+		"thumbnail":   {img.ThumbnailStatus, img.ThumbnailPath},
+		"watermarked": {img.WatermarkStatus, img.WatermarkedPath},
+		"video":       {img.VideoStatus, img.VideoPath},
+		"upscaled":    {img.UpscaleStatus, img.UpscaledPath},
+	} {
+		if v.status == "done" && v.path != "" {
+			expected[variant] = v.path
+		}
+	}
+
+	sums, err := db.ListImageChecksums(img.ID)
+	if err != nil {
+		return nil, err
+	}
+	sizes := map[string]int64{}
+	for _, sum := range sums {
+		sizes[filepath.Clean(sum.Path)] = sum.Size
+		if _, ok := expected[sum.Variant]; !ok {
+			// Preset variants are only known from their checksum
+			expected[sum.Variant] = sum.Path
+		}
+	}
+
+	var issues []ConsistencyIssue
+	for variant, path := range expected {
+		path = filepath.Clean(path)
+		referenced[path] = true
+
+		issue := ConsistencyIssue{ImageID: img.ID, Variant: variant, Path: path}
+		// Recorded sizes are of the content, decrypted for encrypted files
+		actual, err := contentSize(path)
+		switch {
+		case os.IsNotExist(err):
+			issue.Problem = problemMissing
+		case err != nil:
+			return nil, err
+		default:
+			size, ok := sizes[path]
+			if !ok || size == actual {
+				continue
+			}
+			issue.Problem = problemSizeMismatch
+			issue.ExpectedSize = size
+			issue.ActualSize = actual
+		}
+		issues = append(issues, issue)
+	}
+	return issues, nil
+}
+
+// repairImage reprocesses an image to regenerate its broken variants, which
+// needs an intact original
+func repairImage(db *storage.Storage, id uuid.UUID, originalOK bool, enqueue func(uuid.UUID) error) string {
+	if !originalOK {
+		return "original lost, restore it from a backup or replica"
+	}
+	if err := db.ResetForReprocessing([]uuid.UUID{id}); err != nil {
+		return err.Error()
+	}
+	if err := enqueue(id); err != nil {
+		return err.Error()
+	}
+	recordEvent(db, id, "queued", "", "consistency repair")
+	return "requeued"
+}
+
+// consistencyJob guards the state of the last /admin/consistency run
+type consistencyJob struct {
+	mu sync.Mutex
+	consistencyStatus
+}
+
+type consistencyStatus struct {
+	Running    bool               `json:"running"`
+	Repair     bool               `json:"repair"`
+	StartedAt  time.Time          `json:"started_at,omitempty"`
+	FinishedAt time.Time          `json:"finished_at,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	Report     *ConsistencyReport `json:"report,omitempty"`
+}
+
+// handleStartConsistency starts a consistency check in the background,
+// repairing what it can with ?repair=true
+func (s *Server) handleStartConsistency(c *gin.Context) {
+	repair := c.Query("repair") == "true"
+
+	s.consistency.mu.Lock()
+	if s.consistency.Running {
+		s.consistency.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "Consistency check already running"})
+		return
+	}
+	s.consistency.consistencyStatus = consistencyStatus{Running: true, Repair: repair, StartedAt: time.Now()}
+	s.consistency.mu.Unlock()
+
+	go func() {
+		// Requeued images are handed to the outbox if Kafka is down
+		report, err := CheckConsistency(context.Background(), s.cfg, s.db, repair, func(id uuid.UUID) error {
+			return s.enqueueOrStore(context.Background(), id, "consistency repair")
+		})
+
+		s.consistency.mu.Lock()
+		defer s.consistency.mu.Unlock()
+		s.consistency.Running = false
+		s.consistency.FinishedAt = time.Now()
+		s.consistency.Report = report
+		if err != nil {
+			log.Printf("server.handleStartConsistency: %v", err)
+			s.consistency.Error = err.Error()
+		}
+	}()
+
+	s.audit(c, "consistency_check", uuid.Nil, map[string]any{"repair": repair})
+	c.JSON(http.StatusAccepted, gin.H{"message": "Consistency check started"})
+}
+
+func (s *Server) handleConsistencyStatus(c *gin.Context) {
+	s.consistency.mu.Lock()
+	status := s.consistency.consistencyStatus
+	s.consistency.mu.Unlock()
+
+	c.JSON(http.StatusOK, status)
+}
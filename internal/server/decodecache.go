@@ -0,0 +1,132 @@
+package server
+
+import (
+	"image"
+	"sync"
+	"time"
+)
+
+// decodeCache keeps recently decoded originals for a short time so that
+// triggering resize, thumbnail and watermark for the same image decodes it
+// once. Concurrent requests for the same file wait for a single decode.
+// Cached images are charged to the limiter's memory budget and dropped when
+// a reservation would have to wait for them.
+type decodeCache struct {
+	mu      sync.Mutex
+	entries map[string]*decodeEntry
+	size    int
+	ttl     time.Duration
+	limiter *Limiter
+}
+
+type decodeEntry struct {
+	ready   chan struct{} // closed once img/err are set
+	img     image.Image
+	err     error
+	expires time.Time
+	held    int64 // bytes of the budget held by the entry
+	timer   *time.Timer
+}
+
+func newDecodeCache(size int, ttl time.Duration, limiter *Limiter) *decodeCache {
+	c := &decodeCache{
+		entries: make(map[string]*decodeEntry),
+		size:    size,
+		ttl:     ttl,
+		limiter: limiter,
+	}
+	limiter.OnPressure(c.Purge)
+	return c
+}
+
+// Open returns the decoded image at path, decoding it only if no fresh copy
+// is cached or being decoded
+func (c *decodeCache) Open(path string) (image.Image, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[path]; ok && (e.expires.IsZero() || time.Now().Before(e.expires)) {
+		c.mu.Unlock()
+		<-e.ready
+		return e.img, e.err
+	}
+	e := &decodeEntry{ready: make(chan struct{})}
+	c.evictLocked()
+	c.entries[path] = e
+	c.mu.Unlock()
+
+	e.img, e.err = c.limiter.Decode(path)
+
+	c.mu.Lock()
+	switch {
+	case e.err != nil:
+		// Don't cache failures, the next caller retries
+		delete(c.entries, path)
+	case c.entries[path] != e:
+		// Purged while decoding
+	case !c.limiter.TryHold(imageBytes(e.img)):
+		// Keeping it would go over the budget, callers have their own
+		// reservation for as long as they use it
+		delete(c.entries, path)
+	default:
+		e.held = imageBytes(e.img)
+		e.expires = time.Now().Add(c.ttl)
+		e.timer = time.AfterFunc(c.ttl, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.entries[path] == e {
+				c.removeLocked(path)
+			}
+		})
+	}
+	c.mu.Unlock()
+	close(e.ready)
+
+	return e.img, e.err
+}
+
+// Purge drops every completed entry and returns the memory they held
+func (c *decodeCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path, e := range c.entries {
+		if !e.expires.IsZero() {
+			c.removeLocked(path)
+		}
+	}
+}
+
+// evictLocked drops expired entries and, if the cache is still full, the
+// completed entry closest to expiry. Decodes in progress are never evicted.
+func (c *decodeCache) evictLocked() {
+	now := time.Now()
+	var oldest string
+	for path, e := range c.entries {
+		if e.expires.IsZero() {
+			continue
+		}
+		if now.After(e.expires) {
+			c.removeLocked(path)
+			continue
+		}
+		if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+			oldest = path
+		}
+	}
+	if len(c.entries) >= c.size && oldest != "" {
+		c.removeLocked(oldest)
+	}
+}
+
+// removeLocked drops a completed entry and returns the memory it held
+func (c *decodeCache) removeLocked(path string) {
+	e := c.entries[path]
+	delete(c.entries, path)
+	e.timer.Stop()
+	c.limiter.Unhold(e.held)
+}
+
+// imageBytes is the memory held by a decoded image, counted the way
+// AcquireMemory reserves it
+func imageBytes(img image.Image) int64 {
+	b := img.Bounds()
+	return int64(b.Dx()) * int64(b.Dy()) * 4
+}
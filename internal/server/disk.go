@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+)
+
+// storageFreeBytes returns the free space available under the storage path
+// and records it in the metrics
+func (s *Server) storageFreeBytes() (int64, error) {
+	free, err := diskFreeBytes(s.cfg.StoragePath)
+	if err != nil {
+		return 0, err
+	}
+	metrics.StorageFreeBytes.Set(float64(free))
+	return free, nil
+}
+
+// MonitorDiskSpace refreshes the free space metric until ctx is canceled
+func (s *Server) MonitorDiskSpace(ctx context.Context, interval time.Duration) {
+	const op = "server.MonitorDiskSpace"
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.storageFreeBytes(); err != nil {
+			log.Printf("%s: %v", op, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// hasSpaceFor reports whether storing size more bytes keeps the free space
+// above the configured minimum. If free space can't be determined the upload
+// is let through and the write itself will fail if the disk is full.
+func (s *Server) hasSpaceFor(size int64) bool {
+	const op = "server.hasSpaceFor"
+
+	free, err := s.storageFreeBytes()
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		return true
+	}
+	return free-size >= int64(s.cfg.MinFreeDiskMB)<<20
+}
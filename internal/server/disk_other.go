@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package server
+
+import "errors"
+
+func diskFreeBytes(path string) (int64, error) {
+	return 0, errors.New("free disk space is not supported on this platform")
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// Pixel density is kept in the JFIF header of JPEGs and the pHYs chunk of
+// PNGs. Go's encoders write neither, so print scans would come out at the
+// viewers' 72dpi default without it being written back.
+
+const (
+	jfifHeader     = "JFIF\x00"
+	inchesPerMeter = 39.3701
+)
+
+// readDPI returns the horizontal pixel density of a JPEG or PNG file, or 0
+// if the file doesn't declare one
+func readDPI(path string) (int, error) {
+	f, err := openStored(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// Density is in the first segment or chunk after the header
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, nil
+	}
+	head = head[:n]
+
+	switch {
+	case len(head) > 18 && head[0] == 0xFF && head[1] == 0xD8 && head[2] == 0xFF && head[3] == 0xE0 &&
+		bytes.Equal(head[6:11], []byte(jfifHeader)):
+		units, density := head[13], int(binary.BigEndian.Uint16(head[14:16]))
+		switch units {
+		case 1:
+			return density, nil
+		case 2:
+			return int(math.Round(float64(density) * 2.54)), nil
+		}
+	case bytes.HasPrefix(head, pngSignature):
+		if at := pngChunk(head, "pHYs"); at >= 0 && at+8+9 <= len(head) && head[at+8+8] == 1 {
+			ppm := binary.BigEndian.Uint32(head[at+8:])
+			return int(math.Round(float64(ppm) / inchesPerMeter)), nil
+		}
+	}
+	return 0, nil
+}
+
+// embedDPI writes dpi into the JPEG or PNG file at path; other formats and
+// a zero dpi are left alone
+func embedDPI(path string, dpi int) error {
+	ext := strings.ToLower(filepath.Ext(path))
+	if dpi <= 0 || (ext != ".jpg" && ext != ".jpeg" && ext != ".png") {
+		return nil
+	}
+
+	data, err := readStored(path)
+	if err != nil {
+		return err
+	}
+	if ext == ".png" {
+		data, err = withPNGDPI(data, dpi)
+	} else {
+		data, err = withJPEGDPI(data, dpi)
+	}
+	if err != nil {
+		return err
+	}
+	return writeStored(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// withJPEGDPI sets the density of the JFIF segment, adding one right after
+// SOI if the file has none
+func withJPEGDPI(data []byte, dpi int) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("not a JPEG file")
+	}
+	density := uint16(min(dpi, math.MaxUint16))
+	if len(data) > 18 && data[2] == 0xFF && data[3] == 0xE0 && bytes.Equal(data[6:11], []byte(jfifHeader)) {
+		data[13] = 1
+		binary.BigEndian.PutUint16(data[14:], density)
+		binary.BigEndian.PutUint16(data[16:], density)
+		return data, nil
+	}
+
+	var app0 bytes.Buffer
+	app0.Write([]byte{0xFF, 0xE0, 0x00, 0x10})
+	app0.WriteString(jfifHeader)
+	app0.Write([]byte{1, 2, 1}) // version 1.02, dots per inch
+	binary.Write(&app0, binary.BigEndian, density)
+	binary.Write(&app0, binary.BigEndian, density)
+	app0.Write([]byte{0, 0}) // no thumbnail
+
+	out := make([]byte, 0, len(data)+app0.Len())
+	out = append(out, data[:2]...)
+	out = append(out, app0.Bytes()...)
+	return append(out, data[2:]...), nil
+}
+
+// withPNGDPI sets the pHYs chunk, adding one after IHDR if the file has none
+func withPNGDPI(data []byte, dpi int) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) || len(data) < len(pngSignature)+8 {
+		return nil, errors.New("not a PNG file")
+	}
+	ppm := uint32(math.Round(float64(dpi) * inchesPerMeter))
+	var phys [9]byte
+	binary.BigEndian.PutUint32(phys[0:], ppm)
+	binary.BigEndian.PutUint32(phys[4:], ppm)
+	phys[8] = 1 // meters
+
+	if at := pngChunk(data, "pHYs"); at >= 0 && at+12+9 <= len(data) {
+		copy(data[at+8:], phys[:])
+		binary.BigEndian.PutUint32(data[at+8+9:], crc32.ChecksumIEEE(data[at+4:at+8+9]))
+		return data, nil
+	}
+
+	ihdrEnd := len(pngSignature) + 8 + int(binary.BigEndian.Uint32(data[len(pngSignature):])) + 4
+	if ihdrEnd > len(data) {
+		return nil, errors.New("truncated PNG file")
+	}
+	var chunk bytes.Buffer
+	binary.Write(&chunk, binary.BigEndian, uint32(len(phys)))
+	chunk.WriteString("pHYs")
+	chunk.Write(phys[:])
+	binary.Write(&chunk, binary.BigEndian, crc32.ChecksumIEEE(chunk.Bytes()[4:]))
+
+	out := make([]byte, 0, len(data)+chunk.Len())
+	out = append(out, data[:ihdrEnd]...)
+	out = append(out, chunk.Bytes()...)
+	return append(out, data[ihdrEnd:]...), nil
+}
+
+// pngChunk returns the offset of the first chunk of type typ before the
+// image data, or -1
+func pngChunk(data []byte, typ string) int {
+	for at := len(pngSignature); at+8 <= len(data); {
+		switch t := string(data[at+4 : at+8]); t {
+		case typ:
+			return at
+		case "IDAT", "IEND":
+			return -1
+		}
+		at += 12 + int(binary.BigEndian.Uint32(data[at:]))
+	}
+	return -1
+}
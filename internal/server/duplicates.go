@@ -0,0 +1,290 @@
+package server
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"math/bits"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultDuplicateDistance = 4
+	// Candidates are found through one of the eight hash bytes being equal,
+	// which only catches every pair up to seven differing bits
+	maxDuplicateDistance = 7
+)
+
+// perceptualHash returns the difference hash of img: one bit per pixel of a
+// 9x8 grayscale thumbnail telling whether it is brighter than its right
+// neighbour. Rescaled or recompressed copies differ in a few bits at most.
+func perceptualHash(img image.Image) uint64 {
+	small := imaging.Resize(img, 9, 8, imaging.Box)
+	luma := func(x, y int) int {
+		c := small.NRGBAAt(x, y)
+		return 299*int(c.R) + 587*int(c.G) + 114*int(c.B)
+	}
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if luma(x, y) > luma(x+1, y) {
+				hash |= 1 << (y*8 + x)
+			}
+		}
+	}
+	return hash
+}
+
+// recordPerceptualHash stores the hash of a decoded image. Failures are only
+// logged, the image is just left out of near-duplicate detection.
+func recordPerceptualHash(db *storage.Storage, id uuid.UUID, img image.Image) {
+	if err := db.SavePerceptualHash(id, perceptualHash(img)); err != nil {
+		log.Printf("server.recordPerceptualHash: failed to record hash of image %s: %v", id.String(), err)
+	}
+}
+
+// duplicateImage is a member of a duplicate group
+type duplicateImage struct {
+	ID        uuid.UUID `json:"id"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	// Differing hash bits from the kept image, near duplicates only
+	Distance int `json:"distance,omitempty"`
+}
+
+// duplicateGroup is a set of images of the same tenant that are copies of
+// each other; all but Keep could be deleted
+type duplicateGroup struct {
+	Kind             string           `json:"kind"` // exact or near
+	Keep             uuid.UUID        `json:"keep"`
+	Images           []duplicateImage `json:"images"`
+	ReclaimableBytes int64            `json:"reclaimable_bytes"`
+}
+
+// findDuplicates groups identical originals, keeping the oldest, then
+// images whose hashes are at most distance bits apart, keeping the largest.
+// Copies already in an exact group only take part through the kept one.
+func findDuplicates(prints []models.ImageFingerprint, distance int) []duplicateGroup {
+	var groups []duplicateGroup
+
+	covered := make([]bool, len(prints))
+	exact := map[string][]int{}
+	var exactKeys []string
+	for i, p := range prints {
+		if p.SHA256 == "" {
+			continue
+		}
+		key := p.Tenant + "\x00" + p.SHA256
+		if _, ok := exact[key]; !ok {
+			exactKeys = append(exactKeys, key)
+		}
+		exact[key] = append(exact[key], i)
+	}
+	for _, key := range exactKeys {
+		members := exact[key]
+		if len(members) < 2 {
+			continue
+		}
+		// Fingerprints come oldest first
+		for _, i := range members[1:] {
+			covered[i] = true
+		}
+		groups = append(groups, newDuplicateGroup("exact", prints, members, members[0]))
+	}
+
+	// Union-find over the pairs within distance, compared only when they
+	// share a hash byte
+	parent := make([]int, len(prints))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	type bucket struct {
+		tenant string
+		pos    int
+		value  byte
+	}
+	buckets := map[bucket][]int{}
+	for i, p := range prints {
+		if covered[i] || p.DHash == nil {
+			continue
+		}
+		hash := uint64(*p.DHash)
+		for pos := 0; pos < 8; pos++ {
+			b := bucket{p.Tenant, pos, byte(hash >> (pos * 8))}
+			for _, j := range buckets[b] {
+				if find(i) != find(j) && bits.OnesCount64(hash^uint64(*prints[j].DHash)) <= distance {
+					parent[find(i)] = find(j)
+				}
+			}
+			buckets[b] = append(buckets[b], i)
+		}
+	}
+
+	near := map[int][]int{}
+	var roots []int
+	for i, p := range prints {
+		if covered[i] || p.DHash == nil {
+			continue
+		}
+		root := find(i)
+		if _, ok := near[root]; !ok {
+			roots = append(roots, root)
+		}
+		near[root] = append(near[root], i)
+	}
+	for _, root := range roots {
+		members := near[root]
+		if len(members) < 2 {
+			continue
+		}
+		// The largest is likely the best quality copy
+		keep := members[0]
+		for _, i := range members[1:] {
+			if prints[i].Size > prints[keep].Size {
+				keep = i
+			}
+		}
+		groups = append(groups, newDuplicateGroup("near", prints, members, keep))
+	}
+
+	slices.SortStableFunc(groups, func(a, b duplicateGroup) int {
+		switch {
+		case a.ReclaimableBytes > b.ReclaimableBytes:
+			return -1
+		case a.ReclaimableBytes < b.ReclaimableBytes:
+			return 1
+		}
+		return 0
+	})
+	return groups
+}
+
+// newDuplicateGroup builds the group of the given fingerprints
+func newDuplicateGroup(kind string, prints []models.ImageFingerprint, members []int, keep int) duplicateGroup {
+	group := duplicateGroup{Kind: kind, Keep: prints[keep].ImageID}
+	for _, i := range members {
+		p := prints[i]
+		img := duplicateImage{ID: p.ImageID, Size: p.Size, CreatedAt: p.CreatedAt}
+		if kind == "near" {
+			img.Distance = bits.OnesCount64(uint64(*p.DHash) ^ uint64(*prints[keep].DHash))
+		}
+		group.Images = append(group.Images, img)
+		if i != keep {
+			group.ReclaimableBytes += p.Size
+		}
+	}
+	return group
+}
+
+// handleListDuplicates reports exact and near-duplicate images, e.g.
+// GET /admin/duplicates?distance=4. Images processed before hashes were
+// recorded only show up as exact duplicates.
+func (s *Server) handleListDuplicates(c *gin.Context) {
+	const op = "server.handleListDuplicates"
+
+	distance := defaultDuplicateDistance
+	if v := c.Query("distance"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxDuplicateDistance {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("distance must be between 0 and %d", maxDuplicateDistance)})
+			return
+		}
+		distance = n
+	}
+
+	prints, err := s.db.ListFingerprints()
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list image fingerprints"})
+		return
+	}
+
+	groups := findDuplicates(prints, distance)
+	var total int64
+	for _, g := range groups {
+		total += g.ReclaimableBytes
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"distance":                distance,
+		"groups":                  groups,
+		"total_reclaimable_bytes": total,
+	})
+}
+
+// mergeDuplicatesRequest is the body of POST /admin/duplicates/merge
+type mergeDuplicatesRequest struct {
+	Keep   uuid.UUID   `json:"keep"`
+	Remove []uuid.UUID `json:"remove"`
+}
+
+// handleMergeDuplicates keeps one image of a duplicate group and deletes
+// the others with their files
+func (s *Server) handleMergeDuplicates(c *gin.Context) {
+	const op = "server.handleMergeDuplicates"
+
+	var req mergeDuplicatesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if req.Keep == uuid.Nil || len(req.Remove) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "keep and remove are required"})
+		return
+	}
+
+	keep, err := s.db.GetImage(req.Keep)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	// Check all of them before deleting any
+	var remove []*models.Image
+	for _, id := range req.Remove {
+		if id == keep.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The kept image can't be removed"})
+			return
+		}
+		img, err := s.db.GetImage(id)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Image %s not found", id.String())})
+			return
+		}
+		if img.Tenant != keep.Tenant {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Duplicates must belong to the same tenant"})
+			return
+		}
+		remove = append(remove, img)
+	}
+
+	removed := make([]uuid.UUID, 0, len(remove))
+	for _, img := range remove {
+		if err := s.removeImage(img); err != nil {
+			log.Printf("%s: failed to remove image %s: %v", op, img.ID.String(), err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove image " + img.ID.String(), "removed": removed})
+			return
+		}
+		removed = append(removed, img.ID)
+	}
+
+	s.audit(c, "merge_duplicates", keep.ID, map[string]any{"removed": removed})
+	c.JSON(http.StatusOK, gin.H{"keep": keep.ID, "removed": removed})
+}
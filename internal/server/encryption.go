@@ -0,0 +1,395 @@
+package server
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/disintegration/imaging"
+)
+
+// A sealed file starts with sealMagic, the ID of the key it is encrypted
+// with and a random nonce prefix. The content follows in chunks of
+// sealChunkSize bytes, each encrypted with AES-256-GCM on its own so reads
+// can seek. A chunk's nonce is the prefix, its index and whether it is the
+// last one, so chunks can't be reordered, dropped or cut off unnoticed.
+const (
+	sealMagic      = "WBSEAL01"
+	sealKeyIDSize  = 8
+	sealPrefixSize = 7
+	sealHeaderSize = len(sealMagic) + sealKeyIDSize + sealPrefixSize
+	sealChunkSize  = 64 << 10
+	sealTagSize    = 16
+)
+
+var (
+	errUnknownKey    = errors.New("file is encrypted with a key that isn't configured")
+	errCorruptSealed = errors.New("encrypted file is corrupt")
+)
+
+type keyID [sealKeyIDSize]byte
+
+// keyring holds the keys of encryption.key and encryption.previous_keys by
+// ID, a hash of the key
+type keyring struct {
+	sealID keyID
+	// nil when files are only read, not encrypted
+	seal cipher.AEAD
+	keys map[keyID]cipher.AEAD
+}
+
+// processKeys is the keyring of this process, nil while no keys are set
+var processKeys *keyring
+
+// SetupEncryption loads the keys stored files are encrypted with at rest.
+// Without encryption.key new files are stored as they are, those encrypted
+// before stay readable with the key among encryption.previous_keys.
+func SetupEncryption(cfg *models.Config) error {
+	const op = "server.SetupEncryption"
+
+	if cfg.Encryption.Key == "" && len(cfg.Encryption.PreviousKeys) == 0 {
+		return nil
+	}
+	kr := &keyring{keys: make(map[keyID]cipher.AEAD)}
+	for i, encoded := range append([]string{cfg.Encryption.Key}, cfg.Encryption.PreviousKeys...) {
+		if encoded == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("%s: %v", op, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("%s: %v", op, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return fmt.Errorf("%s: %v", op, err)
+		}
+		sum := sha256.Sum256(key)
+		id := keyID(sum[:sealKeyIDSize])
+		kr.keys[id] = aead
+		if i == 0 {
+			kr.sealID, kr.seal = id, aead
+		}
+	}
+	processKeys = kr
+	return nil
+}
+
+// chunkNonce returns the nonce of the index-th chunk of a sealed file
+func chunkNonce(prefix []byte, index int64, last bool) []byte {
+	nonce := make([]byte, 0, sealPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, uint32(index))
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// sealTo writes r encrypted with the current key to w
+func (k *keyring) sealTo(w io.Writer, r io.Reader) error {
+	header := make([]byte, 0, sealHeaderSize)
+	header = append(header, sealMagic...)
+	header = append(header, k.sealID[:]...)
+	prefix := make([]byte, sealPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	buf := make([]byte, sealChunkSize)
+	var out []byte
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !last {
+			return err
+		}
+		// A full chunk is the last one when nothing follows it
+		if !last {
+			if _, err := br.Peek(1); errors.Is(err, io.EOF) {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+		out = k.seal.Seal(out[:0], chunkNonce(prefix, index, last), buf[:n], header)
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// sealedReader decrypts a sealed file, one chunk at a time
+type sealedReader struct {
+	f      StoredFile
+	aead   cipher.AEAD
+	header []byte
+	size   int64 // of the content
+	chunks int64
+	pos    int64
+
+	// index of the chunk decrypted into plain, -1 for none
+	chunk int64
+	plain []byte
+	buf   []byte
+}
+
+// storedContent returns a reader of the content of a stored file: f itself,
+// or a decrypting reader when it is sealed
+func storedContent(f StoredFile) (io.ReadSeeker, bool, error) {
+	header := make([]byte, sealHeaderSize)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, false, err
+	}
+	if n < sealHeaderSize || string(header[:len(sealMagic)]) != sealMagic {
+		return f, false, nil
+	}
+
+	var aead cipher.AEAD
+	if processKeys != nil {
+		aead = processKeys.keys[keyID(header[len(sealMagic):len(sealMagic)+sealKeyIDSize])]
+	}
+	if aead == nil {
+		return nil, true, errUnknownKey
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, true, err
+	}
+
+	// Every chunk but the last is full, the last one may be empty
+	stored := info.Size() - int64(sealHeaderSize)
+	full, rest := stored/(sealChunkSize+sealTagSize), stored%(sealChunkSize+sealTagSize)
+	r := &sealedReader{f: f, aead: aead, header: header, chunks: full, size: full * sealChunkSize, chunk: -1}
+	if rest > 0 {
+		if rest < sealTagSize {
+			return nil, true, errCorruptSealed
+		}
+		r.chunks++
+		r.size += rest - sealTagSize
+	}
+	if r.chunks == 0 {
+		return nil, true, errCorruptSealed
+	}
+	return r, true, nil
+}
+
+func (r *sealedReader) load(index int64) error {
+	if r.chunk == index {
+		return nil
+	}
+	r.chunk = -1
+	if r.buf == nil {
+		r.buf = make([]byte, sealChunkSize+sealTagSize)
+	}
+	offset := int64(sealHeaderSize) + index*(sealChunkSize+sealTagSize)
+	n, err := r.f.ReadAt(r.buf, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	prefix := r.header[len(sealMagic)+sealKeyIDSize:]
+	plain, err := r.aead.Open(r.plain[:0], chunkNonce(prefix, index, index == r.chunks-1), r.buf[:n], r.header)
+	if err != nil {
+		return fmt.Errorf("%w: %s: chunk %d: %v", errCorruptSealed, r.f.Name(), index, err)
+	}
+	r.plain, r.chunk = plain, index
+	return nil
+}
+
+func (r *sealedReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	index := r.pos / sealChunkSize
+	if err := r.load(index); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.plain[r.pos-index*sealChunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *sealedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("sealedReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("sealedReader.Seek: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// openStored opens a stored file for reading its content, decrypting it
+// when it is sealed
+func openStored(path string) (io.ReadSeekCloser, error) {
+	f, err := OpenStoredFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := storedContent(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return struct {
+		io.ReadSeeker
+		io.Closer
+	}{r, f}, nil
+}
+
+// readStored is os.ReadFile for stored files
+func readStored(path string) ([]byte, error) {
+	r, err := openStored(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// decodeStored decodes the stored image at path
+func decodeStored(path string) (image.Image, error) {
+	r, err := openStored(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return imaging.Decode(r)
+}
+
+// decodeStoredConfig reads the dimensions of the stored image at path
+func decodeStoredConfig(path string) (image.Config, error) {
+	r, err := openStored(path)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer r.Close()
+	cfg, _, err := image.DecodeConfig(r)
+	return cfg, err
+}
+
+// contentSize returns the size of a stored file's content
+func contentSize(path string) (int64, error) {
+	r, err := openStored(path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return r.Seek(0, io.SeekEnd)
+}
+
+// sealing reports whether new files are encrypted
+func sealing() bool {
+	return processKeys != nil && processKeys.seal != nil
+}
+
+// writeStored is writeFileAtomic for stored files. With encryption.key set
+// the content is encrypted with the current key as write produces it, so it
+// never reaches the disk in the clear, and a file that can't be encrypted
+// isn't written at all. Files are written as they are while encryption is
+// off.
+func writeStored(path string, write func(w io.Writer) error) error {
+	if !sealing() {
+		return writeFileAtomic(path, write)
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			err := write(pw)
+			pw.CloseWithError(err)
+			done <- err
+		}()
+		err := processKeys.sealTo(w, pr)
+		// Unblocks write when sealing stopped early
+		pr.CloseWithError(err)
+		if writeErr := <-done; writeErr != nil {
+			return writeErr
+		}
+		return err
+	})
+}
+
+// replaceStored moves the file at src, the output of an external tool, to
+// the stored file at path, encrypting it on the way
+func replaceStored(path, src string) error {
+	if !sealing() {
+		return os.Rename(src, path)
+	}
+	defer os.Remove(src)
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeStored(path, func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	})
+}
+
+// plainCopy returns a path external tools can read a stored file's content
+// from: the file itself, or for a sealed file or one in the object store a
+// local, decrypted copy in the temp directory, readable only by this user,
+// which cleanup removes
+func plainCopy(path string) (string, func(), error) {
+	f, err := OpenStoredFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	r, sealed, err := storedContent(f)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if !sealed && !isObjectPath(path) {
+		return path, func() {}, nil
+	}
+
+	// Tools tell the format by the extension
+	tmp, err := os.CreateTemp("", "plain-*"+filepath.Ext(path))
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return tmp.Name(), cleanup, nil
+}
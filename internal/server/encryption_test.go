@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"WB_L3_4/internal/models"
+)
+
+// useKeys sets the keyring of the process to key, with previous keys, for
+// the duration of the test. No key at all leaves encryption off.
+func useKeys(t *testing.T, key string, previous ...string) {
+	t.Helper()
+	saved := processKeys
+	t.Cleanup(func() { processKeys = saved })
+	processKeys = nil
+
+	cfg := &models.Config{}
+	cfg.Encryption.Key = key
+	cfg.Encryption.PreviousKeys = previous
+	if err := SetupEncryption(cfg); err != nil {
+		t.Fatalf("SetupEncryption: %v", err)
+	}
+}
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func testContent(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func writeTestFile(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "image.jpg")
+	err := writeStored(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("writeStored: %v", err)
+	}
+	return path
+}
+
+// sealedSize is the size on disk of n bytes of content once sealed
+func sealedSize(n int) int {
+	chunks := n / sealChunkSize
+	if n%sealChunkSize != 0 || n == 0 {
+		chunks++
+	}
+	return sealHeaderSize + n + chunks*sealTagSize
+}
+
+func TestSealedRoundTrip(t *testing.T) {
+	useKeys(t, testKey(1))
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"one full chunk", sealChunkSize},
+		{"one chunk and a byte", sealChunkSize + 1},
+		{"three full chunks", 3 * sealChunkSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testContent(tt.size)
+			path := writeTestFile(t, data)
+
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(raw, []byte(sealMagic)) {
+				t.Fatalf("file isn't sealed")
+			}
+			if len(raw) != sealedSize(tt.size) {
+				t.Errorf("sealed size = %d, want %d", len(raw), sealedSize(tt.size))
+			}
+
+			got, err := readStored(path)
+			if err != nil {
+				t.Fatalf("readStored: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("content differs after a round trip")
+			}
+			size, err := contentSize(path)
+			if err != nil {
+				t.Fatalf("contentSize: %v", err)
+			}
+			if size != int64(tt.size) {
+				t.Errorf("contentSize = %d, want %d", size, tt.size)
+			}
+		})
+	}
+}
+
+func TestSealedSeek(t *testing.T) {
+	useKeys(t, testKey(1))
+
+	data := testContent(2*sealChunkSize + 100)
+	r, err := openStored(writeTestFile(t, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Reads across the boundary of the first and second chunk
+	offset := int64(sealChunkSize - 10)
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 20)
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, data[offset:offset+20]) {
+		t.Errorf("read at %d = %v, want %v", offset, got, data[offset:offset+20])
+	}
+}
+
+func TestSealedRejectsTampering(t *testing.T) {
+	useKeys(t, testKey(1))
+
+	// Four chunks, the last one partial
+	data := testContent(3*sealChunkSize + 10)
+	stored := sealChunkSize + sealTagSize
+	chunk := func(raw []byte, i int) []byte {
+		start := sealHeaderSize + i*stored
+		return raw[start:min(start+stored, len(raw))]
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(raw []byte) []byte
+	}{
+		{"last chunk dropped", func(raw []byte) []byte {
+			return raw[:sealHeaderSize+3*stored]
+		}},
+		{"last chunk cut short", func(raw []byte) []byte {
+			return raw[:len(raw)-5]
+		}},
+		{"cut inside a tag", func(raw []byte) []byte {
+			return raw[:sealHeaderSize+3*stored+sealTagSize-1]
+		}},
+		{"chunks reordered", func(raw []byte) []byte {
+			out := append([]byte(nil), raw[:sealHeaderSize]...)
+			out = append(out, chunk(raw, 1)...)
+			out = append(out, chunk(raw, 0)...)
+			return append(out, raw[sealHeaderSize+2*stored:]...)
+		}},
+		{"content byte flipped", func(raw []byte) []byte {
+			chunk(raw, 1)[100] ^= 1
+			return raw
+		}},
+		{"tag byte flipped", func(raw []byte) []byte {
+			c := chunk(raw, 2)
+			c[len(c)-1] ^= 1
+			return raw
+		}},
+		{"nonce prefix changed", func(raw []byte) []byte {
+			raw[sealHeaderSize-1] ^= 1
+			return raw
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, data)
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tt.tamper(raw), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = readStored(path)
+			if !errors.Is(err, errCorruptSealed) {
+				t.Errorf("readStored error = %v, want %v", err, errCorruptSealed)
+			}
+		})
+	}
+}
+
+func TestSealedRejectsMissingFinalChunk(t *testing.T) {
+	useKeys(t, testKey(1))
+
+	// Sealed like sealTo does, but with no chunk flagged as the last one, as
+	// if the file had been cut off at a chunk boundary
+	data := testContent(2 * sealChunkSize)
+	prefix := bytes.Repeat([]byte{7}, sealPrefixSize)
+	header := append(append([]byte(sealMagic), processKeys.sealID[:]...), prefix...)
+	raw := append([]byte(nil), header...)
+	for i := 0; i < 2; i++ {
+		plain := data[i*sealChunkSize : (i+1)*sealChunkSize]
+		raw = processKeys.seal.Seal(raw, chunkNonce(prefix, int64(i), false), plain, header)
+	}
+	path := filepath.Join(t.TempDir(), "image.jpg")
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := readStored(path)
+	if !errors.Is(err, errCorruptSealed) {
+		t.Errorf("readStored error = %v, want %v", err, errCorruptSealed)
+	}
+}
+
+func TestSealedKeyRotation(t *testing.T) {
+	useKeys(t, testKey(1))
+	data := testContent(1000)
+	path := writeTestFile(t, data)
+
+	useKeys(t, testKey(2), testKey(1))
+	got, err := readStored(path)
+	if err != nil {
+		t.Fatalf("readStored with the key among previous_keys: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("content differs after key rotation")
+	}
+
+	useKeys(t, testKey(2))
+	if _, err := readStored(path); !errors.Is(err, errUnknownKey) {
+		t.Errorf("readStored error = %v, want %v", err, errUnknownKey)
+	}
+}
+
+func TestPlaintextPassthrough(t *testing.T) {
+	data := testContent(sealChunkSize + 1)
+
+	useKeys(t, "")
+	path := writeTestFile(t, data)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, data) {
+		t.Fatalf("file written without a key isn't stored as is")
+	}
+	got, err := readStored(path)
+	if err != nil {
+		t.Fatalf("readStored: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("content differs without a key")
+	}
+
+	// Files stored before encryption was enabled stay readable
+	useKeys(t, testKey(1))
+	got, err = readStored(path)
+	if err != nil {
+		t.Fatalf("readStored with a key: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("plaintext file differs when read with a key")
+	}
+	plain, cleanup, err := plainCopy(path)
+	if err != nil {
+		t.Fatalf("plainCopy: %v", err)
+	}
+	defer cleanup()
+	if plain != path {
+		t.Errorf("plainCopy of a plaintext file = %s, want the file itself", plain)
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"WB_L3_4/internal/models"
+)
+
+// engine resizes directly from the original file, without decoding it into
+// an image.Image first. The pure-Go imaging path is used when no engine is
+// configured.
+type engine interface {
+	Resize(srcPath, dstPath string, spec resizeSpec, quality int) error
+	Thumbnail(srcPath, dstPath string, size, quality int, background color.NRGBA, filter string) error
+	// Encode writes pixels rendered in Go, for formats imaging can't encode
+	Encode(img image.Image, dstPath string, quality int) error
+	// Shrink decodes the file at srcPath scaled down to width x height
+	// without holding its full-size pixels
+	Shrink(srcPath string, width, height int) (image.Image, error)
+}
+
+// newEngine returns the engine selected in the config, or nil for the
+// default imaging engine
+func newEngine(cfg *models.Config) (engine, error) {
+	switch cfg.Engine {
+	case "", "imaging":
+		return nil, nil
+	case "vips":
+		return newVipsEngine(cfg)
+	default:
+		return nil, fmt.Errorf("unknown processing engine %q", cfg.Engine)
+	}
+}
+
+// CheckEngine reports whether the configured engine is usable in this build
+func CheckEngine(cfg *models.Config) error {
+	_, err := newEngine(cfg)
+	return err
+}
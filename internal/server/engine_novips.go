@@ -0,0 +1,13 @@
+//go:build !vips
+
+package server
+
+import (
+	"fmt"
+
+	"WB_L3_4/internal/models"
+)
+
+func newVipsEngine(cfg *models.Config) (engine, error) {
+	return nil, fmt.Errorf("vips engine not available: rebuild with -tags vips")
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// recordEvent stores a lifecycle event of an image. Failures are only logged,
+// the history must never break processing.
+func recordEvent(db *storage.Storage, id uuid.UUID, event, operation, message string) {
+	err := db.AddImageEvent(&models.ImageEvent{
+		ImageID:   id,
+		Event:     event,
+		Operation: operation,
+		Message:   message,
+	})
+	if err != nil {
+		log.Printf("server.recordEvent: failed to record %s %s for image %s: %v", operation, event, id.String(), err)
+	}
+}
+
+// recordOutcome records whether an operation finished or failed and how long
+// it took since started, and meters it unless it's the whole run
+func recordOutcome(db *storage.Storage, img *models.Image, operation string, started time.Time, err error) {
+	id := img.ID
+	durationMS := time.Since(started).Milliseconds()
+	event := &models.ImageEvent{
+		ImageID:    id,
+		Event:      "finished",
+		Operation:  operation,
+		DurationMS: &durationMS,
+	}
+	if err != nil {
+		event.Event = "error"
+		event.Message = err.Error()
+	}
+	if err := db.AddImageEvent(event); err != nil {
+		log.Printf("server.recordOutcome: failed to record %s %s for image %s: %v", operation, event.Event, id.String(), err)
+	}
+
+	// The last error is kept on the image until the operation next succeeds
+	key := operation
+	if key == "" {
+		key = "processing"
+	}
+	if err := db.SetOperationError(id, key, event.Message); err != nil {
+		log.Printf("server.recordOutcome: failed to update %s error for image %s: %v", key, id.String(), err)
+	}
+
+	if operation != "" {
+		status := "done"
+		if err != nil {
+			status = "error"
+		}
+		meterImage(img, MeteringEvent{Type: meterProcessing, Operation: operation, Status: status, DurationMS: durationMS})
+	}
+}
+
+// observeOperation records the duration and result of an operation producing
+// the given output format in the Prometheus metrics
+func observeOperation(operation, format string, started time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	metrics.OperationDuration.WithLabelValues(operation, format).Observe(time.Since(started).Seconds())
+	metrics.OperationsTotal.WithLabelValues(operation, format, result).Inc()
+}
+
+func (s *Server) handleGetImageEvents(c *gin.Context) {
+	const op = "server.handleGetImageEvents"
+
+	idStr := c.Param("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	if _, err := s.db.GetImage(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	events, err := s.db.ListImageEvents(id)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load image events"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id.String(), "events": events})
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const exportBatchSize = 1000
+
+// exportColumns are the CSV header, in the order of exportRecord
+var exportColumns = []string{
+	"id", "tenant", "original_filename", "content_type", "status",
+	"resize_status", "thumbnail_status", "watermark_status", "preset", "title",
+	"original_size", "total_size", "sha256", "created_at", "updated_at",
+}
+
+// exportRecord returns the CSV fields of an export row
+func exportRecord(e *models.ImageExport) []string {
+	return []string{
+		e.ID.String(), e.Tenant, e.OriginalFilename, e.ContentType, e.Status,
+		e.ResizeStatus, e.ThumbnailStatus, e.WatermarkStatus, e.Preset, e.Title,
+		strconv.FormatInt(e.OriginalSize, 10), strconv.FormatInt(e.TotalSize, 10), e.SHA256,
+		e.CreatedAt.UTC().Format(time.RFC3339), e.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// handleExport streams the metadata of every image as CSV or a JSON array,
+// e.g. GET /admin/export?format=csv&tenant=acme, optionally filtered like
+// GET /images, e.g. ?status=error&uploaded_after=2024-05-01T00:00:00Z. Rows are read in batches
+// by ID, so images changed during the export may show either state. An
+// error midway ends the response early; the response then lacks the closing
+// bracket of the JSON array.
+func (s *Server) handleExport(c *gin.Context) {
+	const op = "server.handleExport"
+
+	format := c.DefaultQuery("format", "json")
+	if format != "csv" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or json"})
+		return
+	}
+	var tenant *string
+	if v, ok := c.GetQuery("tenant"); ok {
+		tenant = &v
+	}
+	filter, err := parseImageFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The first batch is read before anything is written, so a failing
+	// database still gets a proper error response
+	batch, err := s.db.ListImageExports(tenant, filter, uuid.Nil, exportBatchSize)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export images"})
+		return
+	}
+
+	filename := "images-" + time.Now().UTC().Format("20060102-150405") + "." + format
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Header("Cache-Control", "no-store")
+
+	var write func(e *models.ImageExport) error
+	var finish func() error
+	flush := func() {}
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		w := csv.NewWriter(c.Writer)
+		w.Write(exportColumns)
+		write = func(e *models.ImageExport) error { return w.Write(exportRecord(e)) }
+		flush = w.Flush
+		finish = func() error {
+			w.Flush()
+			return w.Error()
+		}
+	} else {
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.Writer.WriteString("[")
+		first := true
+		write = func(e *models.ImageExport) error {
+			if !first {
+				c.Writer.WriteString(",")
+			}
+			first = false
+			b, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			_, err = c.Writer.Write(b)
+			return err
+		}
+		finish = func() error {
+			_, err := c.Writer.WriteString("]\n")
+			return err
+		}
+	}
+	c.Status(http.StatusOK)
+
+	var rows int
+	for len(batch) > 0 {
+		for i := range batch {
+			if err := write(&batch[i]); err != nil {
+				log.Printf("%s: export aborted after %d rows: %v", op, rows, err)
+				return
+			}
+			rows++
+		}
+		flush()
+		c.Writer.Flush()
+		if len(batch) < exportBatchSize || c.Request.Context().Err() != nil {
+			break
+		}
+		if batch, err = s.db.ListImageExports(tenant, filter, batch[len(batch)-1].ID, exportBatchSize); err != nil {
+			log.Printf("%s: export aborted after %d rows: %v", op, rows, err)
+			return
+		}
+	}
+	if err := finish(); err != nil {
+		log.Printf("%s: %v", op, err)
+	}
+	c.Writer.Flush()
+
+	s.audit(c, "export", uuid.Nil, map[string]any{"format": format, "rows": rows})
+}
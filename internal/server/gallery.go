@@ -0,0 +1,209 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// galleryItem is an image as listed by GET /images
+type galleryItem struct {
+	ID               string            `json:"id"`
+	Status           string            `json:"status"`
+	ResizeStatus     string            `json:"resize_status"`
+	ThumbnailStatus  string            `json:"thumbnail_status"`
+	WatermarkStatus  string            `json:"watermark_status"`
+	OriginalFilename string            `json:"original_filename"`
+	Title            string            `json:"title,omitempty"`
+	Tags             []string          `json:"tags,omitempty"`
+	ContentType      string            `json:"content_type"`
+	Size             int64             `json:"size"`
+	CreatedAt        time.Time         `json:"created_at"`
+	URLs             map[string]string `json:"urls"`
+}
+
+// variantURLs returns absolute URLs of the image's ready variants, keyed by
+// original, resized, thumbnail, watermarked and video
+func (s *Server) variantURLs(img *models.Image) map[string]string {
+	base := imageURL(s.cfg.PublicURL, img.ID.String())
+	urls := map[string]string{}
+	if img.OriginalPath != "" {
+		urls["original"] = base + "/original"
+	}
+	if img.ResizeStatus == "done" && img.ProcessedPath != "" {
+		urls["resized"] = base
+	}
+	if img.ThumbnailStatus == "done" && img.ThumbnailPath != "" {
+		urls["thumbnail"] = base + "/thumbnail"
+	}
+	if img.WatermarkStatus == "done" && img.WatermarkedPath != "" {
+		urls["watermarked"] = base + "/watermarked"
+	}
+	if img.VideoStatus == "done" && img.VideoPath != "" {
+		urls["video"] = base + "/video"
+	}
+	if img.UpscaleStatus == "done" && img.UpscaledPath != "" {
+		urls["upscaled"] = base + "/upscaled"
+	}
+	return urls
+}
+
+// handleListImages lists images with ready-to-use variant URLs, newest first
+// or as given by ?sort=created_at|size|status&order=asc|desc, paginated with
+// ?limit= and ?cursor= and filtered like /admin/reprocess
+func (s *Server) handleListImages(c *gin.Context) {
+	const op = "server.handleListImages"
+
+	page, err := parsePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	order := storage.ImageSort{By: c.DefaultQuery("sort", "created_at")}
+	if !slices.Contains(storage.ImageSortColumns, order.By) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be one of " + strings.Join(storage.ImageSortColumns, ", ")})
+		return
+	}
+	switch c.DefaultQuery("order", "desc") {
+	case "asc":
+		order.Asc = true
+	case "desc":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order must be asc or desc"})
+		return
+	}
+
+	filter, err := parseImageFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Tenant- and owner-bound tokens only see their own images
+	if claims := claimsFrom(c); claims != nil {
+		filter.Tenant = claims.Tenant
+		filter.Owner = claims.Owner
+	}
+	images, next, err := s.db.ListImages(filter, order, page)
+	if errors.Is(err, storage.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor, or one from a listing in another order"})
+		return
+	}
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list images"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"images":      s.galleryItems(images),
+		"sort":        order.By,
+		"order":       c.DefaultQuery("order", "desc"),
+		"limit":       page.Limit,
+		"offset":      page.Offset,
+		"next_cursor": next,
+	})
+}
+
+// parsePage reads the ?limit= and ?cursor= of a listing. ?offset= still
+// works for older clients but gets slow deep into large listings.
+func parsePage(c *gin.Context) (storage.Page, error) {
+	page := storage.Page{Limit: defaultListLimit, After: c.Query("cursor")}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return page, errors.New("Invalid limit")
+		}
+		page.Limit = min(n, maxListLimit)
+	}
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return page, errors.New("Invalid offset")
+		}
+		page.Offset = n
+	}
+	if page.After != "" && page.Offset > 0 {
+		return page, errors.New("Use either cursor or offset")
+	}
+	return page, nil
+}
+
+// parseImageFilter reads the filters of an image listing: the statuses,
+// ?uploaded_after= and ?uploaded_before= as RFC 3339 timestamps and
+// ?min_size= and ?max_size= in bytes
+func parseImageFilter(c *gin.Context) (storage.ImageFilter, error) {
+	filter := storage.ImageFilter{
+		Status:          c.Query("status"),
+		ResizeStatus:    c.Query("resize_status"),
+		ThumbnailStatus: c.Query("thumbnail_status"),
+		WatermarkStatus: c.Query("watermark_status"),
+	}
+	if v := c.Query("uploaded_after"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, errors.New("uploaded_after must be an RFC 3339 timestamp")
+		}
+		filter.UploadedAfter = t
+	}
+	if v := c.Query("uploaded_before"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, errors.New("uploaded_before must be an RFC 3339 timestamp")
+		}
+		filter.UploadedBefore = t
+	}
+	if v := c.Query("min_size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return filter, errors.New("Invalid min_size")
+		}
+		filter.MinSize = n
+	}
+	if v := c.Query("max_size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return filter, errors.New("Invalid max_size")
+		}
+		filter.MaxSize = n
+	}
+	if filter.MaxSize > 0 && filter.MinSize > filter.MaxSize {
+		return filter, errors.New("min_size is larger than max_size")
+	}
+	return filter, nil
+}
+
+// galleryItems converts images to their listing entries
+func (s *Server) galleryItems(images []*models.Image) []galleryItem {
+	items := make([]galleryItem, 0, len(images))
+	for _, img := range images {
+		items = append(items, galleryItem{
+			ID:               img.ID.String(),
+			Status:           img.Status,
+			ResizeStatus:     img.ResizeStatus,
+			ThumbnailStatus:  img.ThumbnailStatus,
+			WatermarkStatus:  img.WatermarkStatus,
+			OriginalFilename: img.OriginalFilename,
+			Title:            img.Title,
+			Tags:             img.Tags,
+			ContentType:      img.ContentType,
+			Size:             img.Size,
+			CreatedAt:        img.CreatedAt,
+			URLs:             s.variantURLs(img),
+		})
+	}
+	return items
+}
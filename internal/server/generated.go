@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// openReserved reserves decode memory for the image at path and decodes it.
+// The returned func releases the reservation once the image is not used.
+func (s *Server) openReserved(ctx context.Context, path string) (image.Image, func(), error) {
+	release, err := s.limiter.AcquireMemory(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	src, err := s.decoder.Open(path)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return src, release, nil
+}
+
+// saveGeneratedImage stores an image rendered by the server from other
+// images as the original of a new image record and queues it for the
+// standard processing, just like an upload
+func (s *Server) saveGeneratedImage(c *gin.Context, out image.Image, filename, format, tenant string) (*models.Image, error) {
+	const op = "server.saveGeneratedImage"
+
+	id := uuid.New()
+	originalPath := filepath.Join(ShardDir(s.cfg.StoragePath, "original", id), id.String()+"."+format)
+	if err := os.MkdirAll(filepath.Dir(originalPath), 0755); err != nil {
+		return nil, fmt.Errorf("%s: failed to create directory: %v", op, err)
+	}
+	if err := NewImageProcessor(s.cfg, s.db).save(out, originalPath); err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+
+	img := models.Image{
+		ID:               id,
+		Status:           "pending",
+		OriginalPath:     originalPath,
+		ResizeStatus:     "pending",
+		ThumbnailStatus:  "pending",
+		WatermarkStatus:  "pending",
+		Tenant:           tenant,
+		Owner:            requestOwner(c),
+		OriginalFilename: filename + "." + format,
+		ContentType:      mime.TypeByExtension("." + format),
+	}
+	if size, err := contentSize(originalPath); err == nil {
+		img.Size = size
+	}
+	if err := s.db.SaveImage(&img); err != nil {
+		os.Remove(originalPath)
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+
+	recordChecksum(s.db, id, "original", originalPath)
+
+	if s.readiness.State() == stateDegraded {
+		s.deferProcessing(&img, "kafka unavailable")
+	} else if err := s.enqueue(c.Request.Context(), id); err != nil {
+		log.Printf("%s: failed to send to kafka: %v", op, err)
+		s.deferProcessing(&img, "failed to enqueue for processing: "+err.Error())
+	} else {
+		recordEvent(s.db, id, "queued", "", "")
+	}
+	return &img, nil
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"WB_L3_4/internal/auth"
+	"WB_L3_4/internal/metrics"
+	"WB_L3_4/internal/models"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// The upload service is described by proto/imageprocessor/v1/upload.proto.
+// It is built from well-known message types, so no generated code is needed
+// on this side: the client streams the file as google.protobuf.BytesValue
+// chunks and gets a google.protobuf.Struct with id, status and message back.
+// Everything the HTTP upload takes as form fields is sent as request
+// metadata under the same names, plus filename.
+
+// imageUploadServer is implemented by the handler of the upload service
+type imageUploadServer interface {
+	Upload(stream grpc.ServerStream) error
+}
+
+var imageUploadServiceDesc = grpc.ServiceDesc{
+	ServiceName: "imageprocessor.v1.ImageUpload",
+	HandlerType: (*imageUploadServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Upload",
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				return srv.(imageUploadServer).Upload(stream)
+			},
+			ClientStreams: true,
+		},
+	},
+	Metadata: "imageprocessor/v1/upload.proto",
+}
+
+// grpcUploadService reassembles streamed uploads and hands them to the same
+// pipeline as POST /upload
+type grpcUploadService struct {
+	srv *Server
+}
+
+// Upload receives the chunks of one image until the client closes its side
+func (u *grpcUploadService) Upload(stream grpc.ServerStream) error {
+	const op = "server.grpcUploadService.Upload"
+	s := u.srv
+	ctx := stream.Context()
+
+	if s.readiness.State() == stateUnready {
+		return status.Error(codes.Unavailable, "Service is not ready, try again later")
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	field := func(name string) string {
+		if v := md.Get(name); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	claims, err := s.grpcClaims(field("authorization"))
+	if err != nil {
+		return err
+	}
+
+	fields, err := s.parseUploadFields(field)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// The size isn't known before the stream ends, so only the floor is
+	// checked here and the copy fails on a full disk
+	if !s.hasSpaceFor(0) {
+		metrics.UploadsRejectedTotal.WithLabelValues("disk_full").Inc()
+		return status.Error(codes.ResourceExhausted, "Insufficient storage space, try again later")
+	}
+
+	tenant := field(strings.ToLower(tenantHeader))
+	if claims != nil && claims.Tenant != "" {
+		tenant = claims.Tenant
+	}
+	if claims != nil {
+		fields.Owner = claims.Owner
+	}
+	// The size isn't known yet, so only a full quota is refused
+	if err := s.checkQuota(fields.Owner, 0); errors.Is(err, errQuotaExceeded) {
+		metrics.UploadsRejectedTotal.WithLabelValues("quota").Inc()
+		return status.Error(codes.ResourceExhausted, "Storage quota exceeded")
+	} else if err != nil {
+		log.Printf("%s: %v", op, err)
+	}
+	maxSize := int64(s.cfg.GRPCMaxUploadMB) << 20
+	img, size, err := s.importImage(ctx, &chunkReader{stream: stream}, field("filename"), maxSize, fields, tenant)
+	switch {
+	case errors.Is(err, errUploadTooLarge):
+		return status.Errorf(codes.InvalidArgument, "File too large. Maximum size is %dMB", s.cfg.GRPCMaxUploadMB)
+	case errors.Is(err, errUnsupportedImage):
+		return status.Error(codes.InvalidArgument, "Invalid image format. Only JPEG, PNG, and GIF are supported")
+	case errors.Is(err, errCorruptImage):
+		return status.Error(codes.InvalidArgument, "Invalid or corrupted image file")
+	case ctx.Err() != nil:
+		return status.FromContextError(ctx.Err()).Err()
+	case err != nil:
+		log.Printf("%s: %v", op, err)
+		return status.Error(codes.Internal, "Failed to save image")
+	}
+	id := img.ID
+
+	entry := models.AuditEntry{
+		Actor:   auditActor(claims, field(strings.ToLower(actorHeader))),
+		Action:  "upload",
+		ImageID: &id,
+		Details: map[string]any{"filename": img.OriginalFilename, "size": size, "preset": fields.Preset, "source": "grpc"},
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		entry.RemoteAddr = p.Addr.String()
+	}
+	if err := s.db.AddAuditEntry(&entry); err != nil {
+		log.Printf("%s: failed to record upload: %v", op, err)
+	}
+
+	reply, err := structpb.NewStruct(map[string]any{
+		"id":      id.String(),
+		"status":  img.Status,
+		"message": "Image uploaded successfully",
+	})
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	log.Printf("Image uploaded successfully over gRPC: %s (%d bytes)", id.String(), size)
+	return stream.SendMsg(reply)
+}
+
+// grpcClaims checks the bearer token in the authorization metadata the way
+// requireScope does for HTTP; claims are nil while token auth is disabled
+func (s *Server) grpcClaims(authorization string) (*auth.Claims, error) {
+	if s.cfg.Auth.TokenSecret == "" {
+		return nil, nil
+	}
+
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || token == "" {
+		return nil, status.Error(codes.Unauthenticated, "Missing access token")
+	}
+	claims, err := auth.Verify([]byte(s.cfg.Auth.TokenSecret), token)
+	if err != nil {
+		msg := "Invalid access token"
+		if errors.Is(err, auth.ErrTokenExpired) {
+			msg = "Access token expired"
+		}
+		return nil, status.Error(codes.Unauthenticated, msg)
+	}
+	if !claims.Allows(auth.ScopeUpload) {
+		return nil, status.Error(codes.PermissionDenied, fmt.Sprintf("Token does not allow %s", auth.ScopeUpload))
+	}
+	return claims, nil
+}
+
+// chunkReader reads the chunks of an upload stream as one file
+type chunkReader struct {
+	stream grpc.ServerStream
+	buf    []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		var chunk wrapperspb.BytesValue
+		if err := r.stream.RecvMsg(&chunk); err != nil {
+			return 0, err // io.EOF once the client closes its side
+		}
+		r.buf = chunk.Value
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
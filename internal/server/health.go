@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/segmentio/kafka-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const dependencyCheckTimeout = 3 * time.Second
+
+// dependencies are the names checkDependencies reports failures under
+var dependencies = []string{"database", "kafka", "storage"}
+
+// checkDependencies probes the database, the Kafka broker and the storage
+// directory and returns the error of each failing dependency by name
+func checkDependencies(ctx context.Context, cfg *models.Config, db *storage.Storage) map[string]error {
+	ctx, cancel := context.WithTimeout(ctx, dependencyCheckTimeout)
+	defer cancel()
+
+	failed := map[string]error{}
+	if err := db.Ping(ctx); err != nil {
+		failed["database"] = err
+	}
+	if conn, err := kafka.DialContext(ctx, "tcp", cfg.KafkaBroker); err != nil {
+		failed["kafka"] = err
+	} else {
+		conn.Close()
+	}
+	if _, err := diskFreeBytes(cfg.StoragePath); err != nil {
+		failed["storage"] = err
+	}
+	return failed
+}
+
+// ServeGRPC serves the standard grpc.health.v1 service and the
+// imageprocessor.v1.ImageUpload service on cfg.GRPCAddr until ctx is
+// canceled. The overall ("") health service is SERVING unless the service is
+// unready; "database", "kafka" and "storage" report each dependency on its
+// own.
+func ServeGRPC(ctx context.Context, srv *Server) error {
+	lis, err := net.Listen("tcp", srv.cfg.GRPCAddr)
+	if err != nil {
+		return err
+	}
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	grpcServer := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	grpcServer.RegisterService(&imageUploadServiceDesc, &grpcUploadService{srv: srv})
+
+	srv.readiness.addListener(func(_, next string, failed map[string]error) {
+		for _, name := range dependencies {
+			status := healthpb.HealthCheckResponse_SERVING
+			if _, ok := failed[name]; ok {
+				status = healthpb.HealthCheckResponse_NOT_SERVING
+			}
+			healthServer.SetServingStatus(name, status)
+		}
+		overall := healthpb.HealthCheckResponse_SERVING
+		if next == stateUnready {
+			overall = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		healthServer.SetServingStatus("", overall)
+	})
+
+	go func() {
+		<-ctx.Done()
+		healthServer.Shutdown()
+		grpcServer.GracefulStop()
+	}()
+
+	return grpcServer.Serve(lis)
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// hotFolderRetryDelay is how long a file waits after an import failed for a
+// reason other than the file itself, e.g. the database being down
+const hotFolderRetryDelay = 30 * time.Second
+
+// importSkipped reports whether a file name is left alone by the hot folder
+// and SFTP imports: hidden files and the temporary files copy tools write
+// before renaming
+func importSkipped(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~") {
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".tmp", ".part", ".partial", ".crdownload":
+		return true
+	}
+	return false
+}
+
+// WatchHotFolder imports every image copied into the hot folder until ctx is
+// canceled. A file is picked up once it hasn't been written to for the
+// settle delay, processed like an upload with the configured preset, options
+// and tenant, and removed from the folder. Files that aren't valid images are
+// moved to the failed directory. Files already there on start are imported
+// too.
+func (s *Server) WatchHotFolder(ctx context.Context) {
+	const op = "server.WatchHotFolder"
+	cfg := s.cfg.HotFolder
+
+	fields, err := s.importFields(cfg.Preset, cfg.Options)
+	if err != nil {
+		log.Printf("%s: invalid hot folder settings: %v", op, err)
+		return
+	}
+
+	for _, dir := range []string{cfg.Path, cfg.FailedDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("%s: failed to create %s: %v", op, dir, err)
+			return
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		return
+	}
+	defer watcher.Close()
+	if err := watcher.Add(cfg.Path); err != nil {
+		log.Printf("%s: failed to watch %s: %v", op, cfg.Path, err)
+		return
+	}
+
+	// Each file gets a timer restarted by every write to it; ready receives
+	// the files whose timer fired
+	ready := make(chan string)
+	pending := map[string]*time.Timer{}
+	schedule := func(path string, delay time.Duration) {
+		if t, ok := pending[path]; ok {
+			t.Reset(delay)
+			return
+		}
+		pending[path] = time.AfterFunc(delay, func() {
+			select {
+			case ready <- path:
+			case <-ctx.Done():
+			}
+		})
+	}
+	defer func() {
+		for _, t := range pending {
+			t.Stop()
+		}
+	}()
+
+	// Files copied in while the service was down
+	entries, err := os.ReadDir(cfg.Path)
+	if err != nil {
+		log.Printf("%s: failed to list %s: %v", op, cfg.Path, err)
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() && !importSkipped(e.Name()) {
+			schedule(filepath.Join(cfg.Path, e.Name()), cfg.SettleDelay)
+		}
+	}
+
+	log.Printf("%s: watching %s", op, cfg.Path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// Renames into the folder show up as creates
+			if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) {
+				if !importSkipped(filepath.Base(event.Name)) {
+					schedule(event.Name, cfg.SettleDelay)
+				}
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("%s: %v", op, err)
+		case path := <-ready:
+			delete(pending, path)
+			if retry := s.importHotFile(ctx, path, fields); retry > 0 {
+				schedule(path, retry)
+			}
+		}
+	}
+}
+
+// importHotFile imports one file of the hot folder and returns how long to
+// wait before trying again, 0 when the file is done with
+func (s *Server) importHotFile(ctx context.Context, path string, fields *uploadFields) time.Duration {
+	const op = "server.importHotFile"
+	cfg := s.cfg.HotFolder
+
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0 // Removed meanwhile, or a directory
+	}
+	// Some network shares report no writes, so the file itself must be
+	// settled too
+	if wait := cfg.SettleDelay - time.Since(info.ModTime()); wait > 0 {
+		return wait
+	}
+	if s.readiness.State() == stateUnready {
+		return hotFolderRetryDelay
+	}
+	if !s.hasSpaceFor(info.Size()) {
+		metrics.UploadsRejectedTotal.WithLabelValues("disk_full").Inc()
+		return hotFolderRetryDelay
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		return hotFolderRetryDelay
+	}
+	img, size, err := s.importImage(ctx, f, filepath.Base(path), int64(cfg.MaxSizeMB)<<20, fields, cfg.Tenant)
+	f.Close()
+	if importRejected(err) {
+		log.Printf("%s: rejected %s: %v", op, path, err)
+		failed := filepath.Join(cfg.FailedDir, filepath.Base(path))
+		if err := os.Rename(path, failed); err != nil {
+			log.Printf("%s: failed to move %s to %s: %v", op, path, failed, err)
+		}
+		return 0
+	}
+	if err != nil {
+		log.Printf("%s: failed to import %s: %v", op, path, err)
+		return hotFolderRetryDelay
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.Printf("%s: imported %s as %s but failed to remove it: %v", op, path, img.ID.String(), err)
+	}
+	s.auditSystem("upload", img.ID, map[string]any{
+		"filename": img.OriginalFilename,
+		"size":     size,
+		"preset":   fields.Preset,
+		"source":   "hot_folder",
+	})
+	log.Printf("Image imported from hot folder: %s (%s)", img.ID.String(), path)
+	return 0
+}
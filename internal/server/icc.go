@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Go's encoders drop the color profile of the original, which makes
+// wide-gamut photos look washed out. The profile is read from the original
+// and written back into every JPEG and PNG output, the pixels are left in
+// the original's color space.
+
+const (
+	jpegICCHeader = "ICC_PROFILE\x00"
+	// Largest profile slice per APP2 segment: 65535 minus the length field,
+	// the header and the sequence bytes
+	jpegICCChunk = 65535 - 2 - len(jpegICCHeader) - 2
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// readICCProfile returns the ICC profile embedded in a JPEG or PNG file, or
+// nil if it has none
+func readICCProfile(path string) ([]byte, error) {
+	f, err := openStored(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var magic [8]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		return nil, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	switch {
+	case magic[0] == 0xFF && magic[1] == 0xD8:
+		return readJPEGICC(f)
+	case bytes.Equal(magic[:], pngSignature):
+		return readPNGICC(f)
+	}
+	return nil, nil
+}
+
+// readJPEGICC joins the profile slices of the APP2 segments before the scan
+func readJPEGICC(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	if _, err := br.Discard(2); err != nil {
+		return nil, err
+	}
+
+	slices := map[byte][]byte{}
+	var count byte
+	for {
+		marker, err := jpegMarker(br)
+		if err != nil {
+			return nil, err
+		}
+		// Start of scan or end of image: no more metadata follows
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return nil, err
+		}
+		size := int(binary.BigEndian.Uint16(length[:])) - 2
+		if size < 0 {
+			return nil, errors.New("invalid JPEG segment length")
+		}
+		if marker != 0xE2 || size < len(jpegICCHeader)+2 {
+			if _, err := br.Discard(size); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(data, []byte(jpegICCHeader)) {
+			continue
+		}
+		seq := data[len(jpegICCHeader)]
+		count = data[len(jpegICCHeader)+1]
+		slices[seq] = data[len(jpegICCHeader)+2:]
+	}
+
+	if count == 0 || len(slices) != int(count) {
+		return nil, nil
+	}
+	var profile []byte
+	for seq := byte(1); seq <= count; seq++ {
+		s, ok := slices[seq]
+		if !ok {
+			return nil, nil
+		}
+		profile = append(profile, s...)
+	}
+	return profile, nil
+}
+
+// readPNGICC returns the decompressed profile of the iCCP chunk
+func readPNGICC(r io.Reader) ([]byte, error) {
+	if _, err := io.CopyN(io.Discard, r, int64(len(pngSignature))); err != nil {
+		return nil, err
+	}
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, nil
+		}
+		size := binary.BigEndian.Uint32(header[:4])
+		typ := string(header[4:])
+		// The profile has to come before the image data
+		if typ == "IDAT" || typ == "IEND" {
+			return nil, nil
+		}
+		if typ != "iCCP" {
+			if _, err := io.CopyN(io.Discard, r, int64(size)+4); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		// Profile name, NUL, compression method, zlib stream
+		nul := bytes.IndexByte(data, 0)
+		if nul < 0 || nul+2 > len(data) {
+			return nil, errors.New("invalid iCCP chunk")
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(data[nul+2:]))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	}
+}
+
+// embedICCProfile writes profile into the JPEG or PNG file at path; other
+// formats are left alone
+func embedICCProfile(path string, profile []byte) error {
+	ext := strings.ToLower(filepath.Ext(path))
+	if len(profile) == 0 || (ext != ".jpg" && ext != ".jpeg" && ext != ".png") {
+		return nil
+	}
+
+	data, err := readStored(path)
+	if err != nil {
+		return err
+	}
+	var out []byte
+	if ext == ".png" {
+		out, err = withPNGICC(data, profile)
+	} else {
+		out, err = withJPEGICC(data, profile)
+	}
+	if err != nil || out == nil {
+		return err
+	}
+	return writeStored(path, func(w io.Writer) error {
+		_, err := w.Write(out)
+		return err
+	})
+}
+
+// withJPEGICC inserts the profile as APP2 segments after SOI and APP0
+func withJPEGICC(data, profile []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("not a JPEG file")
+	}
+	at := 2
+	// Keep the JFIF APP0 segment first, as decoders expect
+	if data[2] == 0xFF && data[3] == 0xE0 && len(data) >= 6 {
+		at = 4 + int(binary.BigEndian.Uint16(data[4:6]))
+	}
+
+	count := (len(profile) + jpegICCChunk - 1) / jpegICCChunk
+	if count > 255 {
+		return nil, errors.New("ICC profile too large for JPEG")
+	}
+	var segments bytes.Buffer
+	for i := 0; i < count; i++ {
+		chunk := profile[i*jpegICCChunk : min((i+1)*jpegICCChunk, len(profile))]
+		segments.Write([]byte{0xFF, 0xE2})
+		binary.Write(&segments, binary.BigEndian, uint16(2+len(jpegICCHeader)+2+len(chunk)))
+		segments.WriteString(jpegICCHeader)
+		segments.Write([]byte{byte(i + 1), byte(count)})
+		segments.Write(chunk)
+	}
+
+	out := make([]byte, 0, len(data)+segments.Len())
+	out = append(out, data[:at]...)
+	out = append(out, segments.Bytes()...)
+	return append(out, data[at:]...), nil
+}
+
+// withPNGICC inserts an iCCP chunk after IHDR, nil if the file already
+// declares a color space
+func withPNGICC(data, profile []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) || len(data) < len(pngSignature)+8 {
+		return nil, errors.New("not a PNG file")
+	}
+	ihdrEnd := len(pngSignature) + 8 + int(binary.BigEndian.Uint32(data[len(pngSignature):])) + 4
+	if ihdrEnd > len(data) {
+		return nil, errors.New("truncated PNG file")
+	}
+	if pngChunk(data, "iCCP") >= 0 || pngChunk(data, "sRGB") >= 0 {
+		return nil, nil
+	}
+
+	var payload bytes.Buffer
+	payload.WriteString("ICC Profile\x00\x00")
+	zw := zlib.NewWriter(&payload)
+	zw.Write(profile)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	var chunk bytes.Buffer
+	binary.Write(&chunk, binary.BigEndian, uint32(payload.Len()))
+	chunk.WriteString("iCCP")
+	chunk.Write(payload.Bytes())
+	binary.Write(&chunk, binary.BigEndian, crc32.ChecksumIEEE(chunk.Bytes()[4:]))
+
+	out := make([]byte, 0, len(data)+chunk.Len())
+	out = append(out, data[:ihdrEnd]...)
+	out = append(out, chunk.Bytes()...)
+	return append(out, data[ihdrEnd:]...), nil
+}
+
+// jpegMarker returns the next marker code, skipping fill bytes
+func jpegMarker(r *bufio.Reader) (byte, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if c != 0xFF {
+		return 0, errors.New("invalid JPEG marker")
+	}
+	for c == 0xFF {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return c, nil
+}
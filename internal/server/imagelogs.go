@@ -0,0 +1,130 @@
+package server
+
+import (
+	"container/list"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var uuidPattern = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+
+// imageLogs keeps the last log lines mentioning each image, for the most
+// recently logged images. Lines only live in this process's memory, so
+// they're lost on restart and only cover images this instance handled.
+type imageLogs struct {
+	mu        sync.Mutex
+	maxImages int
+	maxLines  int
+	// Front is the most recently logged image
+	order  *list.List
+	images map[uuid.UUID]*list.Element
+}
+
+type imageLogLines struct {
+	id    uuid.UUID
+	lines []string
+}
+
+// processLogs is filled by the writer CaptureImageLogs returns
+var processLogs = newImageLogs(1000, 200)
+
+func newImageLogs(maxImages, maxLines int) *imageLogs {
+	return &imageLogs{
+		maxImages: maxImages,
+		maxLines:  maxLines,
+		order:     list.New(),
+		images:    map[uuid.UUID]*list.Element{},
+	}
+}
+
+// add records line for every image ID it mentions
+func (l *imageLogs) add(line string) {
+	matches := uuidPattern.FindAllString(line, -1)
+	if len(matches) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range matches {
+		id, err := uuid.Parse(m)
+		if err != nil {
+			continue
+		}
+		el, ok := l.images[id]
+		if !ok {
+			el = l.order.PushFront(&imageLogLines{id: id})
+			l.images[id] = el
+			if l.order.Len() > l.maxImages {
+				oldest := l.order.Back()
+				l.order.Remove(oldest)
+				delete(l.images, oldest.Value.(*imageLogLines).id)
+			}
+		} else {
+			l.order.MoveToFront(el)
+		}
+		entry := el.Value.(*imageLogLines)
+		if len(entry.lines) >= l.maxLines {
+			entry.lines = entry.lines[1:]
+		}
+		entry.lines = append(entry.lines, line)
+	}
+}
+
+// get returns a copy of the lines kept for an image
+func (l *imageLogs) get(id uuid.UUID) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.images[id]
+	if !ok {
+		return []string{}
+	}
+	return append([]string(nil), el.Value.(*imageLogLines).lines...)
+}
+
+// imageLogWriter passes log output through and keeps the lines mentioning
+// images
+type imageLogWriter struct {
+	w    io.Writer
+	logs *imageLogs
+}
+
+func (w imageLogWriter) Write(p []byte) (int, error) {
+	// The standard logger writes a whole line per call
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.logs.add(line)
+	}
+	return w.w.Write(p)
+}
+
+// CaptureImageLogs wraps the log output w so the lines mentioning an image
+// can be read back with GET /image/:id/logs, keeping up to maxLines lines
+// for each of the last maxImages images
+func CaptureImageLogs(w io.Writer, maxImages, maxLines int) io.Writer {
+	processLogs = newImageLogs(maxImages, maxLines)
+	return imageLogWriter{w: w, logs: processLogs}
+}
+
+// handleGetImageLogs returns the recent log lines mentioning an image, e.g.
+// why processing failed. Only lines logged by this instance since it started
+// are available.
+func (s *Server) handleGetImageLogs(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	if _, err := s.db.GetImage(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "lines": processLogs.get(id)})
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// ShardDir returns the directory holding an image's files of the given kind
+// ("original" or "processed"), sharded by the first two bytes of the ID,
+// e.g. original/ab/cd for ID abcd1234-...
+func ShardDir(root, kind string, id uuid.UUID) string {
+	s := id.String()
+	return filepath.Join(root, kind, s[0:2], s[2:4])
+}
+
+// MigrateLayout moves files stored in the flat original/ and processed/
+// directories into the sharded layout and updates the database paths.
+// With dryRun set it only logs what would be moved.
+func MigrateLayout(cfg *models.Config, db *storage.Storage, dryRun bool) (int, error) {
+	const op = "server.MigrateLayout"
+
+	moved := 0
+	for _, kind := range []string{"original", "processed"} {
+		dir := filepath.Join(cfg.StoragePath, kind)
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return moved, fmt.Errorf("%s: %v", op, err)
+		}
+
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			name := entry.Name()
+			// Files are named <id>.<ext> or <id>_<suffix>.<ext>
+			idStr, _, _ := strings.Cut(strings.TrimSuffix(name, filepath.Ext(name)), "_")
+			id, err := uuid.Parse(idStr)
+			if err != nil {
+				log.Printf("%s: skipping %s: not an image file", op, name)
+				continue
+			}
+
+			oldPath := filepath.Join(dir, name)
+			newPath := filepath.Join(ShardDir(cfg.StoragePath, kind, id), name)
+			if dryRun {
+				log.Printf("%s: would move %s to %s", op, oldPath, newPath)
+				moved++
+				continue
+			}
+
+			if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+				return moved, fmt.Errorf("%s: %v", op, err)
+			}
+			if err := os.Rename(oldPath, newPath); err != nil {
+				return moved, fmt.Errorf("%s: %v", op, err)
+			}
+			if err := db.RelocateFile(id, oldPath, newPath); err != nil {
+				// Put the file back so the database keeps pointing at it
+				if rerr := os.Rename(newPath, oldPath); rerr != nil {
+					log.Printf("%s: failed to move %s back: %v", op, newPath, rerr)
+				}
+				return moved, fmt.Errorf("%s: %v", op, err)
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errVariantPending = errors.New("variant is still being generated")
+
+// generateVariant renders a missing thumbnail or watermarked variant on the
+// first request for it and returns its path. Concurrent requests share one
+// generation; when it outlasts lazy_variant_timeout the caller gets
+// errVariantPending and the generation finishes in the background.
+func (s *Server) generateVariant(img *models.Image, variant string) (string, error) {
+	ch := s.variantFlight.DoChan(variant+":"+img.ID.String(), func() (any, error) {
+		return s.renderVariant(img, variant)
+	})
+
+	timer := time.NewTimer(s.cfg.LazyVariantTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return "", res.Err
+		}
+		return res.Val.(string), nil
+	case <-timer.C:
+		return "", errVariantPending
+	}
+}
+
+func (s *Server) renderVariant(img *models.Image, variant string) (string, error) {
+	const op = "server.renderVariant"
+
+	if err := s.limiter.Acquire(context.Background()); err != nil {
+		return "", err
+	}
+	defer s.limiter.Release()
+
+	processor := newProcessorFor(s.cfg, s.db, img)
+
+	// An engine reads the original itself, the watermark always needs it decoded
+	var src image.Image
+	if processor.engine == nil || variant == "watermarked" {
+		release, err := s.limiter.AcquireMemory(context.Background(), img.OriginalPath)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+
+		if src, err = s.decoder.Open(img.OriginalPath); err != nil {
+			return "", fmt.Errorf("%s: %v", op, err)
+		}
+	}
+
+	log.Printf("%s: generating %s of image %s on first request", op, variant, img.ID.String())
+	switch variant {
+	case "thumbnail":
+		if err := processor.ThumbnailHandler(img, src); err != nil {
+			return "", err
+		}
+		return img.ThumbnailPath, nil
+	case "watermarked":
+		if err := processor.WatermarkHandler(img, src); err != nil {
+			return "", err
+		}
+		return img.WatermarkedPath, nil
+	}
+	return "", fmt.Errorf("%s: unknown variant %q", op, variant)
+}
+
+// serveLazyVariant serves a variant generated just now, or tells the client
+// to come back when it takes longer than the time budget
+func (s *Server) serveLazyVariant(c *gin.Context, img *models.Image, variant string) {
+	const op = "server.serveLazyVariant"
+
+	path, err := s.generateVariant(img, variant)
+	switch {
+	case errors.Is(err, errVariantPending):
+		c.Header("Retry-After", strconv.Itoa(max(1, int(s.cfg.LazyVariantTimeout.Seconds()))))
+		c.JSON(http.StatusAccepted, gin.H{
+			"id":      img.ID.String(),
+			"status":  "processing",
+			"message": "The " + variant + " is being generated, retry shortly",
+		})
+	case errors.Is(err, ErrImageTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case err != nil:
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate " + variant})
+	default:
+		s.serveImageFile(c, img, path, "inline")
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"sync/atomic"
+
+	"WB_L3_4/internal/metrics"
+	"WB_L3_4/internal/models"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/sync/semaphore"
+)
+
+// Limiter bounds how many images are decoded and processed at the same time
+// across the HTTP endpoints and the Kafka worker, so bursts queue up instead
+// of decoding dozens of large images at once. It also keeps the memory held
+// by decoded images under a budget.
+type Limiter struct {
+	slots     chan struct{}
+	memory    *semaphore.Weighted
+	budget    int64
+	maxPixels int64
+	// Decode images above maxPixels and scale them down to it instead of
+	// rejecting them, as long as decoding them fits in the budget
+	downsample bool
+	// Shrinks oversized images while decoding them when set, so only the
+	// downsampled pixels are ever held
+	engine engine
+	// Frees memory held beyond a single operation, i.e. the decode cache,
+	// before a reservation has to wait
+	reclaim atomic.Pointer[func()]
+}
+
+func NewLimiter(cfg *models.Config) *Limiter {
+	budget := int64(cfg.DecodeMemoryBudgetMB) << 20
+	// The engine is validated at startup with CheckEngine
+	eng, _ := newEngine(cfg)
+	return &Limiter{
+		slots:      make(chan struct{}, cfg.MaxConcurrentDecodes),
+		memory:     semaphore.NewWeighted(budget),
+		budget:     budget,
+		maxPixels:  int64(cfg.MaxMegapixels) * 1000 * 1000,
+		downsample: cfg.DownsampleOversized,
+		engine:     eng,
+	}
+}
+
+// ErrImageTooLarge is returned for images above the configured megapixel limit
+var ErrImageTooLarge = errors.New("image exceeds the maximum resolution")
+
+// AcquireMemory reads the image header at path and blocks until the memory
+// needed to decode it is available in the budget, so the pixels are never
+// decoded before there is room for them. The returned func releases the
+// reservation once the decoded image is no longer used.
+func (l *Limiter) AcquireMemory(ctx context.Context, path string) (func(), error) {
+	cfg, err := decodeStoredConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decoded images are converted to NRGBA, 4 bytes per pixel
+	pixels := int64(cfg.Width) * int64(cfg.Height)
+	size := pixels * 4
+	if width, height, ok := l.downsampledSize(cfg.Width, cfg.Height); ok {
+		switch {
+		case !l.downsample:
+			return nil, fmt.Errorf("%w: %dx%d", ErrImageTooLarge, cfg.Width, cfg.Height)
+		case l.engine != nil:
+			// Shrunk while decoding, the full size is never held
+			size = int64(width) * int64(height) * 4
+		case size > l.budget:
+			// The pure-Go decoders need the full image decoded first, so
+			// it is only downsampled when that fits in the budget
+			return nil, fmt.Errorf("%w: %dx%d", ErrImageTooLarge, cfg.Width, cfg.Height)
+		}
+	}
+
+	// An image larger than the whole budget waits until it can run alone
+	if size > l.budget {
+		size = l.budget
+	}
+	if !l.memory.TryAcquire(size) {
+		if reclaim := l.reclaim.Load(); reclaim != nil {
+			(*reclaim)()
+		}
+		if err := l.memory.Acquire(ctx, size); err != nil {
+			return nil, err
+		}
+	}
+	metrics.DecodeMemoryReserved.Add(float64(size))
+
+	return func() {
+		l.memory.Release(size)
+		metrics.DecodeMemoryReserved.Sub(float64(size))
+	}, nil
+}
+
+// TryHold takes size bytes of the budget if they are free right now, for
+// decoded images kept after the operation that reserved them is done
+func (l *Limiter) TryHold(size int64) bool {
+	if size > l.budget || !l.memory.TryAcquire(size) {
+		return false
+	}
+	metrics.DecodeMemoryReserved.Add(float64(size))
+	return true
+}
+
+// Unhold returns memory taken with TryHold
+func (l *Limiter) Unhold(size int64) {
+	l.memory.Release(size)
+	metrics.DecodeMemoryReserved.Sub(float64(size))
+}
+
+// OnPressure sets the func AcquireMemory calls to free held memory before it
+// waits for the budget
+func (l *Limiter) OnPressure(reclaim func()) {
+	l.reclaim.Store(&reclaim)
+}
+
+// downsampledSize returns the size an image above the megapixel limit is
+// scaled down to, and false for images within it
+func (l *Limiter) downsampledSize(width, height int) (int, int, bool) {
+	pixels := int64(width) * int64(height)
+	if l.maxPixels <= 0 || pixels <= l.maxPixels {
+		return width, height, false
+	}
+	scale := math.Sqrt(float64(l.maxPixels) / float64(pixels))
+	return max(1, int(float64(width)*scale)), max(1, int(float64(height)*scale)), true
+}
+
+// Decode decodes the image at path, scaling it down to the megapixel limit
+// when it is above it and downsampling is enabled. With an engine the image
+// is shrunk on load, e.g. in the DCT for JPEG; otherwise it is decoded at
+// full size first. Memory for it must have been reserved with AcquireMemory.
+func (l *Limiter) Decode(path string) (image.Image, error) {
+	if l.downsample && l.engine != nil {
+		if cfg, err := decodeStoredConfig(path); err == nil {
+			if width, height, ok := l.downsampledSize(cfg.Width, cfg.Height); ok {
+				log.Printf("Limiter.Decode: shrinking %s on load from %dx%d to %dx%d", path, cfg.Width, cfg.Height, width, height)
+				metrics.DecodeDownsampledTotal.Inc()
+				return l.engine.Shrink(path, width, height)
+			}
+		}
+	}
+
+	img, err := decodeStored(path)
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	width, height, ok := l.downsampledSize(b.Dx(), b.Dy())
+	if !l.downsample || !ok {
+		return img, nil
+	}
+	log.Printf("Limiter.Decode: downsampling %s from %dx%d to %dx%d", path, b.Dx(), b.Dy(), width, height)
+	metrics.DecodeDownsampledTotal.Inc()
+	// Box is fast and alias-free for large reductions
+	return imaging.Resize(img, width, height, imaging.Box), nil
+}
+
+// Acquire blocks until a processing slot is free or ctx is done
+func (l *Limiter) Acquire(ctx context.Context) error {
+	metrics.ProcessingWaiting.Inc()
+	defer metrics.ProcessingWaiting.Dec()
+
+	select {
+	case l.slots <- struct{}{}:
+		metrics.ProcessingInFlight.Inc()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TryAcquire takes a processing slot only if one is free right now
+func (l *Limiter) TryAcquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		metrics.ProcessingInFlight.Inc()
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Limiter) Release() {
+	<-l.slots
+	metrics.ProcessingInFlight.Dec()
+}
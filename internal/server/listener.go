@@ -0,0 +1,40 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long Stop waits for in-flight requests
+const shutdownTimeout = 15 * time.Second
+
+// listen opens the listener for server_addr, either a TCP address like
+// ":8080" or a unix socket like "unix:///var/run/imaging.sock"
+func (s *Server) listen() (net.Listener, error) {
+	const op = "server.listen"
+
+	path, ok := strings.CutPrefix(s.cfg.ServerAddr, "unix://")
+	if !ok {
+		return net.Listen("tcp", s.cfg.ServerAddr)
+	}
+
+	// A socket left behind by a crash would make Listen fail
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: failed to remove stale socket: %v", op, err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	// Validated by LoadConfig
+	mode, _ := strconv.ParseUint(s.cfg.SocketMode, 8, 32)
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return ln, nil
+}
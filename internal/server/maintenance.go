@@ -0,0 +1,259 @@
+package server
+
+import (
+	"context"
+	"hash/fnv"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maintenanceBatchSize = 100
+	// Files younger than this are never treated as orphans, their upload
+	// may not have reached the database yet
+	orphanGracePeriod = time.Hour
+	// How many past days the stats aggregation recomputes, covering events
+	// recorded late for the previous day
+	statsRecomputeDays = 2
+)
+
+// maintenanceJob runs every interval on one replica at a time
+type maintenanceJob struct {
+	name  string
+	every time.Duration
+	run   func(ctx context.Context) error
+}
+
+func (s *Server) maintenanceJobs() []maintenanceJob {
+	m := s.cfg.Maintenance
+	return []maintenanceJob{
+		{"expire_images", m.ExpireImages, s.expireImages},
+		{"reconcile_orphans", m.ReconcileOrphans, s.reconcileOrphans},
+		{"requeue_stuck", m.RequeueStuck, s.requeueStuck},
+		{"aggregate_stats", m.AggregateStats, s.aggregateStats},
+		{"prune_proxy_cache", m.PruneProxyCache, s.pruneProxyCache},
+	}
+}
+
+// RunMaintenance starts every enabled maintenance job on its schedule and
+// blocks until ctx is canceled
+func (s *Server) RunMaintenance(ctx context.Context) {
+	for _, job := range s.maintenanceJobs() {
+		if job.every <= 0 {
+			continue
+		}
+		go s.runJob(ctx, job)
+	}
+	<-ctx.Done()
+}
+
+func (s *Server) runJob(ctx context.Context, job maintenanceJob) {
+	const op = "server.runJob"
+
+	// Advisory lock key derived from the job name, shared by all replicas
+	h := fnv.New64a()
+	h.Write([]byte("maintenance:" + job.name))
+	key := int64(h.Sum64())
+
+	ticker := time.NewTicker(job.every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		release, ok, err := s.db.TryLock(ctx, key)
+		if err != nil {
+			log.Printf("%s: %s: %v", op, job.name, err)
+			continue
+		}
+		if !ok {
+			continue // running on another replica
+		}
+
+		started := time.Now()
+		err = job.run(ctx)
+		release()
+
+		result := "ok"
+		if err != nil {
+			result = "error"
+			log.Printf("%s: %s failed after %s: %v", op, job.name, time.Since(started), err)
+		}
+		metrics.MaintenanceRunsTotal.WithLabelValues(job.name, result).Inc()
+	}
+}
+
+// expireImages deletes images older than the configured TTL, then the files
+// the retention policies no longer keep
+func (s *Server) expireImages(ctx context.Context) error {
+	if s.cfg.Maintenance.ImageTTL <= 0 {
+		return s.enforceRetention(ctx)
+	}
+
+	cutoff := time.Now().Add(-s.cfg.Maintenance.ImageTTL)
+	deleted := 0
+	for ctx.Err() == nil {
+		ids, err := s.db.ListExpiredImageIDs(cutoff, maintenanceBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		for _, id := range ids {
+			img, err := s.db.GetImage(id)
+			if err != nil {
+				return err
+			}
+			if err := s.removeImage(img); err != nil {
+				return err
+			}
+			s.auditSystem("expire", id, map[string]any{"created_at": img.CreatedAt})
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		log.Printf("server.expireImages: deleted %d images created before %s", deleted, cutoff.Format(time.RFC3339))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.enforceRetention(ctx)
+}
+
+// reconcileOrphans removes stored files that belong to no image, and
+// temp files left behind by interrupted writes
+func (s *Server) reconcileOrphans(ctx context.Context) error {
+	const op = "server.reconcileOrphans"
+
+	cutoff := time.Now().Add(-orphanGracePeriod)
+	candidates := map[uuid.UUID][]string{}
+	removed := 0
+
+	flush := func() error {
+		if len(candidates) == 0 {
+			return nil
+		}
+		ids := make([]uuid.UUID, 0, len(candidates))
+		for id := range candidates {
+			ids = append(ids, id)
+		}
+		existing, err := s.db.ExistingImageIDs(ids)
+		if err != nil {
+			return err
+		}
+		for id, paths := range candidates {
+			if existing[id] {
+				continue
+			}
+			for _, path := range paths {
+				if err := os.Remove(path); err == nil {
+					removed++
+				}
+			}
+			removeReplicas(s.cfg, paths...)
+		}
+		candidates = map[uuid.UUID][]string{}
+		return nil
+	}
+
+	for _, kind := range []string{"original", "processed"} {
+		root := filepath.Join(s.cfg.StoragePath, kind)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				return nil
+			}
+
+			name := d.Name()
+			if strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp-") {
+				if err := os.Remove(path); err == nil {
+					removed++
+				}
+				return nil
+			}
+			idStr, _, _ := strings.Cut(strings.TrimSuffix(name, filepath.Ext(name)), "_")
+			id, err := uuid.Parse(idStr)
+			if err != nil {
+				return nil
+			}
+			candidates[id] = append(candidates[id], path)
+			if len(candidates) >= maintenanceBatchSize {
+				return flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if removed > 0 {
+		log.Printf("%s: removed %d orphaned files", op, removed)
+	}
+	return nil
+}
+
+// requeueStuck re-enqueues images whose processing made no progress for
+// longer than the configured limit, e.g. after a worker crashed mid-image
+func (s *Server) requeueStuck(ctx context.Context) error {
+	const op = "server.requeueStuck"
+
+	if s.readiness.State() != stateReady {
+		return nil
+	}
+
+	ids, err := s.db.ListStuckImageIDs(time.Now().Add(-s.cfg.Maintenance.StuckAfter), maintenanceBatchSize)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := s.db.ResetForReprocessing([]uuid.UUID{id}); err != nil {
+			return err
+		}
+		if err := s.enqueueOrStore(ctx, id, "requeue stuck"); err != nil {
+			return err
+		}
+		recordEvent(s.db, id, "queued", "", "requeued after processing stalled")
+	}
+	if len(ids) > 0 {
+		log.Printf("%s: requeued %d stuck images", op, len(ids))
+	}
+	return nil
+}
+
+// aggregateStats refreshes the hourly and daily stats rollups of the last
+// few days
+func (s *Server) aggregateStats(ctx context.Context) error {
+	from := time.Now().AddDate(0, 0, -statsRecomputeDays)
+	if err := s.db.AggregateStats("hour", from); err != nil {
+		return err
+	}
+	return s.db.AggregateStats("day", from)
+}
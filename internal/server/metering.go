@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+	"WB_L3_4/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/segmentio/kafka-go"
+)
+
+// Types of metering events
+const (
+	meterUpload     = "upload"     // bytes of a stored original
+	meterProcessing = "processing" // one operation run on an image
+	meterBandwidth  = "bandwidth"  // bytes of a stored file served
+)
+
+// MeteringEvent is a unit of billable consumption, published as JSON keyed
+// by tenant. Billing deduplicates by ID.
+type MeteringEvent struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Tenant    string `json:"tenant"`
+	Owner     string `json:"owner,omitempty"`
+	ImageID   string `json:"image_id,omitempty"`
+	Operation string `json:"operation,omitempty"`
+	// "done" or "error" for processing
+	Status     string    `json:"status,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	DurationMS int64     `json:"duration_ms,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// Meter publishes metering events to their own Kafka topic in the
+// background. Recording never blocks: with the buffer full, events are
+// dropped and counted in metering_events_total.
+type Meter struct {
+	writer   *kafka.Writer
+	interval time.Duration
+	events   chan MeteringEvent
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// processMeter is the meter of this process, nil while metering is off
+var processMeter *Meter
+
+// StartMetering starts publishing metering events when metering.topic is
+// set. The returned meter, nil otherwise, is flushed by Close on shutdown.
+func StartMetering(cfg *models.Config) *Meter {
+	if cfg.Metering.Topic == "" {
+		return nil
+	}
+	m := &Meter{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.KafkaBroker),
+			Topic:        cfg.Metering.Topic,
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: 10 * time.Millisecond,
+		},
+		interval: cfg.Metering.FlushInterval,
+		events:   make(chan MeteringEvent, cfg.Metering.BufferSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go m.run()
+	processMeter = m
+	return m
+}
+
+// record queues an event, filling in its ID and time
+func (m *Meter) record(e MeteringEvent) {
+	if m == nil {
+		return
+	}
+	e.ID = uuid.NewString()
+	e.Time = time.Now().UTC()
+	select {
+	case m.events <- e:
+	default:
+		metrics.MeteringEventsTotal.WithLabelValues(e.Type, "dropped").Inc()
+	}
+}
+
+// meterBatchSize caps the events published in one write
+const meterBatchSize = 500
+
+// run publishes the queued events in batches until the meter is closed,
+// then the ones still queued
+func (m *Meter) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	var batch []MeteringEvent
+	for {
+		select {
+		case e := <-m.events:
+			if batch = append(batch, e); len(batch) >= meterBatchSize {
+				m.publish(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			m.publish(batch)
+			batch = nil
+		case <-m.stop:
+			for {
+				select {
+				case e := <-m.events:
+					if batch = append(batch, e); len(batch) >= meterBatchSize {
+						m.publish(batch)
+						batch = nil
+					}
+				default:
+					m.publish(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (m *Meter) publish(batch []MeteringEvent) {
+	const op = "server.Meter.publish"
+
+	if len(batch) == 0 {
+		return
+	}
+	msgs := make([]kafka.Message, 0, len(batch))
+	for _, e := range batch {
+		value, _ := json.Marshal(e)
+		msgs = append(msgs, kafka.Message{Key: []byte(e.Tenant), Value: value})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := "published"
+	if err := m.writer.WriteMessages(ctx, msgs...); err != nil {
+		log.Printf("%s: dropped %d events: %v", op, len(batch), err)
+		result = "failed"
+	}
+	for _, e := range batch {
+		metrics.MeteringEventsTotal.WithLabelValues(e.Type, result).Inc()
+	}
+}
+
+// Close publishes the events still queued and closes the writer. Events
+// recorded afterwards are dropped.
+func (m *Meter) Close() {
+	if m == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+	m.writer.Close()
+}
+
+// meterImage records an event about an image, attributed to its tenant and
+// owner
+func meterImage(img *models.Image, e MeteringEvent) {
+	e.Tenant = img.Tenant
+	e.Owner = img.Owner
+	e.ImageID = img.ID.String()
+	processMeter.record(e)
+}
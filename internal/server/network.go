@@ -0,0 +1,32 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// allowNetworks rejects requests from client addresses outside cidrs. The
+// list is validated by LoadConfig; an empty one lets everything through.
+func (s *Server) allowNetworks(cidrs []string) gin.HandlerFunc {
+	prefixes, _ := models.ParsePrefixes(cidrs)
+	return func(c *gin.Context) {
+		if len(prefixes) == 0 {
+			c.Next()
+			return
+		}
+
+		addr, err := netip.ParseAddr(c.ClientIP())
+		if err == nil && slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(addr.Unmap()) }) {
+			c.Next()
+			return
+		}
+		log.Printf("server.allowNetworks: rejected %s %s from %s", c.Request.Method, c.FullPath(), c.ClientIP())
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access from this network is not allowed"})
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+)
+
+// notifyFinished tells the uploader that processing of an image ended, via
+// its callback webhook and notification email if any
+func notifyFinished(cfg *models.Config, db *storage.Storage, img *models.Image) {
+	queueWebhook(db, img)
+	if img.NotifyEmail != "" && cfg.Email.SMTPHost != "" {
+		go sendFinishedEmail(cfg, *img)
+	}
+}
+
+// sendFinishedEmail emails the outcome with links to the produced variants
+func sendFinishedEmail(cfg *models.Config, img models.Image) {
+	const op = "server.sendFinishedEmail"
+
+	name := img.OriginalFilename
+	if name == "" {
+		name = img.ID.String()
+	}
+	subject := fmt.Sprintf("Image %s processed", name)
+	if img.Status == "error" {
+		subject = fmt.Sprintf("Processing of image %s failed", name)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Image: %s\r\nStatus: %s\r\n\r\n", img.ID.String(), img.Status)
+	base := imageURL(cfg.PublicURL, img.ID.String())
+	variants := []struct{ name, status, path string }{
+		{"resized", img.ResizeStatus, img.ProcessedPath},
+		{"thumbnail", img.ThumbnailStatus, img.ThumbnailPath},
+		{"watermarked", img.WatermarkStatus, img.WatermarkedPath},
+	}
+	for _, v := range variants {
+		if v.status == "done" && v.path != "" {
+			fmt.Fprintf(&body, "%s: %s/download?variant=%s\r\n", v.name, base, v.name)
+		} else {
+			fmt.Fprintf(&body, "%s: %s\r\n", v.name, v.status)
+		}
+	}
+	fmt.Fprintf(&body, "original: %s/download?variant=original\r\n", base)
+	fmt.Fprintf(&body, "details: %s/info\r\n", base)
+
+	msg := "From: " + cfg.Email.From + "\r\n" +
+		"To: " + img.NotifyEmail + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body.String()
+
+	var auth smtp.Auth
+	if cfg.Email.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Email.Username, cfg.Email.Password, cfg.Email.SMTPHost)
+	}
+	addr := net.JoinHostPort(cfg.Email.SMTPHost, strconv.Itoa(cfg.Email.SMTPPort))
+	if err := smtp.SendMail(addr, auth, cfg.Email.From, []string{img.NotifyEmail}, []byte(msg)); err != nil {
+		log.Printf("%s: image %s: %v", op, img.ID.String(), err)
+		return
+	}
+	log.Printf("%s: notified %s about image %s", op, img.NotifyEmail, img.ID.String())
+}
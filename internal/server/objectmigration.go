@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// ObjectMigrationResult summarizes moving files into the object store
+type ObjectMigrationResult struct {
+	Images int `json:"images"`
+	// Moved into the object store
+	Files int `json:"files"`
+	// Missing, not matching their checksum or failing to upload; left in
+	// place for the next run
+	Skipped int `json:"skipped"`
+}
+
+// MigrateToObjectStore moves the files of every image from the storage path
+// into the object store, batch images at a time. Each file is uploaded as
+// it is stored, still encrypted when it is sealed, after its content is
+// checked against the recorded checksum, and the uploaded copy is read back
+// and compared. The paths of a batch are then rewritten in one transaction
+// and only after that are the local copies removed.
+//
+// Files already in the object store are skipped, so an interrupted run is
+// resumed by running it again. Processing must be paused, files rewritten
+// while they are moved would be lost.
+//
+// Only the files an image's row points to are moved. Derived files found by
+// their local path instead, like preset renders, aren't: they stay under
+// the storage path.
+func MigrateToObjectStore(ctx context.Context, cfg *models.Config, db *storage.Storage, batch int) (*ObjectMigrationResult, error) {
+	const op = "server.MigrateToObjectStore"
+
+	result := &ObjectMigrationResult{}
+	if processObjects == nil {
+		return result, fmt.Errorf("%s: object_store.endpoint is not set", op)
+	}
+	pause, err := db.GetProcessingPause()
+	if err != nil {
+		return result, fmt.Errorf("%s: %v", op, err)
+	}
+	if pause == nil {
+		return result, fmt.Errorf("%s: pause processing first with POST /admin/processing/pause", op)
+	}
+
+	after := uuid.Nil
+	for ctx.Err() == nil {
+		images, err := db.ListImagesChangedSince(time.Time{}, after, batch)
+		if err != nil {
+			return result, fmt.Errorf("%s: %v", op, err)
+		}
+		if len(images) == 0 {
+			break
+		}
+		after = images[len(images)-1].ID
+
+		var moves []storage.FileMove
+		for _, img := range images {
+			sums, err := db.ListImageChecksums(img.ID)
+			if err != nil {
+				return result, fmt.Errorf("%s: %v", op, err)
+			}
+			recorded := map[string]string{}
+			for _, sum := range sums {
+				recorded[sum.Path] = sum.SHA256
+			}
+
+			seen := map[string]bool{}
+			for _, path := range []string{img.OriginalPath, img.ProcessedPath, img.ThumbnailPath, img.WatermarkedPath, img.VideoPath, img.UpscaledPath} {
+				if path == "" || isObjectPath(path) || seen[path] {
+					continue
+				}
+				seen[path] = true
+				dst, err := migrateFile(cfg, path, recorded[path])
+				if err != nil {
+					log.Printf("%s: leaving %s of image %s in place: %v", op, path, img.ID.String(), err)
+					result.Skipped++
+					continue
+				}
+				moves = append(moves, storage.FileMove{ImageID: img.ID, OldPath: path, NewPath: dst})
+			}
+			result.Images++
+		}
+
+		if err := db.RelocateFiles(moves); err != nil {
+			return result, fmt.Errorf("%s: %v", op, err)
+		}
+		// Nothing refers to the local copies any more
+		for _, m := range moves {
+			if err := os.Remove(m.OldPath); err != nil {
+				log.Printf("%s: failed to remove %s: %v", op, m.OldPath, err)
+			}
+		}
+		result.Files += len(moves)
+		log.Printf("%s: %d images checked, %d files moved, %d skipped", op, result.Images, result.Files, result.Skipped)
+	}
+	return result, ctx.Err()
+}
+
+// migrateFile uploads a local stored file to the object store and returns
+// its path there. want is the recorded checksum of its content, if any.
+func migrateFile(cfg *models.Config, path, want string) (string, error) {
+	rel, err := StoredRel(cfg, path)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("outside the storage path")
+	}
+	if want != "" {
+		sum, _, err := ContentChecksum(path)
+		if err != nil {
+			return "", err
+		}
+		if sum != want {
+			return "", errChecksumMismatch
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	local, err := rawChecksum(f)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	dst := processObjects.Path(filepath.ToSlash(rel))
+	if err := processObjects.Put(dst, f); err != nil {
+		return "", err
+	}
+
+	obj, err := processObjects.Open(dst)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+	uploaded, err := rawChecksum(obj)
+	if err != nil {
+		return "", err
+	}
+	if uploaded != local {
+		processObjects.Remove(dst)
+		return "", fmt.Errorf("uploaded copy: %w", errChecksumMismatch)
+	}
+	return dst, nil
+}
+
+// rawChecksum returns the SHA-256 of a file as it is stored
+func rawChecksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/objectstore"
+)
+
+// processObjects is the object store of this process, nil while none is
+// configured
+var processObjects *objectstore.Client
+
+// SetupObjectStore connects to the bucket of object_store, which files moved
+// out of the storage path with -migrate-objects are read from
+func SetupObjectStore(cfg *models.Config) error {
+	const op = "server.SetupObjectStore"
+
+	if cfg.ObjectStore.Endpoint == "" {
+		return nil
+	}
+	client, err := objectstore.New(cfg.ObjectStore)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	processObjects = client
+	return nil
+}
+
+// StoredFile is a stored file open for reading, on disk or in the object
+// store
+type StoredFile interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Stat() (fs.FileInfo, error)
+	Name() string
+}
+
+// isObjectPath reports whether path is of a file in the object store
+func isObjectPath(path string) bool {
+	return strings.HasPrefix(path, objectstore.Scheme)
+}
+
+func objectClient(path string) (*objectstore.Client, error) {
+	if processObjects == nil {
+		return nil, fmt.Errorf("%s: object_store isn't configured", path)
+	}
+	return processObjects, nil
+}
+
+// OpenStoredFile opens a stored file as it is stored, still encrypted when
+// it is sealed; openStored reads its content
+func OpenStoredFile(path string) (StoredFile, error) {
+	if !isObjectPath(path) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	client, err := objectClient(path)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := client.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// statStored is os.Stat for stored files
+func statStored(path string) (fs.FileInfo, error) {
+	if !isObjectPath(path) {
+		return os.Stat(path)
+	}
+	client, err := objectClient(path)
+	if err != nil {
+		return nil, err
+	}
+	return client.Stat(path)
+}
+
+// removeStored is os.Remove for stored files
+func removeStored(path string) error {
+	if !isObjectPath(path) {
+		return os.Remove(path)
+	}
+	client, err := objectClient(path)
+	if err != nil {
+		return err
+	}
+	return client.Remove(path)
+}
+
+// StoredRel returns the path of a stored file relative to the storage path,
+// which files in the object store keep as their key
+func StoredRel(cfg *models.Config, path string) (string, error) {
+	if !isObjectPath(path) {
+		return filepath.Rel(cfg.StoragePath, path)
+	}
+	client, err := objectClient(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := client.Rel(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.FromSlash(rel), nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+)
+
+// maxOCRTextLength caps the indexed text of documents full of it
+const maxOCRTextLength = 64 << 10
+
+// recognizeText returns the text tesseract finds in the image at path
+func recognizeText(cfg *models.Config, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.OCR.Timeout)
+	defer cancel()
+
+	path, cleanup, err := plainCopy(path)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	cmd := exec.CommandContext(ctx, cfg.OCR.TesseractPath, path, "stdout", "-l", cfg.OCR.Languages)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("tesseract failed: %v: %s", err, stderr.String())
+	}
+
+	text := strings.Join(strings.Fields(string(out)), " ")
+	if len(text) > maxOCRTextLength {
+		text = text[:maxOCRTextLength]
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+	return text, nil
+}
+
+// recordOCRText stores the text recognized in an image's original. Failures
+// are only logged, the image is just found by its metadata alone.
+func recordOCRText(cfg *models.Config, db *storage.Storage, img *models.Image) {
+	const op = "server.recordOCRText"
+
+	text, err := recognizeText(cfg, img.OriginalPath)
+	if err == nil {
+		img.OCRText = text
+		err = db.SaveOCRText(img.ID, text)
+	}
+	if err != nil {
+		log.Printf("%s: failed to recognize text of image %s: %v", op, img.ID.String(), err)
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"WB_L3_4/internal/auth"
+	"WB_L3_4/internal/models"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+)
+
+// oidcCookie carries the state, nonce and PKCE verifier of a login in
+// progress from /auth/login to /auth/callback
+const oidcCookie = "oidc_login"
+
+// oidcLoginTimeout bounds how long a user may take at the provider
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidcLogin talks to the configured OpenID Connect provider. Discovery
+// happens on first use and is retried until it succeeds, so a provider
+// that is down at startup doesn't keep the server from starting.
+type oidcLogin struct {
+	cfg models.OIDCConfig
+
+	mu       sync.Mutex
+	verifier *oidc.IDTokenVerifier
+	oauth    *oauth2.Config
+}
+
+func newOIDCLogin(cfg models.OIDCConfig) *oidcLogin {
+	return &oidcLogin{cfg: cfg}
+}
+
+// providerContext makes the OIDC library use a client with a timeout for
+// discovery, key fetches and code exchanges
+func providerContext(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, &http.Client{Timeout: 10 * time.Second})
+}
+
+// provider returns the ID token verifier and OAuth2 config, discovering the
+// provider if that hasn't succeeded yet
+func (o *oidcLogin) provider() (*oidc.IDTokenVerifier, *oauth2.Config, error) {
+	const op = "server.oidcLogin.provider"
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.verifier != nil {
+		return o.verifier, o.oauth, nil
+	}
+
+	// The provider keeps the context for fetching signing keys later
+	p, err := oidc.NewProvider(providerContext(context.Background()), o.cfg.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", op, err)
+	}
+	o.verifier = p.Verifier(&oidc.Config{ClientID: o.cfg.ClientID})
+	o.oauth = &oauth2.Config{
+		ClientID:     o.cfg.ClientID,
+		ClientSecret: o.cfg.ClientSecret,
+		RedirectURL:  o.cfg.RedirectURL,
+		Endpoint:     p.Endpoint(),
+		Scopes:       o.cfg.Scopes,
+	}
+	return o.verifier, o.oauth, nil
+}
+
+// identity is what the service takes from a verified ID token
+type identity struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// name is how the user shows up in audit entries
+func (id identity) name() string {
+	if id.Email != "" && id.EmailVerified {
+		return id.Email
+	}
+	return id.Subject
+}
+
+// verify checks an ID token and returns the user it identifies and when
+// the token expires
+func (o *oidcLogin) verify(ctx context.Context, rawToken string) (*identity, time.Time, error) {
+	const op = "server.oidcLogin.verify"
+
+	verifier, _, err := o.provider()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	token, err := verifier.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("%s: %v", op, err)
+	}
+	var id identity
+	if err := token.Claims(&id); err != nil {
+		return nil, time.Time{}, fmt.Errorf("%s: %v", op, err)
+	}
+	return &id, token.Expiry, nil
+}
+
+// claims are what an ID token used as a bearer token grants: the
+// configured token scopes over the user's own images
+func (o *oidcLogin) claims(id *identity, expiry time.Time) *auth.Claims {
+	return &auth.Claims{
+		Subject:   id.name(),
+		Scopes:    o.cfg.TokenScopes,
+		Owner:     id.Subject,
+		ExpiresAt: expiry.Unix(),
+	}
+}
+
+// loginState is stored in oidcCookie while the user is at the provider
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Redirect string `json:"redirect"`
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (s *Server) setLoginCookie(c *gin.Context, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    value,
+		Path:     "/auth/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil || isHTTPS(s.cfg.PublicURL),
+		// Lax so the cookie comes along on the provider's redirect back
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// handleLogin sends the user to the provider to sign in. ?redirect=<path>
+// is where the callback returns to, the web UI by default.
+func (s *Server) handleLogin(c *gin.Context) {
+	const op = "server.handleLogin"
+
+	if s.oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Login is not configured"})
+		return
+	}
+	redirect := c.DefaultQuery("redirect", "/")
+	if !localRedirect(redirect) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid redirect"})
+		return
+	}
+	_, oauth, err := s.oidc.provider()
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider is unavailable"})
+		return
+	}
+
+	state, err := randomString()
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+	nonce, err := randomString()
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+	ls := loginState{
+		State:    state,
+		Nonce:    nonce,
+		Verifier: oauth2.GenerateVerifier(),
+		Redirect: redirect,
+	}
+	payload, _ := json.Marshal(ls)
+	s.setLoginCookie(c, base64.RawURLEncoding.EncodeToString(payload), int(oidcLoginTimeout.Seconds()))
+
+	c.Redirect(http.StatusFound, oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(ls.Verifier)))
+}
+
+// handleLoginCallback completes a login: it exchanges the code for an ID
+// token, verifies it and issues an access token bound to the user as owner.
+// The token is handed to the page in the URL fragment, which never reaches
+// a server or a Referer header.
+func (s *Server) handleLoginCallback(c *gin.Context) {
+	const op = "server.handleLoginCallback"
+
+	if s.oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Login is not configured"})
+		return
+	}
+
+	var ls loginState
+	v, err := c.Cookie(oidcCookie)
+	if err == nil {
+		var payload []byte
+		if payload, err = base64.RawURLEncoding.DecodeString(v); err == nil {
+			err = json.Unmarshal(payload, &ls)
+		}
+	}
+	// The login cookie is single-use
+	s.setLoginCookie(c, "", -1)
+	if err != nil || ls.State == "" || c.Query("state") != ls.State {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Login expired or was started elsewhere"})
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed: " + e})
+		return
+	}
+	verifier, oauth, err := s.oidc.provider()
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider is unavailable"})
+		return
+	}
+
+	ctx := providerContext(c.Request.Context())
+	token, err := oauth.Exchange(ctx, c.Query("code"), oauth2.VerifierOption(ls.Verifier))
+	if err != nil {
+		log.Printf("%s: exchange: %v", op, err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed"})
+		return
+	}
+	rawID, ok := token.Extra("id_token").(string)
+	if !ok {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider returned no ID token"})
+		return
+	}
+	idToken, err := verifier.Verify(ctx, rawID)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed"})
+		return
+	}
+	if idToken.Nonce != ls.Nonce {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed"})
+		return
+	}
+	var id identity
+	if err := idToken.Claims(&id); err != nil || id.Subject == "" {
+		log.Printf("%s: claims: %v", op, err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed"})
+		return
+	}
+
+	access, claims, err := auth.Issue([]byte(s.cfg.Auth.TokenSecret), auth.Claims{
+		Subject: id.name(),
+		Scopes:  s.cfg.OIDC.TokenScopes,
+		Owner:   id.Subject,
+	}, s.cfg.OIDC.TokenTTL)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue token"})
+		return
+	}
+	c.Set(claimsKey, claims)
+	s.audit(c, "login", uuid.Nil, map[string]any{
+		"token_id": claims.ID,
+		"owner":    claims.Owner,
+		"issuer":   s.cfg.OIDC.Issuer,
+	})
+
+	c.Redirect(http.StatusFound, ls.Redirect+"#token="+access)
+}
+
+// verifyBearer verifies a token issued by this service or, with OIDC
+// configured, an ID token from the provider
+func (s *Server) verifyBearer(c *gin.Context, token string) (*auth.Claims, error) {
+	claims, err := auth.Verify([]byte(s.cfg.Auth.TokenSecret), token)
+	if err == nil || s.oidc == nil || !errors.Is(err, auth.ErrInvalidToken) {
+		return claims, err
+	}
+	id, expiry, oidcErr := s.oidc.verify(providerContext(c.Request.Context()), token)
+	if oidcErr != nil {
+		return nil, err
+	}
+	return s.oidc.claims(id, expiry), nil
+}
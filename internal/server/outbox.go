@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+
+	"github.com/google/uuid"
+)
+
+const (
+	outboxBatchSize = 100
+	// How long a claimed entry is hidden from other replicas
+	outboxLease = time.Minute
+)
+
+// storeForRelay keeps a processing message that couldn't be published in
+// the outbox, from where RunOutboxRelay publishes it once Kafka is back
+func (s *Server) storeForRelay(id uuid.UUID, reason string) error {
+	if err := s.db.AddOutboxEntry(id, reason); err != nil {
+		return err
+	}
+	metrics.OutboxEntriesTotal.WithLabelValues("stored").Inc()
+	return nil
+}
+
+// enqueueOrStore publishes the processing message of an image, falling back
+// to the outbox when Kafka is unavailable. An error means the message is lost.
+func (s *Server) enqueueOrStore(ctx context.Context, id uuid.UUID, reason string) error {
+	const op = "server.enqueueOrStore"
+
+	err := s.enqueue(ctx, id)
+	if err == nil {
+		return nil
+	}
+	log.Printf("%s: failed to publish image %s, storing it for the relay: %v", op, id.String(), err)
+	return s.storeForRelay(id, reason)
+}
+
+// RunOutboxRelay publishes outbox entries every outbox_relay_interval until
+// ctx is canceled. The relay also runs right away when Kafka recovers.
+func (s *Server) RunOutboxRelay(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.OutboxRelayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.drainOutbox()
+	}
+}
+
+// drainOutbox publishes due outbox entries until none are left or a publish
+// fails. Only one drain runs at a time per replica.
+func (s *Server) drainOutbox() {
+	const op = "server.drainOutbox"
+
+	if !s.outboxMu.TryLock() {
+		return
+	}
+	defer s.outboxMu.Unlock()
+
+	relayed := 0
+	defer func() {
+		if relayed > 0 {
+			log.Printf("%s: published %d messages", op, relayed)
+		}
+		if count, err := s.db.CountOutboxEntries(); err == nil {
+			metrics.OutboxSize.Set(float64(count))
+		}
+	}()
+
+	for {
+		entries, err := s.db.ClaimOutboxEntries(outboxBatchSize, outboxLease)
+		if err != nil {
+			log.Printf("%s: %v", op, err)
+			return
+		}
+		if len(entries) == 0 {
+			return
+		}
+
+		for i := range entries {
+			e := &entries[i]
+			if err := s.enqueue(context.Background(), e.ImageID); err != nil {
+				// Kafka is still down, back off this batch and stop. The
+				// claimed rest becomes due again when its lease runs out.
+				next := time.Now().Add(s.cfg.OutboxRelayInterval)
+				if err := s.db.FailOutboxEntry(e.ID, err.Error(), next); err != nil {
+					log.Printf("%s: %v", op, err)
+				}
+				return
+			}
+			if err := s.db.CompleteOutboxEntry(e); err != nil {
+				// Published anyway, a duplicate message is harmless
+				log.Printf("%s: %v", op, err)
+			}
+			metrics.OutboxEntriesTotal.WithLabelValues("relayed").Inc()
+			recordEvent(s.db, e.ImageID, "queued", "", "relayed from outbox: "+e.Reason)
+			relayed++
+		}
+	}
+}
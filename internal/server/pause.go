@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// pauseRefreshInterval is how often the pause is reread, so a pause set
+// through another replica takes effect within it
+const pauseRefreshInterval = 5 * time.Second
+
+// ProcessingGate holds the worker back while an admin paused processing.
+// The pause is stored in the database, so pausing through any replica pauses
+// them all. Uploads are still accepted meanwhile.
+type ProcessingGate struct {
+	db *storage.Storage
+
+	mu    sync.Mutex
+	pause *models.ProcessingPause
+	// Closed and replaced whenever processing resumes
+	resumed chan struct{}
+}
+
+// NewProcessingGate returns a gate in the state stored in the database
+func NewProcessingGate(db *storage.Storage) *ProcessingGate {
+	g := &ProcessingGate{db: db, resumed: make(chan struct{})}
+	g.refresh()
+	return g
+}
+
+// Run rereads the pause every pauseRefreshInterval until ctx is canceled
+func (g *ProcessingGate) Run(ctx context.Context) {
+	ticker := time.NewTicker(pauseRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		g.refresh()
+	}
+}
+
+// refresh loads the pause, keeping the last known state when the database
+// can't be reached
+func (g *ProcessingGate) refresh() {
+	pause, err := g.db.GetProcessingPause()
+	if err != nil {
+		log.Printf("ProcessingGate.refresh: %v", err)
+		return
+	}
+	g.set(pause)
+}
+
+func (g *ProcessingGate) set(pause *models.ProcessingPause) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	wasPaused := g.pause != nil
+	g.pause = pause
+	switch {
+	case !wasPaused && pause != nil:
+		log.Printf("ProcessingGate: processing paused by %s", pause.PausedBy)
+		metrics.ProcessingPaused.Set(1)
+	case wasPaused && pause == nil:
+		log.Printf("ProcessingGate: processing resumed")
+		metrics.ProcessingPaused.Set(0)
+		close(g.resumed)
+		g.resumed = make(chan struct{})
+	}
+}
+
+// Paused returns the pause in effect, or nil while processing runs
+func (g *ProcessingGate) Paused() *models.ProcessingPause {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.pause
+}
+
+// Wait blocks while processing is paused. It returns ctx's error when ctx is
+// canceled first.
+func (g *ProcessingGate) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	paused, resumed := g.pause != nil, g.resumed
+	g.mu.Unlock()
+	if !paused {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type pauseRequest struct {
+	Reason string `json:"reason"`
+}
+
+// handleProcessingStatus reports whether processing is paused
+func (s *Server) handleProcessingStatus(c *gin.Context) {
+	pause := s.gate.Paused()
+	c.JSON(http.StatusOK, gin.H{"paused": pause != nil, "pause": pause})
+}
+
+// handlePauseProcessing stops every worker from taking new messages, e.g.
+// for maintenance on the storage volume. Images already being processed
+// finish; new uploads are accepted and wait in the queue.
+func (s *Server) handlePauseProcessing(c *gin.Context) {
+	const op = "server.handlePauseProcessing"
+
+	var req pauseRequest
+	// The body is optional
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	pause, err := s.db.PauseProcessing(auditActor(claimsFrom(c), c.GetHeader(actorHeader)), req.Reason)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to pause processing"})
+		return
+	}
+	s.gate.set(pause)
+
+	s.audit(c, "pause_processing", uuid.Nil, map[string]any{"reason": req.Reason})
+	c.JSON(http.StatusOK, gin.H{"paused": true, "pause": pause})
+}
+
+// handleResumeProcessing lets the workers take messages again
+func (s *Server) handleResumeProcessing(c *gin.Context) {
+	const op = "server.handleResumeProcessing"
+
+	wasPaused, err := s.db.ResumeProcessing()
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resume processing"})
+		return
+	}
+	s.gate.set(nil)
+
+	if wasPaused {
+		s.audit(c, "resume_processing", uuid.Nil, nil)
+	}
+	c.JSON(http.StatusOK, gin.H{"paused": false})
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+
+	"WB_L3_4/internal/metrics"
+)
+
+// savePNG writes a size-optimized PNG: images with at most 256 colors are
+// stored as paletted, everything is encoded with best compression and,
+// if enabled, recompressed with zopflipng.
+func (p *ImageProcessor) savePNG(img image.Image, path string) error {
+	const op = "ImageProcessor.savePNG"
+
+	// Baseline size for the savings metric
+	baseline := &countingWriter{}
+	if err := png.Encode(baseline, img); err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+
+	if paletted := toPaletted(img); paletted != nil {
+		img = paletted
+	}
+
+	// Encode straight into the file instead of buffering the whole output
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	err := writeStored(path, func(w io.Writer) error {
+		return enc.Encode(w, img)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+
+	if p.cfg.PNGZopfli {
+		if err := p.zopfli(path); err != nil {
+			// The best-compression file is already in place, zopfli is a bonus
+			log.Printf("%s: %v", op, err)
+		}
+	}
+
+	if size, err := contentSize(path); err == nil && size < baseline.n {
+		metrics.PNGSavedBytesTotal.Add(float64(baseline.n - size))
+	}
+	metrics.PNGOptimizedTotal.Inc()
+	return nil
+}
+
+func (p *ImageProcessor) zopfli(path string) error {
+	srcPath, cleanup, err := plainCopy(path)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	tmpPath := path + ".zopfli"
+	cmd := exec.Command(p.cfg.ZopflipngPath, "-y", srcPath, tmpPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("zopflipng failed: %v: %s", err, out)
+	}
+	if err := replaceStored(path, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// toPaletted returns a lossless paletted copy of img, or nil if the image
+// uses more than 256 distinct colors.
+func toPaletted(img image.Image) *image.Paletted {
+	if _, ok := img.(*image.Paletted); ok {
+		return nil
+	}
+
+	bounds := img.Bounds()
+	index := make(map[color.NRGBA]struct{})
+	var palette color.Palette
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if _, ok := index[c]; ok {
+				continue
+			}
+			if len(palette) == 256 {
+				return nil
+			}
+			index[c] = struct{}{}
+			palette = append(palette, c)
+		}
+	}
+
+	paletted := image.NewPaletted(bounds, palette)
+	draw.Draw(paletted, bounds, img, bounds.Min, draw.Src)
+	return paletted
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
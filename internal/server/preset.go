@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// presetPath returns where the rendered preset variant of an image is stored
+func (p *ImageProcessor) presetPath(id uuid.UUID, name string, preset models.Preset) string {
+	return filepath.Join(ShardDir(p.cfg.StoragePath, "processed", id), fmt.Sprintf("%s_%s.%s", id.String(), name, preset.Format))
+}
+
+// presetResizeSpec returns the resize of a preset with both dimensions set
+func presetResizeSpec(preset models.Preset) resizeSpec {
+	spec := resizeSpec{
+		Width:      preset.Width,
+		Height:     preset.Height,
+		Mode:       preset.Mode,
+		Gravity:    preset.Gravity,
+		Background: white,
+		Filter:     preset.Filter,
+	}
+	switch spec.Mode {
+	case "":
+		spec.Mode = "fit"
+	case "crop":
+		spec.Mode = "fill"
+	}
+	if bg, err := models.ParseColor(preset.Background); err == nil && preset.Background != "" {
+		spec.Background = bg
+	}
+	return spec
+}
+
+// applyPreset scales src as the preset says, watermarks it if asked to,
+// frames it and cuts it to the preset's shape
+func (p *ImageProcessor) applyPreset(src image.Image, preset models.Preset) (image.Image, error) {
+	// Every mode but fit needs both dimensions, see Preset.Validate
+	var out image.Image
+	if preset.Width > 0 && preset.Height > 0 {
+		out = presetResizeSpec(preset).apply(src)
+	} else {
+		out = imaging.Resize(src, preset.Width, preset.Height, resampleFilter(preset.Filter))
+	}
+
+	if preset.Watermark {
+		var err error
+		if out, err = p.applyWatermark(out); err != nil {
+			return nil, err
+		}
+	}
+	if preset.BorderWidth > 0 {
+		border := color.NRGBA{A: 255}
+		if preset.BorderColor != "" {
+			border, _ = models.ParseColor(preset.BorderColor)
+		}
+		out = applyBorder(out, preset.BorderWidth, border, preset.BorderInset)
+	}
+	return applyShape(out, preset.Shape, preset.Radius), nil
+}
+
+// RenderPreset renders the named preset variant of an image and returns its path
+func (p *ImageProcessor) RenderPreset(img *models.Image, src image.Image, name string) (string, error) {
+	const op = "ImageProcessor.RenderPreset"
+
+	preset, ok := p.cfg.Presets[name]
+	if !ok {
+		return "", fmt.Errorf("%s: unknown preset %q", op, name)
+	}
+
+	log.Printf("%s: rendering preset %s for image %s", op, name, img.ID.String())
+
+	out, err := p.applyPreset(src, preset)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", op, err)
+	}
+
+	path := p.presetPath(img.ID, name, preset)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("%s: failed to create processed directory: %v", op, err)
+	}
+
+	presetProcessor := *p
+	presetProcessor.quality = preset.Quality
+	if err := presetProcessor.save(out, path); err != nil {
+		return "", fmt.Errorf("%s: %v", op, err)
+	}
+
+	recordChecksum(p.db, img.ID, "preset:"+name, path)
+
+	log.Printf("%s: successfully rendered preset %s for image %s to %s", op, name, img.ID.String(), path)
+	return path, nil
+}
+
+// handleRenderImage serves a preset variant, rendering it on first request.
+// The preset may be chosen by Client Hints, see renderPresetName.
+func (s *Server) handleRenderImage(c *gin.Context) {
+	const op = "server.handleRenderImage"
+
+	idStr := c.Param("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	name, ok := s.renderPresetName(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown preset"})
+		return
+	}
+	preset := s.cfg.Presets[name]
+
+	img, err := s.db.GetImage(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	processor := newProcessorFor(s.cfg, s.db, img)
+	path := processor.presetPath(img.ID, name, preset)
+	if !s.fileExists(path) {
+		if err := s.limiter.Acquire(c.Request.Context()); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Request canceled while waiting for processing"})
+			return
+		}
+		defer s.limiter.Release()
+
+		release, err := s.limiter.AcquireMemory(c.Request.Context(), img.OriginalPath)
+		if errors.Is(err, ErrImageTooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("%s: failed to reserve decode memory for %s: %v", op, img.OriginalPath, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Image could not be decoded right now"})
+			return
+		}
+		defer release()
+
+		src, err := s.decoder.Open(img.OriginalPath)
+		if err != nil {
+			log.Printf("%s: failed to open image %s: %v", op, img.OriginalPath, err)
+			c.JSON(http.StatusNotFound, gin.H{"error": "Original image file not found"})
+			return
+		}
+
+		if path, err = processor.RenderPreset(img, src, name); err != nil {
+			log.Printf("%s: %v", op, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render preset"})
+			return
+		}
+	}
+
+	s.serveImageFile(c, img, path, "inline")
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+)
+
+// image/jpeg only produces baseline JPEGs, so progressive output is done by
+// losslessly re-encoding the saved file with jpegtran.
+func (p *ImageProcessor) saveProgressive(img image.Image, path string) error {
+	const op = "ImageProcessor.saveProgressive"
+
+	if err := p.save(img, path); err != nil {
+		return err
+	}
+	if !p.cfg.ProgressiveJPEG {
+		return nil
+	}
+
+	srcPath, cleanup, err := plainCopy(path)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	defer cleanup()
+	tmpPath := path + ".progressive"
+	cmd := exec.Command(p.cfg.JpegtranPath, "-progressive", "-optimize", "-copy", "all", "-outfile", tmpPath, srcPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("%s: jpegtran failed: %v: %s", op, err, out)
+	}
+	if err := replaceStored(path, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
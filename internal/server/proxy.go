@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+	"WB_L3_4/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errProxyTooLarge = errors.New("remote image is too large")
+
+// proxyCachePath returns where a proxied file is cached under
+// <storage>/proxy/<kind>, sharded like the image files
+func (s *Server) proxyCachePath(kind, key, ext string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(s.cfg.StoragePath, "proxy", kind, name[0:2], name[2:4], name+ext)
+}
+
+// proxyHostAllowed reports whether images may be fetched from host
+func (s *Server) proxyHostAllowed(host string) bool {
+	return hostMatches(host, s.cfg.Proxy.AllowedHosts)
+}
+
+// freshFile reports whether path exists and was written within the cache TTL
+func (s *Server) freshFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && time.Since(info.ModTime()) < s.cfg.Proxy.CacheTTL
+}
+
+// fetchRemote downloads a remote image to path. Redirects are only followed
+// to allowed hosts and the body is capped at proxy.max_size_mb.
+func (s *Server) fetchRemote(remote *url.URL, path string) error {
+	client := &http.Client{
+		Timeout: s.cfg.Proxy.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if !s.proxyHostAllowed(req.URL.Hostname()) {
+				return fmt.Errorf("redirect to %s is not allowed", req.URL.Hostname())
+			}
+			return nil
+		},
+	}
+	resp, err := client.Get(remote.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("remote responded with %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "image/") {
+		return fmt.Errorf("remote content type %q is not an image", ct)
+	}
+
+	maxSize := int64(s.cfg.Proxy.MaxSizeMB) << 20
+	if resp.ContentLength > maxSize {
+		return errProxyTooLarge
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		n, err := io.Copy(w, io.LimitReader(resp.Body, maxSize+1))
+		if err != nil {
+			return err
+		}
+		if n > maxSize {
+			return errProxyTooLarge
+		}
+		return nil
+	})
+}
+
+// parseProxyParams reads the transformation of a /proxy request:
+// w, h, mode (fit, fill, pad or crop), gravity, background, format (jpg,
+// png, gif or webp with the vips engine), quality, watermark, shape (circle
+// or rounded), radius, border (width), border_color, border_inset and filter
+func (s *Server) parseProxyParams(c *gin.Context) (models.Preset, error) {
+	var preset models.Preset
+	for name, dst := range map[string]*int{"w": &preset.Width, "h": &preset.Height, "radius": &preset.Radius, "border": &preset.BorderWidth} {
+		if v := c.Query(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return preset, fmt.Errorf("%s must be an integer", name)
+			}
+			*dst = n
+		}
+	}
+	preset.Mode = c.Query("mode")
+	preset.Gravity = c.Query("gravity")
+	preset.Background = c.Query("background")
+	preset.Format = c.DefaultQuery("format", "jpg")
+	quality, err := s.parseQuality(c)
+	if err != nil {
+		return preset, err
+	}
+	preset.Quality = quality
+	preset.Watermark = c.Query("watermark") == "true"
+	preset.Shape = c.Query("shape")
+	preset.BorderColor = c.Query("border_color")
+	preset.BorderInset = c.Query("border_inset") == "true"
+	preset.Filter = c.Query("filter")
+
+	if err := s.cfg.ValidatePreset(preset); err != nil {
+		return preset, err
+	}
+	if preset.Quality == 0 {
+		preset.Quality = s.cfg.JPEGQuality
+	}
+	return preset, nil
+}
+
+// handleProxy fetches an external image, transforms it and serves the
+// result. Both the fetched original and every rendered variant are cached on
+// disk for proxy.cache_ttl, keyed by the URL and the transformation.
+func (s *Server) handleProxy(c *gin.Context) {
+	const op = "server.handleProxy"
+
+	remote, err := url.Parse(c.Query("url"))
+	if err != nil || (remote.Scheme != "http" && remote.Scheme != "https") || remote.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid url"})
+		return
+	}
+	if !s.proxyHostAllowed(remote.Hostname()) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Host is not allowed"})
+		return
+	}
+	preset, err := s.parseProxyParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key := fmt.Sprintf("%s|w=%d|h=%d|mode=%s,%s,%s|q=%d|wm=%t|shape=%s|r=%d|b=%d,%s,%t|f=%s", remote.String(), preset.Width, preset.Height, preset.Mode, preset.Gravity, preset.Background, preset.Quality, preset.Watermark, preset.Shape, preset.Radius, preset.BorderWidth, preset.BorderColor, preset.BorderInset, preset.Filter)
+	path := s.proxyCachePath("render", key, "."+preset.Format)
+
+	result := "hit"
+	if !s.freshFile(path) {
+		result = "miss"
+		// Concurrent requests for the same variant share one fetch and render
+		_, err, _ = s.proxyFlight.Do(path, func() (any, error) {
+			return nil, s.renderProxied(remote, preset, path)
+		})
+		if err != nil {
+			metrics.ProxyRequestsTotal.WithLabelValues("error").Inc()
+			switch {
+			case errors.Is(err, errProxyTooLarge), errors.Is(err, ErrImageTooLarge):
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			default:
+				log.Printf("%s: %s: %v", op, remote.String(), err)
+				c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to fetch remote image"})
+			}
+			return
+		}
+	}
+	metrics.ProxyRequestsTotal.WithLabelValues(result).Inc()
+
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.cfg.Proxy.CacheTTL.Seconds())))
+	c.Header("X-Cache", strings.ToUpper(result))
+	// Proxied images aren't stored for anyone, the requesting tenant pays
+	if n := s.sendFile(c, path, time.Time{}, ""); n > 0 {
+		processMeter.record(MeteringEvent{Type: meterBandwidth, Tenant: requestTenant(c), Owner: requestOwner(c), Bytes: n})
+	}
+}
+
+// renderProxied fetches the remote original unless a fresh copy is cached,
+// then renders the transformation to path. It runs detached from the request
+// that started it since other requests may be waiting for the result.
+func (s *Server) renderProxied(remote *url.URL, preset models.Preset, path string) error {
+	srcPath := s.proxyCachePath("source", remote.String(), "")
+	if !s.freshFile(srcPath) {
+		if err := s.fetchRemote(remote, srcPath); err != nil {
+			return err
+		}
+	}
+
+	if err := s.limiter.Acquire(context.Background()); err != nil {
+		return err
+	}
+	defer s.limiter.Release()
+
+	release, err := s.limiter.AcquireMemory(context.Background(), srcPath)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	src, err := s.decoder.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to decode remote image: %v", err)
+	}
+
+	processor := NewImageProcessor(s.cfg, s.db)
+	processor.quality = preset.Quality
+	out, err := processor.applyPreset(src, preset)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return processor.save(out, path)
+}
+
+// pruneProxyCache removes cached remote images and renders older than the
+// cache TTL; they would be fetched again on the next request anyway
+func (s *Server) pruneProxyCache(ctx context.Context) error {
+	const op = "server.pruneProxyCache"
+
+	cutoff := time.Now().Add(-s.cfg.Proxy.CacheTTL)
+	removed := 0
+	err := filepath.WalkDir(filepath.Join(s.cfg.StoragePath, "proxy"), func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().Before(cutoff) {
+			if err := os.Remove(path); err == nil {
+				removed++
+			}
+		}
+		return nil
+	})
+	if removed > 0 {
+		log.Printf("%s: removed %d cached files", op, removed)
+	}
+	return err
+}
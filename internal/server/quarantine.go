@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultQuarantineListLimit = 100
+	maxQuarantineListLimit     = 1000
+)
+
+// quarantineImage gives up on an image that used up its processing
+// attempts. It is marked failed, so it is neither processed nor requeued as
+// stuck again, and its message is quarantined for an admin to requeue.
+func quarantineImage(cfg *models.Config, db *storage.Storage, img *models.Image) {
+	const op = "server.quarantineImage"
+
+	reason := fmt.Sprintf("gave up after %d processing attempts", img.Attempts["processing"])
+	if last := img.Errors["processing"]; last != "" {
+		reason += ", last error: " + last
+	}
+	img.Status = "error"
+	for _, status := range []*string{&img.ResizeStatus, &img.ThumbnailStatus, &img.WatermarkStatus} {
+		if *status == "pending" || *status == "processing" {
+			*status = "error"
+		}
+	}
+	if err := db.UpdateImage(img); err != nil {
+		log.Printf("%s: failed to update image %s: %v", op, img.ID.String(), err)
+	}
+	recordEvent(db, img.ID, "quarantined", "", reason)
+	if err := db.SetOperationError(img.ID, "processing", reason); err != nil {
+		log.Printf("%s: %v", op, err)
+	}
+	quarantineMessage(db, img.ID.String(), &img.ID, img.Attempts["processing"], reason)
+	notifyFinished(cfg, db, img)
+}
+
+// quarantineMessage stores a processing message that can't succeed, e.g.
+// one that isn't an image ID. Failures are only logged.
+func quarantineMessage(db *storage.Storage, payload string, imageID *uuid.UUID, attempts int, reason string) {
+	const op = "server.quarantineMessage"
+
+	err := db.AddQuarantineEntry(&models.QuarantineEntry{
+		ImageID:  imageID,
+		Payload:  payload,
+		Error:    reason,
+		Attempts: attempts,
+	})
+	if err != nil {
+		log.Printf("%s: failed to quarantine message %q: %v", op, payload, err)
+		return
+	}
+	log.Printf("%s: quarantined message %q: %s", op, payload, reason)
+}
+
+// handleListQuarantine lists quarantined messages, newest first, paginated
+// with ?before=<id>
+func (s *Server) handleListQuarantine(c *gin.Context) {
+	const op = "server.handleListQuarantine"
+
+	var before int64
+	if v := c.Query("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid before"})
+			return
+		}
+		before = n
+	}
+	limit := defaultQuarantineListLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = min(n, maxQuarantineListLimit)
+	}
+
+	entries, err := s.db.ListQuarantineEntries(before, limit)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list quarantine"})
+		return
+	}
+	total, err := s.db.CountQuarantineEntries()
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list quarantine"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "total": total})
+}
+
+// quarantineEntry loads the entry named by the :id parameter, responding
+// with an error and returning nil when it can't
+func (s *Server) quarantineEntry(c *gin.Context, op string) *models.QuarantineEntry {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quarantine ID"})
+		return nil
+	}
+	entry, err := s.db.GetQuarantineEntry(id)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load quarantine entry"})
+		return nil
+	}
+	if entry == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quarantine entry not found"})
+		return nil
+	}
+	return entry
+}
+
+func (s *Server) handleGetQuarantine(c *gin.Context) {
+	if entry := s.quarantineEntry(c, "server.handleGetQuarantine"); entry != nil {
+		c.JSON(http.StatusOK, entry)
+	}
+}
+
+type updateQuarantineRequest struct {
+	Payload string `json:"payload" binding:"required"`
+}
+
+// handleUpdateQuarantine replaces the payload of a quarantined message,
+// e.g. to point a malformed one at the right image before requeueing it
+func (s *Server) handleUpdateQuarantine(c *gin.Context) {
+	const op = "server.handleUpdateQuarantine"
+
+	entry := s.quarantineEntry(c, op)
+	if entry == nil {
+		return
+	}
+	var req updateQuarantineRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	old := entry.Payload
+	entry.Payload = req.Payload
+	entry.ImageID = nil
+	if id, err := uuid.Parse(req.Payload); err == nil {
+		entry.ImageID = &id
+	}
+	ok, err := s.db.UpdateQuarantinePayload(entry)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quarantine entry"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quarantine entry not found"})
+		return
+	}
+
+	s.audit(c, "update_quarantine", uuid.Nil, map[string]any{
+		"quarantine_id": entry.ID,
+		"old_payload":   old,
+		"payload":       entry.Payload,
+	})
+	c.JSON(http.StatusOK, entry)
+}
+
+// handleRequeueQuarantine publishes a quarantined message again with a fresh
+// attempt budget and removes it from the quarantine
+func (s *Server) handleRequeueQuarantine(c *gin.Context) {
+	const op = "server.handleRequeueQuarantine"
+
+	entry := s.quarantineEntry(c, op)
+	if entry == nil {
+		return
+	}
+	id, err := uuid.Parse(entry.Payload)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Payload is not an image ID, fix it before requeueing"})
+		return
+	}
+	if _, err := s.db.GetImage(id); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Image not found, fix the payload before requeueing"})
+		return
+	}
+
+	ids := []uuid.UUID{id}
+	if err := s.db.ResetForReprocessing(ids); err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to requeue"})
+		return
+	}
+	if err := s.db.ResetAttempts(ids); err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to requeue"})
+		return
+	}
+	if err := s.enqueueOrStore(context.Background(), id, "requeue quarantined"); err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to requeue"})
+		return
+	}
+	recordEvent(s.db, id, "queued", "", "requeued from quarantine")
+	if _, err := s.db.DeleteQuarantineEntry(entry.ID); err != nil {
+		log.Printf("%s: requeued image %s but failed to remove entry %d: %v", op, id.String(), entry.ID, err)
+	}
+
+	s.audit(c, "requeue_quarantine", id, map[string]any{"quarantine_id": entry.ID})
+	c.JSON(http.StatusAccepted, gin.H{"message": "Requeued", "id": id.String()})
+}
+
+// handleDeleteQuarantine discards a quarantined message
+func (s *Server) handleDeleteQuarantine(c *gin.Context) {
+	const op = "server.handleDeleteQuarantine"
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quarantine ID"})
+		return
+	}
+	ok, err := s.db.DeleteQuarantineEntry(id)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete quarantine entry"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quarantine entry not found"})
+		return
+	}
+
+	s.audit(c, "delete_quarantine", uuid.Nil, map[string]any{"quarantine_id": id})
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Readiness states. The service is degraded when only Kafka is unavailable:
+// uploads are still accepted and their processing is deferred until Kafka
+// recovers. Without the database or storage it is unready.
+const (
+	stateReady    = "ready"
+	stateDegraded = "degraded"
+	stateUnready  = "unready"
+)
+
+var readinessStates = []string{stateReady, stateDegraded, stateUnready}
+
+// readinessListener is called after every check with the previous and the
+// new state and the errors of the failing dependencies
+type readinessListener func(prev, next string, failed map[string]error)
+
+// Readiness tracks the service state from periodic dependency checks
+type Readiness struct {
+	cfg *models.Config
+	db  *storage.Storage
+
+	mu        sync.RWMutex
+	state     string
+	failed    map[string]error
+	since     time.Time
+	listeners []readinessListener
+}
+
+func NewReadiness(cfg *models.Config, db *storage.Storage) *Readiness {
+	return &Readiness{cfg: cfg, db: db, state: stateUnready, since: time.Now()}
+}
+
+// State returns the current readiness state
+func (r *Readiness) State() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state
+}
+
+func (r *Readiness) addListener(l readinessListener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listeners = append(r.listeners, l)
+}
+
+// Run checks the dependencies every cfg.HealthCheckInterval until ctx is
+// canceled
+func (r *Readiness) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		r.update(checkDependencies(ctx, r.cfg, r.db))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Readiness) update(failed map[string]error) {
+	const op = "Readiness.update"
+
+	next := stateReady
+	if _, ok := failed["kafka"]; ok {
+		next = stateDegraded
+	}
+	if _, ok := failed["database"]; ok {
+		next = stateUnready
+	}
+	if _, ok := failed["storage"]; ok {
+		next = stateUnready
+	}
+
+	r.mu.Lock()
+	prev := r.state
+	r.state = next
+	r.failed = failed
+	if prev != next {
+		r.since = time.Now()
+	}
+	listeners := r.listeners
+	r.mu.Unlock()
+
+	if prev != next {
+		log.Printf("%s: %s -> %s (failing: %v)", op, prev, next, failed)
+	}
+	for _, state := range readinessStates {
+		value := 0.0
+		if state == next {
+			value = 1
+		}
+		metrics.ReadinessState.WithLabelValues(state).Set(value)
+	}
+	for _, name := range dependencies {
+		value := 1.0
+		if _, ok := failed[name]; ok {
+			value = 0
+		}
+		metrics.DependencyUp.WithLabelValues(name).Set(value)
+	}
+
+	for _, l := range listeners {
+		l(prev, next, failed)
+	}
+}
+
+// handleReadyz reports the readiness state; degraded still answers 200 since
+// the service accepts uploads
+func (s *Server) handleReadyz(c *gin.Context) {
+	s.readiness.mu.RLock()
+	state, since := s.readiness.state, s.readiness.since
+	failing := make(map[string]string, len(s.readiness.failed))
+	for name, err := range s.readiness.failed {
+		failing[name] = err.Error()
+	}
+	s.readiness.mu.RUnlock()
+
+	code := http.StatusOK
+	if state == stateUnready {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{"state": state, "since": since, "failing": failing})
+}
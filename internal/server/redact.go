@@ -0,0 +1,214 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	maxRedactRegions = 100
+	maxRedactBlock   = 256
+
+	defaultRedactBlock = 16
+)
+
+// redactRegion is a rectangle of the original in pixels
+type redactRegion struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// redactRequest is the body of POST /image/:id/redact
+type redactRequest struct {
+	Regions []redactRegion `json:"regions"`
+	// pixelate or black; defaults to pixelate
+	Method string `json:"method"`
+	// Pixel block size for pixelate; defaults to 16
+	Block int `json:"block"`
+	// jpg or png; defaults to jpg
+	Format string `json:"format"`
+}
+
+// normalize fills in defaults and validates the request
+func (r *redactRequest) normalize() error {
+	if len(r.Regions) == 0 {
+		return errors.New("at least one region is required")
+	}
+	if len(r.Regions) > maxRedactRegions {
+		return fmt.Errorf("at most %d regions are allowed", maxRedactRegions)
+	}
+	for i, region := range r.Regions {
+		if region.X < 0 || region.Y < 0 || region.Width <= 0 || region.Height <= 0 {
+			return fmt.Errorf("region %d must have a non-negative position and a positive size", i)
+		}
+	}
+	if r.Method == "" {
+		r.Method = "pixelate"
+	}
+	if r.Method != "pixelate" && r.Method != "black" {
+		return fmt.Errorf("unknown method %q", r.Method)
+	}
+	if r.Block == 0 {
+		r.Block = defaultRedactBlock
+	}
+	if r.Block < 2 || r.Block > maxRedactBlock {
+		return fmt.Errorf("block must be between 2 and %d", maxRedactBlock)
+	}
+	if r.Format == "" {
+		r.Format = "jpg"
+	}
+	if r.Format != "jpg" && r.Format != "png" {
+		return fmt.Errorf("unsupported format %q", r.Format)
+	}
+	return nil
+}
+
+// key identifies the redaction so identical requests reuse the file
+func (r *redactRequest) key() string {
+	parts := []string{r.Method, strconv.Itoa(r.Block), r.Format}
+	for _, region := range r.Regions {
+		parts = append(parts, fmt.Sprintf("%d,%d,%d,%d", region.X, region.Y, region.Width, region.Height))
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// redactedPath returns where a redacted copy of an image is stored
+func (p *ImageProcessor) redactedPath(id uuid.UUID, req *redactRequest) string {
+	return filepath.Join(ShardDir(p.cfg.StoragePath, "processed", id), fmt.Sprintf("%s_redacted_%s.%s", id.String(), req.key(), req.Format))
+}
+
+// applyRedaction pixelates or blacks out the regions on a copy of src.
+// Regions are clipped to the image, ones entirely outside it are skipped.
+func applyRedaction(src image.Image, req *redactRequest) image.Image {
+	dst := imaging.Clone(src)
+	bounds := dst.Bounds()
+
+	for _, region := range req.Regions {
+		rect := image.Rect(region.X, region.Y, region.X+region.Width, region.Y+region.Height).Intersect(bounds)
+		if rect.Empty() {
+			continue
+		}
+		var patch image.Image
+		if req.Method == "black" {
+			patch = imaging.New(rect.Dx(), rect.Dy(), color.NRGBA{A: 255})
+		} else {
+			// Averaging down to one pixel per block and scaling back up
+			// leaves nothing of the original detail to recover
+			w, h := max(rect.Dx()/req.Block, 1), max(rect.Dy()/req.Block, 1)
+			small := imaging.Resize(imaging.Crop(dst, rect), w, h, imaging.Box)
+			patch = imaging.Resize(small, rect.Dx(), rect.Dy(), imaging.NearestNeighbor)
+		}
+		dst = imaging.Paste(dst, patch, rect.Min)
+	}
+	return dst
+}
+
+// RenderRedaction redacts the regions on a copy of the image and returns its
+// path
+func (p *ImageProcessor) RenderRedaction(img *models.Image, src image.Image, req *redactRequest) (string, error) {
+	const op = "ImageProcessor.RenderRedaction"
+
+	log.Printf("%s: redacting %d regions of image %s", op, len(req.Regions), img.ID.String())
+
+	out := applyRedaction(src, req)
+
+	path := p.redactedPath(img.ID, req)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("%s: failed to create processed directory: %v", op, err)
+	}
+	if err := p.save(out, path); err != nil {
+		return "", fmt.Errorf("%s: %v", op, err)
+	}
+
+	recordChecksum(p.db, img.ID, "redacted:"+req.key(), path)
+
+	log.Printf("%s: successfully redacted image %s to %s", op, img.ID.String(), path)
+	return path, nil
+}
+
+// handleRedactImage pixelates or blacks out rectangles of a copy of the image
+// and serves it; the stored variants are left untouched
+func (s *Server) handleRedactImage(c *gin.Context) {
+	const op = "server.handleRedactImage"
+
+	idStr := c.Param("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	var req redactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	img, err := s.db.GetImage(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	if err := req.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	processor := newProcessorFor(s.cfg, s.db, img)
+	path := processor.redactedPath(img.ID, &req)
+	if !s.fileExists(path) {
+		if err := s.limiter.Acquire(c.Request.Context()); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Request canceled while waiting for processing"})
+			return
+		}
+		defer s.limiter.Release()
+
+		release, err := s.limiter.AcquireMemory(c.Request.Context(), img.OriginalPath)
+		if errors.Is(err, ErrImageTooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("%s: failed to reserve decode memory for %s: %v", op, img.OriginalPath, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Image could not be decoded right now"})
+			return
+		}
+		defer release()
+
+		src, err := s.decoder.Open(img.OriginalPath)
+		if err != nil {
+			log.Printf("%s: failed to open image %s: %v", op, img.OriginalPath, err)
+			c.JSON(http.StatusNotFound, gin.H{"error": "Original image file not found"})
+			return
+		}
+
+		if path, err = processor.RenderRedaction(img, src, &req); err != nil {
+			log.Printf("%s: %v", op, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redact image"})
+			return
+		}
+	}
+
+	s.audit(c, "redact", img.ID, map[string]any{"regions": len(req.Regions), "method": req.Method})
+	s.serveImageFile(c, img, path, "inline")
+}
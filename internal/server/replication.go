@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const replicationBatchSize = 100
+
+// replicaBackend stores copies of files under their path relative to the
+// storage root. dirReplica is the only backend for now; a bucket backend
+// only needs to implement the same two methods.
+type replicaBackend interface {
+	Put(rel string, r io.Reader) error
+	Remove(rel string) error
+}
+
+// dirReplica replicates files into a directory, typically on another volume
+type dirReplica struct {
+	root string
+}
+
+func (d dirReplica) Put(rel string, r io.Reader) error {
+	path := filepath.Join(d.root, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+func (d dirReplica) Remove(rel string) error {
+	err := os.Remove(filepath.Join(d.root, rel))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// newReplica returns the configured replica backend, or nil if replication
+// is disabled
+func newReplica(cfg *models.Config) replicaBackend {
+	if cfg.ReplicaPath == "" {
+		return nil
+	}
+	return dirReplica{root: cfg.ReplicaPath}
+}
+
+// Replicate copies pending files to the replica every interval until ctx is
+// canceled. It does nothing when no replica is configured.
+func Replicate(ctx context.Context, cfg *models.Config, db *storage.Storage) {
+	const op = "server.Replicate"
+
+	replica := newReplica(cfg)
+	if replica == nil {
+		return
+	}
+
+	ticker := time.NewTicker(cfg.ReplicationInterval)
+	defer ticker.Stop()
+
+	for {
+		copied, failed, err := replicatePending(ctx, cfg, db, replica)
+		if err != nil {
+			log.Printf("%s: %v", op, err)
+		}
+		if copied > 0 || failed > 0 {
+			log.Printf("%s: replicated %d files, %d failed", op, copied, failed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// replicatePending makes one pass over every file not yet replicated
+func replicatePending(ctx context.Context, cfg *models.Config, db *storage.Storage, replica replicaBackend) (copied, failed int, err error) {
+	afterID, afterVariant := uuid.Nil, ""
+	for ctx.Err() == nil {
+		sums, err := db.ListUnreplicated(afterID, afterVariant, replicationBatchSize)
+		if err != nil {
+			return copied, failed, err
+		}
+		if len(sums) == 0 {
+			break
+		}
+		last := sums[len(sums)-1]
+		afterID, afterVariant = last.ImageID, last.Variant
+
+		for _, sum := range sums {
+			replErr := replicateFile(cfg, replica, sum)
+			if replErr != nil {
+				log.Printf("server.replicatePending: %s %s: %v", sum.ImageID.String(), sum.Variant, replErr)
+				metrics.ReplicatedFilesTotal.WithLabelValues("error").Inc()
+				failed++
+			} else {
+				metrics.ReplicatedFilesTotal.WithLabelValues("ok").Inc()
+				copied++
+			}
+			if err := db.MarkReplicated(sum.ImageID, sum.Variant, replErr); err != nil {
+				return copied, failed, err
+			}
+		}
+	}
+	return copied, failed, nil
+}
+
+// replicateFile copies a stored file to the replica, refusing to replicate a
+// file that no longer matches its recorded checksum. Encrypted files are
+// copied as they are stored, after checking their decrypted content.
+func replicateFile(cfg *models.Config, replica replicaBackend, sum models.FileChecksum) error {
+	rel, err := StoredRel(cfg, sum.Path)
+	if err != nil {
+		return err
+	}
+
+	f, err := OpenStoredFile(sum.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	content, sealed, err := storedContent(f)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	src := io.TeeReader(f, h)
+	if sealed {
+		if _, err := io.Copy(h, content); err != nil {
+			return err
+		}
+		src = f
+	}
+	if err := replica.Put(rel, src); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != sum.SHA256 {
+		metrics.IntegrityFailuresTotal.Inc()
+		replica.Remove(rel)
+		return fmt.Errorf("%w: %s", errChecksumMismatch, sum.Path)
+	}
+	return nil
+}
+
+// removeReplicas deletes the replicated copies of an image's files
+func removeReplicas(cfg *models.Config, paths ...string) {
+	replica := newReplica(cfg)
+	if replica == nil {
+		return
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		rel, err := StoredRel(cfg, path)
+		if err != nil {
+			continue
+		}
+		if err := replica.Remove(rel); err != nil {
+			log.Printf("server.removeReplicas: %v", err)
+		}
+	}
+}
+
+func (s *Server) handleReplicationStatus(c *gin.Context) {
+	const op = "server.handleReplicationStatus"
+
+	if s.cfg.ReplicaPath == "" {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+
+	counts, err := s.db.ReplicationCounts()
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get replication status"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "files": counts})
+}
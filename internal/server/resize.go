@@ -0,0 +1,198 @@
+package server
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+// resizeSpec is how the resized variant is scaled
+type resizeSpec struct {
+	Width  int
+	Height int    // 0 keeps the aspect ratio
+	Mode   string // "", fit, fill or pad
+	// Anchor of the crop for fill
+	Gravity string
+	// Color of the pad borders
+	Background color.NRGBA
+	// Resampling kernel, lanczos when empty
+	Filter string
+}
+
+// resizeSpecFor returns the resize of an image's upload options
+func resizeSpecFor(opts models.ProcessingOptions) resizeSpec {
+	spec := resizeSpec{
+		Width:   opts.ResizeWidth,
+		Height:  opts.ResizeHeight,
+		Mode:    opts.ResizeMode,
+		Gravity: opts.Gravity,
+		Filter:  opts.Filter,
+	}
+	if spec.Width == 0 {
+		spec.Width = defaultResizeWidth
+	}
+	if spec.Mode == "" {
+		spec.Height = 0
+	}
+	spec.Background = backgroundFor(opts)
+	return spec
+}
+
+// white is the default background
+var white = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+
+// backgroundFor returns the background of an image's upload options,
+// white by default
+func backgroundFor(opts models.ProcessingOptions) color.NRGBA {
+	if bg, err := models.ParseColor(opts.Background); err == nil && opts.Background != "" {
+		return bg
+	}
+	return white
+}
+
+// flatten returns img drawn onto an opaque background, for formats without
+// alpha. A transparent background counts as white. Pixels are composited as
+// the encoder reads them, so no second full-size copy is made.
+func flatten(img image.Image, background color.NRGBA) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+	if background.A < 255 {
+		background = white
+	}
+	return flatView{Image: img, background: background}
+}
+
+// flatView is an image composited onto an opaque background on access
+type flatView struct {
+	image.Image
+	background color.NRGBA
+}
+
+func (f flatView) ColorModel() color.Model { return color.RGBA64Model }
+
+func (f flatView) Opaque() bool { return true }
+
+func (f flatView) At(x, y int) color.Color {
+	// Premultiplied, so the background shows through by 1-a
+	r, g, b, a := f.Image.At(x, y).RGBA()
+	under := 0xffff - a
+	return color.RGBA64{
+		R: uint16(r + uint32(f.background.R)*0x101*under/0xffff),
+		G: uint16(g + uint32(f.background.G)*0x101*under/0xffff),
+		B: uint16(b + uint32(f.background.B)*0x101*under/0xffff),
+		A: 0xffff,
+	}
+}
+
+// sharpen applies an unsharp mask to img: the difference between img and a
+// blur of it with sigma radius is added back amount times. Alpha is left
+// alone and a zero amount returns img as is.
+func sharpen(img image.Image, amount, radius float64) image.Image {
+	if amount <= 0 || radius <= 0 {
+		return img
+	}
+	dst := imaging.Clone(img)
+	blurred := imaging.Blur(dst, radius)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		for c := i; c < i+3; c++ {
+			v := float64(dst.Pix[c]) + amount*(float64(dst.Pix[c])-float64(blurred.Pix[c]))
+			dst.Pix[c] = uint8(math.Min(math.Max(math.Round(v), 0), 255))
+		}
+	}
+	return dst
+}
+
+// resampleFilters maps filter names to imaging's kernels
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"nearest":    imaging.NearestNeighbor,
+	"box":        imaging.Box,
+	"linear":     imaging.Linear,
+	"catmullrom": imaging.CatmullRom,
+	"lanczos":    imaging.Lanczos,
+}
+
+// resampleFilter returns the named kernel, Lanczos by default
+func resampleFilter(name string) imaging.ResampleFilter {
+	if f, ok := resampleFilters[name]; ok {
+		return f
+	}
+	return imaging.Lanczos
+}
+
+// gravityAnchors maps gravities to imaging's anchors
+var gravityAnchors = map[string]imaging.Anchor{
+	"center":       imaging.Center,
+	"top":          imaging.Top,
+	"bottom":       imaging.Bottom,
+	"left":         imaging.Left,
+	"right":        imaging.Right,
+	"top-left":     imaging.TopLeft,
+	"top-right":    imaging.TopRight,
+	"bottom-left":  imaging.BottomLeft,
+	"bottom-right": imaging.BottomRight,
+}
+
+// apply scales src as the spec says
+func (r resizeSpec) apply(src image.Image) image.Image {
+	filter := resampleFilter(r.Filter)
+	switch r.Mode {
+	case "fit":
+		return imaging.Fit(src, r.Width, r.Height, filter)
+	case "fill":
+		anchor, ok := gravityAnchors[r.Gravity]
+		if !ok {
+			anchor = imaging.Center
+		}
+		return imaging.Fill(src, r.Width, r.Height, anchor, filter)
+	case "pad":
+		fitted := imaging.Fit(src, r.Width, r.Height, filter)
+		canvas := imaging.New(r.Width, r.Height, r.Background)
+		return imaging.PasteCenter(canvas, fitted)
+	}
+	return imaging.Resize(src, r.Width, 0, filter)
+}
+
+// parseResizeParams applies the optional ?mode=, ?width=, ?height=,
+// ?gravity=, ?background= and ?filter= of a resize request to a copy of
+// opts. changed is false when none was given.
+func parseResizeParams(c *gin.Context, opts models.ProcessingOptions) (models.ProcessingOptions, bool, error) {
+	changed := false
+	for name, dst := range map[string]*int{"width": &opts.ResizeWidth, "height": &opts.ResizeHeight} {
+		if v := c.Query(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return opts, false, fmt.Errorf("invalid %s", name)
+			}
+			*dst = n
+			changed = true
+		}
+	}
+	if v := c.Query("mode"); v != "" {
+		opts.ResizeMode = v
+		changed = true
+	}
+	if v := c.Query("gravity"); v != "" {
+		opts.Gravity = v
+		changed = true
+	}
+	if v := c.Query("background"); v != "" {
+		opts.Background = v
+		changed = true
+	}
+	if v := c.Query("filter"); v != "" {
+		opts.Filter = v
+		changed = true
+	}
+	if err := opts.Validate(); err != nil {
+		return opts, false, err
+	}
+	return opts, changed, nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"WB_L3_4/internal/models"
+)
+
+// Like the actor, the tenant is set by the gateway in front of the service
+const tenantHeader = "X-Tenant"
+
+// enforceRetention deletes the files each tenant's policy no longer keeps
+func (s *Server) enforceRetention(ctx context.Context) error {
+	configured := make([]string, 0, len(s.cfg.Tenants))
+	for name, tenant := range s.cfg.Tenants {
+		configured = append(configured, name)
+		if err := s.applyRetention(ctx, []string{name}, false, tenant.Retention); err != nil {
+			return err
+		}
+	}
+	// The default policy covers every tenant not configured above
+	return s.applyRetention(ctx, configured, true, s.cfg.Retention)
+}
+
+func (s *Server) applyRetention(ctx context.Context, tenants []string, exclude bool, policy models.RetentionPolicy) error {
+	const op = "server.applyRetention"
+
+	for kind, keep := range policy.Kinds() {
+		if keep <= 0 {
+			continue
+		}
+		cutoff := time.Now().Add(-keep)
+		expired := 0
+		for ctx.Err() == nil {
+			images, err := s.db.ListRetentionExpired(kind, tenants, exclude, cutoff, maintenanceBatchSize)
+			if err != nil {
+				return err
+			}
+			if len(images) == 0 {
+				break
+			}
+			for _, img := range images {
+				path := kindPath(img, kind)
+				if err := removeStored(path); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				removeReplicas(s.cfg, path)
+				if err := s.db.ExpireFile(img.ID, kind); err != nil {
+					return err
+				}
+				s.auditSystem("retention", img.ID, map[string]any{
+					"kind":   kind,
+					"tenant": img.Tenant,
+					"path":   path,
+				})
+				expired++
+			}
+		}
+		if expired > 0 {
+			log.Printf("%s: deleted %d %s files older than %s", op, expired, kind, keep)
+		}
+	}
+	return ctx.Err()
+}
+
+// kindPath returns the path of an image's file of the given retention kind
+func kindPath(img *models.Image, kind string) string {
+	switch kind {
+	case "original":
+		return img.OriginalPath
+	case "resized":
+		return img.ProcessedPath
+	case "thumbnail":
+		return img.ThumbnailPath
+	case "watermarked":
+		return img.WatermarkedPath
+	}
+	return ""
+}
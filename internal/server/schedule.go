@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RunScheduler enqueues scheduled images once their process_at passes,
+// checking every interval until ctx is canceled
+func (s *Server) RunScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// Leave them scheduled while Kafka is down
+		if s.readiness.State() == stateReady {
+			s.enqueueDue(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) enqueueDue(ctx context.Context) {
+	const op = "server.enqueueDue"
+
+	count := 0
+	for ctx.Err() == nil {
+		ids, err := s.db.ListDueImageIDs(defaultReprocessBatchSize)
+		if err != nil {
+			log.Printf("%s: %v", op, err)
+			return
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		for _, id := range ids {
+			if err := s.enqueue(ctx, id); err != nil {
+				log.Printf("%s: enqueued %d images before failing: %v", op, count, err)
+				return
+			}
+			// Moves the image out of the scheduled state so it isn't listed again
+			if err := s.db.ResetForReprocessing([]uuid.UUID{id}); err != nil {
+				log.Printf("%s: %v", op, err)
+				return
+			}
+			recordEvent(s.db, id, "queued", "", "")
+			count++
+		}
+	}
+	if count > 0 {
+		log.Printf("%s: enqueued %d scheduled images", op, count)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const maxSearchQueryLength = 500
+
+// handleSearchImages finds images by title, tags, description, filename
+// and recognized text, e.g. GET /images/search?q=beach+-night. The query
+// takes quoted phrases, "or" and -excluded words; results come best match
+// first and are paged like GET /images.
+func (s *Server) handleSearchImages(c *gin.Context) {
+	const op = "server.handleSearchImages"
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+	if len(query) > maxSearchQueryLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is too long"})
+		return
+	}
+
+	page, err := parsePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filter, err := parseImageFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Tenant- and owner-bound tokens only see their own images
+	if claims := claimsFrom(c); claims != nil {
+		filter.Tenant = claims.Tenant
+		filter.Owner = claims.Owner
+	}
+	images, next, err := s.db.SearchImages(query, filter, page)
+	if errors.Is(err, storage.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		return
+	}
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search images"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"images": s.galleryItems(images), "q": query, "limit": page.Limit, "offset": page.Offset, "next_cursor": next})
+}
+
+// handleUpdateMetadata changes the title, description or tags of an image,
+// e.g. PATCH /image/:id/metadata {"tags": ["beach", "summer"]}
+func (s *Server) handleUpdateMetadata(c *gin.Context) {
+	const op = "server.handleUpdateMetadata"
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	var req models.ImageMetadata
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	img, err := s.db.GetImage(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	if err := req.Apply(img); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.db.UpdateMetadata(img.ID, img.Title, img.Description, img.Tags); err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update metadata"})
+		return
+	}
+
+	s.audit(c, "update_metadata", img.ID, map[string]any{"title": img.Title, "tags": img.Tags})
+	c.JSON(http.StatusOK, gin.H{"id": img.ID, "title": img.Title, "description": img.Description, "tags": img.Tags})
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sendFile serves a stored file, or with sendfile.mode set, answers with an
+// empty body and a header telling the reverse proxy to send the file itself.
+// The proxy keeps the Content-Type, Content-Disposition and caching headers
+// set before. Files outside the storage path are always streamed.
+//
+// modTime is sent as Last-Modified and answers If-Modified-Since with 304;
+// the zero time uses the file's mtime. etag, a quoted strong entity tag,
+// likewise answers If-None-Match; without one a weak tag is made from the
+// mtime and size. HEAD requests are always answered here, with the headers
+// of the file and no body, since a proxy told to send the file would.
+// Encrypted files are always decrypted and streamed.
+//
+// Returns the bytes of the file sent, for metering. Offloaded files count
+// whole, the proxy may send just a range of them.
+func (s *Server) sendFile(c *gin.Context, path string, modTime time.Time, etag string) int64 {
+	f, err := OpenStoredFile(path)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return 0
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return 0
+	}
+	content, sealed, err := storedContent(f)
+	if err != nil {
+		log.Printf("server.sendFile: %s: %v", path, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return 0
+	}
+
+	if modTime.IsZero() {
+		modTime = info.ModTime()
+	}
+	if etag == "" {
+		etag = fmt.Sprintf(`W/"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+	}
+	c.Header("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	c.Header("ETag", etag)
+	if etagMatches(c.Request, etag) || notModified(c.Request, modTime) {
+		c.Status(http.StatusNotModified)
+		return 0
+	}
+
+	mode := s.cfg.Sendfile.Mode
+	if c.Request.Method == http.MethodHead || sealed {
+		mode = ""
+	}
+	switch mode {
+	case "x-accel-redirect":
+		if uri, ok := s.accelURI(path); ok {
+			c.Header("X-Accel-Redirect", uri)
+			c.Status(http.StatusOK)
+			return info.Size()
+		}
+	case "x-sendfile":
+		if _, ok := s.storageRel(path); ok {
+			abs, _ := filepath.Abs(path)
+			c.Header("X-Sendfile", abs)
+			c.Status(http.StatusOK)
+			return info.Size()
+		}
+	}
+
+	// ServeContent handles ranges and keeps the Last-Modified given
+	written := c.Writer.Size()
+	http.ServeContent(c.Writer, c.Request, filepath.Base(path), modTime, content)
+	return int64(max(c.Writer.Size(), 0) - max(written, 0))
+}
+
+// notModified reports whether a GET or HEAD request's If-Modified-Since is
+// no earlier than modTime. Dates have second precision.
+func notModified(r *http.Request, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	// If-None-Match takes precedence when a client sends both
+	if r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// etagMatches reports whether a GET or HEAD request's If-None-Match lists
+// etag, compared weakly as RFC 9110 asks for
+func etagMatches(r *http.Request, etag string) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" {
+		return false
+	}
+	for _, tag := range strings.Split(inm, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// accelURI maps a stored file to its URI under the internal nginx location
+// aliased to the storage path
+func (s *Server) accelURI(path string) (string, bool) {
+	rel, ok := s.storageRel(path)
+	if !ok {
+		return "", false
+	}
+	uri := strings.TrimSuffix(s.cfg.Sendfile.AccelPrefix, "/") + "/" + filepath.ToSlash(rel)
+	return (&url.URL{Path: uri}).EscapedPath(), true
+}
+
+// storageRel returns path relative to the storage path, ok is false when it
+// lies outside of it or in the object store
+func (s *Server) storageRel(path string) (string, bool) {
+	if isObjectPath(path) {
+		return "", false
+	}
+	root, err := filepath.Abs(s.cfg.StoragePath)
+	if err != nil {
+		return "", false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
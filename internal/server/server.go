@@ -1,26 +1,39 @@
 package server
 
 import (
+	"archive/zip"
+	"context"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"WB_L3_4/internal/auth"
+	"WB_L3_4/internal/metrics"
 	"WB_L3_4/internal/models"
 	"WB_L3_4/internal/storage"
 
 	"github.com/disintegration/imaging"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/segmentio/kafka-go"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 type Server struct {
@@ -28,43 +41,233 @@ type Server struct {
 	router   *gin.Engine
 	db       *storage.Storage
 	producer *kafka.Writer
+	limiter  *Limiter
+	decoder  *decodeCache
+	verify   verifyJob
+	// State of the last /admin/consistency run
+	consistency consistencyJob
+	// Deduplicates concurrent /proxy renders of the same variant
+	proxyFlight singleflight.Group
+	// Deduplicates concurrent first requests for a missing variant
+	variantFlight singleflight.Group
+	// Shared with the gRPC health service
+	readiness *Readiness
+	http      *http.Server
+	// Wraps every publish to Kafka
+	kafkaBreaker *breaker
+	outboxMu     sync.Mutex
+	// Shared with the worker, which it holds back while paused
+	gate *ProcessingGate
+	// Nil unless oidc.issuer is configured
+	oidc *oidcLogin
 }
 
-func NewServer(cfg *models.Config, db *storage.Storage, producer *kafka.Writer) *Server {
-	r := gin.Default()
-	r.Static("/web", "./web")
-	r.Static("/files", cfg.StoragePath)
-
-	s := &Server{cfg: cfg, router: r, db: db, producer: producer}
+func NewServer(cfg *models.Config, db *storage.Storage, producer *kafka.Writer, limiter *Limiter, readiness *Readiness, gate *ProcessingGate) *Server {
+	r := gin.New()
+	r.Use(requestID())
+	if cfg.AccessLog.Format != "off" {
+		r.Use(accessLog(cfg.AccessLog, gin.DefaultWriter))
+	}
+	r.Use(gin.Recovery())
+	r.MaxMultipartMemory = int64(cfg.HTTP.MaxMultipartMemoryMB) << 20
+	// Validated by LoadConfig
+	r.SetTrustedProxies(cfg.Network.TrustedProxies)
+
+	s := &Server{
+		cfg:      cfg,
+		router:   r,
+		db:       db,
+		producer: producer,
+		limiter:  limiter,
+		decoder:  newDecodeCache(cfg.DecodeCacheSize, cfg.DecodeCacheTTL, limiter),
+
+		readiness: readiness,
+		gate:      gate,
+		http: &http.Server{
+			Handler:           r,
+			ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+			ReadTimeout:       cfg.HTTP.ReadTimeout,
+			WriteTimeout:      cfg.HTTP.WriteTimeout,
+			IdleTimeout:       cfg.HTTP.IdleTimeout,
+			MaxHeaderBytes:    cfg.HTTP.MaxHeaderBytes,
+		},
+	}
+	if cfg.OIDC.Issuer != "" {
+		s.oidc = newOIDCLogin(cfg.OIDC)
+	}
+	s.kafkaBreaker = newBreaker("kafka", cfg.KafkaBreaker.FailureThreshold, cfg.KafkaBreaker.Cooldown, s.drainOutbox)
+	readiness.addListener(func(prev, next string, _ map[string]error) {
+		if next == stateReady && prev != stateReady {
+			s.drainOutbox()
+		}
+	})
 
-	r.POST("/upload", s.handleUpload)
-	r.GET("/image/:id", s.handleGetImage)
-	r.GET("/image/:id/info", s.handleGetImageInfo)
-	r.GET("/image/:id/original", s.handleGetOriginalImage)
-	r.GET("/image/:id/thumbnail", s.handleGetThumbnail)
-	r.GET("/image/:id/watermarked", s.handleGetWatermarkedImage)
-	r.DELETE("/image/:id", s.handleDeleteImage)
+	r.Use(s.cors())
+	r.Static("/web", "./web")
 
-	// Individual processing endpoints
-	r.POST("/image/:id/resize", s.handleResizeImage)
-	r.POST("/image/:id/thumbnail", s.handleThumbnailImage)
-	r.POST("/image/:id/watermark", s.handleWatermarkImage)
+	r.GET("/access", s.handleAccessCookie)
+	r.GET("/auth/login", s.handleLogin)
+	r.GET("/auth/callback", s.handleLoginCallback)
 	r.GET("/", func(c *gin.Context) {
 		c.File("./web/index.html")
 	})
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/readyz", s.handleReadyz)
+
+	s.registerAPI(r.Group(apiPrefix), 1)
+	// The paths from before versioning keep working for existing clients
+	s.registerAPI(r.Group("/", deprecatedAlias(apiPrefix)), 1)
 
 	return s
 }
 
+// registerAPI registers the API routes on g for the given version. A
+// breaking change ships as a new version registered next to the old ones:
+// only the routes that changed get a new handler here, the others are
+// shared and can branch on apiVersion where needed.
+func (s *Server) registerAPI(g *gin.RouterGroup, version int) {
+	g.Use(withAPIVersion(version))
+
+	g.POST("/upload", s.requireScope(auth.ScopeUpload), s.handleUpload)
+
+	read := g.Group("/", s.requireScope(auth.ScopeRead))
+	read.GET("/images", s.handleListImages)
+	read.GET("/images/search", s.handleSearchImages)
+	read.POST("/images/status", s.handleBulkImageStatus)
+	read.GET("/image/:id", s.handleGetImage)
+	read.HEAD("/image/:id", s.handleGetImage)
+	read.GET("/image/:id/info", s.handleGetImageInfo)
+	read.GET("/image/:id/status", s.handleGetImageStatus)
+	read.GET("/image/:id/original", s.handleGetOriginalImage)
+	read.HEAD("/image/:id/original", s.handleGetOriginalImage)
+	read.GET("/image/:id/thumbnail", s.handleGetThumbnail)
+	read.HEAD("/image/:id/thumbnail", s.handleGetThumbnail)
+	read.GET("/image/:id/watermarked", s.handleGetWatermarkedImage)
+	read.HEAD("/image/:id/watermarked", s.handleGetWatermarkedImage)
+	read.GET("/image/:id/video", s.handleGetVideo)
+	read.HEAD("/image/:id/video", s.handleGetVideo)
+	read.GET("/image/:id/upscaled", s.handleGetUpscaled)
+	read.HEAD("/image/:id/upscaled", s.handleGetUpscaled)
+	read.GET("/image/:id/render", s.handleRenderImage)
+	read.HEAD("/image/:id/render", s.handleRenderImage)
+	read.GET("/image/:id/download", s.handleDownloadImage)
+	read.HEAD("/image/:id/download", s.handleDownloadImage)
+	read.GET("/image/:id/archive.zip", s.handleArchiveImage)
+	read.GET("/image/:id/events", s.handleGetImageEvents)
+	read.GET("/image/:id/logs", s.handleGetImageLogs)
+	read.GET("/proxy", s.handleProxy)
+	read.POST("/sprite", s.handleCreateSprite)
+	read.GET("/sprite/:file", s.handleGetSprite)
+	read.HEAD("/sprite/:file", s.handleGetSprite)
+	// :owner rather than :id, which requireScope takes for an image ID
+	read.GET("/users/:owner/usage", s.handleOwnerUsage)
+	read.GET("/me/usage", s.handleMyUsage)
+
+	write := g.Group("/", s.requireScope(auth.ScopeWrite))
+	write.DELETE("/image/:id", s.allowNetworks(s.cfg.Network.DeleteCIDRs), s.handleDeleteImage)
+
+	// Individual processing endpoints
+	write.POST("/image/:id/resize", s.handleResizeImage)
+	write.POST("/image/:id/thumbnail", s.handleThumbnailImage)
+	write.POST("/image/:id/watermark", s.handleWatermarkImage)
+	write.POST("/image/:id/caption", s.handleCaptionImage)
+	write.POST("/image/:id/composite", s.handleCompositeImage)
+	write.POST("/collage", s.handleCreateCollage)
+	write.POST("/image/:id/redact", s.handleRedactImage)
+	write.POST("/image/:id/upscale", s.handleUpscaleImage)
+	write.PATCH("/image/:id/metadata", s.handleUpdateMetadata)
+
+	admin := g.Group("/admin", s.allowNetworks(s.cfg.Network.AdminCIDRs), s.requireClientCert(), s.requireScope(auth.ScopeAdmin))
+	admin.POST("/reprocess", s.handleReprocess)
+	admin.GET("/audit", s.handleListAudit)
+	admin.GET("/stats", s.handleStats)
+	admin.GET("/stats/timeseries", s.handleStatsTimeseries)
+	admin.POST("/verify", s.handleStartVerify)
+	admin.GET("/verify", s.handleVerifyStatus)
+	admin.POST("/consistency", s.handleStartConsistency)
+	admin.GET("/consistency", s.handleConsistencyStatus)
+	admin.GET("/replication", s.handleReplicationStatus)
+	admin.GET("/webhooks", s.handleListWebhooks)
+	admin.POST("/webhooks/:id/redeliver", s.handleRedeliverWebhook)
+	admin.GET("/processing", s.handleProcessingStatus)
+	admin.POST("/processing/pause", s.handlePauseProcessing)
+	admin.POST("/processing/resume", s.handleResumeProcessing)
+	admin.GET("/quarantine", s.handleListQuarantine)
+	admin.GET("/quarantine/:id", s.handleGetQuarantine)
+	admin.PATCH("/quarantine/:id", s.handleUpdateQuarantine)
+	admin.POST("/quarantine/:id/requeue", s.handleRequeueQuarantine)
+	admin.DELETE("/quarantine/:id", s.handleDeleteQuarantine)
+	admin.POST("/tokens", s.handleIssueToken)
+	admin.GET("/duplicates", s.handleListDuplicates)
+	admin.POST("/duplicates/merge", s.handleMergeDuplicates)
+	admin.GET("/export", s.handleExport)
+}
+
 func (s *Server) Start() error {
-	return s.router.Run(s.cfg.ServerAddr)
+	ln, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	if !s.cfg.TLS.Enabled() {
+		log.Printf("server.Start: serving HTTP on %s", s.cfg.ServerAddr)
+		err = s.http.Serve(ln)
+	} else {
+		m := s.autocertManager()
+		if s.http.TLSConfig, err = s.tlsConfig(m); err != nil {
+			ln.Close()
+			return err
+		}
+		log.Printf("server.Start: serving HTTPS on %s", s.cfg.ServerAddr)
+		if m != nil {
+			// Answers HTTP-01 challenges and redirects everything else to HTTPS
+			go func() {
+				log.Printf("server.Start: redirecting HTTP on %s to HTTPS", s.cfg.TLS.HTTPRedirectAddr)
+				if err := http.ListenAndServe(s.cfg.TLS.HTTPRedirectAddr, m.HTTPHandler(nil)); err != nil {
+					log.Printf("server.Start: http listener: %v", err)
+				}
+			}()
+			// Certificates come from TLSConfig.GetCertificate
+			err = s.http.ServeTLS(ln, "", "")
+		} else {
+			err = s.http.ServeTLS(ln, s.cfg.TLS.CertFile, s.cfg.TLS.KeyFile)
+		}
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
+// Stop stops accepting connections and waits for in-flight requests to
+// finish. Closing a unix socket listener also removes the socket file.
 func (s *Server) Stop() {
-	// No shutdown needed for gin
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.http.Shutdown(ctx); err != nil {
+		log.Printf("server.Stop: %v", err)
+	}
+}
+
+// ImageMessage is the processing message for an image. It is keyed by the
+// image ID so, with a hash balancer, every message for one image lands on the
+// same partition and is handled by a single consumer in the group.
+func ImageMessage(id uuid.UUID) kafka.Message {
+	return kafka.Message{Key: []byte(id.String()), Value: []byte(id.String())}
+}
+
+// enqueue publishes the image ID for processing by the worker
+func (s *Server) enqueue(ctx context.Context, id uuid.UUID) error {
+	return s.kafkaBreaker.Do(func() error {
+		ctx, cancel := context.WithTimeout(ctx, s.cfg.KafkaBreaker.PublishTimeout)
+		defer cancel()
+		return s.producer.WriteMessages(ctx, ImageMessage(id))
+	})
 }
 
-func (s *Server) isValidImageType(file *multipart.FileHeader) bool {
+// detectImageType sniffs the uploaded file and returns its MIME type and
+// whether it is one of the supported image formats
+func (s *Server) detectImageType(file *multipart.FileHeader) (string, bool) {
 	validTypes := map[string]bool{
 		"image/jpeg": true,
 		"image/jpg":  true,
@@ -75,23 +278,23 @@ func (s *Server) isValidImageType(file *multipart.FileHeader) bool {
 	// Check MIME type from header
 	src, err := file.Open()
 	if err != nil {
-		return false
+		return "", false
 	}
 	defer src.Close()
 
 	// Read first 512 bytes to detect content type
 	buffer := make([]byte, 512)
-	_, err = src.Read(buffer)
+	n, err := src.Read(buffer)
 	if err != nil {
-		return false
+		return "", false
 	}
 
-	contentType := http.DetectContentType(buffer)
-	return validTypes[contentType]
+	contentType := http.DetectContentType(buffer[:n])
+	return contentType, validTypes[contentType]
 }
 
 func (s *Server) validateImageFile(path string) error {
-	file, err := os.Open(path)
+	file, err := openStored(path)
 	if err != nil {
 		return err
 	}
@@ -102,13 +305,119 @@ func (s *Server) validateImageFile(path string) error {
 }
 
 func (s *Server) fileExists(path string) bool {
-	_, err := os.Stat(path)
+	_, err := statStored(path)
 	return err == nil
 }
 
+// serveImageFile serves a stored file of the image with an explicit
+// Content-Type and a Content-Disposition based on the uploaded filename,
+// instead of letting Gin guess from the on-disk extension
+func (s *Server) serveImageFile(c *gin.Context, img *models.Image, path, disposition string) {
+	// A HEAD request reads no content, so there is nothing to verify
+	if s.cfg.VerifyOnServe && c.Request.Method != http.MethodHead {
+		if err := verifyStoredFile(s.db, img.ID, path); err != nil {
+			log.Printf("server.serveImageFile: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Stored file failed integrity verification"})
+			return
+		}
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if path == img.OriginalPath && img.ContentType != "" {
+		contentType = img.ContentType
+	}
+	if contentType != "" {
+		c.Header("Content-Type", contentType)
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{
+		"filename": downloadFilename(img, path),
+	}))
+
+	// When the file was produced and its checksum, which unlike its mtime
+	// survive restores and replication; files without a checksum fall back
+	// to the mtime and size
+	modTime, sum, err := s.db.GetFileVersion(img.ID, path)
+	if err != nil {
+		log.Printf("server.serveImageFile: %v", err)
+	}
+	etag := ""
+	if sum != "" {
+		etag = `"` + sum + `"`
+	}
+	if n := s.sendFile(c, path, modTime, etag); n > 0 {
+		meterImage(img, MeteringEvent{Type: meterBandwidth, Bytes: n})
+	}
+}
+
+// variantFile returns the stored path of a named variant, or "" if the
+// variant has not been produced yet. ok is false for unknown variant names.
+func variantFile(img *models.Image, variant string) (path string, ok bool) {
+	switch variant {
+	case "original":
+		return img.OriginalPath, true
+	case "resized":
+		if img.ResizeStatus == "done" {
+			path = img.ProcessedPath
+		}
+	case "thumbnail":
+		if img.ThumbnailStatus == "done" {
+			path = img.ThumbnailPath
+		}
+	case "watermarked":
+		if img.WatermarkStatus == "done" {
+			path = img.WatermarkedPath
+		}
+	case "video":
+		if img.VideoStatus == "done" {
+			path = img.VideoPath
+		}
+	case "upscaled":
+		if img.UpscaleStatus == "done" {
+			path = img.UpscaledPath
+		}
+	default:
+		return "", false
+	}
+	return path, true
+}
+
+// downloadFilename derives a client-facing filename for a stored file,
+// e.g. holiday_thumb.jpg for the thumbnail of holiday.png
+func downloadFilename(img *models.Image, path string) string {
+	name := img.OriginalFilename
+	if name == "" {
+		name = img.ID.String() + filepath.Ext(img.OriginalPath)
+	}
+	if path == img.OriginalPath {
+		return name
+	}
+	// Variants are stored as <id>_<variant>.<ext>
+	suffix := strings.TrimPrefix(filepath.Base(path), img.ID.String())
+	return strings.TrimSuffix(name, filepath.Ext(name)) + suffix
+}
+
+// parseQuality reads the optional "quality" query parameter used to override
+// the configured JPEG quality for a single request. Returns 0 if not set.
+func (s *Server) parseQuality(c *gin.Context) (int, error) {
+	q := c.Query("quality")
+	if q == "" {
+		return 0, nil
+	}
+	quality, err := strconv.Atoi(q)
+	if err != nil || quality < 1 || quality > 100 {
+		return 0, fmt.Errorf("quality must be an integer between 1 and 100")
+	}
+	return quality, nil
+}
+
 func (s *Server) handleUpload(c *gin.Context) {
 	const op = "server.handleUpload"
 
+	if s.readiness.State() == stateUnready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service is not ready, try again later"})
+		return
+	}
+
 	file, err := c.FormFile("image")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No image file provided"})
@@ -116,7 +425,8 @@ func (s *Server) handleUpload(c *gin.Context) {
 	}
 
 	// Validate file type
-	if !s.isValidImageType(file) {
+	contentType, ok := s.detectImageType(file)
+	if !ok {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image format. Only JPEG, PNG, and GIF are supported"})
 		return
 	}
@@ -127,12 +437,49 @@ func (s *Server) handleUpload(c *gin.Context) {
 		return
 	}
 
+	// Refuse early instead of failing mid-copy on a full disk
+	if !s.hasSpaceFor(file.Size) {
+		metrics.UploadsRejectedTotal.WithLabelValues("disk_full").Inc()
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Insufficient storage space, try again later"})
+		return
+	}
+
+	// ?sync=true processes the image before answering instead of queueing it
+	inline, err := strconv.ParseBool(c.DefaultQuery("sync", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sync must be true or false"})
+		return
+	}
+	if inline && file.Size > s.cfg.SyncUpload.MaxSizeMB*1024*1024 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("File too large to process synchronously. Maximum size is %dMB", s.cfg.SyncUpload.MaxSizeMB)})
+		return
+	}
+
+	fields, err := s.parseUploadFields(c.PostForm)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if inline && fields.ProcessAt != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "process_at can't be combined with sync"})
+		return
+	}
+
+	// Quotas are best effort: a failed check lets the upload through
+	if err := s.checkQuota(requestOwner(c), file.Size); errors.Is(err, errQuotaExceeded) {
+		metrics.UploadsRejectedTotal.WithLabelValues("quota").Inc()
+		c.JSON(http.StatusForbidden, gin.H{"error": "Storage quota exceeded"})
+		return
+	} else if err != nil {
+		log.Printf("%s: %v", op, err)
+	}
+
 	id := uuid.New()
 	ext := strings.ToLower(filepath.Ext(file.Filename))
 	if ext == "" {
 		ext = ".jpg" // Default extension
 	}
-	originalPath := filepath.Join(s.cfg.StoragePath, "original", id.String()+ext)
+	originalPath := filepath.Join(ShardDir(s.cfg.StoragePath, "original", id), id.String()+ext)
 
 	if err := os.MkdirAll(filepath.Dir(originalPath), 0755); err != nil {
 		log.Printf("%s: failed to create directory: %v", op, err)
@@ -140,14 +487,6 @@ func (s *Server) handleUpload(c *gin.Context) {
 		return
 	}
 
-	f, err := os.Create(originalPath)
-	if err != nil {
-		log.Printf("%s: failed to create file: %v", op, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create file"})
-		return
-	}
-	defer f.Close()
-
 	src, err := file.Open()
 	if err != nil {
 		log.Printf("%s: failed to open uploaded file: %v", op, err)
@@ -156,7 +495,11 @@ func (s *Server) handleUpload(c *gin.Context) {
 	}
 	defer src.Close()
 
-	if _, err := io.Copy(f, src); err != nil {
+	err = writeStored(originalPath, func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+	if err != nil {
 		log.Printf("%s: failed to copy file: %v", op, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
 		return
@@ -170,35 +513,53 @@ func (s *Server) handleUpload(c *gin.Context) {
 		return
 	}
 
-	img := models.Image{
-		ID:              id,
-		Status:          "pending",
-		OriginalPath:    originalPath,
-		ResizeStatus:    "pending",
-		ThumbnailStatus: "pending",
-		WatermarkStatus: "pending",
+	// Keep only the base name, clients may send full paths
+	fields.Owner = requestOwner(c)
+	img := fields.image(id, originalPath, filepath.Base(file.Filename), contentType, requestTenant(c))
+	img.Size = file.Size
+	if inline {
+		err = s.saveUpload(img)
+	} else {
+		err = s.storeUpload(c.Request.Context(), img)
 	}
-	if err := s.db.SaveImage(&img); err != nil {
-		log.Printf("%s: failed to save to database: %v", op, err)
-		os.Remove(originalPath) // Clean up file
+	if err != nil {
+		log.Printf("%s: %v", op, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save image metadata"})
 		return
 	}
 
-	// Send to Kafka
-	err = s.producer.WriteMessages(c.Request.Context(), kafka.Message{Value: []byte(id.String())})
-	if err != nil {
-		log.Printf("%s: failed to send to kafka: %v", op, err)
-		// Don't return error here, just log it - the image is saved and can be processed manually
-	}
+	s.audit(c, "upload", id, map[string]any{
+		"filename": img.OriginalFilename,
+		"size":     file.Size,
+		"preset":   fields.Preset,
+		"sync":     inline,
+	})
 
 	log.Printf("Image uploaded successfully: %s", id.String())
+	if inline {
+		s.processSync(c, img)
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"id":      id.String(),
+		"status":  img.Status,
 		"message": "Image uploaded successfully",
 	})
 }
 
+// deferProcessing marks an uploaded image as deferred and stores its
+// processing message in the outbox, to be published once Kafka is back
+func (s *Server) deferProcessing(img *models.Image, reason string) {
+	img.Status = "deferred"
+	if err := s.db.UpdateImage(img); err != nil {
+		log.Printf("server.deferProcessing: %v", err)
+	}
+	if err := s.storeForRelay(img.ID, reason); err != nil {
+		log.Printf("server.deferProcessing: %v", err)
+	}
+	recordEvent(s.db, img.ID, "deferred", "", reason)
+}
+
 func (s *Server) handleGetImage(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := uuid.Parse(idStr)
@@ -222,6 +583,11 @@ func (s *Server) handleGetImage(c *gin.Context) {
 		return
 	}
 
+	if img.ResizeStatus == "skipped" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Resize was skipped at upload"})
+		return
+	}
+
 	// Check if processed file exists
 	if img.ProcessedPath == "" || !s.fileExists(img.ProcessedPath) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Processed image not found"})
@@ -229,7 +595,7 @@ func (s *Server) handleGetImage(c *gin.Context) {
 	}
 
 	// Return the processed image file
-	c.File(img.ProcessedPath)
+	s.serveImageFile(c, img, img.ProcessedPath, "inline")
 }
 
 func (s *Server) handleGetImageInfo(c *gin.Context) {
@@ -246,16 +612,37 @@ func (s *Server) handleGetImageInfo(c *gin.Context) {
 		return
 	}
 
+	// Density of the original, 0 when it doesn't declare one
+	dpi, _ := readDPI(img.OriginalPath)
+
 	c.JSON(http.StatusOK, gin.H{
-		"id":               img.ID.String(),
-		"status":           img.Status,
-		"original_path":    img.OriginalPath,
-		"processed_path":   img.ProcessedPath,
-		"thumbnail_path":   img.ThumbnailPath,
-		"watermarked_path": img.WatermarkedPath,
-		"resize_status":    img.ResizeStatus,
-		"thumbnail_status": img.ThumbnailStatus,
-		"watermark_status": img.WatermarkStatus,
+		"id":                img.ID.String(),
+		"status":            img.Status,
+		"dpi":               dpi,
+		"original_path":     img.OriginalPath,
+		"processed_path":    img.ProcessedPath,
+		"thumbnail_path":    img.ThumbnailPath,
+		"watermarked_path":  img.WatermarkedPath,
+		"resize_status":     img.ResizeStatus,
+		"thumbnail_status":  img.ThumbnailStatus,
+		"watermark_status":  img.WatermarkStatus,
+		"video_status":      img.VideoStatus,
+		"video_path":        img.VideoPath,
+		"upscale_status":    img.UpscaleStatus,
+		"upscaled_path":     img.UpscaledPath,
+		"preset":            img.Preset,
+		"options":           img.Options,
+		"title":             img.Title,
+		"description":       img.Description,
+		"tags":              img.Tags,
+		"original_filename": img.OriginalFilename,
+		"content_type":      img.ContentType,
+		"process_at":        img.ProcessAt,
+		"tenant":            img.Tenant,
+		"owner":             img.Owner,
+		"callback_url":      img.CallbackURL,
+		"errors":            img.Errors,
+		"attempts":          img.Attempts,
 	})
 }
 
@@ -278,7 +665,7 @@ func (s *Server) handleGetOriginalImage(c *gin.Context) {
 		return
 	}
 
-	c.File(img.OriginalPath)
+	s.serveImageFile(c, img, img.OriginalPath, "inline")
 }
 
 func (s *Server) handleGetThumbnail(c *gin.Context) {
@@ -295,17 +682,22 @@ func (s *Server) handleGetThumbnail(c *gin.Context) {
 		return
 	}
 
-	if img.Status != "done" || img.ThumbnailPath == "" || !s.fileExists(img.ThumbnailPath) {
-		// Return original image if thumbnail not ready
-		if s.fileExists(img.OriginalPath) {
-			c.File(img.OriginalPath)
-		} else {
+	if img.ThumbnailStatus != "done" || img.ThumbnailPath == "" || !s.fileExists(img.ThumbnailPath) {
+		switch {
+		case !s.fileExists(img.OriginalPath):
 			c.JSON(http.StatusNotFound, gin.H{"error": "Image not available"})
+		case img.ThumbnailStatus == "skipped":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Thumbnail was skipped at upload"})
+		case img.ThumbnailStatus == "expired":
+			// Removed by the retention policy, don't bring it back
+			s.serveImageFile(c, img, img.OriginalPath, "inline")
+		default:
+			s.serveLazyVariant(c, img, "thumbnail")
 		}
 		return
 	}
 
-	c.File(img.ThumbnailPath)
+	s.serveImageFile(c, img, img.ThumbnailPath, "inline")
 }
 
 func (s *Server) handleGetWatermarkedImage(c *gin.Context) {
@@ -323,16 +715,121 @@ func (s *Server) handleGetWatermarkedImage(c *gin.Context) {
 	}
 
 	if img.WatermarkStatus != "done" || img.WatermarkedPath == "" || !s.fileExists(img.WatermarkedPath) {
-		// Return original image if watermarked not ready
-		if s.fileExists(img.OriginalPath) {
-			c.File(img.OriginalPath)
-		} else {
+		switch {
+		case !s.fileExists(img.OriginalPath):
 			c.JSON(http.StatusNotFound, gin.H{"error": "Image not available"})
+		case img.WatermarkStatus == "skipped":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Watermark was skipped at upload"})
+		case img.WatermarkStatus == "expired":
+			// Removed by the retention policy, don't bring it back
+			s.serveImageFile(c, img, img.OriginalPath, "inline")
+		default:
+			s.serveLazyVariant(c, img, "watermarked")
 		}
 		return
 	}
 
-	c.File(img.WatermarkedPath)
+	s.serveImageFile(c, img, img.WatermarkedPath, "inline")
+}
+
+func (s *Server) handleDownloadImage(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	img, err := s.db.GetImage(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	path, ok := variantFile(img, c.DefaultQuery("variant", "original"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid variant. Use original, resized, thumbnail, watermarked, video or upscaled"})
+		return
+	}
+	if path == "" || !s.fileExists(path) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Variant not available"})
+		return
+	}
+
+	s.serveImageFile(c, img, path, "attachment")
+}
+
+// handleArchiveImage streams a zip of all available variants directly to the
+// response without creating temp files
+func (s *Server) handleArchiveImage(c *gin.Context) {
+	const op = "server.handleArchiveImage"
+
+	idStr := c.Param("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	img, err := s.db.GetImage(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	if !s.fileExists(img.OriginalPath) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Original image file not found"})
+		return
+	}
+
+	name := downloadFilename(img, img.OriginalPath)
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": strings.TrimSuffix(name, filepath.Ext(name)) + ".zip",
+	}))
+	c.Status(http.StatusOK)
+
+	zw := zip.NewWriter(c.Writer)
+	defer zw.Close()
+
+	for _, variant := range []string{"original", "resized", "thumbnail", "watermarked", "video", "upscaled"} {
+		path, _ := variantFile(img, variant)
+		if path == "" || !s.fileExists(path) {
+			continue
+		}
+		// Headers are already sent, so failures can only be logged
+		if err := addFileToZip(zw, path, downloadFilename(img, path)); err != nil {
+			log.Printf("%s: failed to add %s of image %s: %v", op, variant, img.ID.String(), err)
+			return
+		}
+	}
+}
+
+func addFileToZip(zw *zip.Writer, path, name string) error {
+	info, err := statStored(path)
+	if err != nil {
+		return err
+	}
+	f, err := openStored(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	// Images are already compressed
+	header.Method = zip.Store
+
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
 }
 
 func (s *Server) handleResizeImage(c *gin.Context) {
@@ -354,25 +851,58 @@ func (s *Server) handleResizeImage(c *gin.Context) {
 		return
 	}
 
-	if img.ResizeStatus == "done" {
+	// A new geometry re-renders a completed resize
+	options, changed, err := parseResizeParams(c, img.Options)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if img.ResizeStatus == "done" && !changed {
 		c.JSON(http.StatusOK, gin.H{"message": "Resize already completed", "path": img.ProcessedPath})
 		return
 	}
 
+	quality, err := s.parseQuality(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Start resize processing
 	go func() {
-		src, err := imaging.Open(img.OriginalPath)
-		if err != nil {
-			log.Printf("Failed to open image for resize: %v", err)
-			return
+		s.limiter.Acquire(context.Background())
+		defer s.limiter.Release()
+
+		processor := newProcessorFor(s.cfg, s.db, img)
+
+		// An engine reads the original itself
+		var src image.Image
+		if processor.engine == nil {
+			release, err := s.limiter.AcquireMemory(context.Background(), img.OriginalPath)
+			if err != nil {
+				log.Printf("Failed to open image for resize: %v", err)
+				return
+			}
+			defer release()
+
+			if src, err = s.decoder.Open(img.OriginalPath); err != nil {
+				log.Printf("Failed to open image for resize: %v", err)
+				return
+			}
 		}
 
-		processor := NewImageProcessor(s.cfg)
+		// Only for this run, the stored options are left alone
+		img.Options = options
+		if quality > 0 {
+			img.Options.Quality = quality
+		}
 		if err := processor.ResizeHandler(img, src); err != nil {
 			log.Printf("Resize processing failed: %v", err)
 		}
 	}()
 
+	s.audit(c, "resize", img.ID, nil)
 	c.JSON(http.StatusAccepted, gin.H{"message": "Resize processing started"})
 }
 
@@ -400,20 +930,45 @@ func (s *Server) handleThumbnailImage(c *gin.Context) {
 		return
 	}
 
+	quality, err := s.parseQuality(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Start thumbnail processing
 	go func() {
-		src, err := imaging.Open(img.OriginalPath)
-		if err != nil {
-			log.Printf("Failed to open image for thumbnail: %v", err)
-			return
+		s.limiter.Acquire(context.Background())
+		defer s.limiter.Release()
+
+		processor := newProcessorFor(s.cfg, s.db, img)
+
+		// An engine reads the original itself
+		var src image.Image
+		if processor.engine == nil {
+			release, err := s.limiter.AcquireMemory(context.Background(), img.OriginalPath)
+			if err != nil {
+				log.Printf("Failed to open image for thumbnail: %v", err)
+				return
+			}
+			defer release()
+
+			if src, err = s.decoder.Open(img.OriginalPath); err != nil {
+				log.Printf("Failed to open image for thumbnail: %v", err)
+				return
+			}
 		}
 
-		processor := NewImageProcessor(s.cfg)
+		if quality > 0 {
+			// Only for this run, the stored options are left alone
+			img.Options.Quality = quality
+		}
 		if err := processor.ThumbnailHandler(img, src); err != nil {
 			log.Printf("Thumbnail processing failed: %v", err)
 		}
 	}()
 
+	s.audit(c, "thumbnail", img.ID, nil)
 	c.JSON(http.StatusAccepted, gin.H{"message": "Thumbnail processing started"})
 }
 
@@ -441,20 +996,41 @@ func (s *Server) handleWatermarkImage(c *gin.Context) {
 		return
 	}
 
+	quality, err := s.parseQuality(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Start watermark processing
 	go func() {
-		src, err := imaging.Open(img.OriginalPath)
+		s.limiter.Acquire(context.Background())
+		defer s.limiter.Release()
+
+		release, err := s.limiter.AcquireMemory(context.Background(), img.OriginalPath)
 		if err != nil {
 			log.Printf("Failed to open image for watermark: %v", err)
 			return
 		}
+		defer release()
 
-		processor := NewImageProcessor(s.cfg)
+		src, err := s.decoder.Open(img.OriginalPath)
+		if err != nil {
+			log.Printf("Failed to open image for watermark: %v", err)
+			return
+		}
+
+		processor := newProcessorFor(s.cfg, s.db, img)
+		if quality > 0 {
+			// Only for this run, the stored options are left alone
+			img.Options.Quality = quality
+		}
 		if err := processor.WatermarkHandler(img, src); err != nil {
 			log.Printf("Watermark processing failed: %v", err)
 		}
 	}()
 
+	s.audit(c, "watermark", img.ID, nil)
 	c.JSON(http.StatusAccepted, gin.H{"message": "Watermark processing started"})
 }
 
@@ -473,70 +1049,227 @@ func (s *Server) handleDeleteImage(c *gin.Context) {
 		return
 	}
 
-	// Delete files
-	os.Remove(img.OriginalPath)
-	os.Remove(img.ProcessedPath)
-	os.Remove(img.ThumbnailPath)
-	os.Remove(img.WatermarkedPath)
-
-	if err := s.db.DeleteImage(id); err != nil {
+	if err := s.removeImage(img); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("%s: %v", op, err)})
 		return
 	}
+	s.audit(c, "delete", id, nil)
 
 	c.Status(http.StatusNoContent)
 }
 
+// removeImage deletes an image's files, their replicas and its row
+func (s *Server) removeImage(img *models.Image) error {
+	paths := []string{img.OriginalPath, img.ProcessedPath, img.ThumbnailPath, img.WatermarkedPath, img.VideoPath, img.UpscaledPath}
+	for _, path := range paths {
+		if path != "" {
+			removeStored(path)
+		}
+	}
+	processor := NewImageProcessor(s.cfg, s.db)
+	for name, preset := range s.cfg.Presets {
+		path := processor.presetPath(img.ID, name, preset)
+		os.Remove(path)
+		paths = append(paths, path)
+	}
+	for _, path := range processor.derivedPaths(img.ID) {
+		os.Remove(path)
+		paths = append(paths, path)
+	}
+	removeReplicas(s.cfg, paths...)
+
+	return s.db.DeleteImage(img.ID)
+}
+
+const (
+	defaultResizeWidth   = 800
+	defaultThumbnailSize = 100
+)
+
 // Separate processing handlers
 type ImageProcessor struct {
-	cfg *models.Config
+	cfg     *models.Config
+	db      *storage.Storage
+	engine  engine // nil for the default imaging engine
+	quality int    // JPEG quality, defaults to cfg.JPEGQuality
+	icc     []byte // ICC profile embedded into outputs, nil for none
+	dpi     int    // pixel density written into outputs, 0 for none
+	// Matte transparent images are flattened onto when saved as JPEG
+	background color.NRGBA
+}
+
+func NewImageProcessor(cfg *models.Config, db *storage.Storage) *ImageProcessor {
+	// The engine is validated at startup with CheckEngine
+	eng, _ := newEngine(cfg)
+	return &ImageProcessor{cfg: cfg, db: db, engine: eng, quality: cfg.JPEGQuality, background: white}
+}
+
+// newProcessorFor returns a processor honoring the image's upload options
+func newProcessorFor(cfg *models.Config, db *storage.Storage, img *models.Image) *ImageProcessor {
+	p := NewImageProcessor(cfg, db)
+	if img.Options.Quality > 0 {
+		p.quality = img.Options.Quality
+	}
+	if cfg.ICCProfile != "strip" {
+		icc, err := readICCProfile(img.OriginalPath)
+		if err != nil {
+			log.Printf("server.newProcessorFor: failed to read color profile of %s: %v", img.OriginalPath, err)
+		}
+		p.icc = icc
+	}
+	p.background = backgroundFor(img.Options)
+	p.dpi = img.Options.DPI
+	if p.dpi == 0 {
+		dpi, err := readDPI(img.OriginalPath)
+		if err != nil {
+			log.Printf("server.newProcessorFor: failed to read density of %s: %v", img.OriginalPath, err)
+		}
+		p.dpi = dpi
+	}
+	return p
+}
+
+// outputFor resolves the encoding of an operation's output: the upload's
+// per-operation choice, then its format and quality, then the configured
+// default for the operation, then jpg at the processor's quality
+func (p *ImageProcessor) outputFor(img *models.Image, operation string) models.OutputFormat {
+	out := p.cfg.Outputs[operation]
+	if img.Options.Format != "" {
+		out.Format = img.Options.Format
+	}
+	if img.Options.Quality > 0 {
+		out.Quality = img.Options.Quality
+	}
+	if o, ok := img.Options.Outputs[operation]; ok {
+		if o.Format != "" {
+			out.Format = o.Format
+		}
+		if o.Quality > 0 {
+			out.Quality = o.Quality
+		}
+	}
+	if out.Format == "" {
+		out.Format = "jpg"
+	}
+	if out.Quality == 0 {
+		out.Quality = p.quality
+	}
+	return out
+}
+
+// variantPath returns where a processed variant is stored, e.g. <id>_thumb.png
+func (p *ImageProcessor) variantPath(img *models.Image, suffix, format string) string {
+	return filepath.Join(ShardDir(p.cfg.StoragePath, "processed", img.ID), img.ID.String()+"_"+suffix+"."+format)
+}
+
+// derivedPaths lists the on-request renders of an image, captions and
+// redactions, which its row doesn't reference
+func (p *ImageProcessor) derivedPaths(id uuid.UUID) []string {
+	var paths []string
+	for _, kind := range []string{"caption", "redacted"} {
+		matches, _ := filepath.Glob(filepath.Join(ShardDir(p.cfg.StoragePath, "processed", id), id.String()+"_"+kind+"_*"))
+		paths = append(paths, matches...)
+	}
+	return paths
 }
 
-func NewImageProcessor(cfg *models.Config) *ImageProcessor {
-	return &ImageProcessor{cfg: cfg}
+// withQuality returns a copy of the processor encoding at quality
+func (p *ImageProcessor) withQuality(quality int) *ImageProcessor {
+	c := *p
+	c.quality = quality
+	return &c
+}
+
+// save encodes the image to path using the processor's output settings
+func (p *ImageProcessor) save(img image.Image, path string) error {
+	if err := p.encode(img, path); err != nil {
+		return err
+	}
+	if err := embedICCProfile(path, p.icc); err != nil {
+		return err
+	}
+	return embedDPI(path, p.dpi)
+}
+
+func (p *ImageProcessor) encode(img image.Image, path string) error {
+	if p.cfg.PNGOptimize && strings.EqualFold(filepath.Ext(path), ".png") {
+		return p.savePNG(img, path)
+	}
+	if strings.EqualFold(filepath.Ext(path), ".webp") {
+		if p.engine == nil {
+			return fmt.Errorf("webp output requires the vips engine")
+		}
+		return p.engine.Encode(img, path, p.quality)
+	}
+	format, err := imaging.FormatFromFilename(path)
+	if err != nil {
+		return err
+	}
+	if format == imaging.JPEG {
+		img = flatten(img, p.background)
+	}
+	return writeStored(path, func(w io.Writer) error {
+		return imaging.Encode(w, img, format, imaging.JPEGQuality(p.quality))
+	})
 }
 
 // ResizeHandler handles image resizing
-func (p *ImageProcessor) ResizeHandler(img *models.Image, src image.Image) error {
+func (p *ImageProcessor) ResizeHandler(img *models.Image, src image.Image) (err error) {
 	const op = "ImageProcessor.ResizeHandler"
 
 	log.Printf("%s: starting resize for image %s", op, img.ID.String())
 
 	// Update status to processing
 	img.ResizeStatus = "processing"
-	db, err := storage.NewStorage(p.cfg.DatabaseURL)
-	if err != nil {
-		return fmt.Errorf("%s: %v", op, err)
-	}
-	defer db.Close()
+	out := p.outputFor(img, "resize")
+	started := time.Now()
+	recordEvent(p.db, img.ID, "started", "resize", "")
+	defer func() {
+		recordOutcome(p.db, img, "resize", started, err)
+		observeOperation("resize", out.Format, started, err)
+	}()
 
-	if err := db.UpdateImage(img); err != nil {
+	if err := p.db.UpdateOperation(img.ID, "resize", img.ResizeStatus, img.ProcessedPath); err != nil {
 		log.Printf("%s: failed to update resize status: %v", op, err)
 	}
 
 	// Create processed directory if it doesn't exist
-	processedDir := filepath.Join(p.cfg.StoragePath, "processed")
+	processedDir := ShardDir(p.cfg.StoragePath, "processed", img.ID)
 	if err := os.MkdirAll(processedDir, 0755); err != nil {
 		img.ResizeStatus = "error"
-		db.UpdateImage(img)
+		p.db.UpdateOperation(img.ID, "resize", img.ResizeStatus, img.ProcessedPath)
 		return fmt.Errorf("%s: failed to create processed directory: %v", op, err)
 	}
 
-	// Resize to 800px width, maintain aspect ratio
-	resized := imaging.Resize(src, 800, 0, imaging.Lanczos)
-	resizedPath := filepath.Join(processedDir, img.ID.String()+"_resized.jpg")
+	// Resize to the requested width (800px by default) keeping the aspect
+	// ratio, or to an exact size in the requested mode
+	spec := resizeSpecFor(img.Options)
+	p = p.withQuality(out.Quality)
+	resizedPath := p.variantPath(img, "resized", out.Format)
 
-	if err := imaging.Save(resized, resizedPath); err != nil {
+	var saveErr error
+	if p.engine != nil {
+		saveErr = p.engine.Resize(img.OriginalPath, resizedPath, spec, p.quality)
+		if saveErr == nil {
+			// libvips keeps the original's density, a requested one is set here
+			saveErr = embedDPI(resizedPath, img.Options.DPI)
+		}
+	} else {
+		resized := sharpen(spec.apply(src), p.cfg.SharpenAmount, p.cfg.SharpenRadius)
+		saveErr = p.saveProgressive(resized, resizedPath)
+	}
+	if err := saveErr; err != nil {
 		log.Printf("%s: failed to save resized image: %v", op, err)
 		img.ResizeStatus = "error"
-		db.UpdateImage(img)
+		p.db.UpdateOperation(img.ID, "resize", img.ResizeStatus, img.ProcessedPath)
 		return fmt.Errorf("%s: %v", op, err)
 	}
 
 	img.ProcessedPath = resizedPath
 	img.ResizeStatus = "done"
+	recordChecksum(p.db, img.ID, "resized", resizedPath)
 
-	if err := db.UpdateImage(img); err != nil {
+	if err := p.db.UpdateOperation(img.ID, "resize", img.ResizeStatus, img.ProcessedPath); err != nil {
 		log.Printf("%s: failed to update image with resize results: %v", op, err)
 		return fmt.Errorf("%s: %v", op, err)
 	}
@@ -546,46 +1279,63 @@ func (p *ImageProcessor) ResizeHandler(img *models.Image, src image.Image) error
 }
 
 // ThumbnailHandler handles thumbnail generation
-func (p *ImageProcessor) ThumbnailHandler(img *models.Image, src image.Image) error {
+func (p *ImageProcessor) ThumbnailHandler(img *models.Image, src image.Image) (err error) {
 	const op = "ImageProcessor.ThumbnailHandler"
 
 	log.Printf("%s: starting thumbnail generation for image %s", op, img.ID.String())
 
 	// Update status to processing
 	img.ThumbnailStatus = "processing"
-	db, err := storage.NewStorage(p.cfg.DatabaseURL)
-	if err != nil {
-		return fmt.Errorf("%s: %v", op, err)
-	}
-	defer db.Close()
+	out := p.outputFor(img, "thumbnail")
+	started := time.Now()
+	recordEvent(p.db, img.ID, "started", "thumbnail", "")
+	defer func() {
+		recordOutcome(p.db, img, "thumbnail", started, err)
+		observeOperation("thumbnail", out.Format, started, err)
+	}()
 
-	if err := db.UpdateImage(img); err != nil {
+	if err := p.db.UpdateOperation(img.ID, "thumbnail", img.ThumbnailStatus, img.ThumbnailPath); err != nil {
 		log.Printf("%s: failed to update thumbnail status: %v", op, err)
 	}
 
 	// Create processed directory if it doesn't exist
-	processedDir := filepath.Join(p.cfg.StoragePath, "processed")
+	processedDir := ShardDir(p.cfg.StoragePath, "processed", img.ID)
 	if err := os.MkdirAll(processedDir, 0755); err != nil {
 		img.ThumbnailStatus = "error"
-		db.UpdateImage(img)
+		p.db.UpdateOperation(img.ID, "thumbnail", img.ThumbnailStatus, img.ThumbnailPath)
 		return fmt.Errorf("%s: failed to create processed directory: %v", op, err)
 	}
 
-	// Generate 100x100 thumbnail
-	thumb := imaging.Thumbnail(src, 100, 100, imaging.Lanczos)
-	thumbPath := filepath.Join(processedDir, img.ID.String()+"_thumb.jpg")
+	// Generate square thumbnail (100x100 by default)
+	size := img.Options.ThumbnailSize
+	if size == 0 {
+		size = defaultThumbnailSize
+	}
+	p = p.withQuality(out.Quality)
+	thumbPath := p.variantPath(img, "thumb", out.Format)
 
-	if err := imaging.Save(thumb, thumbPath); err != nil {
+	var saveErr error
+	if p.engine != nil {
+		saveErr = p.engine.Thumbnail(img.OriginalPath, thumbPath, size, p.quality, p.background, img.Options.Filter)
+		if saveErr == nil {
+			saveErr = embedDPI(thumbPath, img.Options.DPI)
+		}
+	} else {
+		thumb := imaging.Thumbnail(src, size, size, resampleFilter(img.Options.Filter))
+		saveErr = p.save(sharpen(thumb, p.cfg.SharpenAmount, p.cfg.SharpenRadius), thumbPath)
+	}
+	if err := saveErr; err != nil {
 		log.Printf("%s: failed to save thumbnail: %v", op, err)
 		img.ThumbnailStatus = "error"
-		db.UpdateImage(img)
+		p.db.UpdateOperation(img.ID, "thumbnail", img.ThumbnailStatus, img.ThumbnailPath)
 		return fmt.Errorf("%s: %v", op, err)
 	}
 
 	img.ThumbnailPath = thumbPath
 	img.ThumbnailStatus = "done"
+	recordChecksum(p.db, img.ID, "thumbnail", thumbPath)
 
-	if err := db.UpdateImage(img); err != nil {
+	if err := p.db.UpdateOperation(img.ID, "thumbnail", img.ThumbnailStatus, img.ThumbnailPath); err != nil {
 		log.Printf("%s: failed to update image with thumbnail results: %v", op, err)
 		return fmt.Errorf("%s: %v", op, err)
 	}
@@ -595,31 +1345,67 @@ func (p *ImageProcessor) ThumbnailHandler(img *models.Image, src image.Image) er
 }
 
 // WatermarkHandler handles watermark application
-func (p *ImageProcessor) WatermarkHandler(img *models.Image, src image.Image) error {
+func (p *ImageProcessor) WatermarkHandler(img *models.Image, src image.Image) (err error) {
 	const op = "ImageProcessor.WatermarkHandler"
 
 	log.Printf("%s: starting watermark application for image %s", op, img.ID.String())
 
 	// Update status to processing
 	img.WatermarkStatus = "processing"
-	db, err := storage.NewStorage(p.cfg.DatabaseURL)
-	if err != nil {
-		return fmt.Errorf("%s: %v", op, err)
-	}
-	defer db.Close()
+	out := p.outputFor(img, "watermark")
+	started := time.Now()
+	recordEvent(p.db, img.ID, "started", "watermark", "")
+	defer func() {
+		recordOutcome(p.db, img, "watermark", started, err)
+		observeOperation("watermark", out.Format, started, err)
+	}()
 
-	if err := db.UpdateImage(img); err != nil {
+	if err := p.db.UpdateOperation(img.ID, "watermark", img.WatermarkStatus, img.WatermarkedPath); err != nil {
 		log.Printf("%s: failed to update watermark status: %v", op, err)
 	}
 
 	// Create processed directory if it doesn't exist
-	processedDir := filepath.Join(p.cfg.StoragePath, "processed")
+	processedDir := ShardDir(p.cfg.StoragePath, "processed", img.ID)
 	if err := os.MkdirAll(processedDir, 0755); err != nil {
 		img.WatermarkStatus = "error"
-		db.UpdateImage(img)
+		p.db.UpdateOperation(img.ID, "watermark", img.WatermarkStatus, img.WatermarkedPath)
 		return fmt.Errorf("%s: failed to create processed directory: %v", op, err)
 	}
 
+	watermarked, err := p.applyWatermark(src)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		// Don't fail the entire process if watermark fails, just skip it
+		img.WatermarkStatus = "error"
+		p.db.UpdateOperation(img.ID, "watermark", img.WatermarkStatus, img.WatermarkedPath)
+		return fmt.Errorf("%s: watermark not available: %v", op, err)
+	}
+
+	p = p.withQuality(out.Quality)
+	watermarkedPath := p.variantPath(img, "watermarked", out.Format)
+
+	if err := p.saveProgressive(watermarked, watermarkedPath); err != nil {
+		log.Printf("%s: failed to save watermarked image: %v", op, err)
+		img.WatermarkStatus = "error"
+		p.db.UpdateOperation(img.ID, "watermark", img.WatermarkStatus, img.WatermarkedPath)
+		return fmt.Errorf("%s: %v", op, err)
+	}
+
+	img.WatermarkedPath = watermarkedPath
+	img.WatermarkStatus = "done"
+	recordChecksum(p.db, img.ID, "watermarked", watermarkedPath)
+
+	if err := p.db.UpdateOperation(img.ID, "watermark", img.WatermarkStatus, img.WatermarkedPath); err != nil {
+		log.Printf("%s: failed to update image with watermark results: %v", op, err)
+		return fmt.Errorf("%s: %v", op, err)
+	}
+
+	log.Printf("%s: successfully watermarked image %s to %s", op, img.ID.String(), watermarkedPath)
+	return nil
+}
+
+// applyWatermark overlays the watermark asset onto the bottom-right corner of src
+func (p *ImageProcessor) applyWatermark(src image.Image) (image.Image, error) {
 	// Load watermark image
 	watermarkPath := filepath.Join("/app", "watermark.png")
 	if _, err := os.Stat(watermarkPath); os.IsNotExist(err) {
@@ -629,11 +1415,7 @@ func (p *ImageProcessor) WatermarkHandler(img *models.Image, src image.Image) er
 
 	watermark, err := imaging.Open(watermarkPath)
 	if err != nil {
-		log.Printf("%s: failed to open watermark image %s: %v", op, watermarkPath, err)
-		// Don't fail the entire process if watermark fails, just skip it
-		img.WatermarkStatus = "error"
-		db.UpdateImage(img)
-		return fmt.Errorf("%s: watermark not available: %v", op, err)
+		return nil, fmt.Errorf("failed to open watermark image %s: %v", watermarkPath, err)
 	}
 
 	// Scale watermark to be 20% of the image width
@@ -647,48 +1429,33 @@ func (p *ImageProcessor) WatermarkHandler(img *models.Image, src image.Image) er
 		Y: bounds.Dy() - watermark.Bounds().Dy() - 20,
 	}
 
-	watermarked := imaging.Overlay(src, watermark, position, 0.7)
-	watermarkedPath := filepath.Join(processedDir, img.ID.String()+"_watermarked.jpg")
-
-	if err := imaging.Save(watermarked, watermarkedPath); err != nil {
-		log.Printf("%s: failed to save watermarked image: %v", op, err)
-		img.WatermarkStatus = "error"
-		db.UpdateImage(img)
-		return fmt.Errorf("%s: %v", op, err)
-	}
-
-	img.WatermarkedPath = watermarkedPath
-	img.WatermarkStatus = "done"
-
-	if err := db.UpdateImage(img); err != nil {
-		log.Printf("%s: failed to update image with watermark results: %v", op, err)
-		return fmt.Errorf("%s: %v", op, err)
-	}
+	return imaging.Overlay(src, watermark, position, 0.7), nil
+}
 
-	log.Printf("%s: successfully watermarked image %s to %s", op, img.ID.String(), watermarkedPath)
-	return nil
+// pipelineOperation is one variant produced by ProcessImage
+type pipelineOperation struct {
+	name string
+	run  func() error
 }
 
-func ProcessImage(idStr string, cfg *models.Config) error {
+func ProcessImage(idStr string, cfg *models.Config, db *storage.Storage, limiter *Limiter) error {
 	const op = "server.processImage"
 	id, err := uuid.Parse(idStr)
 	if err != nil {
 		log.Printf("%s: invalid UUID %s: %v", op, idStr, err)
+		quarantineMessage(db, idStr, nil, 1, "invalid image ID: "+err.Error())
 		return fmt.Errorf("%s: %v", op, err)
 	}
 
 	log.Printf("%s: starting processing for image %s", op, id.String())
 
-	db, err := storage.NewStorage(cfg.DatabaseURL)
-	if err != nil {
-		log.Printf("%s: failed to connect to database: %v", op, err)
-		return fmt.Errorf("%s: %v", op, err)
-	}
-	defer db.Close()
-
 	img, err := db.GetImage(id)
 	if err != nil {
 		log.Printf("%s: failed to get image %s from database: %v", op, id.String(), err)
+		// Only a message for an image that doesn't exist can't succeed later
+		if found, existsErr := db.ExistingImageIDs([]uuid.UUID{id}); existsErr == nil && !found[id] {
+			quarantineMessage(db, idStr, nil, 1, "image not found")
+		}
 		return fmt.Errorf("%s: %v", op, err)
 	}
 
@@ -697,53 +1464,149 @@ func ProcessImage(idStr string, cfg *models.Config) error {
 		return nil // Already processed or error
 	}
 
+	// Every run counts, including those cut short by a crash, so an image
+	// that keeps killing the worker isn't requeued as stuck forever
+	if img.Attempts["processing"] >= cfg.MaxProcessingAttempts {
+		quarantineImage(cfg, db, img)
+		return fmt.Errorf("%s: image %s quarantined", op, id.String())
+	}
+	if _, err := db.IncrementAttempts(id, "processing"); err != nil {
+		log.Printf("%s: failed to count attempt: %v", op, err)
+		return fmt.Errorf("%s: %v", op, err)
+	}
+
 	// Update main status to processing
 	img.Status = "processing"
 	if err := db.UpdateImage(img); err != nil {
 		log.Printf("%s: failed to update status to processing: %v", op, err)
 		return fmt.Errorf("%s: %v", op, err)
 	}
+	started := time.Now()
+	recordEvent(db, img.ID, "started", "", "")
 
-	// Open and validate the image once for all processors
-	src, err := imaging.Open(img.OriginalPath)
-	if err != nil {
-		log.Printf("%s: failed to open image %s: %v", op, img.OriginalPath, err)
-		img.Status = "error"
-		img.ResizeStatus = "error"
-		img.ThumbnailStatus = "error"
-		img.WatermarkStatus = "error"
-		db.UpdateImage(img)
-		return fmt.Errorf("%s: failed to open image: %v", op, err)
+	// Wait for a free processing slot before decoding
+	if err := limiter.Acquire(context.Background()); err != nil {
+		return fmt.Errorf("%s: %v", op, err)
 	}
+	defer limiter.Release()
+
+	// Create image processor honoring the upload options
+	processor := newProcessorFor(cfg, db, img)
+
+	// Open and validate the image once for all processors. An engine reads
+	// the original itself, so decoding is only needed for watermark/preset.
+	var src image.Image
+	if processor.engine == nil || img.Options.WatermarkEnabled() || img.Preset != "" {
+		// Reserve memory for the decoded pixels based on the header first
+		var release func()
+		release, err = limiter.AcquireMemory(context.Background(), img.OriginalPath)
+		if err == nil {
+			defer release()
+			src, err = limiter.Decode(img.OriginalPath)
+		}
+		if err != nil {
+			log.Printf("%s: failed to open image %s: %v", op, img.OriginalPath, err)
+			img.Status = "error"
+			img.ResizeStatus = "error"
+			img.ThumbnailStatus = "error"
+			img.WatermarkStatus = "error"
+			db.UpdateImage(img)
+			recordOutcome(db, img, "", started, fmt.Errorf("failed to open image: %v", err))
+			notifyFinished(cfg, db, img)
+			return fmt.Errorf("%s: failed to open image: %v", op, err)
+		}
 
-	log.Printf("%s: successfully opened image %s", op, id.String())
-
-	// Create image processor
-	processor := NewImageProcessor(cfg)
-
-	// Process with separate handlers
-	var processingErrors []error
+		log.Printf("%s: successfully opened image %s", op, id.String())
+		recordPerceptualHash(db, img.ID, src)
+	}
 
-	// Run resize handler
-	if err := processor.ResizeHandler(img, src); err != nil {
-		log.Printf("%s: resize failed: %v", op, err)
-		processingErrors = append(processingErrors, fmt.Errorf("resize: %v", err))
+	// Process with separate handlers, leaving out those skipped at upload
+	var operations []pipelineOperation
+	if img.Options.ResizeEnabled() {
+		operations = append(operations, pipelineOperation{"resize", func() error { return processor.ResizeHandler(img, src) }})
+	} else {
+		img.ResizeStatus = "skipped"
+	}
+	if img.Options.ThumbnailEnabled() {
+		operations = append(operations, pipelineOperation{"thumbnail", func() error { return processor.ThumbnailHandler(img, src) }})
+	} else {
+		img.ThumbnailStatus = "skipped"
+	}
+	if img.Options.WatermarkEnabled() {
+		operations = append(operations, pipelineOperation{"watermark", func() error { return processor.WatermarkHandler(img, src) }})
+	} else {
+		img.WatermarkStatus = "skipped"
+	}
+
+	// Animated GIFs also get a much smaller video
+	if wantsVideo(cfg, img) {
+		operations = append(operations, pipelineOperation{"video", func() error { return processor.VideoHandler(img) }})
+	}
+
+	// Upscaling was asked for at upload
+	if wantsUpscale(cfg, img) {
+		operations = append(operations, pipelineOperation{"upscale", func() error { return processor.UpscaleHandler(img) }})
+	}
+
+	// Render the preset requested at upload
+	if img.Preset != "" {
+		operations = append(operations, pipelineOperation{"preset", func() error {
+			presetStarted := time.Now()
+			recordEvent(db, img.ID, "started", "preset", img.Preset)
+			_, err := processor.RenderPreset(img, src, img.Preset)
+			recordOutcome(db, img, "preset", presetStarted, err)
+			return err
+		}})
+	}
+
+	// Run the operations concurrently on the decoded image. The slot held for
+	// decoding runs whatever cannot get an extra slot from the limiter, so
+	// the global bound is respected and the pipeline can't deadlock on it.
+	var (
+		mu               sync.Mutex
+		processingErrors []error
+		g                errgroup.Group
+	)
+	for _, operation := range operations {
+		run := func() {
+			if _, err := db.IncrementAttempts(id, operation.name); err != nil {
+				log.Printf("%s: failed to count %s attempt: %v", op, operation.name, err)
+			}
+			if err := operation.run(); err != nil {
+				log.Printf("%s: %s failed: %v", op, operation.name, err)
+				mu.Lock()
+				processingErrors = append(processingErrors, fmt.Errorf("%s: %v", operation.name, err))
+				mu.Unlock()
+			}
+		}
+		if limiter.TryAcquire() {
+			g.Go(func() error {
+				defer limiter.Release()
+				run()
+				return nil
+			})
+		} else {
+			run()
+		}
 	}
+	g.Wait()
 
-	// Run thumbnail handler
-	if err := processor.ThumbnailHandler(img, src); err != nil {
-		log.Printf("%s: thumbnail failed: %v", op, err)
-		processingErrors = append(processingErrors, fmt.Errorf("thumbnail: %v", err))
+	// Recognized text is only indexed for search, failing it doesn't fail
+	// the image
+	if cfg.OCR.Enabled {
+		recordOCRText(cfg, db, img)
 	}
 
-	// Run watermark handler
-	if err := processor.WatermarkHandler(img, src); err != nil {
-		log.Printf("%s: watermark failed: %v", op, err)
-		processingErrors = append(processingErrors, fmt.Errorf("watermark: %v", err))
+	// Without a decoded original the resized variant is fingerprinted, the
+	// hash only looks at a 9x8 downscale anyway
+	if src == nil && img.ResizeStatus == "done" {
+		if resized, err := decodeStored(img.ProcessedPath); err == nil {
+			recordPerceptualHash(db, img.ID, resized)
+		}
 	}
 
 	// Determine final status based on individual processing results
-	if len(processingErrors) == 3 {
+	if len(operations) > 0 && len(processingErrors) == len(operations) {
 		// All processing failed
 		img.Status = "error"
 	} else if len(processingErrors) > 0 {
@@ -760,12 +1623,15 @@ func ProcessImage(idStr string, cfg *models.Config) error {
 		log.Printf("%s: failed to update final status: %v", op, err)
 		return fmt.Errorf("%s: %v", op, err)
 	}
+	notifyFinished(cfg, db, img)
 
 	if len(processingErrors) > 0 {
+		recordOutcome(db, img, "", started, fmt.Errorf("processing finished with status %s: %v", img.Status, processingErrors))
 		log.Printf("%s: processing completed with some errors for image %s", op, id.String())
 		return fmt.Errorf("%s: processing completed with errors", op)
 	}
 
+	recordOutcome(db, img, "", started, nil)
 	log.Printf("%s: successfully processed image %s", op, id.String())
 	return nil
 }
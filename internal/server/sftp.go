@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// PollSFTP imports the images in the configured SFTP directory every
+// interval until ctx is canceled. Imported files are deleted or moved to the
+// processed directory; files that aren't valid images are moved to the
+// failed directory. Anything else that fails is tried again on the next poll.
+func (s *Server) PollSFTP(ctx context.Context) {
+	const op = "server.PollSFTP"
+	cfg := s.cfg.SFTP
+
+	fields, err := s.importFields(cfg.Preset, cfg.Options)
+	if err != nil {
+		log.Printf("%s: invalid sftp settings: %v", op, err)
+		return
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		// Nothing is pulled while the service can't take uploads
+		if s.readiness.State() != stateUnready {
+			if err := s.pollSFTP(ctx, fields); err != nil {
+				log.Printf("%s: %v", op, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sftpClient connects to the configured server
+func (s *Server) sftpClient(ctx context.Context) (*sftp.Client, error) {
+	cfg := s.cfg.SFTP
+
+	var methods []ssh.AuthMethod
+	if cfg.PrivateKeyPath != "" {
+		pem, err := os.ReadFile(cfg.PrivateKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key: %v", err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		methods = append(methods, ssh.Password(cfg.Password))
+	}
+
+	hostKey := ssh.InsecureIgnoreHostKey()
+	if cfg.KnownHostsPath != "" {
+		var err error
+		if hostKey, err = knownhosts.New(cfg.KnownHostsPath); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake has no context of its own
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, cfg.Addr, &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            methods,
+		HostKeyCallback: hostKey,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	client, err := sftp.NewClient(ssh.NewClient(sshConn, chans, reqs))
+	if err != nil {
+		sshConn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// pollSFTP imports the files currently in the remote directory
+func (s *Server) pollSFTP(ctx context.Context, fields *uploadFields) error {
+	const op = "server.pollSFTP"
+	cfg := s.cfg.SFTP
+
+	client, err := s.sftpClient(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: failed to connect to %s: %v", op, cfg.Addr, err)
+	}
+	defer client.Close()
+
+	entries, err := client.ReadDir(cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("%s: failed to list %s: %v", op, cfg.Dir, err)
+	}
+
+	for _, info := range entries {
+		if ctx.Err() != nil {
+			return nil
+		}
+		// Uploads still in progress are left for the next poll
+		if !info.Mode().IsRegular() || importSkipped(info.Name()) || time.Since(info.ModTime()) < cfg.MinAge {
+			continue
+		}
+		if !s.hasSpaceFor(info.Size()) {
+			metrics.UploadsRejectedTotal.WithLabelValues("disk_full").Inc()
+			return fmt.Errorf("%s: insufficient storage space, stopping until the next poll", op)
+		}
+		s.importSFTPFile(ctx, client, path.Join(cfg.Dir, info.Name()), fields)
+	}
+	return nil
+}
+
+// importSFTPFile imports one remote file and deletes or moves it
+func (s *Server) importSFTPFile(ctx context.Context, client *sftp.Client, remotePath string, fields *uploadFields) {
+	const op = "server.importSFTPFile"
+	cfg := s.cfg.SFTP
+	name := path.Base(remotePath)
+
+	f, err := client.Open(remotePath)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		return
+	}
+	img, size, err := s.importImage(ctx, f, name, int64(cfg.MaxSizeMB)<<20, fields, cfg.Tenant)
+	f.Close()
+	if importRejected(err) {
+		log.Printf("%s: rejected %s: %v", op, remotePath, err)
+		s.moveSFTPFile(client, remotePath, cfg.FailedDir)
+		return
+	}
+	if err != nil {
+		log.Printf("%s: failed to import %s: %v", op, remotePath, err)
+		return
+	}
+
+	if cfg.ProcessedDir != "" {
+		s.moveSFTPFile(client, remotePath, cfg.ProcessedDir)
+	} else if err := client.Remove(remotePath); err != nil {
+		log.Printf("%s: imported %s as %s but failed to remove it: %v", op, remotePath, img.ID.String(), err)
+	}
+	s.auditSystem("upload", img.ID, map[string]any{
+		"filename": img.OriginalFilename,
+		"size":     size,
+		"preset":   fields.Preset,
+		"source":   "sftp",
+	})
+	log.Printf("Image imported from sftp: %s (%s)", img.ID.String(), remotePath)
+}
+
+// moveSFTPFile moves a remote file into dir, replacing a file of the same
+// name. Failures are only logged; an imported file left behind is imported
+// again on the next poll.
+func (s *Server) moveSFTPFile(client *sftp.Client, remotePath, dir string) {
+	const op = "server.moveSFTPFile"
+
+	if err := client.MkdirAll(dir); err != nil {
+		log.Printf("%s: failed to create %s: %v", op, dir, err)
+		return
+	}
+	target := path.Join(dir, path.Base(remotePath))
+	// Plain SFTP rename fails when the target exists
+	if err := client.PosixRename(remotePath, target); err != nil {
+		client.Remove(target)
+		if err := client.Rename(remotePath, target); err != nil {
+			log.Printf("%s: failed to move %s to %s: %v", op, remotePath, target, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// applyShape cuts img to a circle or gives it rounded corners, leaving the
+// cut-off area transparent. A circle is cropped to a centered square first.
+// radius is the corner radius for rounded, 0 picks a tenth of the shorter
+// side.
+func applyShape(img image.Image, shape string, radius int) image.Image {
+	bounds := img.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+
+	var dst *image.NRGBA
+	switch shape {
+	case "circle":
+		dst = imaging.CropCenter(img, side, side)
+		radius = side / 2
+	case "rounded":
+		dst = imaging.Clone(img)
+		if radius <= 0 {
+			radius = side / 10
+		}
+		radius = min(radius, side/2)
+	default:
+		return img
+	}
+
+	w, h := dst.Bounds().Dx(), dst.Bounds().Dy()
+	r := float64(radius)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// Distance past the arc of the nearest corner; pixels off the
+			// corners are left alone
+			cx := math.Max(r-float64(x)-0.5, float64(x)+0.5-(float64(w)-r))
+			cy := math.Max(r-float64(y)-0.5, float64(y)+0.5-(float64(h)-r))
+			if cx <= 0 || cy <= 0 {
+				continue
+			}
+			// One pixel wide edge blended for antialiasing
+			coverage := math.Min(math.Max(r-math.Hypot(cx, cy)+0.5, 0), 1)
+			if coverage == 1 {
+				continue
+			}
+			i := dst.PixOffset(x, y) + 3
+			dst.Pix[i] = uint8(float64(dst.Pix[i]) * coverage)
+		}
+	}
+	return dst
+}
+
+// applyBorder frames img with a border of width pixels. inset draws it over
+// the edges of the image, keeping its size; otherwise the image is padded.
+func applyBorder(img image.Image, width int, c color.NRGBA, inset bool) image.Image {
+	if width <= 0 {
+		return img
+	}
+	bounds := img.Bounds()
+	if inset {
+		frame := imaging.New(bounds.Dx(), bounds.Dy(), c)
+		inner := image.Rect(width, width, bounds.Dx()-width, bounds.Dy()-width)
+		if inner.Empty() {
+			return frame
+		}
+		return imaging.Paste(frame, imaging.Crop(img, inner.Add(bounds.Min)), inner.Min)
+	}
+	frame := imaging.New(bounds.Dx()+2*width, bounds.Dy()+2*width, c)
+	return imaging.Paste(frame, img, image.Pt(width, width))
+}
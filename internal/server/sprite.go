@@ -0,0 +1,235 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"WB_L3_4/internal/auth"
+	"WB_L3_4/internal/models"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	maxSpriteImages    = 200
+	defaultSpriteTile  = 100
+	maxSpriteTile      = 500
+	maxSpriteColumns   = 50
+	spriteSheetMaxSide = 16384
+)
+
+// spriteRequest is the body of POST /sprite
+type spriteRequest struct {
+	IDs []string `json:"ids"`
+	// Square tile size in pixels; defaults to 100
+	Tile int `json:"tile"`
+	// Tiles per row; defaults to a square-ish sheet
+	Columns int `json:"columns"`
+	// jpg or png; defaults to jpg
+	Format string `json:"format"`
+}
+
+// spriteTile is where one image sits on the sheet
+type spriteTile struct {
+	ID     string `json:"id"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// validate fills in defaults and checks the request
+func (r *spriteRequest) validate() error {
+	if len(r.IDs) == 0 {
+		return errors.New("at least one image is required")
+	}
+	if len(r.IDs) > maxSpriteImages {
+		return fmt.Errorf("at most %d images are allowed", maxSpriteImages)
+	}
+	if r.Tile == 0 {
+		r.Tile = defaultSpriteTile
+	}
+	if r.Tile < 1 || r.Tile > maxSpriteTile {
+		return fmt.Errorf("tile must be between 1 and %d", maxSpriteTile)
+	}
+	if r.Columns == 0 {
+		r.Columns = int(math.Ceil(math.Sqrt(float64(len(r.IDs)))))
+	}
+	if r.Columns < 1 || r.Columns > maxSpriteColumns {
+		return fmt.Errorf("columns must be between 1 and %d", maxSpriteColumns)
+	}
+	if r.Format == "" {
+		r.Format = "jpg"
+	}
+	if r.Format != "jpg" && r.Format != "png" {
+		return fmt.Errorf("unsupported format %q", r.Format)
+	}
+	rows := (len(r.IDs) + r.Columns - 1) / r.Columns
+	if min(r.Columns, len(r.IDs))*r.Tile > spriteSheetMaxSide || rows*r.Tile > spriteSheetMaxSide {
+		return fmt.Errorf("sheet would be larger than %dpx", spriteSheetMaxSide)
+	}
+	return nil
+}
+
+// key identifies the sheet so identical requests reuse the rendered file
+func (r *spriteRequest) key() string {
+	sum := sha256.Sum256([]byte(strings.Join(r.IDs, ",") + "|" + strconv.Itoa(r.Tile) + "|" + strconv.Itoa(r.Columns)))
+	return hex.EncodeToString(sum[:])
+}
+
+// layout returns the tile of each image and the size of the sheet
+func (r *spriteRequest) layout() ([]spriteTile, int, int) {
+	tiles := make([]spriteTile, len(r.IDs))
+	for i, id := range r.IDs {
+		tiles[i] = spriteTile{
+			ID:     id,
+			X:      (i % r.Columns) * r.Tile,
+			Y:      (i / r.Columns) * r.Tile,
+			Width:  r.Tile,
+			Height: r.Tile,
+		}
+	}
+	rows := (len(r.IDs) + r.Columns - 1) / r.Columns
+	return tiles, min(r.Columns, len(r.IDs)) * r.Tile, rows * r.Tile
+}
+
+// spriteFileRe matches the file names of sprite sheets, <key>.<format>
+var spriteFileRe = regexp.MustCompile(`^[0-9a-f]{64}\.(jpg|png)$`)
+
+// spriteScope names the directory of the sheets of the tenant and owner the
+// claims are bound to. Every image on a sheet was visible to them, so a
+// sheet is only served within the same scope.
+func spriteScope(claims *auth.Claims) string {
+	var tenant, owner string
+	if claims != nil {
+		tenant, owner = claims.Tenant, claims.Owner
+	}
+	scope := sha256.Sum256([]byte(tenant + "\x00" + owner))
+	return hex.EncodeToString(scope[:8])
+}
+
+// spritePath returns where a sheet is stored
+func (s *Server) spritePath(claims *auth.Claims, file string) string {
+	return filepath.Join(s.cfg.StoragePath, "sprites", spriteScope(claims), file[:2], file)
+}
+
+// spriteSource picks the smallest ready file of an image to tile from
+func spriteSource(img *models.Image) string {
+	if img.ThumbnailStatus == "done" && img.ThumbnailPath != "" {
+		return img.ThumbnailPath
+	}
+	if img.ResizeStatus == "done" && img.ProcessedPath != "" {
+		return img.ProcessedPath
+	}
+	return img.OriginalPath
+}
+
+// handleCreateSprite renders a sprite sheet of the images, e.g. an album,
+// and returns its URL under GET /sprite/:file with the coordinates of every
+// image on it
+func (s *Server) handleCreateSprite(c *gin.Context) {
+	const op = "server.handleCreateSprite"
+
+	var req spriteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims := claimsFrom(c)
+	images := make([]*models.Image, 0, len(req.IDs))
+	for i, raw := range req.IDs {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID: " + raw})
+			return
+		}
+		img, err := s.db.GetImage(id)
+		if err != nil || !imageVisible(claims, img) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Image not found: " + raw})
+			return
+		}
+		// Normalized so the cache key doesn't depend on how IDs are spelled
+		req.IDs[i] = id.String()
+		images = append(images, img)
+	}
+
+	tiles, width, height := req.layout()
+	file := req.key() + "." + req.Format
+	path := s.spritePath(claims, file)
+	if !s.fileExists(path) {
+		if err := s.limiter.Acquire(c.Request.Context()); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Request canceled while waiting for processing"})
+			return
+		}
+		defer s.limiter.Release()
+
+		sheet := imaging.New(width, height, image.Transparent)
+		for i, img := range images {
+			src, release, err := s.openReserved(c.Request.Context(), spriteSource(img))
+			if errors.Is(err, ErrImageTooLarge) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				log.Printf("%s: failed to open image %s: %v", op, img.ID.String(), err)
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Image could not be decoded right now"})
+				return
+			}
+			tile := imaging.Fill(src, req.Tile, req.Tile, imaging.Center, imaging.Lanczos)
+			release()
+			sheet = imaging.Paste(sheet, tile, image.Pt(tiles[i].X, tiles[i].Y))
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			log.Printf("%s: failed to create sprite directory: %v", op, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sprite sheet"})
+			return
+		}
+		if err := NewImageProcessor(s.cfg, s.db).save(sheet, path); err != nil {
+			log.Printf("%s: %v", op, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sprite sheet"})
+			return
+		}
+		// The sheet is a single file, recorded with the first image on it
+		recordChecksum(s.db, images[0].ID, "sprite:"+spriteScope(claims)+"/"+file, path)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"url":    strings.TrimRight(s.cfg.PublicURL, "/") + apiPrefix + "/sprite/" + file,
+		"width":  width,
+		"height": height,
+		"tiles":  tiles,
+	})
+}
+
+// handleGetSprite serves a sheet rendered by POST /sprite for the same
+// tenant and owner
+func (s *Server) handleGetSprite(c *gin.Context) {
+	file := c.Param("file")
+	if !spriteFileRe.MatchString(file) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sprite sheet not found"})
+		return
+	}
+	if n := s.sendFile(c, s.spritePath(claimsFrom(c), file), time.Time{}, ""); n > 0 {
+		processMeter.record(MeteringEvent{Type: meterBandwidth, Tenant: requestTenant(c), Owner: requestOwner(c), Bytes: n})
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// maxStatusWait caps ?wait= so a held request can't tie up a connection for
+// longer than a client would reasonably wait on a single poll
+const maxStatusWait = time.Minute
+
+// statusPollInterval is how often a held status request rereads the image.
+// Processing may run in another replica, so there is nothing to wake on.
+const statusPollInterval = 500 * time.Millisecond
+
+// finishedStatus reports whether an image's processing has come to an end
+// and its status won't change without someone reprocessing it
+func finishedStatus(status string) bool {
+	return status == "done" || status == "partial" || status == "error"
+}
+
+// handleGetImageStatus returns the processing status of an image. With
+// ?wait=<duration>, e.g. 30s, it holds the request until the status differs
+// from ?status=, the one known to the client, or the wait is over. Without
+// ?status= it waits for a change from the current status unless processing
+// has already finished.
+func (s *Server) handleGetImageStatus(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	var wait time.Duration
+	if v := c.Query("wait"); v != "" {
+		if wait, err = time.ParseDuration(v); err != nil || wait < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "wait must be a duration like 30s"})
+			return
+		}
+		wait = min(wait, maxStatusWait)
+	}
+
+	img, err := s.db.GetImage(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	known, ok := c.GetQuery("status")
+	if !ok {
+		known = img.Status
+		if finishedStatus(known) {
+			wait = 0
+		}
+	}
+
+	if wait > 0 && img.Status == known {
+		deadline := time.NewTimer(wait)
+		defer deadline.Stop()
+		ticker := time.NewTicker(statusPollInterval)
+		defer ticker.Stop()
+	poll:
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-deadline.C:
+				break poll
+			case <-ticker.C:
+				// A failed read is retried on the next tick
+				if latest, err := s.db.GetImage(id); err == nil {
+					if img = latest; img.Status != known {
+						break poll
+					}
+				}
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, s.imageStatus(img))
+}
+
+// imageStatus is the processing status of an image as reported by the status
+// endpoints
+func (s *Server) imageStatus(img *models.Image) gin.H {
+	return gin.H{
+		"id":               img.ID.String(),
+		"status":           img.Status,
+		"resize_status":    img.ResizeStatus,
+		"thumbnail_status": img.ThumbnailStatus,
+		"watermark_status": img.WatermarkStatus,
+		"video_status":     img.VideoStatus,
+		"upscale_status":   img.UpscaleStatus,
+		"errors":           img.Errors,
+		"urls":             s.variantURLs(img),
+		"updated_at":       img.UpdatedAt,
+	}
+}
+
+// maxStatusIDs caps the images one bulk status request may ask about
+const maxStatusIDs = 100
+
+type bulkStatusRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// handleBulkImageStatus returns the processing status of up to maxStatusIDs
+// images in one response, in the order asked. IDs of images that don't exist
+// or aren't visible to the caller are listed under "missing".
+func (s *Server) handleBulkImageStatus(c *gin.Context) {
+	const op = "server.handleBulkImageStatus"
+
+	var req bulkStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if len(req.IDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ids is required"})
+		return
+	}
+	if len(req.IDs) > maxStatusIDs {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d ids are allowed", maxStatusIDs)})
+		return
+	}
+
+	ids := make([]uuid.UUID, 0, len(req.IDs))
+	for _, raw := range req.IDs {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID: " + raw})
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	images, err := s.db.GetImagesByID(ids)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load image statuses"})
+		return
+	}
+	claims := claimsFrom(c)
+	found := make(map[uuid.UUID]*models.Image, len(images))
+	for _, img := range images {
+		if imageVisible(claims, img) {
+			found[img.ID] = img
+		}
+	}
+
+	statuses := make([]gin.H, 0, len(found))
+	missing := []string{}
+	seen := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if img, ok := found[id]; ok {
+			statuses = append(statuses, s.imageStatus(img))
+		} else {
+			missing = append(missing, id.String())
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"images": statuses, "missing": missing})
+}
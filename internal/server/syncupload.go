@@ -0,0 +1,84 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+	"WB_L3_4/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// processSync processes a saved upload inline, bypassing Kafka, and answers
+// with its variant URLs. Processing that outlasts sync_upload.timeout goes on
+// in the background and is answered with 202, as is an upload that had to be
+// queued after all because processing is paused or couldn't start.
+func (s *Server) processSync(c *gin.Context, img *models.Image) {
+	const op = "server.processSync"
+
+	if s.gate.Paused() != nil {
+		s.queueSync(c, img)
+		return
+	}
+
+	// Buffered so the goroutine can finish after the handler gave up waiting
+	done := make(chan error, 1)
+	go func() {
+		done <- ProcessImage(img.ID.String(), s.cfg, s.db, s.limiter)
+	}()
+
+	timer := time.NewTimer(s.cfg.SyncUpload.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		// Failed operations are reflected in the image's status
+		if err != nil {
+			log.Printf("%s: %v", op, err)
+		}
+	case <-timer.C:
+		metrics.SyncUploadsTotal.WithLabelValues("timeout").Inc()
+		c.JSON(http.StatusAccepted, gin.H{
+			"id":      img.ID.String(),
+			"status":  "processing",
+			"message": "Image uploaded, processing continues in the background",
+		})
+		return
+	case <-c.Request.Context().Done():
+		// The client is gone, processing finishes on its own
+		metrics.SyncUploadsTotal.WithLabelValues("timeout").Inc()
+		return
+	}
+
+	processed, err := s.db.GetImage(img.ID)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load processed image"})
+		return
+	}
+	// Processing didn't get to start, e.g. the database hiccuped
+	if processed.Status == "pending" {
+		s.queueSync(c, processed)
+		return
+	}
+
+	metrics.SyncUploadsTotal.WithLabelValues("done").Inc()
+	c.JSON(http.StatusOK, gin.H{
+		"id":      processed.ID.String(),
+		"status":  processed.Status,
+		"urls":    s.variantURLs(processed),
+		"message": "Image uploaded and processed",
+	})
+}
+
+// queueSync falls back to processing a sync upload through the queue
+func (s *Server) queueSync(c *gin.Context, img *models.Image) {
+	s.queueUpload(c.Request.Context(), img)
+	metrics.SyncUploadsTotal.WithLabelValues("queued").Inc()
+	c.JSON(http.StatusAccepted, gin.H{
+		"id":      img.ID.String(),
+		"status":  img.Status,
+		"message": "Image uploaded and queued for processing",
+	})
+}
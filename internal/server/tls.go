@@ -0,0 +1,70 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// autocertManager returns the Let's Encrypt certificate manager, nil unless
+// autocert domains are configured
+func (s *Server) autocertManager() *autocert.Manager {
+	if len(s.cfg.TLS.AutocertDomains) == 0 {
+		return nil
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(s.cfg.TLS.AutocertDomains...),
+		Cache:      autocert.DirCache(s.cfg.TLS.AutocertCacheDir),
+		Email:      s.cfg.TLS.AutocertEmail,
+	}
+}
+
+// tlsConfig returns the TLS settings of the HTTPS listener, taking
+// certificates from m when set. With an admin client CA, client
+// certificates are requested and verified against it but only required on
+// admin routes, see requireClientCert.
+func (s *Server) tlsConfig(m *autocert.Manager) (*tls.Config, error) {
+	const op = "server.tlsConfig"
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if m != nil {
+		cfg.GetCertificate = m.GetCertificate
+		cfg.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	}
+	if s.cfg.TLS.AdminClientCA != "" {
+		pem, err := os.ReadFile(s.cfg.TLS.AdminClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", op, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found in %s", op, s.cfg.TLS.AdminClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// requireClientCert rejects requests without a verified client certificate
+// when an admin client CA is configured
+func (s *Server) requireClientCert() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.cfg.TLS.AdminClientCA == "" {
+			c.Next()
+			return
+		}
+		if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Client certificate required"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/google/uuid"
+)
+
+var (
+	errUploadTooLarge   = errors.New("upload is too large")
+	errUnsupportedImage = errors.New("unsupported image format")
+	errCorruptImage     = errors.New("invalid or corrupted image file")
+)
+
+// uploadExtensions maps the accepted content types to the stored extension
+// of files imported without one
+var uploadExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// uploadFields are the settings sent along with an uploaded image, as form
+// fields over HTTP and as metadata over gRPC
+type uploadFields struct {
+	// Named preset rendered in addition to the standard variants
+	Preset      string
+	Options     models.ProcessingOptions
+	CallbackURL string
+	NotifyEmail string
+	// Processing is held until then when set
+	ProcessAt *time.Time
+	// Searchable metadata
+	Metadata models.Image
+	// The signed in user, taken from the token rather than a field
+	Owner string
+}
+
+// parseUploadFields reads and validates the upload settings; field returns
+// the value of a named field, "" when absent. Errors are meant for the
+// client.
+func (s *Server) parseUploadFields(field func(name string) string) (*uploadFields, error) {
+	var f uploadFields
+
+	f.Preset = field("preset")
+	if _, ok := s.cfg.Presets[f.Preset]; f.Preset != "" && !ok {
+		return nil, errors.New("Unknown preset")
+	}
+
+	// Optional per-image processing options sent as JSON
+	if raw := field("options"); raw != "" {
+		dec := json.NewDecoder(strings.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&f.Options); err != nil {
+			return nil, errors.New("Invalid options: " + err.Error())
+		}
+	}
+	// Operations can also be skipped with plain fields, e.g. thumbnail=false
+	for name, dst := range map[string]**bool{
+		"resize":    &f.Options.Resize,
+		"thumbnail": &f.Options.Thumbnail,
+		"watermark": &f.Options.Watermark,
+	} {
+		if raw := field(name); raw != "" {
+			enabled, err := strconv.ParseBool(raw)
+			if err != nil {
+				return nil, errors.New("Invalid " + name + " flag, expected true or false")
+			}
+			*dst = &enabled
+		}
+	}
+	if err := f.Options.Validate(); err != nil {
+		return nil, errors.New("Invalid options: " + err.Error())
+	}
+	for operation, out := range f.Options.Outputs {
+		if err := s.cfg.ValidateOutput(operation, out); err != nil {
+			return nil, errors.New("Invalid options: " + err.Error())
+		}
+	}
+	if !f.Options.ResizeEnabled() && !f.Options.ThumbnailEnabled() && !f.Options.WatermarkEnabled() && f.Preset == "" {
+		return nil, errors.New("Every operation is skipped, nothing to process")
+	}
+
+	// Optional URL notified once processing finishes
+	f.CallbackURL = field("callback_url")
+	if f.CallbackURL != "" && !validCallbackURL(s.cfg, f.CallbackURL) {
+		return nil, errors.New("Invalid callback_url, expected an http(s) URL to an allowed public host")
+	}
+
+	// Optional address emailed once processing finishes
+	if notifyEmail := field("notify_email"); notifyEmail != "" {
+		if s.cfg.Email.SMTPHost == "" {
+			return nil, errors.New("Email notifications are not configured")
+		}
+		addr, err := mail.ParseAddress(notifyEmail)
+		if err != nil {
+			return nil, errors.New("Invalid notify_email")
+		}
+		f.NotifyEmail = addr.Address
+	}
+
+	// Optional searchable metadata, tags separated by commas
+	var metadata models.ImageMetadata
+	for name, dst := range map[string]**string{"title": &metadata.Title, "description": &metadata.Description} {
+		if v := field(name); v != "" {
+			*dst = &v
+		}
+	}
+	if raw := field("tags"); raw != "" {
+		tags := strings.Split(raw, ",")
+		metadata.Tags = &tags
+	}
+	if err := metadata.Apply(&f.Metadata); err != nil {
+		return nil, err
+	}
+
+	// Optional RFC 3339 time to hold processing until, e.g. off-peak hours
+	if raw := field("process_at"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return nil, errors.New("Invalid process_at, expected RFC 3339 time")
+		}
+		if t.After(time.Now()) {
+			f.ProcessAt = &t
+		}
+	}
+	return &f, nil
+}
+
+// importFields returns the settings of images imported from a configured
+// source, which only sets the preset and the JSON options
+func (s *Server) importFields(preset, options string) (*uploadFields, error) {
+	return s.parseUploadFields(func(name string) string {
+		switch name {
+		case "preset":
+			return preset
+		case "options":
+			return options
+		}
+		return ""
+	})
+}
+
+// image returns the record of a stored upload with these settings
+func (f *uploadFields) image(id uuid.UUID, originalPath, filename, contentType, tenant string) *models.Image {
+	img := &models.Image{
+		ID:               id,
+		Status:           "pending",
+		OriginalPath:     originalPath,
+		ResizeStatus:     "pending",
+		ThumbnailStatus:  "pending",
+		WatermarkStatus:  "pending",
+		Preset:           f.Preset,
+		Options:          f.Options,
+		ProcessAt:        f.ProcessAt,
+		Tenant:           tenant,
+		Owner:            f.Owner,
+		CallbackURL:      f.CallbackURL,
+		NotifyEmail:      f.NotifyEmail,
+		Title:            f.Metadata.Title,
+		Description:      f.Metadata.Description,
+		Tags:             f.Metadata.Tags,
+		OriginalFilename: filename,
+		ContentType:      contentType,
+	}
+	if f.ProcessAt != nil {
+		img.Status = "scheduled"
+	}
+	return img
+}
+
+// storeUpload saves the record of an uploaded original and queues it for
+// processing. While Kafka is unavailable the image is marked deferred and
+// enqueued once it recovers. The original is removed if the record can't be
+// saved.
+func (s *Server) storeUpload(ctx context.Context, img *models.Image) error {
+	if err := s.saveUpload(img); err != nil {
+		return err
+	}
+	s.queueUpload(ctx, img)
+	return nil
+}
+
+// saveUpload saves the record of an uploaded original without queueing it,
+// removing the original if that fails
+func (s *Server) saveUpload(img *models.Image) error {
+	const op = "server.saveUpload"
+
+	if err := s.db.SaveImage(img); err != nil {
+		os.Remove(img.OriginalPath) // Clean up file
+		return fmt.Errorf("%s: failed to save to database: %v", op, err)
+	}
+
+	recordChecksum(s.db, img.ID, "original", img.OriginalPath)
+	meterImage(img, MeteringEvent{Type: meterUpload, Bytes: img.Size})
+	return nil
+}
+
+// queueUpload hands a saved upload to the workers, or schedules or defers it
+func (s *Server) queueUpload(ctx context.Context, img *models.Image) {
+	const op = "server.queueUpload"
+
+	if img.ProcessAt != nil {
+		recordEvent(s.db, img.ID, "scheduled", "", img.ProcessAt.Format(time.RFC3339))
+	} else if s.readiness.State() == stateDegraded {
+		s.deferProcessing(img, "kafka unavailable")
+	} else if err := s.enqueue(ctx, img.ID); err != nil {
+		log.Printf("%s: failed to send to kafka: %v", op, err)
+		s.deferProcessing(img, "failed to enqueue for processing: "+err.Error())
+	} else {
+		recordEvent(s.db, img.ID, "queued", "", "")
+	}
+}
+
+// importRejected reports whether importImage failed because of the file
+// itself, so trying again won't help
+func importRejected(err error) bool {
+	return errors.Is(err, errUploadTooLarge) || errors.Is(err, errUnsupportedImage) || errors.Is(err, errCorruptImage)
+}
+
+// importImage stores an image read from src as a new original and queues it
+// like an upload. Only filename's base name and extension are used; the
+// extension falls back to the detected type. Images over maxSize bytes fail
+// with errUploadTooLarge, other formats with errUnsupportedImage and
+// undecodable files with errCorruptImage. Returns the stored size.
+func (s *Server) importImage(ctx context.Context, src io.Reader, filename string, maxSize int64, fields *uploadFields, tenant string) (*models.Image, int64, error) {
+	const op = "server.importImage"
+
+	// The type is sniffed from the first bytes before anything is written
+	br := bufio.NewReader(src)
+	head, _ := br.Peek(512)
+	contentType := http.DetectContentType(head)
+	typeExt, ok := uploadExtensions[contentType]
+	if len(head) == 0 || !ok {
+		return nil, 0, errUnsupportedImage
+	}
+
+	id := uuid.New()
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == "" {
+		ext = typeExt
+	}
+	// Keep only the base name, clients may send full paths
+	filename = filepath.Base(filename)
+	if filename == "." || filename == string(filepath.Separator) {
+		filename = id.String() + ext
+	}
+	originalPath := filepath.Join(ShardDir(s.cfg.StoragePath, "original", id), id.String()+ext)
+	if err := os.MkdirAll(filepath.Dir(originalPath), 0755); err != nil {
+		return nil, 0, fmt.Errorf("%s: failed to create directory: %v", op, err)
+	}
+
+	var size int64
+	err := writeStored(originalPath, func(w io.Writer) error {
+		n, err := io.Copy(w, io.LimitReader(br, maxSize+1))
+		size = n
+		if err != nil {
+			return err
+		}
+		if n > maxSize {
+			return errUploadTooLarge
+		}
+		return nil
+	})
+	if errors.Is(err, errUploadTooLarge) {
+		return nil, size, err
+	}
+	if err != nil {
+		return nil, size, fmt.Errorf("%s: failed to save file: %v", op, err)
+	}
+
+	if err := s.validateImageFile(originalPath); err != nil {
+		os.Remove(originalPath) // Clean up invalid file
+		log.Printf("%s: invalid image file %s: %v", op, filename, err)
+		return nil, size, errCorruptImage
+	}
+
+	img := fields.image(id, originalPath, filename, contentType, tenant)
+	img.Size = size
+	if err := s.storeUpload(ctx, img); err != nil {
+		return nil, size, fmt.Errorf("%s: %v", op, err)
+	}
+	return img, size, nil
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// The upscaling service gets the original as the body of a POST to
+// upscale.url?scale=N and answers either
+//   - 200 with the upscaled image, or
+//   - 202 with a Location to poll: GET answers 202 while the job runs and
+//     200 with the upscaled image once it is done.
+//
+// Anything else fails the operation.
+
+var errUpscaleTooLarge = errors.New("upscaled image is too large")
+
+// upscaleFormats maps the content types a service may answer with to the
+// stored extension
+var upscaleFormats = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpg",
+	"image/webp": "webp",
+}
+
+// wantsUpscale reports whether the image gets an upscaled variant
+func wantsUpscale(cfg *models.Config, img *models.Image) bool {
+	return cfg.Upscale.URL != "" && img.Options.Upscale
+}
+
+// requestUpscale posts the original to the service and returns the response
+// carrying the result, waiting for an accepted job to finish
+func (p *ImageProcessor) requestUpscale(ctx context.Context, img *models.Image) (*http.Response, error) {
+	f, err := openStored(img.OriginalPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	endpoint, err := url.Parse(p.cfg.Upscale.URL)
+	if err != nil {
+		return nil, err
+	}
+	q := endpoint.Query()
+	q.Set("scale", strconv.Itoa(p.cfg.Upscale.Scale))
+	endpoint.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), f)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", img.ContentType)
+	resp, err := p.doUpscale(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Polls keep the job's location unless they point somewhere else
+	var location *url.URL
+	for resp.StatusCode == http.StatusAccepted {
+		if next, err := resp.Location(); err == nil {
+			location = next
+		}
+		resp.Body.Close()
+		if location == nil {
+			return nil, errors.New("accepted job without a location")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(p.cfg.Upscale.PollInterval):
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp, err = p.doUpscale(req); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upscaling service responded with %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// doUpscale sends a request to the service with its token
+func (p *ImageProcessor) doUpscale(req *http.Request) (*http.Response, error) {
+	if p.cfg.Upscale.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.cfg.Upscale.Token)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// UpscaleHandler has the original upscaled by the external service and
+// stores the result as the upscaled variant
+func (p *ImageProcessor) UpscaleHandler(img *models.Image) (err error) {
+	const op = "ImageProcessor.UpscaleHandler"
+
+	log.Printf("%s: starting upscale for image %s", op, img.ID.String())
+
+	img.UpscaleStatus = "processing"
+	started := time.Now()
+	recordEvent(p.db, img.ID, "started", "upscale", "")
+	defer func() { recordOutcome(p.db, img, "upscale", started, err) }()
+
+	if err := p.db.UpdateOperation(img.ID, "upscale", img.UpscaleStatus, img.UpscaledPath); err != nil {
+		log.Printf("%s: failed to update upscale status: %v", op, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.Upscale.Timeout)
+	defer cancel()
+	resp, err := p.requestUpscale(ctx, img)
+	if err != nil {
+		img.UpscaleStatus = "error"
+		p.db.UpdateOperation(img.ID, "upscale", img.UpscaleStatus, img.UpscaledPath)
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	defer resp.Body.Close()
+
+	contentType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	format, ok := upscaleFormats[strings.TrimSpace(contentType)]
+	if !ok {
+		img.UpscaleStatus = "error"
+		p.db.UpdateOperation(img.ID, "upscale", img.UpscaleStatus, img.UpscaledPath)
+		return fmt.Errorf("%s: unsupported content type %q", op, contentType)
+	}
+
+	upscaledPath := p.variantPath(img, "upscaled", format)
+	if err := os.MkdirAll(filepath.Dir(upscaledPath), 0755); err != nil {
+		img.UpscaleStatus = "error"
+		p.db.UpdateOperation(img.ID, "upscale", img.UpscaleStatus, img.UpscaledPath)
+		return fmt.Errorf("%s: failed to create processed directory: %v", op, err)
+	}
+
+	maxSize := int64(p.cfg.Upscale.MaxSizeMB) << 20
+	err = writeStored(upscaledPath, func(w io.Writer) error {
+		n, err := io.Copy(w, io.LimitReader(resp.Body, maxSize+1))
+		if err != nil {
+			return err
+		}
+		if n > maxSize {
+			return errUpscaleTooLarge
+		}
+		return nil
+	})
+	if err != nil {
+		img.UpscaleStatus = "error"
+		p.db.UpdateOperation(img.ID, "upscale", img.UpscaleStatus, img.UpscaledPath)
+		return fmt.Errorf("%s: %v", op, err)
+	}
+
+	img.UpscaledPath = upscaledPath
+	img.UpscaleStatus = "done"
+	recordChecksum(p.db, img.ID, "upscaled", upscaledPath)
+
+	if err := p.db.UpdateOperation(img.ID, "upscale", img.UpscaleStatus, img.UpscaledPath); err != nil {
+		log.Printf("%s: failed to update image with upscale results: %v", op, err)
+		return fmt.Errorf("%s: %v", op, err)
+	}
+
+	log.Printf("%s: successfully upscaled image %s to %s", op, img.ID.String(), upscaledPath)
+	return nil
+}
+
+// handleUpscaleImage starts upscaling an image with the external service
+func (s *Server) handleUpscaleImage(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	if s.cfg.Upscale.URL == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Upscaling is not configured"})
+		return
+	}
+
+	img, err := s.db.GetImage(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	if img.UpscaleStatus == "processing" {
+		c.JSON(http.StatusAccepted, gin.H{"message": "Upscale already in progress"})
+		return
+	}
+
+	if img.UpscaleStatus == "done" {
+		c.JSON(http.StatusOK, gin.H{"message": "Upscale already completed", "path": img.UpscaledPath})
+		return
+	}
+
+	// The service does the work, so no decode slot is held while waiting
+	go func() {
+		processor := NewImageProcessor(s.cfg, s.db)
+		if err := processor.UpscaleHandler(img); err != nil {
+			log.Printf("Upscale processing failed: %v", err)
+		}
+	}()
+
+	s.audit(c, "upscale", img.ID, nil)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Upscale processing started"})
+}
+
+// handleGetUpscaled serves the upscaled variant
+func (s *Server) handleGetUpscaled(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	img, err := s.db.GetImage(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	if img.UpscaleStatus != "done" || img.UpscaledPath == "" || !s.fileExists(img.UpscaledPath) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upscaled image not available"})
+		return
+	}
+
+	s.serveImageFile(c, img, img.UpscaledPath, "inline")
+}
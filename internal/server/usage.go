@@ -0,0 +1,97 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"WB_L3_4/internal/auth"
+	"WB_L3_4/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// checkQuota fails with errQuotaExceeded when storing another image of size
+// bytes would take owner over the configured quota. Images without an owner
+// aren't limited.
+func (s *Server) checkQuota(owner string, size int64) error {
+	const op = "server.checkQuota"
+
+	q := s.cfg.Quota
+	if owner == "" || (q.MaxImages == 0 && q.MaxStorageMB == 0) {
+		return nil
+	}
+	usage, err := s.db.GetOwnerUsage(owner)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	if q.MaxImages > 0 && usage.Images+1 > q.MaxImages {
+		return fmt.Errorf("%w: limit of %d images reached", errQuotaExceeded, q.MaxImages)
+	}
+	if q.MaxStorageMB > 0 && usage.Bytes+size > q.MaxStorageMB<<20 {
+		return fmt.Errorf("%w: limit of %dMB reached", errQuotaExceeded, q.MaxStorageMB)
+	}
+	return nil
+}
+
+// quotaRemaining returns what is left of each limit of the quota, nil for
+// those without one
+func (s *Server) quotaRemaining(usage *models.OwnerUsage) gin.H {
+	remaining := gin.H{"images": nil, "bytes": nil}
+	if q := s.cfg.Quota.MaxImages; q > 0 {
+		remaining["images"] = max(q-usage.Images, 0)
+	}
+	if q := s.cfg.Quota.MaxStorageMB; q > 0 {
+		remaining["bytes"] = max(q<<20-usage.Bytes, 0)
+	}
+	return remaining
+}
+
+// handleOwnerUsage reports the storage used by an owner, e.g.
+// GET /users/:owner/usage. Tokens bound to an owner only see their own
+// usage, any other owner needs the admin scope.
+func (s *Server) handleOwnerUsage(c *gin.Context) {
+	owner := c.Param("owner")
+	if claims := claimsFrom(c); claims != nil && claims.Owner != owner && !claims.Allows(auth.ScopeAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Token does not allow reading another user's usage"})
+		return
+	}
+	s.respondUsage(c, owner)
+}
+
+// handleMyUsage reports the storage used by the owner the token is bound
+// to, e.g. the user signed in with OIDC
+func (s *Server) handleMyUsage(c *gin.Context) {
+	owner := requestOwner(c)
+	if owner == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token is not bound to a user"})
+		return
+	}
+	s.respondUsage(c, owner)
+}
+
+func (s *Server) respondUsage(c *gin.Context, owner string) {
+	const op = "server.respondUsage"
+
+	usage, err := s.db.GetOwnerUsage(owner)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load usage"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"owner":    usage.Owner,
+		"images":   usage.Images,
+		"bytes":    usage.Bytes,
+		"variants": usage.Variants,
+		"quota": gin.H{
+			"max_images": s.cfg.Quota.MaxImages,
+			"max_bytes":  s.cfg.Quota.MaxStorageMB << 20,
+			"remaining":  s.quotaRemaining(usage),
+		},
+		"updated_at": usage.UpdatedAt,
+	})
+}
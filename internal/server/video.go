@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"WB_L3_4/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func init() {
+	// Not in Go's builtin table and often missing from minimal images
+	mime.AddExtensionType(".mp4", "video/mp4")
+	mime.AddExtensionType(".webm", "video/webm")
+}
+
+// gifFrameMarker starts the graphic control extension written before every
+// frame of an animated GIF
+var gifFrameMarker = []byte{0x21, 0xF9, 0x04}
+
+// isAnimatedGIF reports whether the GIF at path has more than one frame,
+// without decoding any of them
+func isAnimatedGIF(path string) bool {
+	data, err := readStored(path)
+	if err != nil {
+		return false
+	}
+	return bytes.Count(data, gifFrameMarker) > 1
+}
+
+// wantsVideo reports whether the image gets a video variant
+func wantsVideo(cfg *models.Config, img *models.Image) bool {
+	return cfg.GIFVideoFormat != "" && img.ContentType == "image/gif" && isAnimatedGIF(img.OriginalPath)
+}
+
+// ffmpegArgs returns the ffmpeg arguments converting in to out in format
+func ffmpegArgs(in, out, format string) []string {
+	args := []string{"-y", "-loglevel", "error", "-i", in, "-an"}
+	switch format {
+	case "webm":
+		args = append(args, "-c:v", "libvpx-vp9", "-b:v", "0", "-crf", "40")
+	default:
+		// H.264 needs even dimensions and yuv420p to play in browsers
+		args = append(args, "-c:v", "libx264", "-pix_fmt", "yuv420p", "-movflags", "+faststart",
+			"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2")
+	}
+	return append(args, "-f", format, out)
+}
+
+// VideoHandler converts an animated GIF to a video with ffmpeg
+func (p *ImageProcessor) VideoHandler(img *models.Image) (err error) {
+	const op = "ImageProcessor.VideoHandler"
+
+	log.Printf("%s: starting video conversion for image %s", op, img.ID.String())
+
+	img.VideoStatus = "processing"
+	started := time.Now()
+	recordEvent(p.db, img.ID, "started", "video", "")
+	defer func() { recordOutcome(p.db, img, "video", started, err) }()
+
+	if err := p.db.UpdateOperation(img.ID, "video", img.VideoStatus, img.VideoPath); err != nil {
+		log.Printf("%s: failed to update video status: %v", op, err)
+	}
+
+	videoPath := p.variantPath(img, "video", p.cfg.GIFVideoFormat)
+	if err := os.MkdirAll(filepath.Dir(videoPath), 0755); err != nil {
+		img.VideoStatus = "error"
+		p.db.UpdateOperation(img.ID, "video", img.VideoStatus, img.VideoPath)
+		return fmt.Errorf("%s: failed to create processed directory: %v", op, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.FFmpegTimeout)
+	defer cancel()
+	srcPath, cleanup, err := plainCopy(img.OriginalPath)
+	if err != nil {
+		img.VideoStatus = "error"
+		p.db.UpdateOperation(img.ID, "video", img.VideoStatus, img.VideoPath)
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	defer cleanup()
+	tmpPath := videoPath + ".tmp"
+	cmd := exec.CommandContext(ctx, p.cfg.FFmpegPath, ffmpegArgs(srcPath, tmpPath, p.cfg.GIFVideoFormat)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmpPath)
+		img.VideoStatus = "error"
+		p.db.UpdateOperation(img.ID, "video", img.VideoStatus, img.VideoPath)
+		return fmt.Errorf("%s: ffmpeg failed: %v: %s", op, err, out)
+	}
+	if err := replaceStored(videoPath, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		img.VideoStatus = "error"
+		p.db.UpdateOperation(img.ID, "video", img.VideoStatus, img.VideoPath)
+		return fmt.Errorf("%s: %v", op, err)
+	}
+
+	img.VideoPath = videoPath
+	img.VideoStatus = "done"
+	recordChecksum(p.db, img.ID, "video", videoPath)
+
+	if err := p.db.UpdateOperation(img.ID, "video", img.VideoStatus, img.VideoPath); err != nil {
+		log.Printf("%s: failed to update image with video results: %v", op, err)
+		return fmt.Errorf("%s: %v", op, err)
+	}
+
+	log.Printf("%s: successfully converted image %s to %s", op, img.ID.String(), videoPath)
+	return nil
+}
+
+// handleGetVideo serves the video converted from an animated GIF
+func (s *Server) handleGetVideo(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	img, err := s.db.GetImage(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	if img.VideoStatus != "done" || img.VideoPath == "" || !s.fileExists(img.VideoPath) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Video not available"})
+		return
+	}
+
+	s.serveImageFile(c, img, img.VideoPath, "inline")
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"WB_L3_4/internal/metrics"
+	"WB_L3_4/internal/models"
+	"WB_L3_4/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	webhookBatchSize = 20
+	// How long a claimed delivery is hidden from other replicas
+	webhookLease = 2 * time.Minute
+
+	defaultWebhookListLimit = 100
+	maxWebhookListLimit     = 1000
+)
+
+// validCallbackURL reports whether raw is an absolute http(s) URL to a host
+// callbacks may be sent to
+func validCallbackURL(cfg *models.Config, raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	if len(cfg.Webhooks.AllowedHosts) > 0 && !hostMatches(u.Hostname(), cfg.Webhooks.AllowedHosts) {
+		return false
+	}
+	// Names are checked again when they are resolved at delivery
+	addr, err := netip.ParseAddr(u.Hostname())
+	return err != nil || cfg.Webhooks.AllowPrivateNetworks || !internalAddr(addr)
+}
+
+// hostMatches reports whether host is in the list; entries with a leading
+// dot match every subdomain
+func hostMatches(host string, hosts []string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// internalAddr reports whether addr is loopback, private, link-local (cloud
+// metadata services), shared or unspecified, i.e. not a public receiver
+func internalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() || addr.IsUnspecified() || sharedAddressSpace.Contains(addr)
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, RFC 6598
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// webhookClient returns the client deliveries are sent with. Redirects are
+// not followed and, unless private networks are allowed, connections to
+// internal addresses are refused after the name is resolved, so a callback
+// can't reach services next to the worker.
+func webhookClient(cfg *models.Config) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.Webhooks.Timeout}
+	if !cfg.Webhooks.AllowPrivateNetworks {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if addr, err := netip.ParseAddr(host); err != nil || internalAddr(addr) {
+				return fmt.Errorf("callback to internal address %s is not allowed", host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   cfg.Webhooks.Timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// queueWebhook persists a processing outcome notification for the image's
+// callback URL. Failures are only logged.
+func queueWebhook(db *storage.Storage, img *models.Image) {
+	if img.CallbackURL == "" {
+		return
+	}
+
+	event := "image.processed"
+	if img.Status == "error" {
+		event = "image.failed"
+	}
+	delivery := models.WebhookDelivery{
+		ImageID: img.ID,
+		URL:     img.CallbackURL,
+		Event:   event,
+		Payload: map[string]any{
+			"event":            event,
+			"id":               img.ID.String(),
+			"status":           img.Status,
+			"resize_status":    img.ResizeStatus,
+			"thumbnail_status": img.ThumbnailStatus,
+			"watermark_status": img.WatermarkStatus,
+		},
+	}
+	if err := db.AddWebhookDelivery(&delivery); err != nil {
+		log.Printf("server.queueWebhook: image %s: %v", img.ID.String(), err)
+	}
+}
+
+// RunWebhookDeliveries sends due webhook deliveries until ctx is canceled.
+// 5xx responses, 429 and network errors are retried with exponential
+// backoff; other failures and exhausted retries dead-letter the delivery.
+func RunWebhookDeliveries(ctx context.Context, cfg *models.Config, db *storage.Storage) {
+	const op = "server.RunWebhookDeliveries"
+
+	client := webhookClient(cfg)
+	ticker := time.NewTicker(cfg.Webhooks.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		for ctx.Err() == nil {
+			deliveries, err := db.ClaimDueWebhookDeliveries(webhookBatchSize, webhookLease)
+			if err != nil {
+				log.Printf("%s: %v", op, err)
+				break
+			}
+			for i := range deliveries {
+				deliverWebhook(ctx, cfg, db, client, &deliveries[i])
+			}
+			if len(deliveries) < webhookBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func deliverWebhook(ctx context.Context, cfg *models.Config, db *storage.Storage, client *http.Client, d *models.WebhookDelivery) {
+	const op = "server.deliverWebhook"
+
+	d.Attempts++
+	code, err := postWebhook(ctx, client, d)
+	d.LastStatusCode = nil
+	if code != 0 {
+		d.LastStatusCode = &code
+	}
+
+	switch {
+	case err == nil:
+		now := time.Now()
+		d.Status = "delivered"
+		d.LastError = ""
+		d.DeliveredAt = &now
+	case (code == 0 || code >= 500 || code == http.StatusTooManyRequests) && d.Attempts < cfg.Webhooks.MaxAttempts:
+		d.LastError = err.Error()
+		d.NextAttemptAt = time.Now().Add(webhookBackoff(cfg, d.Attempts))
+	default:
+		d.Status = "failed"
+		d.LastError = err.Error()
+		log.Printf("%s: delivery %d to %s failed after %d attempts: %v", op, d.ID, d.URL, d.Attempts, err)
+	}
+	metrics.WebhookDeliveriesTotal.WithLabelValues(d.Status).Inc()
+
+	if err := db.UpdateWebhookDelivery(d); err != nil {
+		log.Printf("%s: %v", op, err)
+	}
+}
+
+// postWebhook sends the payload and returns the response status code, 0 if
+// no response was received
+func postWebhook(ctx context.Context, client *http.Client, d *models.WebhookDelivery) (int, error) {
+	body, err := json.Marshal(d.Payload)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.ID, 10))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookBackoff doubles the delay after every attempt up to the maximum
+func webhookBackoff(cfg *models.Config, attempts int) time.Duration {
+	delay := cfg.Webhooks.BackoffBase
+	for i := 1; i < attempts && delay < cfg.Webhooks.BackoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, cfg.Webhooks.BackoffMax)
+}
+
+// handleListWebhooks lists deliveries by ?status= (default failed), newest
+// first, paginated with ?before=<id>
+func (s *Server) handleListWebhooks(c *gin.Context) {
+	const op = "server.handleListWebhooks"
+
+	status := c.DefaultQuery("status", "failed")
+	switch status {
+	case "pending", "delivered", "failed":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+
+	var before int64
+	if v := c.Query("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid before"})
+			return
+		}
+		before = n
+	}
+	limit := defaultWebhookListLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = min(n, maxWebhookListLimit)
+	}
+
+	deliveries, err := s.db.ListWebhookDeliveries(status, before, limit)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list webhook deliveries"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+// handleRedeliverWebhook queues a dead-lettered delivery again
+func (s *Server) handleRedeliverWebhook(c *gin.Context) {
+	const op = "server.handleRedeliverWebhook"
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery ID"})
+		return
+	}
+
+	ok, err := s.db.RedeliverWebhook(id)
+	if err != nil {
+		log.Printf("%s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeliver webhook"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Failed delivery not found"})
+		return
+	}
+
+	s.audit(c, "redeliver_webhook", uuid.Nil, map[string]any{"delivery_id": id})
+	c.JSON(http.StatusAccepted, gin.H{"message": "Redelivery queued"})
+}
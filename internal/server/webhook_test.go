@@ -0,0 +1,134 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"WB_L3_4/internal/models"
+)
+
+func TestInternalAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"fe80::1%eth0", true},
+		{"fc00::1", true},
+		{"100.64.0.1", true},
+		{"100.127.255.255", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"224.0.0.1", true},
+		{"ff02::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"8.8.8.8", false},
+		{"100.128.0.1", false},
+		{"172.32.0.1", false},
+		{"2001:4860:4860::8888", false},
+		{"::ffff:8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		if got := internalAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("internalAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestValidCallbackURL(t *testing.T) {
+	open := &models.Config{}
+	private := &models.Config{}
+	private.Webhooks.AllowPrivateNetworks = true
+	allowed := &models.Config{}
+	allowed.Webhooks.AllowedHosts = []string{"hooks.example.com", ".example.org"}
+
+	tests := []struct {
+		name string
+		cfg  *models.Config
+		url  string
+		want bool
+	}{
+		{"https", open, "https://hooks.example.com/done", true},
+		{"http with port", open, "http://hooks.example.com:8080/done", true},
+		{"public address", open, "https://8.8.8.8/done", true},
+		{"relative", open, "/done", false},
+		{"no host", open, "https:///done", false},
+		{"other scheme", open, "ftp://hooks.example.com/done", false},
+		{"file", open, "file:///etc/passwd", false},
+		{"unparsable", open, "http://[::1", false},
+		{"loopback", open, "http://127.0.0.1:8080/done", false},
+		{"loopback ipv6", open, "http://[::1]:8080/done", false},
+		{"metadata service", open, "http://169.254.169.254/latest/meta-data", false},
+		{"private", open, "http://10.0.0.5/done", false},
+		{"mapped loopback", open, "http://[::ffff:127.0.0.1]/done", false},
+		// Resolved names are checked when they are dialed
+		{"name", open, "http://localhost/done", true},
+		{"private allowed", private, "http://10.0.0.5/done", true},
+		{"allowed host", allowed, "https://hooks.example.com/done", true},
+		{"allowed host case", allowed, "https://HOOKS.example.com/done", true},
+		{"allowed subdomain", allowed, "https://a.b.example.org/done", true},
+		{"host not allowed", allowed, "https://example.com/done", false},
+		{"parent of subdomains not allowed", allowed, "https://example.org/done", false},
+		{"suffix without dot", allowed, "https://evilexample.org/done", false},
+		{"subdomain of exact host", allowed, "https://x.hooks.example.com/done", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validCallbackURL(tt.cfg, tt.url); got != tt.want {
+				t.Errorf("validCallbackURL(%q) = %v, want %v", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookClientRefusesInternalAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	cfg := &models.Config{}
+	cfg.Webhooks.Timeout = 5 * time.Second
+	if resp, err := webhookClient(cfg).Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("delivery to %s wasn't refused", srv.URL)
+	}
+
+	cfg.Webhooks.AllowPrivateNetworks = true
+	resp, err := webhookClient(cfg).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("delivery with private networks allowed: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestWebhookClientDoesNotFollowRedirects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/done" {
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+			return
+		}
+		t.Errorf("redirect to %s was followed", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	cfg := &models.Config{}
+	cfg.Webhooks.Timeout = 5 * time.Second
+	cfg.Webhooks.AllowPrivateNetworks = true
+	resp, err := webhookClient(cfg).Get(srv.URL + "/done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+}
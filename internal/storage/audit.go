@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"WB_L3_4/internal/models"
+)
+
+func (s *Storage) AddAuditEntry(entry *models.AuditEntry) error {
+	const op = "storage.AddAuditEntry"
+	if entry.Details == nil {
+		entry.Details = map[string]any{}
+	}
+	err := s.pool.QueryRow(context.Background(),
+		`INSERT INTO audit_log (actor, remote_addr, action, image_id, details)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`,
+		entry.Actor, entry.RemoteAddr, entry.Action, entry.ImageID, entry.Details).Scan(&entry.ID, &entry.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// AuditFilter narrows audit log queries; zero values match everything
+type AuditFilter struct {
+	Action  string
+	Actor   string
+	ImageID uuid.UUID
+	Since   time.Time
+	Limit   int
+	Offset  int
+	// Cursor of the page to continue after
+	After string
+}
+
+// ListAuditEntries returns matching entries, newest first, and the cursor
+// of the next page, "" after the last one
+func (s *Storage) ListAuditEntries(filter AuditFilter) ([]models.AuditEntry, string, error) {
+	const op = "storage.ListAuditEntries"
+
+	after, err := decodeCursor(filter.After)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var (
+		conds = "TRUE"
+		args  []any
+	)
+	if filter.Action != "" {
+		args = append(args, filter.Action)
+		conds += fmt.Sprintf(" AND action = $%d", len(args))
+	}
+	if filter.Actor != "" {
+		args = append(args, filter.Actor)
+		conds += fmt.Sprintf(" AND actor = $%d", len(args))
+	}
+	if filter.ImageID != uuid.Nil {
+		args = append(args, filter.ImageID)
+		conds += fmt.Sprintf(" AND image_id = $%d", len(args))
+	}
+	if !filter.Since.IsZero() {
+		args = append(args, filter.Since)
+		conds += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if after != nil {
+		args = append(args, after.Seq)
+		conds += fmt.Sprintf(" AND id < $%d", len(args))
+	}
+	args = append(args, filter.Limit, filter.Offset)
+
+	rows, err := s.pool.Query(context.Background(),
+		fmt.Sprintf(`SELECT id, created_at, actor, remote_addr, action, image_id, details
+		 FROM audit_log WHERE %s ORDER BY id DESC LIMIT $%d OFFSET $%d`, conds, len(args)-1, len(args)),
+		args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", op, err)
+	}
+	entries, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.AuditEntry])
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", op, err)
+	}
+	if len(entries) < filter.Limit {
+		return entries, "", nil
+	}
+	return entries, cursor{Seq: entries[len(entries)-1].ID}.encode(), nil
+}
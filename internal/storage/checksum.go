@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"WB_L3_4/internal/models"
+)
+
+// SaveChecksum stores the checksum of a file, replacing the previous one of
+// the same variant
+func (s *Storage) SaveChecksum(sum *models.FileChecksum) error {
+	const op = "storage.SaveChecksum"
+	_, err := s.pool.Exec(context.Background(),
+		`INSERT INTO file_checksums (image_id, variant, path, sha256, size)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (image_id, variant) DO UPDATE
+		SET path = EXCLUDED.path, sha256 = EXCLUDED.sha256, size = EXCLUDED.size,
+		    created_at = now(), verified_at = NULL, replicated_at = NULL, replication_error = NULL`,
+		sum.ImageID, sum.Variant, sum.Path, sum.SHA256, sum.Size)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// GetChecksumByPath returns the checksum recorded for a stored file
+func (s *Storage) GetChecksumByPath(id uuid.UUID, path string) (*models.FileChecksum, error) {
+	const op = "storage.GetChecksumByPath"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT image_id, variant, path, sha256, size, created_at, verified_at,
+		 replicated_at, replication_error
+		 FROM file_checksums WHERE image_id = $1 AND path = $2`, id, path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	sum, err := pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByPos[models.FileChecksum])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return sum, nil
+}
+
+// GetFileVersion returns when a stored file of an image was last written
+// and its SHA-256, or zero values when it has no recorded checksum
+func (s *Storage) GetFileVersion(id uuid.UUID, path string) (time.Time, string, error) {
+	const op = "storage.GetFileVersion"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT created_at, sha256 FROM file_checksums WHERE image_id = $1 AND path = $2`, id, path)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("%s: %v", op, err)
+	}
+	type version struct {
+		WrittenAt time.Time
+		SHA256    string
+	}
+	versions, err := pgx.CollectRows(rows, pgx.RowToStructByPos[version])
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("%s: %v", op, err)
+	}
+	if len(versions) == 0 {
+		return time.Time{}, "", nil
+	}
+	return versions[0].WrittenAt, versions[0].SHA256, nil
+}
+
+// ListChecksums returns up to limit checksums ordered by image and variant,
+// starting after the given key (keyset pagination, use uuid.Nil to start)
+func (s *Storage) ListChecksums(afterID uuid.UUID, afterVariant string, limit int) ([]models.FileChecksum, error) {
+	const op = "storage.ListChecksums"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT image_id, variant, path, sha256, size, created_at, verified_at,
+		 replicated_at, replication_error
+		 FROM file_checksums WHERE (image_id, variant) > ($1, $2)
+		 ORDER BY image_id, variant LIMIT $3`, afterID, afterVariant, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	sums, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.FileChecksum])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return sums, nil
+}
+
+func (s *Storage) MarkChecksumVerified(id uuid.UUID, variant string) error {
+	const op = "storage.MarkChecksumVerified"
+	_, err := s.pool.Exec(context.Background(),
+		`UPDATE file_checksums SET verified_at = now() WHERE image_id = $1 AND variant = $2`, id, variant)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// ListUnreplicated returns up to limit checksums of files not yet copied to
+// the replica, starting after the given key (use uuid.Nil to start)
+func (s *Storage) ListUnreplicated(afterID uuid.UUID, afterVariant string, limit int) ([]models.FileChecksum, error) {
+	const op = "storage.ListUnreplicated"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT image_id, variant, path, sha256, size, created_at, verified_at,
+		 replicated_at, replication_error
+		 FROM file_checksums WHERE replicated_at IS NULL AND (image_id, variant) > ($1, $2)
+		 ORDER BY image_id, variant LIMIT $3`, afterID, afterVariant, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	sums, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.FileChecksum])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return sums, nil
+}
+
+// MarkReplicated records the outcome of copying a file to the replica; a nil
+// replErr marks it replicated
+func (s *Storage) MarkReplicated(id uuid.UUID, variant string, replErr error) error {
+	const op = "storage.MarkReplicated"
+	var err error
+	if replErr == nil {
+		_, err = s.pool.Exec(context.Background(),
+			`UPDATE file_checksums SET replicated_at = now(), replication_error = NULL
+			 WHERE image_id = $1 AND variant = $2`, id, variant)
+	} else {
+		_, err = s.pool.Exec(context.Background(),
+			`UPDATE file_checksums SET replication_error = $3 WHERE image_id = $1 AND variant = $2`,
+			id, variant, replErr.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+func (s *Storage) ReplicationCounts() (*models.ReplicationCounts, error) {
+	const op = "storage.ReplicationCounts"
+	var counts models.ReplicationCounts
+	err := s.pool.QueryRow(context.Background(),
+		`SELECT COUNT(*) FILTER (WHERE replicated_at IS NOT NULL),
+		        COUNT(*) FILTER (WHERE replicated_at IS NULL AND replication_error IS NULL),
+		        COUNT(*) FILTER (WHERE replicated_at IS NULL AND replication_error IS NOT NULL)
+		 FROM file_checksums`).Scan(&counts.Replicated, &counts.Pending, &counts.Failed)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return &counts, nil
+}
+
+// ListImageChecksums returns the checksums of every stored file of an image
+func (s *Storage) ListImageChecksums(id uuid.UUID) ([]models.FileChecksum, error) {
+	const op = "storage.ListImageChecksums"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT image_id, variant, path, sha256, size, created_at, verified_at,
+		 replicated_at, replication_error
+		 FROM file_checksums WHERE image_id = $1 ORDER BY variant`, id)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	sums, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.FileChecksum])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return sums, nil
+}
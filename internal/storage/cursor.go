@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrInvalidCursor is returned for a cursor that no listing handed out
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page selects a page of a listing. Every listing returns the cursor of the
+// page after it; passing that as After continues right after the previous
+// page through the index, where Offset has to skip over every earlier row.
+// Offset is kept for clients that page by number.
+type Page struct {
+	Limit  int
+	Offset int
+	After  string
+}
+
+// cursor is the position of the last row of a page: the values of the
+// columns the listing is sorted by. It's handed out base64url-encoded so
+// clients treat it as opaque.
+type cursor struct {
+	// Order the cursor was handed out for, "" for the default one
+	Sort      string    `json:"s,omitempty"`
+	Rank      *float32  `json:"r,omitempty"`
+	Size      int64     `json:"z,omitempty"`
+	Status    string    `json:"st,omitempty"`
+	CreatedAt time.Time `json:"t,omitzero"`
+	ID        uuid.UUID `json:"i,omitzero"`
+	Seq       int64     `json:"n,omitempty"`
+}
+
+func (c cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses a cursor from a client; the empty string is the
+// start of the listing
+func decodeCursor(s string) (*cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
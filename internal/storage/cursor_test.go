@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	rank := float32(0.25)
+	tests := []struct {
+		name string
+		c    cursor
+	}{
+		{"default order", cursor{CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), ID: uuid.New()}},
+		{"by size", cursor{Sort: "size:asc", Size: 1 << 20, CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), ID: uuid.New()}},
+		{"by status", cursor{Sort: "status:desc", Status: "completed", ID: uuid.New()}},
+		{"search", cursor{Rank: &rank, CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), ID: uuid.New()}},
+		{"audit", cursor{Seq: 42}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeCursor(tt.c.encode())
+			if err != nil {
+				t.Fatalf("decodeCursor: %v", err)
+			}
+			if got.Sort != tt.c.Sort || got.Size != tt.c.Size || got.Status != tt.c.Status ||
+				!got.CreatedAt.Equal(tt.c.CreatedAt) || got.ID != tt.c.ID || got.Seq != tt.c.Seq {
+				t.Errorf("decodeCursor = %+v, want %+v", *got, tt.c)
+			}
+			if (got.Rank == nil) != (tt.c.Rank == nil) || got.Rank != nil && *got.Rank != *tt.c.Rank {
+				t.Errorf("decodeCursor rank = %v, want %v", got.Rank, tt.c.Rank)
+			}
+		})
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	c, err := decodeCursor("")
+	if c != nil || err != nil {
+		t.Errorf(`decodeCursor("") = %v, %v, want the start of the listing`, c, err)
+	}
+
+	for _, s := range []string{
+		"not base64!",
+		base64.StdEncoding.EncodeToString([]byte(`{"s":"size:asc"}`)),
+		base64.RawURLEncoding.EncodeToString([]byte("not json")),
+		base64.RawURLEncoding.EncodeToString([]byte(`["size:asc"]`)),
+		base64.RawURLEncoding.EncodeToString([]byte(`{"i":"not a uuid"}`)),
+	} {
+		if _, err := decodeCursor(s); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("decodeCursor(%q) error = %v, want %v", s, err, ErrInvalidCursor)
+		}
+	}
+}
+
+// ListImages rejects the cursor before it queries the database, so the
+// Storage needs no pool
+func TestListImagesRejectsCursorOfAnotherOrder(t *testing.T) {
+	s := &Storage{}
+	tests := []struct {
+		name   string
+		issued ImageSort
+		given  ImageSort
+	}{
+		{"default for size", ImageSort{}, ImageSort{By: "size"}},
+		{"size for default", ImageSort{By: "size"}, ImageSort{}},
+		{"ascending for descending", ImageSort{By: "size", Asc: true}, ImageSort{By: "size"}},
+		{"oldest first for newest first", ImageSort{By: "created_at", Asc: true}, ImageSort{By: "created_at"}},
+		{"size for status", ImageSort{By: "size"}, ImageSort{By: "status"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			after := cursor{Sort: tt.issued.key(), CreatedAt: time.Now(), ID: uuid.New()}.encode()
+			_, _, err := s.ListImages(ImageFilter{}, tt.given, Page{Limit: 10, After: after})
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("ListImages error = %v, want %v", err, ErrInvalidCursor)
+			}
+		})
+	}
+}
+
+func TestImageSortKey(t *testing.T) {
+	// created_at newest first is the default, spelled out or not
+	if (ImageSort{}).key() != (ImageSort{By: "created_at"}).key() {
+		t.Errorf("default order and created_at descending have different keys")
+	}
+	keys := map[string]ImageSort{}
+	for _, by := range ImageSortColumns {
+		for _, asc := range []bool{false, true} {
+			order := ImageSort{By: by, Asc: asc}
+			if other, ok := keys[order.key()]; ok {
+				t.Errorf("%+v and %+v share the key %q", order, other, order.key())
+			}
+			keys[order.key()] = order
+		}
+	}
+}
+
+func TestSearchImagesRejectsCursorWithoutRank(t *testing.T) {
+	s := &Storage{}
+	// As handed out by ListImages; rejected before the database is queried
+	after := cursor{CreatedAt: time.Now(), ID: uuid.New()}.encode()
+	_, _, err := s.SearchImages("beach", ImageFilter{}, Page{Limit: 10, After: after})
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("SearchImages error = %v, want %v", err, ErrInvalidCursor)
+	}
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"WB_L3_4/internal/models"
+)
+
+// SavePerceptualHash stores the difference hash of an image's original
+func (s *Storage) SavePerceptualHash(id uuid.UUID, dhash uint64) error {
+	const op = "storage.SavePerceptualHash"
+	_, err := s.pool.Exec(context.Background(),
+		`INSERT INTO image_hashes (image_id, dhash) VALUES ($1, $2)
+		ON CONFLICT (image_id) DO UPDATE SET dhash = EXCLUDED.dhash, created_at = now()`,
+		id, int64(dhash))
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// ListFingerprints returns the fingerprints of every image with a recorded
+// checksum or hash, oldest first
+func (s *Storage) ListFingerprints() ([]models.ImageFingerprint, error) {
+	const op = "storage.ListFingerprints"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT i.id, i.tenant, COALESCE(c.sha256, ''), h.dhash, COALESCE(c.size, 0), i.created_at
+		 FROM images i
+		 LEFT JOIN file_checksums c ON c.image_id = i.id AND c.variant = 'original'
+		 LEFT JOIN image_hashes h ON h.image_id = i.id
+		 WHERE c.sha256 IS NOT NULL OR h.dhash IS NOT NULL
+		 ORDER BY i.created_at, i.id`)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	prints, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.ImageFingerprint])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return prints, nil
+}
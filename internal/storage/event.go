@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"WB_L3_4/internal/models"
+)
+
+func (s *Storage) AddImageEvent(event *models.ImageEvent) error {
+	const op = "storage.AddImageEvent"
+	err := s.pool.QueryRow(context.Background(),
+		`INSERT INTO image_events (image_id, event, operation, message, duration_ms)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`,
+		event.ImageID, event.Event, event.Operation, event.Message, event.DurationMS).Scan(&event.ID, &event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// ListImageEvents returns the events of an image in the order they happened
+func (s *Storage) ListImageEvents(id uuid.UUID) ([]models.ImageEvent, error) {
+	const op = "storage.ListImageEvents"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT id, image_id, created_at, event, operation, message, duration_ms
+		 FROM image_events WHERE image_id = $1 ORDER BY id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	events, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.ImageEvent])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return events, nil
+}
+
+// OperationDurationStats returns duration percentiles per operation for
+// operations completed since the given time
+func (s *Storage) OperationDurationStats(since time.Time) ([]models.OperationStats, error) {
+	const op = "storage.OperationDurationStats"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT CASE WHEN operation = '' THEN 'pipeline' ELSE operation END,
+		 COUNT(*),
+		 COUNT(*) FILTER (WHERE event = 'error'),
+		 percentile_cont(0.5) WITHIN GROUP (ORDER BY duration_ms),
+		 percentile_cont(0.9) WITHIN GROUP (ORDER BY duration_ms),
+		 percentile_cont(0.99) WITHIN GROUP (ORDER BY duration_ms),
+		 MAX(duration_ms)
+		 FROM image_events
+		 WHERE duration_ms IS NOT NULL AND created_at >= $1
+		 GROUP BY 1 ORDER BY 1`, since)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	stats, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.OperationStats])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return stats, nil
+}
+
+// CountImagesByStatus returns the number of images in each overall status
+func (s *Storage) CountImagesByStatus() (map[string]int64, error) {
+	const op = "storage.CountImagesByStatus"
+	rows, err := s.pool.Query(context.Background(), `SELECT status, COUNT(*) FROM images GROUP BY status`)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var (
+			status string
+			count  int64
+		)
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, fmt.Errorf("%s: %v", op, err)
+		}
+		counts[status] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return counts, nil
+}
+
+// ProcessingOutcomes counts the images that finished or failed processing
+// since the given time
+func (s *Storage) ProcessingOutcomes(since time.Time) (finished, failed int64, err error) {
+	const op = "storage.ProcessingOutcomes"
+	err = s.pool.QueryRow(context.Background(),
+		`SELECT COUNT(*) FILTER (WHERE event = 'finished'), COUNT(*) FILTER (WHERE event = 'error')
+		 FROM image_events WHERE operation = '' AND duration_ms IS NOT NULL AND created_at >= $1`,
+		since).Scan(&finished, &failed)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %v", op, err)
+	}
+	return finished, failed, nil
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"WB_L3_4/internal/models"
+)
+
+// ListImageExports returns up to limit export rows of images matching filter
+// ordered by ID, starting after the given one; tenant limits them to one
+// tenant when not nil
+func (s *Storage) ListImageExports(tenant *string, filter ImageFilter, after uuid.UUID, limit int) ([]models.ImageExport, error) {
+	const op = "storage.ListImageExports"
+	where, args := filter.where([]any{after, tenant, limit})
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT i.id, i.tenant, i.original_filename, i.content_type, i.status,
+		        COALESCE(i.resize_status, 'pending'), COALESCE(i.thumbnail_status, 'pending'),
+		        COALESCE(i.watermark_status, 'pending'), COALESCE(i.preset, ''), i.title,
+		        COALESCE(o.size, 0), COALESCE(t.size, 0), COALESCE(o.sha256, ''),
+		        i.created_at, i.updated_at
+		 FROM (
+		     SELECT * FROM images WHERE id > $1 AND ($2::TEXT IS NULL OR tenant = $2) AND `+where+`
+		 ) i
+		 LEFT JOIN file_checksums o ON o.image_id = i.id AND o.variant = 'original'
+		 LEFT JOIN LATERAL (
+		     SELECT SUM(size)::BIGINT AS size FROM file_checksums c WHERE c.image_id = i.id
+		 ) t ON true
+		 ORDER BY i.id LIMIT $3`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	exports, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.ImageExport])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return exports, nil
+}
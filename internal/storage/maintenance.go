@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"WB_L3_4/internal/models"
+)
+
+// TryLock takes a session-level advisory lock so only one replica runs a
+// maintenance job at a time. ok is false if another session holds it;
+// otherwise release must be called when the job is done.
+func (s *Storage) TryLock(ctx context.Context, key int64) (release func(), ok bool, err error) {
+	const op = "storage.TryLock"
+
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %v", op, err)
+	}
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&ok); err != nil {
+		conn.Release()
+		return nil, false, fmt.Errorf("%s: %v", op, err)
+	}
+	if !ok {
+		conn.Release()
+		return nil, false, nil
+	}
+	return func() {
+		conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, key)
+		conn.Release()
+	}, true, nil
+}
+
+// ListExpiredImageIDs returns up to limit images created before the cutoff
+func (s *Storage) ListExpiredImageIDs(before time.Time, limit int) ([]uuid.UUID, error) {
+	const op = "storage.ListExpiredImageIDs"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT id FROM images WHERE created_at < $1 ORDER BY created_at LIMIT $2`, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return ids, nil
+}
+
+// ListStuckImageIDs returns up to limit images that have been processing
+// without any update since the cutoff
+func (s *Storage) ListStuckImageIDs(before time.Time, limit int) ([]uuid.UUID, error) {
+	const op = "storage.ListStuckImageIDs"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT id FROM images WHERE status = 'processing' AND updated_at < $1 ORDER BY updated_at LIMIT $2`,
+		before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return ids, nil
+}
+
+// ExistingImageIDs returns which of the given IDs have an image row
+func (s *Storage) ExistingImageIDs(ids []uuid.UUID) (map[uuid.UUID]bool, error) {
+	const op = "storage.ExistingImageIDs"
+	rows, err := s.pool.Query(context.Background(), `SELECT id FROM images WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	found, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	existing := make(map[uuid.UUID]bool, len(found))
+	for _, id := range found {
+		existing[id] = true
+	}
+	return existing, nil
+}
+
+// statsRollups maps a rollup granularity to its table and bucket column
+var statsRollups = map[string]struct{ table, column string }{
+	"hour": {"image_stats_hourly", "hour"},
+	"day":  {"image_stats_daily", "day"},
+}
+
+// AggregateStats recomputes the hourly or daily rollup from the bucket
+// containing from up to the current one
+func (s *Storage) AggregateStats(granularity string, from time.Time) error {
+	const op = "storage.AggregateStats"
+
+	rollup, ok := statsRollups[granularity]
+	if !ok {
+		return fmt.Errorf("%s: unknown granularity %q", op, granularity)
+	}
+	// granularity is either hour or day, both valid date_trunc units
+	step := "interval '1 " + granularity + "'"
+
+	_, err := s.pool.Exec(context.Background(),
+		`INSERT INTO `+rollup.table+` (`+rollup.column+`, uploaded, processed, failed, avg_duration_ms, updated_at)
+		SELECT b.bucket,
+		       (SELECT COUNT(*) FROM images i
+		         WHERE i.created_at >= b.bucket AND i.created_at < b.bucket + `+step+`),
+		       COUNT(e.id) FILTER (WHERE e.event = 'finished'),
+		       COUNT(e.id) FILTER (WHERE e.event = 'error'),
+		       COALESCE(AVG(e.duration_ms), 0),
+		       now()
+		FROM generate_series(date_trunc($2, $1::timestamptz), date_trunc($2, now()), `+step+`) AS b(bucket)
+		LEFT JOIN image_events e ON e.operation = '' AND e.duration_ms IS NOT NULL
+		     AND e.created_at >= b.bucket AND e.created_at < b.bucket + `+step+`
+		GROUP BY b.bucket
+		ON CONFLICT (`+rollup.column+`) DO UPDATE SET uploaded = EXCLUDED.uploaded, processed = EXCLUDED.processed,
+		    failed = EXCLUDED.failed, avg_duration_ms = EXCLUDED.avg_duration_ms, updated_at = now()`,
+		from, granularity)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// ListStats returns the hourly or daily rollup from the bucket containing
+// from on
+func (s *Storage) ListStats(granularity string, from time.Time) ([]models.StatsPoint, error) {
+	const op = "storage.ListStats"
+
+	rollup, ok := statsRollups[granularity]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown granularity %q", op, granularity)
+	}
+
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT `+rollup.column+`::timestamptz, uploaded, processed, failed, avg_duration_ms
+		 FROM `+rollup.table+` WHERE `+rollup.column+` >= date_trunc($2, $1::timestamptz)
+		 ORDER BY `+rollup.column, from, granularity)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	stats, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.StatsPoint])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return stats, nil
+}
+
+// fileKinds maps the kind of a stored file to its path and status columns.
+// The kinds match the checksum variants.
+var fileKinds = map[string]struct{ path, status string }{
+	"original":    {"original_path", ""},
+	"resized":     {"processed_path", "resize_status"},
+	"thumbnail":   {"thumbnail_path", "thumbnail_status"},
+	"watermarked": {"watermarked_path", "watermark_status"},
+}
+
+// ListRetentionExpired returns up to limit images created before the cutoff
+// that still have a file of the given kind. It selects the images of the
+// listed tenants or, with exclude set, of every other tenant.
+func (s *Storage) ListRetentionExpired(kind string, tenants []string, exclude bool, before time.Time, limit int) ([]*models.Image, error) {
+	const op = "storage.ListRetentionExpired"
+
+	columns, ok := fileKinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown file kind %q", op, kind)
+	}
+	tenantCond := `tenant = ANY($1)`
+	if exclude {
+		tenantCond = `NOT (tenant = ANY($1))`
+	}
+
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT `+imageColumns+` FROM images
+		 WHERE `+tenantCond+` AND created_at < $2 AND COALESCE(`+columns.path+`, '') <> ''
+		 ORDER BY created_at LIMIT $3`, tenants, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	images, err := collectImages(rows)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return images, nil
+}
+
+// ExpireFile clears the path of a deleted file, marks a variant expired and
+// drops its checksum
+func (s *Storage) ExpireFile(id uuid.UUID, kind string) error {
+	const op = "storage.ExpireFile"
+
+	columns, ok := fileKinds[kind]
+	if !ok {
+		return fmt.Errorf("%s: unknown file kind %q", op, kind)
+	}
+	set := columns.path + ` = ''`
+	if columns.status != "" {
+		set += `, ` + columns.status + ` = 'expired'`
+	}
+
+	ctx := context.Background()
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `UPDATE images SET `+set+` WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM file_checksums WHERE image_id = $1 AND variant = $2`, id, kind); err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"WB_L3_4/internal/models"
+)
+
+const outboxColumns = `id, image_id, reason, attempts, last_error, next_attempt_at, created_at`
+
+// AddOutboxEntry stores a processing message for the relay to publish
+func (s *Storage) AddOutboxEntry(imageID uuid.UUID, reason string) error {
+	const op = "storage.AddOutboxEntry"
+	_, err := s.pool.Exec(context.Background(),
+		`INSERT INTO kafka_outbox (image_id, reason) VALUES ($1, $2)`, imageID, reason)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// ClaimOutboxEntries returns up to limit entries that are due, oldest first,
+// and pushes their next attempt back by lease so other replicas skip them
+// while they are being relayed
+func (s *Storage) ClaimOutboxEntries(limit int, lease time.Duration) ([]models.OutboxEntry, error) {
+	const op = "storage.ClaimOutboxEntries"
+	rows, err := s.pool.Query(context.Background(),
+		`UPDATE kafka_outbox SET next_attempt_at = now() + $2::interval
+		 WHERE id IN (
+		     SELECT id FROM kafka_outbox WHERE next_attempt_at <= now()
+		     ORDER BY id LIMIT $1
+		     FOR UPDATE SKIP LOCKED)
+		 RETURNING `+outboxColumns, limit, lease)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	entries, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.OutboxEntry])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return entries, nil
+}
+
+// CompleteOutboxEntry removes a published entry and moves its image out of
+// the deferred state
+func (s *Storage) CompleteOutboxEntry(e *models.OutboxEntry) error {
+	const op = "storage.CompleteOutboxEntry"
+
+	tx, err := s.pool.Begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(context.Background(), `DELETE FROM kafka_outbox WHERE id = $1`, e.ID); err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	_, err = tx.Exec(context.Background(),
+		`UPDATE images SET status = 'pending' WHERE id = $1 AND status = 'deferred'`, e.ImageID)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	if err := tx.Commit(context.Background()); err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// FailOutboxEntry records a failed publish and when to try again
+func (s *Storage) FailOutboxEntry(id int64, lastError string, next time.Time) error {
+	const op = "storage.FailOutboxEntry"
+	_, err := s.pool.Exec(context.Background(),
+		`UPDATE kafka_outbox SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3 WHERE id = $1`,
+		id, lastError, next)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// CountOutboxEntries returns how many messages wait to be published
+func (s *Storage) CountOutboxEntries() (int, error) {
+	const op = "storage.CountOutboxEntries"
+	var count int
+	if err := s.pool.QueryRow(context.Background(), `SELECT COUNT(*) FROM kafka_outbox`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("%s: %v", op, err)
+	}
+	return count, nil
+}
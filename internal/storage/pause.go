@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+
+	"WB_L3_4/internal/models"
+)
+
+// GetProcessingPause returns the current pause, or nil while processing runs
+func (s *Storage) GetProcessingPause() (*models.ProcessingPause, error) {
+	const op = "storage.GetProcessingPause"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT paused_by, reason, paused_at FROM processing_pause`)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	pauses, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByPos[models.ProcessingPause])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	if len(pauses) == 0 {
+		return nil, nil
+	}
+	return pauses[0], nil
+}
+
+// PauseProcessing pauses processing, keeping the original pause when it is
+// already paused, and returns the pause in effect
+func (s *Storage) PauseProcessing(pausedBy, reason string) (*models.ProcessingPause, error) {
+	const op = "storage.PauseProcessing"
+	_, err := s.pool.Exec(context.Background(),
+		`INSERT INTO processing_pause (paused_by, reason) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		pausedBy, reason)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	pause, err := s.GetProcessingPause()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return pause, nil
+}
+
+// ResumeProcessing lifts the pause. It reports whether processing was
+// paused.
+func (s *Storage) ResumeProcessing() (bool, error) {
+	const op = "storage.ResumeProcessing"
+	tag, err := s.pool.Exec(context.Background(), `DELETE FROM processing_pause`)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", op, err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
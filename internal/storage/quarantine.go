@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+
+	"WB_L3_4/internal/models"
+)
+
+const quarantineColumns = `id, image_id, payload, error, attempts, created_at, updated_at`
+
+// AddQuarantineEntry stores a message that failed for good
+func (s *Storage) AddQuarantineEntry(e *models.QuarantineEntry) error {
+	const op = "storage.AddQuarantineEntry"
+	err := s.pool.QueryRow(context.Background(),
+		`INSERT INTO quarantine (image_id, payload, error, attempts) VALUES ($1, $2, $3, $4)
+		 RETURNING id, created_at, updated_at`,
+		e.ImageID, e.Payload, e.Error, e.Attempts).Scan(&e.ID, &e.CreatedAt, &e.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// ListQuarantineEntries returns up to limit entries, newest first, starting
+// before the given ID (use 0 to start)
+func (s *Storage) ListQuarantineEntries(before int64, limit int) ([]models.QuarantineEntry, error) {
+	const op = "storage.ListQuarantineEntries"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT `+quarantineColumns+` FROM quarantine
+		 WHERE ($1 = 0 OR id < $1) ORDER BY id DESC LIMIT $2`, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	entries, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.QuarantineEntry])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return entries, nil
+}
+
+// GetQuarantineEntry returns an entry, or nil when there is none with that ID
+func (s *Storage) GetQuarantineEntry(id int64) (*models.QuarantineEntry, error) {
+	const op = "storage.GetQuarantineEntry"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT `+quarantineColumns+` FROM quarantine WHERE id = $1`, id)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	entries, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByPos[models.QuarantineEntry])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return entries[0], nil
+}
+
+// UpdateQuarantinePayload replaces the payload of an entry, e.g. to fix a
+// malformed message before requeueing it. It reports whether the entry
+// existed.
+func (s *Storage) UpdateQuarantinePayload(e *models.QuarantineEntry) (bool, error) {
+	const op = "storage.UpdateQuarantinePayload"
+	err := s.pool.QueryRow(context.Background(),
+		`UPDATE quarantine SET payload = $2, image_id = $3, updated_at = now() WHERE id = $1
+		 RETURNING updated_at`, e.ID, e.Payload, e.ImageID).Scan(&e.UpdatedAt)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", op, err)
+	}
+	return true, nil
+}
+
+// DeleteQuarantineEntry removes an entry. It reports whether it existed.
+func (s *Storage) DeleteQuarantineEntry(id int64) (bool, error) {
+	const op = "storage.DeleteQuarantineEntry"
+	tag, err := s.pool.Exec(context.Background(), `DELETE FROM quarantine WHERE id = $1`, id)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", op, err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// CountQuarantineEntries returns how many messages are quarantined
+func (s *Storage) CountQuarantineEntries() (int, error) {
+	const op = "storage.CountQuarantineEntries"
+	var count int
+	if err := s.pool.QueryRow(context.Background(), `SELECT COUNT(*) FROM quarantine`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("%s: %v", op, err)
+	}
+	return count, nil
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"WB_L3_4/internal/models"
+)
+
+// searchConfig is the text search configuration of the search_vector trigger
+const searchConfig = "simple"
+
+// tagsOrEmpty keeps the NOT NULL tags column from getting a nil slice
+func tagsOrEmpty(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
+
+// UpdateMetadata sets the descriptive metadata of an image
+func (s *Storage) UpdateMetadata(id uuid.UUID, title, description string, tags []string) error {
+	const op = "storage.UpdateMetadata"
+	_, err := s.pool.Exec(context.Background(),
+		`UPDATE images SET title = $2, description = $3, tags = $4 WHERE id = $1`,
+		id, title, description, tagsOrEmpty(tags))
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// SaveOCRText stores the text recognized in an image
+func (s *Storage) SaveOCRText(id uuid.UUID, text string) error {
+	const op = "storage.SaveOCRText"
+	_, err := s.pool.Exec(context.Background(), `UPDATE images SET ocr_text = $2 WHERE id = $1`, id, text)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// SearchImages returns a page of images matching a web search style query,
+// e.g. `beach -night "red car"`, best matches first, and the cursor of the
+// next page, "" after the last one
+func (s *Storage) SearchImages(query string, filter ImageFilter, page Page) ([]*models.Image, string, error) {
+	const op = "storage.SearchImages"
+	after, err := decodeCursor(page.After)
+	if err != nil {
+		return nil, "", err
+	}
+	if after != nil && after.Rank == nil {
+		return nil, "", ErrInvalidCursor
+	}
+	where, args := filter.where([]any{page.Limit, page.Offset, query})
+	next := "TRUE"
+	if after != nil {
+		args = append(args, *after.Rank, after.CreatedAt, after.ID)
+		next = fmt.Sprintf("(rank, created_at, id) < ($%d::real, $%d, $%d)", len(args)-2, len(args)-1, len(args))
+	}
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT `+imageColumns+`, rank FROM (
+		   SELECT *, ts_rank_cd(search_vector, websearch_to_tsquery('`+searchConfig+`', $3)) AS rank FROM images
+		   WHERE search_vector @@ websearch_to_tsquery('`+searchConfig+`', $3) AND `+where+`
+		 ) matches WHERE `+next+`
+		 ORDER BY rank DESC, created_at DESC, id DESC LIMIT $1 OFFSET $2`, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", op, err)
+	}
+	defer rows.Close()
+
+	var (
+		images []*models.Image
+		rank   float32
+	)
+	for rows.Next() {
+		img, err := scanImage(rows, &rank)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %v", op, err)
+		}
+		images = append(images, img)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("%s: %v", op, err)
+	}
+	if len(images) < page.Limit {
+		return images, "", nil
+	}
+	last := images[len(images)-1]
+	return images, cursor{Rank: &rank, CreatedAt: last.CreatedAt, ID: last.ID}.encode(), nil
+}
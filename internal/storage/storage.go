@@ -4,8 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jackc/pgx/v5/stdlib"
 
@@ -42,6 +46,11 @@ func NewStorage(dsn string) (*Storage, error) {
 	return storage, nil
 }
 
+// Ping checks that the database is reachable
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
+}
+
 func (s *Storage) Close() {
 	s.db.Close()
 	s.pool.Close()
@@ -91,10 +100,13 @@ func (s *Storage) SaveImage(img *models.Image) error {
 
 	// Try to insert with new schema first
 	_, err := s.pool.Exec(context.Background(),
-		`INSERT INTO images (id, status, original_path, processed_path, thumbnail_path, watermarked_path, resize_status, thumbnail_status, watermark_status)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		`INSERT INTO images (id, status, original_path, processed_path, thumbnail_path, watermarked_path, resize_status, thumbnail_status, watermark_status, preset, options,
+		 original_filename, content_type, process_at, tenant, callback_url, notify_email, title, description, tags, owner, size)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22)`,
 		img.ID, img.Status, img.OriginalPath, img.ProcessedPath, img.ThumbnailPath, img.WatermarkedPath,
-		img.ResizeStatus, img.ThumbnailStatus, img.WatermarkStatus)
+		img.ResizeStatus, img.ThumbnailStatus, img.WatermarkStatus, img.Preset, img.Options,
+		img.OriginalFilename, img.ContentType, img.ProcessAt, img.Tenant, img.CallbackURL, img.NotifyEmail,
+		img.Title, img.Description, tagsOrEmpty(img.Tags), img.Owner, img.Size)
 
 	if err != nil {
 		// If new schema fails, try old schema (backward compatibility)
@@ -109,21 +121,86 @@ func (s *Storage) SaveImage(img *models.Image) error {
 	return nil
 }
 
+const imageColumns = `id, status, original_path, processed_path, thumbnail_path, watermarked_path,
+	COALESCE(resize_status, 'pending') as resize_status,
+	COALESCE(thumbnail_status, 'pending') as thumbnail_status,
+	COALESCE(watermark_status, 'pending') as watermark_status,
+	COALESCE(preset, '') as preset, options, original_filename, content_type, process_at, tenant, callback_url, notify_email,
+	video_status, video_path, upscale_status, upscaled_path, title, description, tags, ocr_text, errors, attempts, owner, size, created_at, updated_at`
+
+// scanImage scans the imageColumns of a row, followed by any extra columns
+// the query selects
+func scanImage(row pgx.Row, extra ...any) (*models.Image, error) {
+	var img models.Image
+	dest := []any{&img.ID, &img.Status, &img.OriginalPath, &img.ProcessedPath, &img.ThumbnailPath, &img.WatermarkedPath,
+		&img.ResizeStatus, &img.ThumbnailStatus, &img.WatermarkStatus, &img.Preset, &img.Options,
+		&img.OriginalFilename, &img.ContentType, &img.ProcessAt, &img.Tenant, &img.CallbackURL, &img.NotifyEmail,
+		&img.VideoStatus, &img.VideoPath, &img.UpscaleStatus, &img.UpscaledPath,
+		&img.Title, &img.Description, &img.Tags, &img.OCRText, &img.Errors, &img.Attempts, &img.Owner, &img.Size, &img.CreatedAt, &img.UpdatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+func collectImages(rows pgx.Rows) ([]*models.Image, error) {
+	defer rows.Close()
+
+	var images []*models.Image
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
 func (s *Storage) GetImage(id uuid.UUID) (*models.Image, error) {
 	const op = "storage.GetImage"
-	var img models.Image
-	err := s.pool.QueryRow(context.Background(),
-		`SELECT id, status, original_path, processed_path, thumbnail_path, watermarked_path, 
-		 COALESCE(resize_status, 'pending') as resize_status, 
-		 COALESCE(thumbnail_status, 'pending') as thumbnail_status, 
-		 COALESCE(watermark_status, 'pending') as watermark_status 
-		 FROM images WHERE id = $1`,
-		id).Scan(&img.ID, &img.Status, &img.OriginalPath, &img.ProcessedPath, &img.ThumbnailPath, &img.WatermarkedPath,
-		&img.ResizeStatus, &img.ThumbnailStatus, &img.WatermarkStatus)
+	img, err := scanImage(s.pool.QueryRow(context.Background(),
+		`SELECT `+imageColumns+` FROM images WHERE id = $1`, id))
 	if err != nil {
 		return nil, fmt.Errorf("%s: %v", op, err)
 	}
-	return &img, nil
+	return img, nil
+}
+
+// GetImagesByID returns the images with the given IDs that exist, in no
+// particular order
+func (s *Storage) GetImagesByID(ids []uuid.UUID) ([]*models.Image, error) {
+	const op = "storage.GetImagesByID"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT `+imageColumns+` FROM images WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	images, err := collectImages(rows)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return images, nil
+}
+
+// ListImagesChangedSince returns up to limit images updated at or after
+// since, or whose stored files changed since then, ordered by ID and
+// starting after the given ID (use uuid.Nil to start)
+func (s *Storage) ListImagesChangedSince(since time.Time, after uuid.UUID, limit int) ([]*models.Image, error) {
+	const op = "storage.ListImagesChangedSince"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT `+imageColumns+` FROM images i
+		 WHERE id > $2 AND (updated_at >= $1 OR EXISTS (
+		     SELECT 1 FROM file_checksums c WHERE c.image_id = i.id AND c.created_at >= $1))
+		 ORDER BY id LIMIT $3`, since, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	images, err := collectImages(rows)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return images, nil
 }
 
 func (s *Storage) UpdateImage(img *models.Image) error {
@@ -156,3 +233,369 @@ func (s *Storage) DeleteImage(id uuid.UUID) error {
 	}
 	return nil
 }
+
+// ImageFilter selects images by status, upload time and size; empty fields
+// match everything
+type ImageFilter struct {
+	Status          string `json:"status"`
+	ResizeStatus    string `json:"resize_status"`
+	ThumbnailStatus string `json:"thumbnail_status"`
+	WatermarkStatus string `json:"watermark_status"`
+	Tenant          string `json:"tenant"`
+	Owner           string `json:"owner"`
+	// Uploaded at or after UploadedAfter and before UploadedBefore
+	UploadedAfter  time.Time `json:"uploaded_after,omitzero"`
+	UploadedBefore time.Time `json:"uploaded_before,omitzero"`
+	// Bounds of the original's size in bytes, inclusive
+	MinSize int64 `json:"min_size,omitempty"`
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+func (f ImageFilter) where(args []any) (string, []any) {
+	var conds []string
+	cond := func(expr string, value any) {
+		args = append(args, value)
+		conds = append(conds, fmt.Sprintf(expr, len(args)))
+	}
+	add := func(column, value string) {
+		if value != "" {
+			cond(column+" = $%d", value)
+		}
+	}
+	add("status", f.Status)
+	add("COALESCE(resize_status, 'pending')", f.ResizeStatus)
+	add("COALESCE(thumbnail_status, 'pending')", f.ThumbnailStatus)
+	add("COALESCE(watermark_status, 'pending')", f.WatermarkStatus)
+	add("tenant", f.Tenant)
+	add("owner", f.Owner)
+	if !f.UploadedAfter.IsZero() {
+		cond("created_at >= $%d", f.UploadedAfter)
+	}
+	if !f.UploadedBefore.IsZero() {
+		cond("created_at < $%d", f.UploadedBefore)
+	}
+	if f.MinSize > 0 {
+		cond("size >= $%d", f.MinSize)
+	}
+	if f.MaxSize > 0 {
+		cond("size <= $%d", f.MaxSize)
+	}
+	if len(conds) == 0 {
+		return "TRUE", args
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func (s *Storage) CountImages(filter ImageFilter) (int, error) {
+	const op = "storage.CountImages"
+	where, args := filter.where(nil)
+	var count int
+	err := s.pool.QueryRow(context.Background(), `SELECT COUNT(*) FROM images WHERE `+where, args...).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", op, err)
+	}
+	return count, nil
+}
+
+// ImageSort orders an image listing. Ties are broken by creation time and
+// ID in the same direction, so every order can be paged with a cursor.
+type ImageSort struct {
+	// One of ImageSortColumns, created_at when empty
+	By  string
+	Asc bool
+}
+
+// ImageSortColumns are the columns image listings can be sorted by, each
+// backed by an index on (column, created_at, id)
+var ImageSortColumns = []string{"created_at", "size", "status"}
+
+// key identifies the order in cursors, "" for the default newest first
+func (o ImageSort) key() string {
+	if (o.By == "" || o.By == "created_at") && !o.Asc {
+		return ""
+	}
+	if o.Asc {
+		return o.By + ":asc"
+	}
+	return o.By + ":desc"
+}
+
+// ListImages returns a page of images matching filter in the given order,
+// and the cursor of the next page, "" after the last one
+func (s *Storage) ListImages(filter ImageFilter, order ImageSort, page Page) ([]*models.Image, string, error) {
+	const op = "storage.ListImages"
+
+	if order.By == "" {
+		order.By = "created_at"
+	}
+	if !slices.Contains(ImageSortColumns, order.By) {
+		return nil, "", fmt.Errorf("%s: unknown sort column %q", op, order.By)
+	}
+	after, err := decodeCursor(page.After)
+	if err != nil {
+		return nil, "", err
+	}
+	if after != nil && after.Sort != order.key() {
+		return nil, "", ErrInvalidCursor
+	}
+
+	// Sort columns and their values in the cursor
+	columns := []string{"created_at", "id"}
+	var values []any
+	if after != nil {
+		values = []any{after.CreatedAt, after.ID}
+	}
+	switch order.By {
+	case "size":
+		columns = append([]string{"size"}, columns...)
+		if after != nil {
+			values = append([]any{after.Size}, values...)
+		}
+	case "status":
+		columns = append([]string{"status"}, columns...)
+		if after != nil {
+			values = append([]any{after.Status}, values...)
+		}
+	}
+	dir, cmp := "DESC", "<"
+	if order.Asc {
+		dir, cmp = "ASC", ">"
+	}
+
+	where, args := filter.where([]any{page.Limit, page.Offset})
+	if after != nil {
+		params := make([]string, len(values))
+		for i, v := range values {
+			args = append(args, v)
+			params[i] = fmt.Sprintf("$%d", len(args))
+		}
+		where += fmt.Sprintf(" AND (%s) %s (%s)", strings.Join(columns, ", "), cmp, strings.Join(params, ", "))
+	}
+	orderBy := make([]string, len(columns))
+	for i, column := range columns {
+		orderBy[i] = column + " " + dir
+	}
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT `+imageColumns+` FROM images WHERE `+where+`
+		 ORDER BY `+strings.Join(orderBy, ", ")+` LIMIT $1 OFFSET $2`, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", op, err)
+	}
+	images, err := collectImages(rows)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", op, err)
+	}
+	if len(images) < page.Limit {
+		return images, "", nil
+	}
+	last := images[len(images)-1]
+	next := cursor{Sort: order.key(), CreatedAt: last.CreatedAt, ID: last.ID}
+	switch order.By {
+	case "size":
+		next.Size = last.Size
+	case "status":
+		next.Status = last.Status
+	}
+	return images, next.encode(), nil
+}
+
+// ListImageIDs returns up to limit IDs matching filter ordered by ID,
+// starting after the given ID (keyset pagination, use uuid.Nil to start)
+func (s *Storage) ListImageIDs(filter ImageFilter, after uuid.UUID, limit int) ([]uuid.UUID, error) {
+	const op = "storage.ListImageIDs"
+	where, args := filter.where([]any{after, limit})
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT id FROM images WHERE id > $1 AND `+where+` ORDER BY id LIMIT $2`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return ids, nil
+}
+
+// ListDueImageIDs returns up to limit scheduled images whose process_at has
+// passed, earliest first
+func (s *Storage) ListDueImageIDs(limit int) ([]uuid.UUID, error) {
+	const op = "storage.ListDueImageIDs"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT id FROM images WHERE status = 'scheduled' AND process_at <= now()
+		 ORDER BY process_at LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return ids, nil
+}
+
+// ResetForReprocessing puts the images back into the pending state so the
+// worker processes them again
+func (s *Storage) ResetForReprocessing(ids []uuid.UUID) error {
+	const op = "storage.ResetForReprocessing"
+	_, err := s.pool.Exec(context.Background(),
+		`UPDATE images SET status = 'pending', resize_status = 'pending', thumbnail_status = 'pending',
+		 watermark_status = 'pending' WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// UpdateOperation updates the status and output path of a single processing
+// operation without touching the other columns, so operations on the same
+// image can run concurrently
+func (s *Storage) UpdateOperation(id uuid.UUID, operation, status, path string) error {
+	const op = "storage.UpdateOperation"
+
+	var query string
+	switch operation {
+	case "resize":
+		query = `UPDATE images SET resize_status = $2, processed_path = $3 WHERE id = $1`
+	case "thumbnail":
+		query = `UPDATE images SET thumbnail_status = $2, thumbnail_path = $3 WHERE id = $1`
+	case "watermark":
+		query = `UPDATE images SET watermark_status = $2, watermarked_path = $3 WHERE id = $1`
+	case "video":
+		query = `UPDATE images SET video_status = $2, video_path = $3 WHERE id = $1`
+	case "upscale":
+		query = `UPDATE images SET upscale_status = $2, upscaled_path = $3 WHERE id = $1`
+	default:
+		return fmt.Errorf("%s: unknown operation %q", op, operation)
+	}
+
+	if _, err := s.pool.Exec(context.Background(), query, id, status, path); err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// SetOperationError stores message as the last error of an operation, or
+// clears it when message is empty
+func (s *Storage) SetOperationError(id uuid.UUID, operation, message string) error {
+	const op = "storage.SetOperationError"
+
+	var err error
+	if message == "" {
+		_, err = s.pool.Exec(context.Background(),
+			`UPDATE images SET errors = errors - $2::text WHERE id = $1 AND errors ? $2::text`, id, operation)
+	} else {
+		_, err = s.pool.Exec(context.Background(),
+			`UPDATE images SET errors = errors || jsonb_build_object($2::text, $3::text) WHERE id = $1`, id, operation, message)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// IncrementAttempts counts another run of an operation and returns how many
+// were started so far
+func (s *Storage) IncrementAttempts(id uuid.UUID, operation string) (int, error) {
+	const op = "storage.IncrementAttempts"
+	var attempts int
+	err := s.pool.QueryRow(context.Background(),
+		`UPDATE images SET attempts = attempts || jsonb_build_object($2::text, COALESCE((attempts->>$2::text)::int, 0) + 1)
+		 WHERE id = $1 RETURNING (attempts->>$2::text)::int`, id, operation).Scan(&attempts)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", op, err)
+	}
+	return attempts, nil
+}
+
+// ResetAttempts clears the attempt counts of the given images, giving them a
+// fresh budget
+func (s *Storage) ResetAttempts(ids []uuid.UUID) error {
+	const op = "storage.ResetAttempts"
+	_, err := s.pool.Exec(context.Background(), `UPDATE images SET attempts = '{}' WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// FileMove is a file of an image moved from OldPath to NewPath
+type FileMove struct {
+	ImageID uuid.UUID
+	OldPath string
+	NewPath string
+}
+
+// RelocateFile rewrites every reference an image holds to oldPath after the
+// file was moved to newPath
+func (s *Storage) RelocateFile(id uuid.UUID, oldPath, newPath string) error {
+	return s.RelocateFiles([]FileMove{{ImageID: id, OldPath: oldPath, NewPath: newPath}})
+}
+
+// RelocateFiles is RelocateFile for many files, in one transaction
+func (s *Storage) RelocateFiles(moves []FileMove) error {
+	const op = "storage.RelocateFiles"
+
+	ctx := context.Background()
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	for _, m := range moves {
+		_, err = tx.Exec(ctx,
+			`UPDATE images SET
+			 original_path = CASE WHEN original_path = $2 THEN $3 ELSE original_path END,
+			 processed_path = CASE WHEN processed_path = $2 THEN $3 ELSE processed_path END,
+			 thumbnail_path = CASE WHEN thumbnail_path = $2 THEN $3 ELSE thumbnail_path END,
+			 watermarked_path = CASE WHEN watermarked_path = $2 THEN $3 ELSE watermarked_path END,
+			 video_path = CASE WHEN video_path = $2 THEN $3 ELSE video_path END,
+			 upscaled_path = CASE WHEN upscaled_path = $2 THEN $3 ELSE upscaled_path END
+			 WHERE id = $1`, m.ImageID, m.OldPath, m.NewPath)
+		if err != nil {
+			return fmt.Errorf("%s: %v", op, err)
+		}
+		_, err = tx.Exec(ctx, `UPDATE file_checksums SET path = $3, replicated_at = NULL WHERE image_id = $1 AND path = $2`,
+			m.ImageID, m.OldPath, m.NewPath)
+		if err != nil {
+			return fmt.Errorf("%s: %v", op, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// RestoreImage inserts an image from a backup, replacing an existing row
+// with the same ID
+func (s *Storage) RestoreImage(img *models.Image) error {
+	const op = "storage.RestoreImage"
+	_, err := s.pool.Exec(context.Background(),
+		`INSERT INTO images (id, status, original_path, processed_path, thumbnail_path, watermarked_path,
+		 resize_status, thumbnail_status, watermark_status, preset, options, original_filename, content_type, process_at, tenant, callback_url, notify_email, created_at,
+		 video_status, video_path, upscale_status, upscaled_path, title, description, tags, ocr_text, owner, size)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22,
+		 $23, $24, $25, $26, $27, $28)
+		ON CONFLICT (id) DO UPDATE SET status = EXCLUDED.status, original_path = EXCLUDED.original_path,
+		 processed_path = EXCLUDED.processed_path, thumbnail_path = EXCLUDED.thumbnail_path,
+		 watermarked_path = EXCLUDED.watermarked_path, resize_status = EXCLUDED.resize_status,
+		 thumbnail_status = EXCLUDED.thumbnail_status, watermark_status = EXCLUDED.watermark_status,
+		 preset = EXCLUDED.preset, options = EXCLUDED.options, original_filename = EXCLUDED.original_filename,
+		 content_type = EXCLUDED.content_type, process_at = EXCLUDED.process_at, tenant = EXCLUDED.tenant,
+		 callback_url = EXCLUDED.callback_url, notify_email = EXCLUDED.notify_email, created_at = EXCLUDED.created_at,
+		 video_status = EXCLUDED.video_status, video_path = EXCLUDED.video_path,
+		 upscale_status = EXCLUDED.upscale_status, upscaled_path = EXCLUDED.upscaled_path,
+		 title = EXCLUDED.title, description = EXCLUDED.description, tags = EXCLUDED.tags, ocr_text = EXCLUDED.ocr_text,
+		 owner = EXCLUDED.owner, size = EXCLUDED.size`,
+		img.ID, img.Status, img.OriginalPath, img.ProcessedPath, img.ThumbnailPath, img.WatermarkedPath,
+		img.ResizeStatus, img.ThumbnailStatus, img.WatermarkStatus, img.Preset, img.Options,
+		img.OriginalFilename, img.ContentType, img.ProcessAt, img.Tenant, img.CallbackURL, img.NotifyEmail, img.CreatedAt,
+		img.VideoStatus, img.VideoPath, img.UpscaleStatus, img.UpscaledPath,
+		img.Title, img.Description, tagsOrEmpty(img.Tags), img.OCRText, img.Owner, img.Size)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
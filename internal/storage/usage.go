@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"WB_L3_4/internal/models"
+)
+
+// GetOwnerUsage returns the storage used by an owner's images, zero for an
+// owner without any. The totals are kept up to date by triggers on images
+// and file_checksums.
+func (s *Storage) GetOwnerUsage(owner string) (*models.OwnerUsage, error) {
+	const op = "storage.GetOwnerUsage"
+
+	usage := models.OwnerUsage{Owner: owner, Variants: map[string]models.VariantUsage{}}
+	ctx := context.Background()
+	rows, err := s.pool.Query(ctx, `SELECT images, updated_at FROM owner_usage WHERE owner = $1`, owner)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	for rows.Next() {
+		if err := rows.Scan(&usage.Images, &usage.UpdatedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("%s: %v", op, err)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+
+	rows, err = s.pool.Query(ctx,
+		`SELECT variant, files, bytes FROM owner_variant_usage WHERE owner = $1 AND files > 0`, owner)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			variant string
+			v       models.VariantUsage
+		)
+		if err := rows.Scan(&variant, &v.Files, &v.Bytes); err != nil {
+			return nil, fmt.Errorf("%s: %v", op, err)
+		}
+		usage.Variants[variant] = v
+		usage.Bytes += v.Bytes
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return &usage, nil
+}
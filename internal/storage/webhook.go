@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"WB_L3_4/internal/models"
+)
+
+const webhookColumns = `id, image_id, url, event, payload, status, attempts, next_attempt_at,
+	last_status_code, last_error, created_at, delivered_at`
+
+func (s *Storage) AddWebhookDelivery(d *models.WebhookDelivery) error {
+	const op = "storage.AddWebhookDelivery"
+	err := s.pool.QueryRow(context.Background(),
+		`INSERT INTO webhook_deliveries (image_id, url, event, payload)
+		VALUES ($1, $2, $3, $4) RETURNING id, status, next_attempt_at, created_at`,
+		d.ImageID, d.URL, d.Event, d.Payload).Scan(&d.ID, &d.Status, &d.NextAttemptAt, &d.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// ClaimDueWebhookDeliveries returns up to limit pending deliveries that are
+// due and pushes their next attempt back by lease, so other replicas skip
+// them while they are being delivered
+func (s *Storage) ClaimDueWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	const op = "storage.ClaimDueWebhookDeliveries"
+	rows, err := s.pool.Query(context.Background(),
+		`UPDATE webhook_deliveries SET next_attempt_at = now() + $2::interval
+		 WHERE id IN (
+		     SELECT id FROM webhook_deliveries
+		     WHERE status = 'pending' AND next_attempt_at <= now()
+		     ORDER BY next_attempt_at LIMIT $1
+		     FOR UPDATE SKIP LOCKED)
+		 RETURNING `+webhookColumns, limit, lease)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	deliveries, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.WebhookDelivery])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return deliveries, nil
+}
+
+// UpdateWebhookDelivery stores the outcome of a delivery attempt
+func (s *Storage) UpdateWebhookDelivery(d *models.WebhookDelivery) error {
+	const op = "storage.UpdateWebhookDelivery"
+	_, err := s.pool.Exec(context.Background(),
+		`UPDATE webhook_deliveries SET status = $2, attempts = $3, next_attempt_at = $4,
+		 last_status_code = $5, last_error = $6, delivered_at = $7 WHERE id = $1`,
+		d.ID, d.Status, d.Attempts, d.NextAttemptAt, d.LastStatusCode, d.LastError, d.DeliveredAt)
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// ListWebhookDeliveries returns up to limit deliveries with the given
+// status, newest first, starting before the given ID (use 0 to start)
+func (s *Storage) ListWebhookDeliveries(status string, before int64, limit int) ([]models.WebhookDelivery, error) {
+	const op = "storage.ListWebhookDeliveries"
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT `+webhookColumns+` FROM webhook_deliveries
+		 WHERE status = $1 AND ($2 = 0 OR id < $2) ORDER BY id DESC LIMIT $3`, status, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	deliveries, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.WebhookDelivery])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	return deliveries, nil
+}
+
+// RedeliverWebhook puts a failed delivery back in the queue with a fresh
+// attempt budget. It reports whether a failed delivery with that ID existed.
+func (s *Storage) RedeliverWebhook(id int64) (bool, error) {
+	const op = "storage.RedeliverWebhook"
+	tag, err := s.pool.Exec(context.Background(),
+		`UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = now()
+		 WHERE id = $1 AND status = 'failed'`, id)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", op, err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *Storage) CountWebhookDeliveries(status string) (int64, error) {
+	const op = "storage.CountWebhookDeliveries"
+	var count int64
+	err := s.pool.QueryRow(context.Background(),
+		`SELECT COUNT(*) FROM webhook_deliveries WHERE status = $1`, status).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", op, err)
+	}
+	return count, nil
+}
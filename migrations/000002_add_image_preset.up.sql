@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE images ADD COLUMN IF NOT EXISTS preset TEXT DEFAULT '';
+
+-- +goose Down
+ALTER TABLE images DROP COLUMN IF EXISTS preset;
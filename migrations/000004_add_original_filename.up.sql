@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE images ADD COLUMN IF NOT EXISTS original_filename TEXT NOT NULL DEFAULT '';
+ALTER TABLE images ADD COLUMN IF NOT EXISTS content_type TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE images DROP COLUMN IF EXISTS original_filename;
+ALTER TABLE images DROP COLUMN IF EXISTS content_type;
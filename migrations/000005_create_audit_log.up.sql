@@ -0,0 +1,15 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    actor TEXT NOT NULL,
+    remote_addr TEXT NOT NULL,
+    action TEXT NOT NULL,
+    image_id UUID,
+    details JSONB NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at);
+CREATE INDEX IF NOT EXISTS audit_log_image_id_idx ON audit_log (image_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS audit_log;
@@ -0,0 +1,13 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS image_events (
+    id BIGSERIAL PRIMARY KEY,
+    image_id UUID NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    event TEXT NOT NULL,
+    operation TEXT NOT NULL DEFAULT '',
+    message TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS image_events_image_id_idx ON image_events (image_id, id);
+
+-- +goose Down
+DROP TABLE IF EXISTS image_events;
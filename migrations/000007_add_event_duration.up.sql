@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE image_events ADD COLUMN IF NOT EXISTS duration_ms BIGINT;
+CREATE INDEX IF NOT EXISTS image_events_created_at_idx ON image_events (created_at);
+
+-- +goose Down
+DROP INDEX IF EXISTS image_events_created_at_idx;
+ALTER TABLE image_events DROP COLUMN IF EXISTS duration_ms;
@@ -0,0 +1,14 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS file_checksums (
+    image_id UUID NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+    variant TEXT NOT NULL,
+    path TEXT NOT NULL,
+    sha256 TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    verified_at TIMESTAMPTZ,
+    PRIMARY KEY (image_id, variant)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS file_checksums;
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE file_checksums ADD COLUMN IF NOT EXISTS replicated_at TIMESTAMPTZ;
+ALTER TABLE file_checksums ADD COLUMN IF NOT EXISTS replication_error TEXT;
+
+-- +goose Down
+ALTER TABLE file_checksums DROP COLUMN IF EXISTS replication_error;
+ALTER TABLE file_checksums DROP COLUMN IF EXISTS replicated_at;
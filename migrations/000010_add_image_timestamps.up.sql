@@ -0,0 +1,24 @@
+-- +goose Up
+ALTER TABLE images ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE images ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS images_updated_at_idx ON images (updated_at);
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION images_set_updated_at() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.updated_at = now();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+DROP TRIGGER IF EXISTS images_updated_at ON images;
+CREATE TRIGGER images_updated_at BEFORE UPDATE ON images
+    FOR EACH ROW EXECUTE FUNCTION images_set_updated_at();
+
+-- +goose Down
+DROP TRIGGER IF EXISTS images_updated_at ON images;
+DROP FUNCTION IF EXISTS images_set_updated_at();
+DROP INDEX IF EXISTS images_updated_at_idx;
+ALTER TABLE images DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE images DROP COLUMN IF EXISTS created_at;
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE images ADD COLUMN IF NOT EXISTS process_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS images_scheduled_idx ON images (process_at) WHERE status = 'scheduled';
+
+-- +goose Down
+DROP INDEX IF EXISTS images_scheduled_idx;
+ALTER TABLE images DROP COLUMN IF EXISTS process_at;
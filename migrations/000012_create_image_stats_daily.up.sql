@@ -0,0 +1,14 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS image_stats_daily (
+    day DATE PRIMARY KEY,
+    uploaded BIGINT NOT NULL DEFAULT 0,
+    processed BIGINT NOT NULL DEFAULT 0,
+    failed BIGINT NOT NULL DEFAULT 0,
+    avg_duration_ms DOUBLE PRECISION NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS images_created_at_idx ON images (created_at);
+
+-- +goose Down
+DROP INDEX IF EXISTS images_created_at_idx;
+DROP TABLE IF EXISTS image_stats_daily;
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE images ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS images_tenant_created_at_idx ON images (tenant, created_at);
+
+-- +goose Down
+DROP INDEX IF EXISTS images_tenant_created_at_idx;
+ALTER TABLE images DROP COLUMN IF EXISTS tenant;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE images ADD COLUMN IF NOT EXISTS notify_email TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE images DROP COLUMN IF EXISTS notify_email;
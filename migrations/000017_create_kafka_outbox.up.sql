@@ -0,0 +1,18 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS kafka_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    image_id UUID NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+    reason TEXT NOT NULL DEFAULT '',
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS kafka_outbox_next_attempt_at_idx ON kafka_outbox (next_attempt_at);
+
+-- Images deferred before the outbox existed are relayed through it
+INSERT INTO kafka_outbox (image_id, reason)
+SELECT id, 'deferred' FROM images WHERE status = 'deferred';
+
+-- +goose Down
+DROP TABLE IF EXISTS kafka_outbox;
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE images ADD COLUMN IF NOT EXISTS video_status TEXT NOT NULL DEFAULT '';
+ALTER TABLE images ADD COLUMN IF NOT EXISTS video_path TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE images DROP COLUMN IF EXISTS video_path;
+ALTER TABLE images DROP COLUMN IF EXISTS video_status;
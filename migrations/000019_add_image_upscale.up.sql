@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE images ADD COLUMN IF NOT EXISTS upscale_status TEXT NOT NULL DEFAULT '';
+ALTER TABLE images ADD COLUMN IF NOT EXISTS upscaled_path TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE images DROP COLUMN IF EXISTS upscaled_path;
+ALTER TABLE images DROP COLUMN IF EXISTS upscale_status;
@@ -0,0 +1,9 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS image_hashes (
+    image_id UUID PRIMARY KEY REFERENCES images (id) ON DELETE CASCADE,
+    dhash BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS image_hashes;
@@ -0,0 +1,40 @@
+-- +goose Up
+ALTER TABLE images ADD COLUMN IF NOT EXISTS title TEXT NOT NULL DEFAULT '';
+ALTER TABLE images ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+ALTER TABLE images ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE images ADD COLUMN IF NOT EXISTS ocr_text TEXT NOT NULL DEFAULT '';
+ALTER TABLE images ADD COLUMN IF NOT EXISTS search_vector TSVECTOR;
+CREATE INDEX IF NOT EXISTS images_search_vector_idx ON images USING GIN (search_vector);
+
+-- The simple configuration doesn't stem, so metadata in any language matches
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION images_set_search_vector() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.search_vector =
+        setweight(to_tsvector('simple', NEW.title), 'A') ||
+        setweight(to_tsvector('simple', array_to_string(NEW.tags, ' ')), 'A') ||
+        setweight(to_tsvector('simple', NEW.description), 'B') ||
+        setweight(to_tsvector('simple', NEW.original_filename), 'C') ||
+        setweight(to_tsvector('simple', NEW.ocr_text), 'D');
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+DROP TRIGGER IF EXISTS images_search_vector ON images;
+CREATE TRIGGER images_search_vector
+    BEFORE INSERT OR UPDATE OF title, description, tags, ocr_text, original_filename ON images
+    FOR EACH ROW EXECUTE FUNCTION images_set_search_vector();
+
+-- Index the existing images by their filenames
+UPDATE images SET original_filename = original_filename;
+
+-- +goose Down
+DROP TRIGGER IF EXISTS images_search_vector ON images;
+DROP FUNCTION IF EXISTS images_set_search_vector();
+DROP INDEX IF EXISTS images_search_vector_idx;
+ALTER TABLE images DROP COLUMN IF EXISTS search_vector;
+ALTER TABLE images DROP COLUMN IF EXISTS ocr_text;
+ALTER TABLE images DROP COLUMN IF EXISTS tags;
+ALTER TABLE images DROP COLUMN IF EXISTS description;
+ALTER TABLE images DROP COLUMN IF EXISTS title;
@@ -0,0 +1,6 @@
+-- +goose Up
+-- Last error message of each failed operation, keyed by operation
+ALTER TABLE images ADD COLUMN IF NOT EXISTS errors JSONB NOT NULL DEFAULT '{}';
+
+-- +goose Down
+ALTER TABLE images DROP COLUMN IF EXISTS errors;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- Processing runs started by the worker, keyed by operation; "processing"
+-- counts whole pipeline runs
+ALTER TABLE images ADD COLUMN IF NOT EXISTS attempts JSONB NOT NULL DEFAULT '{}';
+
+-- +goose Down
+ALTER TABLE images DROP COLUMN IF EXISTS attempts;
@@ -0,0 +1,16 @@
+-- +goose Up
+-- Processing messages that failed for good, kept for admins to inspect,
+-- fix and requeue
+CREATE TABLE IF NOT EXISTS quarantine (
+    id BIGSERIAL PRIMARY KEY,
+    -- NULL when the payload isn't a valid image ID
+    image_id UUID,
+    payload TEXT NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    attempts INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS quarantine;
@@ -0,0 +1,11 @@
+-- +goose Up
+-- Processing is paused on every replica while this holds a row
+CREATE TABLE IF NOT EXISTS processing_pause (
+    singleton BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (singleton),
+    paused_by TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT '',
+    paused_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS processing_pause;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- Who uploaded the image, the subject of an owner-bound token such as one
+-- issued on OIDC login; empty for images without one
+ALTER TABLE images ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS images_owner_idx ON images (owner) WHERE owner <> '';
+
+-- +goose Down
+DROP INDEX IF EXISTS images_owner_idx;
+ALTER TABLE images DROP COLUMN IF EXISTS owner;
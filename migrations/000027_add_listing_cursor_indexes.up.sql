@@ -0,0 +1,16 @@
+-- +goose Up
+-- Listings page by (created_at, id) after the last row of the previous page
+CREATE INDEX IF NOT EXISTS images_created_at_id_idx ON images (created_at, id);
+CREATE INDEX IF NOT EXISTS images_tenant_created_at_id_idx ON images (tenant, created_at, id);
+CREATE INDEX IF NOT EXISTS images_owner_created_at_id_idx ON images (owner, created_at, id) WHERE owner <> '';
+DROP INDEX IF EXISTS images_created_at_idx;
+DROP INDEX IF EXISTS images_tenant_created_at_idx;
+DROP INDEX IF EXISTS images_owner_idx;
+
+-- +goose Down
+CREATE INDEX IF NOT EXISTS images_created_at_idx ON images (created_at);
+CREATE INDEX IF NOT EXISTS images_tenant_created_at_idx ON images (tenant, created_at);
+CREATE INDEX IF NOT EXISTS images_owner_idx ON images (owner) WHERE owner <> '';
+DROP INDEX IF EXISTS images_created_at_id_idx;
+DROP INDEX IF EXISTS images_tenant_created_at_id_idx;
+DROP INDEX IF EXISTS images_owner_created_at_id_idx;
@@ -0,0 +1,13 @@
+-- +goose Up
+-- Size in bytes of the original, for sorting and filtering listings
+ALTER TABLE images ADD COLUMN IF NOT EXISTS size BIGINT NOT NULL DEFAULT 0;
+UPDATE images i SET size = c.size FROM file_checksums c
+WHERE c.image_id = i.id AND c.variant = 'original' AND i.size = 0;
+-- Listings sorted by size or status, ties broken like the default order
+CREATE INDEX IF NOT EXISTS images_size_created_at_id_idx ON images (size, created_at, id);
+CREATE INDEX IF NOT EXISTS images_status_created_at_id_idx ON images (status, created_at, id);
+
+-- +goose Down
+DROP INDEX IF EXISTS images_status_created_at_id_idx;
+DROP INDEX IF EXISTS images_size_created_at_id_idx;
+ALTER TABLE images DROP COLUMN IF EXISTS size;
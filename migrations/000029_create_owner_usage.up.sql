@@ -0,0 +1,122 @@
+-- +goose Up
+-- Storage used by each owner, kept up to date by triggers so reading it
+-- doesn't scan images or the filesystem
+CREATE TABLE IF NOT EXISTS owner_usage (
+    owner TEXT PRIMARY KEY,
+    images BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS owner_variant_usage (
+    owner TEXT NOT NULL,
+    variant TEXT NOT NULL,
+    files BIGINT NOT NULL DEFAULT 0,
+    bytes BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (owner, variant)
+);
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION owner_usage_add_images(o TEXT, n BIGINT) RETURNS void AS $$
+BEGIN
+    INSERT INTO owner_usage (owner, images) VALUES (o, n)
+    ON CONFLICT (owner) DO UPDATE SET images = owner_usage.images + n, updated_at = now();
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION owner_usage_add_files(o TEXT, v TEXT, n BIGINT, b BIGINT) RETURNS void AS $$
+BEGIN
+    INSERT INTO owner_variant_usage (owner, variant, files, bytes) VALUES (o, v, n, b)
+    ON CONFLICT (owner, variant) DO UPDATE
+    SET files = owner_variant_usage.files + n, bytes = owner_variant_usage.bytes + b;
+    UPDATE owner_usage SET updated_at = now() WHERE owner = o;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- The files of a deleted image are subtracted before the cascade removes
+-- their checksums, which then no longer find the image
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION images_track_owner_usage() RETURNS TRIGGER AS $$
+DECLARE
+    f RECORD;
+BEGIN
+    IF TG_OP IN ('DELETE', 'UPDATE') AND OLD.owner <> '' THEN
+        PERFORM owner_usage_add_images(OLD.owner, -1);
+        FOR f IN SELECT variant, COUNT(*) AS n, SUM(size) AS b FROM file_checksums WHERE image_id = OLD.id GROUP BY variant LOOP
+            PERFORM owner_usage_add_files(OLD.owner, f.variant, -f.n, -f.b);
+        END LOOP;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.owner <> '' THEN
+        PERFORM owner_usage_add_images(NEW.owner, 1);
+        FOR f IN SELECT variant, COUNT(*) AS n, SUM(size) AS b FROM file_checksums WHERE image_id = NEW.id GROUP BY variant LOOP
+            PERFORM owner_usage_add_files(NEW.owner, f.variant, f.n, f.b);
+        END LOOP;
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION file_checksums_track_owner_usage() RETURNS TRIGGER AS $$
+DECLARE
+    o TEXT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        SELECT owner INTO o FROM images WHERE id = OLD.image_id;
+        IF o <> '' THEN
+            PERFORM owner_usage_add_files(o, OLD.variant, -1, -OLD.size);
+        END IF;
+        RETURN OLD;
+    END IF;
+    SELECT owner INTO o FROM images WHERE id = NEW.image_id;
+    IF o <> '' THEN
+        IF TG_OP = 'INSERT' THEN
+            PERFORM owner_usage_add_files(o, NEW.variant, 1, NEW.size);
+        ELSIF NEW.size <> OLD.size THEN
+            PERFORM owner_usage_add_files(o, NEW.variant, 0, NEW.size - OLD.size);
+        END IF;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+DROP TRIGGER IF EXISTS images_owner_usage_insert ON images;
+CREATE TRIGGER images_owner_usage_insert AFTER INSERT ON images
+    FOR EACH ROW EXECUTE FUNCTION images_track_owner_usage();
+DROP TRIGGER IF EXISTS images_owner_usage_update ON images;
+CREATE TRIGGER images_owner_usage_update AFTER UPDATE OF owner ON images
+    FOR EACH ROW WHEN (OLD.owner IS DISTINCT FROM NEW.owner) EXECUTE FUNCTION images_track_owner_usage();
+DROP TRIGGER IF EXISTS images_owner_usage_delete ON images;
+CREATE TRIGGER images_owner_usage_delete BEFORE DELETE ON images
+    FOR EACH ROW EXECUTE FUNCTION images_track_owner_usage();
+DROP TRIGGER IF EXISTS file_checksums_owner_usage ON file_checksums;
+CREATE TRIGGER file_checksums_owner_usage AFTER INSERT OR UPDATE OF size OR DELETE ON file_checksums
+    FOR EACH ROW EXECUTE FUNCTION file_checksums_track_owner_usage();
+
+INSERT INTO owner_usage (owner, images)
+SELECT owner, COUNT(*) FROM images WHERE owner <> '' GROUP BY owner
+ON CONFLICT (owner) DO NOTHING;
+INSERT INTO owner_variant_usage (owner, variant, files, bytes)
+SELECT i.owner, c.variant, COUNT(*), SUM(c.size)
+FROM file_checksums c JOIN images i ON i.id = c.image_id
+WHERE i.owner <> '' GROUP BY i.owner, c.variant
+ON CONFLICT (owner, variant) DO NOTHING;
+
+-- +goose Down
+DROP TRIGGER IF EXISTS file_checksums_owner_usage ON file_checksums;
+DROP TRIGGER IF EXISTS images_owner_usage_delete ON images;
+DROP TRIGGER IF EXISTS images_owner_usage_update ON images;
+DROP TRIGGER IF EXISTS images_owner_usage_insert ON images;
+DROP FUNCTION IF EXISTS file_checksums_track_owner_usage();
+DROP FUNCTION IF EXISTS images_track_owner_usage();
+DROP FUNCTION IF EXISTS owner_usage_add_files(TEXT, TEXT, BIGINT, BIGINT);
+DROP FUNCTION IF EXISTS owner_usage_add_images(TEXT, BIGINT);
+DROP TABLE IF EXISTS owner_variant_usage;
+DROP TABLE IF EXISTS owner_usage;
@@ -1,6 +1,28 @@
+// Access token, when the server requires one. Embedding sites pass it in
+// the page URL (?token=...), a login via /auth/login returns it in the
+// fragment (#token=...); it's kept for the rest of the session.
+const loginToken = new URLSearchParams(location.hash.slice(1)).get('token');
+if (loginToken) {
+    history.replaceState(null, '', location.pathname + location.search);
+}
+const accessToken = loginToken || new URLSearchParams(location.search).get('token') || sessionStorage.getItem('accessToken');
+if (accessToken) {
+    sessionStorage.setItem('accessToken', accessToken);
+    const plainFetch = window.fetch;
+    window.fetch = (url, options = {}) => {
+        const headers = new Headers(options.headers || {});
+        headers.set('Authorization', 'Bearer ' + accessToken);
+        return plainFetch(url, { ...options, headers });
+    };
+}
+
 // Global state
 let uploadedImages = new Map();
-let pollingIntervals = new Map();
+// Images still processing, polled together with one bulk status request
+let pollingImages = new Set();
+let pollTimer = null;
+// The most IDs POST /images/status accepts at once
+const maxStatusIds = 100;
 
 // DOM elements
 const uploadForm = document.getElementById('uploadForm');
@@ -17,8 +39,30 @@ const closeModal = document.querySelector('.close');
 document.addEventListener('DOMContentLoaded', function() {
     setupEventListeners();
     updateNoImagesMessage();
+    loadGallery();
 });
 
+// Render previously uploaded images from the listing endpoint
+async function loadGallery() {
+    try {
+        const response = await fetch('/api/v1/images?limit=50');
+        if (!response.ok) {
+            return;
+        }
+        const result = await response.json();
+        // The listing is newest first, add the oldest first like uploads
+        for (const item of result.images.reverse()) {
+            addImageToGrid(item.id, null, item);
+        }
+    } catch (error) {
+        console.error('Error loading gallery:', error);
+    }
+}
+
+function isFinished(status) {
+    return status === 'done' || status === 'partial' || status === 'error';
+}
+
 function setupEventListeners() {
     // Upload form
     uploadForm.addEventListener('submit', handleUpload);
@@ -73,7 +117,7 @@ async function handleUpload(e) {
     uploadBtn.innerHTML = '<span class="btn-icon">⏳</span> Uploading...';
     
     try {
-        const response = await fetch('/upload', {
+        const response = await fetch('/api/v1/upload', {
             method: 'POST',
             body: formData
         });
@@ -100,21 +144,24 @@ async function handleUpload(e) {
     }
 }
 
-function addImageToGrid(imageId, file) {
+// Adds a card for a fresh upload (file) or a listed image (item)
+function addImageToGrid(imageId, file, item = null) {
     // Create image card
     const imageCard = document.createElement('div');
     imageCard.className = 'image-card';
     imageCard.id = `img-${imageId}`;
     
     // Create preview from file for original
-    const fileReader = new FileReader();
-    fileReader.onload = function(e) {
-        const originalPreview = imageCard.querySelector('.original-preview');
-        if (originalPreview) {
-            originalPreview.src = e.target.result;
-        }
-    };
-    fileReader.readAsDataURL(file);
+    if (file) {
+        const fileReader = new FileReader();
+        fileReader.onload = function(e) {
+            const originalPreview = imageCard.querySelector('.original-preview');
+            if (originalPreview) {
+                originalPreview.src = e.target.result;
+            }
+        };
+        fileReader.readAsDataURL(file);
+    }
     
     imageCard.innerHTML = `
         <div class="image-info">
@@ -169,47 +216,85 @@ function addImageToGrid(imageId, file) {
     });
     
     updateNoImagesMessage();
+    if (item) {
+        showListedImage(imageId, item);
+        if (isFinished(item.status)) {
+            return;
+        }
+    }
     startPolling(imageId);
 }
 
+// Fill a card from a listing item, whose URLs point at the ready variants
+function showListedImage(imageId, item) {
+    updateImageStatus(imageId, item.status);
+    updateProcessingStatus(imageId, 'resize', item.resize_status);
+    updateProcessingStatus(imageId, 'thumbnail', item.thumbnail_status);
+    updateProcessingStatus(imageId, 'watermark', item.watermark_status);
+    
+    for (const [variant, url] of Object.entries(item.urls)) {
+        const img = document.querySelector(`#img-${imageId} .${variant}-preview`);
+        if (img) {
+            img.src = url;
+        }
+    }
+}
+
 function startPolling(imageId) {
-    // Clear existing interval if any
-    if (pollingIntervals.has(imageId)) {
-        clearInterval(pollingIntervals.get(imageId));
+    pollingImages.add(imageId);
+    if (!pollTimer) {
+        pollTimer = setInterval(pollStatuses, 2000);
     }
-    
-    const pollInterval = setInterval(async () => {
+}
+
+function stopPolling(imageId) {
+    pollingImages.delete(imageId);
+    if (pollingImages.size === 0 && pollTimer) {
+        clearInterval(pollTimer);
+        pollTimer = null;
+    }
+}
+
+// Refresh every image still processing, a batch of IDs per request
+async function pollStatuses() {
+    const ids = [...pollingImages];
+    for (let i = 0; i < ids.length; i += maxStatusIds) {
         try {
-            // Get detailed info about all processing statuses
-            const infoResponse = await fetch(`/image/${imageId}/info`);
-            
-            if (infoResponse.ok) {
-                const info = await infoResponse.json();
-                
+            const response = await fetch('/api/v1/images/status', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ ids: ids.slice(i, i + maxStatusIds) })
+            });
+            if (!response.ok) {
+                continue;
+            }
+            const result = await response.json();
+            for (const info of result.images) {
                 // Update overall status
-                updateImageStatus(imageId, info.status);
+                updateImageStatus(info.id, info.status);
                 
                 // Update individual processing statuses
-                updateProcessingStatus(imageId, 'resize', info.resize_status);
-                updateProcessingStatus(imageId, 'thumbnail', info.thumbnail_status);
-                updateProcessingStatus(imageId, 'watermark', info.watermark_status);
+                updateProcessingStatus(info.id, 'resize', info.resize_status);
+                updateProcessingStatus(info.id, 'thumbnail', info.thumbnail_status);
+                updateProcessingStatus(info.id, 'watermark', info.watermark_status);
                 
                 // Load processed images if they're done
-                await loadProcessedImages(imageId, info);
+                await loadProcessedImages(info.id, info);
                 
                 // Stop polling if all processing is complete
-                if (info.status === 'done' || info.status === 'error') {
-                    clearInterval(pollInterval);
-                    pollingIntervals.delete(imageId);
+                if (isFinished(info.status)) {
+                    stopPolling(info.id);
                 }
             }
+            // Deleted elsewhere, nothing left to wait for
+            for (const id of result.missing) {
+                stopPolling(id);
+            }
         } catch (error) {
             console.error('Polling error:', error);
             // Don't stop polling on network errors, just log them
         }
-    }, 2000);
-    
-    pollingIntervals.set(imageId, pollInterval);
+    }
 }
 
 function updateImageStatus(imageId, status) {
@@ -238,7 +323,7 @@ async function loadProcessedImages(imageId, info) {
     // Load resized image
     if (info.resize_status === 'done') {
         try {
-            const response = await fetch(`/image/${imageId}`);
+            const response = await fetch(`/api/v1/image/${imageId}`);
             if (response.ok) {
                 const blob = await response.blob();
                 const url = URL.createObjectURL(blob);
@@ -256,7 +341,7 @@ async function loadProcessedImages(imageId, info) {
     // Load thumbnail
     if (info.thumbnail_status === 'done') {
         try {
-            const response = await fetch(`/image/${imageId}/thumbnail`);
+            const response = await fetch(`/api/v1/image/${imageId}/thumbnail`);
             if (response.ok) {
                 const blob = await response.blob();
                 const url = URL.createObjectURL(blob);
@@ -274,7 +359,7 @@ async function loadProcessedImages(imageId, info) {
     // Load watermarked image
     if (info.watermark_status === 'done') {
         try {
-            const response = await fetch(`/image/${imageId}/watermarked`);
+            const response = await fetch(`/api/v1/image/${imageId}/watermarked`);
             if (response.ok) {
                 const blob = await response.blob();
                 const url = URL.createObjectURL(blob);
@@ -296,7 +381,7 @@ async function deleteImage(imageId) {
     }
     
     try {
-        const response = await fetch(`/image/${imageId}`, {
+        const response = await fetch(`/api/v1/image/${imageId}`, {
             method: 'DELETE'
         });
         
@@ -308,10 +393,7 @@ async function deleteImage(imageId) {
             }
             
             // Clean up
-            if (pollingIntervals.has(imageId)) {
-                clearInterval(pollingIntervals.get(imageId));
-                pollingIntervals.delete(imageId);
-            }
+            stopPolling(imageId);
             uploadedImages.delete(imageId);
             
             updateNoImagesMessage();
@@ -328,7 +410,7 @@ async function deleteImage(imageId) {
 
 async function viewImageInfo(imageId) {
     try {
-        const response = await fetch(`/image/${imageId}/info`);
+        const response = await fetch(`/api/v1/image/${imageId}/info`);
         const data = await response.json();
         
         if (response.ok) {
@@ -358,63 +440,53 @@ File Paths:
     }
 }
 
+async function downloadVariant(imageId, variant) {
+    const response = await fetch(`/api/v1/image/${imageId}/download?variant=${variant}`);
+    if (!response.ok) {
+        const data = await response.json();
+        throw new Error(data.error || 'Download failed');
+    }
+    
+    // The server sends the original filename in Content-Disposition
+    const disposition = response.headers.get('Content-Disposition') || '';
+    const match = disposition.match(/filename="?([^";]+)"?/);
+    
+    const blob = await response.blob();
+    const url = URL.createObjectURL(blob);
+    const a = document.createElement('a');
+    a.href = url;
+    a.download = match ? match[1] : `${imageId}_${variant}`;
+    document.body.appendChild(a);
+    a.click();
+    document.body.removeChild(a);
+    URL.revokeObjectURL(url);
+}
+
 async function downloadImage(imageId) {
     try {
-        const response = await fetch(`/image/${imageId}`);
-        
-        if (response.ok) {
-            const blob = await response.blob();
-            const url = URL.createObjectURL(blob);
-            const a = document.createElement('a');
-            a.href = url;
-            a.download = `processed-image-${imageId}.jpg`;
-            document.body.appendChild(a);
-            a.click();
-            document.body.removeChild(a);
-            URL.revokeObjectURL(url);
-            
-            showNotification('Download started', 'success');
-        } else {
-            const data = await response.json();
-            showNotification(data.error || 'Download failed', 'error');
-        }
+        await downloadVariant(imageId, 'resized');
+        showNotification('Download started', 'success');
     } catch (error) {
         console.error('Download error:', error);
-        showNotification('Download failed', 'error');
+        showNotification(error.message || 'Download failed', 'error');
     }
 }
 
 async function downloadAll(imageId) {
     try {
-        const endpoints = [
-            { url: `/image/${imageId}/original`, name: `${imageId}_original` },
-            { url: `/image/${imageId}`, name: `${imageId}_resized` },
-            { url: `/image/${imageId}/thumbnail`, name: `${imageId}_thumbnail` },
-            { url: `/image/${imageId}/watermarked`, name: `${imageId}_watermarked` }
-        ];
+        const variants = ['original', 'resized', 'thumbnail', 'watermarked'];
         
         let downloadCount = 0;
         
-        for (const endpoint of endpoints) {
+        for (const variant of variants) {
             try {
-                const response = await fetch(endpoint.url);
-                if (response.ok) {
-                    const blob = await response.blob();
-                    const url = URL.createObjectURL(blob);
-                    const a = document.createElement('a');
-                    a.href = url;
-                    a.download = `${endpoint.name}.jpg`;
-                    document.body.appendChild(a);
-                    a.click();
-                    document.body.removeChild(a);
-                    URL.revokeObjectURL(url);
-                    downloadCount++;
-                    
-                    // Small delay between downloads
-                    await new Promise(resolve => setTimeout(resolve, 500));
-                }
+                await downloadVariant(imageId, variant);
+                downloadCount++;
+                
+                // Small delay between downloads
+                await new Promise(resolve => setTimeout(resolve, 500));
             } catch (error) {
-                console.error(`Error downloading ${endpoint.name}:`, error);
+                console.error(`Error downloading ${variant}:`, error);
             }
         }
         
@@ -430,30 +502,31 @@ async function openImageModal(imageId, imageType = 'resized') {
         let endpoint;
         switch (imageType) {
             case 'original':
-                endpoint = `/image/${imageId}/original`;
+                endpoint = `/api/v1/image/${imageId}/original`;
                 break;
             case 'thumbnail':
-                endpoint = `/image/${imageId}/thumbnail`;
+                endpoint = `/api/v1/image/${imageId}/thumbnail`;
                 break;
             case 'watermarked':
-                endpoint = `/image/${imageId}/watermarked`;
+                endpoint = `/api/v1/image/${imageId}/watermarked`;
                 break;
             case 'resized':
             default:
-                endpoint = `/image/${imageId}`;
+                endpoint = `/api/v1/image/${imageId}`;
                 break;
         }
         
         const response = await fetch(endpoint);
         
-        if (response.ok) {
+        // 202 means the variant is still being generated
+        if (response.status === 200) {
             const blob = await response.blob();
             const url = URL.createObjectURL(blob);
             modalImage.src = url;
             modal.style.display = 'block';
         } else {
             // Fallback to original image if requested type is not available
-            const originalResponse = await fetch(`/image/${imageId}/original`);
+            const originalResponse = await fetch(`/api/v1/image/${imageId}/original`);
             if (originalResponse.ok) {
                 const blob = await originalResponse.blob();
                 const url = URL.createObjectURL(blob);
@@ -536,7 +609,7 @@ function showNotification(message, type = 'info') {
 // Individual processing triggers
 async function triggerResize(imageId) {
     try {
-        const response = await fetch(`/image/${imageId}/resize`, {
+        const response = await fetch(`/api/v1/image/${imageId}/resize`, {
             method: 'POST'
         });
         
@@ -557,7 +630,7 @@ async function triggerResize(imageId) {
 
 async function triggerThumbnail(imageId) {
     try {
-        const response = await fetch(`/image/${imageId}/thumbnail`, {
+        const response = await fetch(`/api/v1/image/${imageId}/thumbnail`, {
             method: 'POST'
         });
         
@@ -578,7 +651,7 @@ async function triggerThumbnail(imageId) {
 
 async function triggerWatermark(imageId) {
     try {
-        const response = await fetch(`/image/${imageId}/watermark`, {
+        const response = await fetch(`/api/v1/image/${imageId}/watermark`, {
             method: 'POST'
         });
         
@@ -599,5 +672,5 @@ async function triggerWatermark(imageId) {
 
 // Clean up on page unload
 window.addEventListener('beforeunload', function() {
-    pollingIntervals.forEach(interval => clearInterval(interval));
+    clearInterval(pollTimer);
 });
\ No newline at end of file